@@ -1,16 +1,19 @@
 package aof
 
 import (
+	"bufio"
 	"go-redis/config"
 	"go-redis/interface/database"
 	"go-redis/lib/logger"
 	"go-redis/lib/utils"
+	"go-redis/rdb"
 	"go-redis/resp/connection"
 	"go-redis/resp/parser"
 	"go-redis/resp/reply"
 	"io"
 	"os"
 	"strconv"
+	"sync"
 )
 
 type CmdLine = [][]byte
@@ -25,18 +28,22 @@ type payload struct {
 
 type AofHandler struct {
 	database    database.Database
+	tmpDBMaker  func() database.DBEngine // 创建 AOF 重写时使用的临时数据库
 	aofChan     chan *payload
 	aofFile     *os.File
 	aofFilename string
 	currentDB   int
+	pausingAof  sync.RWMutex // AOF 重写开始和结束时需要暂停写入 aof 文件
+	rewriting   sync.Mutex   // 同一时间只允许一个重写任务
 }
 
-func NewAofHandler(database database.Database) (*AofHandler, error) {
+func NewAofHandler(database database.Database, tmpDBMaker func() database.DBEngine) (*AofHandler, error) {
 	handler := &AofHandler{}
 	handler.aofFilename = config.Properties.AppendFilename
 	handler.database = database
+	handler.tmpDBMaker = tmpDBMaker
 	// 加载 AOF，将历史的AOF内容进行恢复
-	handler.LoadAof()
+	handler.LoadAof(0)
 	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
@@ -68,36 +75,62 @@ func (handler *AofHandler) AddAof(dbIndex int, cmd CmdLine) {
 func (handler *AofHandler) handleAof() {
 	handler.currentDB = 0
 	for p := range handler.aofChan {
-		// 如果发生了db切换，要往aof文件中额外插入一条select语句(*2/r/n$6/r/nselect/r/n$1/r/n3/r/n)，表示选择了某某db
-		if p.dbIndex != handler.currentDB {
-			data := reply.MakeMultiBulkReply(utils.ToCmdLine("select", strconv.Itoa(p.dbIndex))).ToBytes()
-			_, err := handler.aofFile.Write(data)
-			if err != nil {
-				logger.Error(err)
-				continue // 继续读下一条
-			}
-			handler.currentDB = p.dbIndex
-		}
-		// 未切换db || 切换完成后：将指令按符合resp协议的格式写入aof文件
-		data := reply.MakeMultiBulkReply(p.cmdline).ToBytes()
+		handler.pausingAof.RLock() // 重写期间会替换 aofFile，写入前需要持有读锁
+		handler.writeAof(p)
+		handler.pausingAof.RUnlock()
+	}
+}
+
+func (handler *AofHandler) writeAof(p *payload) {
+	// 如果发生了db切换，要往aof文件中额外插入一条select语句(*2/r/n$6/r/nselect/r/n$1/r/n3/r/n)，表示选择了某某db
+	if p.dbIndex != handler.currentDB {
+		data := reply.MakeMultiBulkReply(utils.ToCmdLine("select", strconv.Itoa(p.dbIndex))).ToBytes()
 		_, err := handler.aofFile.Write(data)
 		if err != nil {
 			logger.Error(err)
+			return // 继续读下一条
 		}
+		handler.currentDB = p.dbIndex
+	}
+	// 未切换db || 切换完成后：将指令按符合resp协议的格式写入aof文件
+	data := reply.MakeMultiBulkReply(p.cmdline).ToBytes()
+	_, err := handler.aofFile.Write(data)
+	if err != nil {
+		logger.Error(err)
 	}
 }
 
-// LoadAof 用于系统重启时，重放 aof 文件中的指令
+// LoadAof 用于系统重启时，重放 aof 文件中的指令，maxBytes > 0 时只读取文件的前 maxBytes 个字节
 
-func (handler *AofHandler) LoadAof() {
+func (handler *AofHandler) LoadAof(maxBytes int64) {
 	file, err := os.Open(handler.aofFilename)
 	if err != nil {
 		logger.Error(err)
 		return
 	}
 	defer file.Close()
-	ch := parser.ParseStream(file) // 用 ParseStream 解析 aof 文件中的指令
-	fakeConn := &connection.Connection{}
+	var reader io.Reader = file
+	if maxBytes > 0 {
+		reader = io.LimitReader(file, maxBytes)
+	}
+	if err := Replay(reader, handler.database); err != nil {
+		logger.Error(err)
+	}
+}
+
+// Replay 将 aof 内容重放到 db 中，纯 RDB 文件可以看作只有前导的 aof，同样可以用它加载
+// 若 aof 以 "REDIS" 开头，说明开头是重写时生成的 RDB 前导，先用 RDB 解码器加载这部分数据，再解析剩余的 RESP 指令
+
+func Replay(reader io.Reader, db database.Database) error {
+	bufReader := bufio.NewReader(reader)
+	fakeConn := connection.NewFakeConn()
+	header, _ := bufReader.Peek(5)
+	if string(header) == "REDIS" {
+		if err := loadRDBPreamble(bufReader, db, fakeConn); err != nil {
+			return err
+		}
+	}
+	ch := parser.ParseStream(bufReader) // 用 ParseStream 解析 aof 文件中的指令
 	for p := range ch {
 		if p.Err != nil {
 			if p.Err == io.EOF { // 读到文件结束符
@@ -115,9 +148,34 @@ func (handler *AofHandler) LoadAof() {
 			logger.Error("need multi bulk")
 			continue
 		}
-		rep := handler.database.Exec(fakeConn, r.Args)
+		rep := db.Exec(fakeConn, r.Args)
 		if reply.IsErrorReply(rep) {
 			logger.Error(rep)
 		}
 	}
+	return nil
+}
+
+// loadRDBPreamble 读取 RDB 前导，将其中的每个 key 转换为指令在 db 中执行
+// 解码器直接使用 bufReader，读完 RDB 的校验和后便停止，剩余内容留给 RESP 解析器
+
+func loadRDBPreamble(bufReader *bufio.Reader, db database.Database, fakeConn *connection.Connection) error {
+	return rdb.NewDecoder(bufReader).Parse(func(o *rdb.Object) bool {
+		if o.DB != fakeConn.GetDBIndex() {
+			rep := db.Exec(fakeConn, utils.ToCmdLine("select", strconv.Itoa(o.DB)))
+			if reply.IsErrorReply(rep) {
+				logger.Error(rep)
+				return true
+			}
+		}
+		cmd := EntityToCmd(o.Key, &database.DataEntity{Data: o.Value})
+		if cmd == nil {
+			return true
+		}
+		rep := db.Exec(fakeConn, cmd.Args)
+		if reply.IsErrorReply(rep) {
+			logger.Error(rep)
+		}
+		return true
+	})
 }
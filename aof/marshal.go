@@ -0,0 +1,22 @@
+package aof
+
+import (
+	"go-redis/interface/database"
+	"go-redis/resp/reply"
+)
+
+var setCmd = []byte("SET")
+
+// EntityToCmd 将一个 key-value 转换为能够重建它的指令，如 string 类型转换为 SET key value
+// 不支持的数据类型返回 nil
+
+func EntityToCmd(key string, entity *database.DataEntity) *reply.MultiBulkReply {
+	if entity == nil {
+		return nil
+	}
+	switch val := entity.Data.(type) {
+	case []byte:
+		return reply.MakeMultiBulkReply([][]byte{setCmd, []byte(key), val})
+	}
+	return nil
+}
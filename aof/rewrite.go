@@ -0,0 +1,198 @@
+package aof
+
+import (
+	"go-redis/config"
+	"go-redis/interface/database"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/rdb"
+	"go-redis/resp/reply"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// RewriteCtx 记录重写开始时 aof 文件的状态
+
+type RewriteCtx struct {
+	tmpFile  *os.File // 重写生成的临时文件
+	fileSize int64    // 重写开始时 aof 文件的大小，之后追加的内容需要拷贝到新文件中
+	dbIdx    int      // 重写开始时 aof 文件中最后选择的子数据库
+}
+
+// Rewrite 重写 aof 文件：
+// 1. 暂停写入，记录当前 aof 文件的大小
+// 2. 将这部分 aof 加载到临时数据库中，把临时数据库的数据以 RDB 前导或者 RESP 指令的形式写入临时文件
+// 3. 再次暂停写入，把重写期间追加到 aof 中的内容拷贝到临时文件末尾，然后用临时文件替换 aof 文件
+
+func (handler *AofHandler) Rewrite() error {
+	handler.rewriting.Lock()
+	defer handler.rewriting.Unlock()
+	start := time.Now()
+	ctx, err := handler.StartRewrite()
+	if err != nil {
+		return err
+	}
+	err = handler.DoRewrite(ctx)
+	if err != nil {
+		_ = ctx.tmpFile.Close()
+		_ = os.Remove(ctx.tmpFile.Name())
+		return err
+	}
+	err = handler.FinishRewrite(ctx)
+	if err != nil {
+		return err
+	}
+	logger.Info("AOF rewrite finished in " + time.Since(start).String())
+	return nil
+}
+
+// StartRewrite 暂停 aof 写入，将已写入的内容刷盘并记录文件大小
+
+func (handler *AofHandler) StartRewrite() (*RewriteCtx, error) {
+	handler.pausingAof.Lock()
+	defer handler.pausingAof.Unlock()
+
+	err := handler.aofFile.Sync()
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(handler.aofFilename)
+	if err != nil {
+		return nil, err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(handler.aofFilename), "temp-rewriteaof-*.aof")
+	if err != nil {
+		return nil, err
+	}
+	return &RewriteCtx{
+		tmpFile:  tmpFile,
+		fileSize: fileInfo.Size(),
+		dbIdx:    handler.currentDB,
+	}, nil
+}
+
+// DoRewrite 将重写开始前的 aof 内容压缩后写入临时文件，这一步不会阻塞 aof 的写入
+
+func (handler *AofHandler) DoRewrite(ctx *RewriteCtx) error {
+	tmpDB := handler.tmpDBMaker()
+	tmpHandler := &AofHandler{
+		database:    tmpDB,
+		aofFilename: handler.aofFilename,
+	}
+	if ctx.fileSize > 0 {
+		tmpHandler.LoadAof(ctx.fileSize)
+	}
+
+	if config.Properties.AofUseRdbPreamble {
+		return rdb.Dump(ctx.tmpFile, tmpDB, map[string]string{"aof-preamble": "1"})
+	}
+	var err error
+	for i := 0; i < tmpDB.GetDBNum() && err == nil; i++ {
+		selected := false
+		tmpDB.ForEach(i, func(key string, entity *database.DataEntity) bool {
+			cmd := EntityToCmd(key, entity)
+			if cmd == nil {
+				return true
+			}
+			if !selected { // 子数据库中有数据时才需要写入 select
+				data := reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes()
+				if _, err = ctx.tmpFile.Write(data); err != nil {
+					return false
+				}
+				selected = true
+			}
+			_, err = ctx.tmpFile.Write(cmd.ToBytes())
+			return err == nil
+		})
+	}
+	return err
+}
+
+// FinishRewrite 将重写期间追加的 aof 内容拷贝到临时文件，并用临时文件替换原 aof 文件
+
+func (handler *AofHandler) FinishRewrite(ctx *RewriteCtx) error {
+	handler.pausingAof.Lock()
+	defer handler.pausingAof.Unlock()
+
+	tmpFile := ctx.tmpFile
+	src, err := os.Open(handler.aofFilename)
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+	defer src.Close()
+	_, err = src.Seek(ctx.fileSize, io.SeekStart)
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+	// 追加的内容是基于重写开始时选择的子数据库写入的，先补上一条 select
+	data := reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(ctx.dbIdx))).ToBytes()
+	if _, err = tmpFile.Write(data); err == nil {
+		_, err = io.Copy(tmpFile, src)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	_ = tmpFile.Close()
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), handler.aofFilename); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+	// 重新打开 aof 文件，后续的写入追加到新文件中
+	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	_ = handler.aofFile.Close()
+	handler.aofFile = aofFile
+	return nil
+}
+
+// ResetWithRDB 用一份 RDB 数据替换整个 aof 文件，从节点全量同步后调用，使 aof 与同步得到的数据保持一致
+// 新文件以 RDB 前导开头，末尾补一条 SELECT 0，与之后追加的指令所假定的子数据库保持一致
+
+func (handler *AofHandler) ResetWithRDB(rdbData []byte) error {
+	handler.rewriting.Lock()
+	defer handler.rewriting.Unlock()
+	handler.pausingAof.Lock()
+	defer handler.pausingAof.Unlock()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(handler.aofFilename), "temp-resetaof-*.aof")
+	if err != nil {
+		return err
+	}
+	_, err = tmpFile.Write(rdbData)
+	if err == nil {
+		_, err = tmpFile.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", "0")).ToBytes())
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	_ = tmpFile.Close()
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), handler.aofFilename)
+	}
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+	aofFile, err := os.OpenFile(handler.aofFilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	_ = handler.aofFile.Close()
+	handler.aofFile = aofFile
+	handler.currentDB = 0
+	return nil
+}
@@ -0,0 +1,749 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"go-redis/config"
+	"go-redis/lib/logger"
+	"go-redis/lib/tlsutil"
+	"go-redis/tcp"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 集群总线：节点之间通过单独的端口交换 PING/PONG 消息来维护成员关系，与 Redis Cluster 的做法相同
+// 消息中携带了发送者的 epoch、负责的槽位以及它所知道的其他节点的状态（gossip），
+// 新节点通过 CLUSTER MEET 加入后，其余节点会经由 gossip 逐步认识它；
+// 长时间不回复 PING 的节点先被标记为疑似下线（PFAIL），超过半数节点都认为它疑似下线时标记为下线（FAIL）并广播
+
+// 节点的状态标记
+const (
+	nodeFlagMyself    = 1 << iota // 本节点
+	nodeFlagPFail                 // 疑似下线：本节点在 node-timeout 内没有收到它的回复
+	nodeFlagFail                  // 下线：超过半数节点认为它疑似下线
+	nodeFlagHandshake             // 通过 MEET 或 gossip 得知、尚未完成第一次 PING/PONG 的节点
+)
+
+// 总线消息的类型
+const (
+	busMsgPing = "ping"
+	busMsgPong = "pong"
+	busMsgMeet = "meet"
+	busMsgFail = "fail"
+)
+
+const (
+	busCronPeriod          = 100 * time.Millisecond
+	busPingPeriod          = time.Second      // 向每个节点发送 PING 的间隔
+	forgetBlacklistTTL     = 60 * time.Second // FORGET 的节点在这段时间内不会因为 gossip 被重新加入
+	defaultNodeTimeout     = 15 * time.Second
+	failReportValidityMult = 2 // 失败报告的有效期为 node-timeout 的倍数
+)
+
+// busMessage 是集群总线上传输的消息，以 JSON 编码
+
+type busMessage struct {
+	Type         string       `json:"type"`
+	Sender       string       `json:"sender"`   // 发送者的服务地址
+	BusAddr      string       `json:"bus_addr"` // 发送者的集群总线地址
+	CurrentEpoch uint64       `json:"current_epoch"`
+	ConfigEpoch  uint64       `json:"config_epoch"`
+	Slots        [][2]int     `json:"slots,omitempty"`  // 发送者负责的槽位区间
+	Gossip       []gossipInfo `json:"gossip,omitempty"` // 发送者所知道的其他节点
+	Failed       string       `json:"failed,omitempty"` // FAIL 消息宣告下线的节点
+}
+
+// gossipInfo 是消息中携带的某个节点的状态
+
+type gossipInfo struct {
+	Addr    string `json:"addr"`
+	BusAddr string `json:"bus_addr"`
+	Flags   int    `json:"flags"`
+}
+
+// clusterNode 是本节点所知道的一个集群节点
+
+type clusterNode struct {
+	addr        string
+	busAddr     string
+	configEpoch uint64
+	flags       int
+	createTime  time.Time
+	lastPing    time.Time            // 最近一次开始发送 PING 的时间
+	pingSent    time.Time            // 最早一个尚未收到回复的 PING 的发送时间，收到回复后清零
+	pongRecv    time.Time            // 最近一次收到回复的时间
+	pinging     bool                 // 是否有协程正在向它发送 PING，link 只由该协程使用
+	link        *busLink             // 发往该节点的连接
+	failReports map[string]time.Time // 报告它疑似下线的节点 -> 报告时间
+}
+
+// busLink 是一条总线连接，请求和回复都是一行 JSON
+
+type busLink struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+func makeBusLink(conn net.Conn) *busLink {
+	return &busLink{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}
+}
+
+// clusterBus 维护集群的成员关系
+
+type clusterBus struct {
+	mu           sync.Mutex
+	cluster      *ClusterDatabase
+	myself       *clusterNode
+	nodes        map[string]*clusterNode // 节点地址 -> 节点，包括本节点
+	currentEpoch uint64
+	blacklist    map[string]time.Time // 被 FORGET 的节点 -> 解除时间
+	nodeTimeout  time.Duration
+	listener     net.Listener
+	closeChan    chan struct{}
+	closeOnce    sync.Once
+}
+
+// makeClusterBus 以配置文件中的节点作为初始成员，这些节点的 configEpoch 按地址排序依次为 1, 2, 3 ...，
+// 每个节点按相同的规则计算，因此初始时各节点的 epoch 一致
+
+func makeClusterBus(cluster *ClusterDatabase, nodes []string) *clusterBus {
+	bus := &clusterBus{
+		cluster:     cluster,
+		nodes:       make(map[string]*clusterNode),
+		blacklist:   make(map[string]time.Time),
+		nodeTimeout: defaultNodeTimeout,
+		closeChan:   make(chan struct{}),
+	}
+	if config.Properties.ClusterNodeTimeout > 0 {
+		bus.nodeTimeout = time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+	}
+	sorted := make([]string, len(nodes))
+	copy(sorted, nodes)
+	sort.Strings(sorted)
+	now := time.Now()
+	for i, addr := range sorted {
+		node := &clusterNode{
+			addr:        addr,
+			busAddr:     defaultBusAddr(addr),
+			configEpoch: uint64(i + 1),
+			createTime:  now,
+			pongRecv:    now, // 视为刚刚收到过回复，避免启动时立即被判定为疑似下线
+			failReports: make(map[string]time.Time),
+		}
+		if addr == cluster.self {
+			node.flags = nodeFlagMyself
+			if config.Properties.ClusterPort > 0 {
+				host, _ := splitAddr(addr)
+				node.busAddr = net.JoinHostPort(host, strconv.Itoa(config.Properties.ClusterPort))
+			}
+			bus.myself = node
+		}
+		bus.nodes[addr] = node
+	}
+	bus.currentEpoch = uint64(len(sorted))
+	return bus
+}
+
+// defaultBusAddr 返回节点默认的总线地址，即服务端口 + 10000
+
+func defaultBusAddr(addr string) string {
+	host, port := splitAddr(addr)
+	return net.JoinHostPort(host, strconv.Itoa(port+clusterBusPortOffset))
+}
+
+// start 开始监听总线端口并启动定时任务
+
+func (bus *clusterBus) start() error {
+	_, port := splitAddr(bus.myself.busAddr)
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.Properties.Bind, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	if store := tlsutil.Default(); store != nil && config.Properties.TLSCluster {
+		listener = tls.NewListener(listener, store.ServerConfig())
+	}
+	bus.listener = listener
+	logger.Info("cluster: bus listening on " + listener.Addr().String())
+	go tcp.ListenAndServe(listener, &busHandler{bus: bus}, bus.closeChan)
+	go bus.cron()
+	return nil
+}
+
+func (bus *clusterBus) close() {
+	bus.closeOnce.Do(func() {
+		close(bus.closeChan)
+		bus.mu.Lock()
+		defer bus.mu.Unlock()
+		for _, node := range bus.nodes {
+			if !node.pinging && node.link != nil {
+				_ = node.link.conn.Close()
+				node.link = nil
+			}
+		}
+	})
+}
+
+func (bus *clusterBus) cron() {
+	ticker := time.NewTicker(busCronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			bus.clusterCron()
+		case <-bus.closeChan:
+			return
+		}
+	}
+}
+
+// clusterCron 定期向各节点发送 PING，检测疑似下线和下线的节点
+
+func (bus *clusterBus) clusterCron() {
+	now := time.Now()
+	bus.mu.Lock()
+	changed := false
+	for addr, node := range bus.nodes {
+		if node == bus.myself {
+			continue
+		}
+		// 握手在 node-timeout 内没有完成，放弃该节点
+		if node.flags&nodeFlagHandshake > 0 && now.Sub(node.createTime) > bus.nodeTimeout {
+			logger.Info("cluster: handshake with " + addr + " timed out")
+			bus.removeNodeLocked(node)
+			changed = true
+			continue
+		}
+		if !node.pinging && now.Sub(node.lastPing) >= busPingPeriod {
+			msgType := busMsgPing
+			if node.flags&nodeFlagHandshake > 0 {
+				msgType = busMsgMeet
+			}
+			node.pinging = true
+			node.lastPing = now
+			if node.pingSent.IsZero() {
+				node.pingSent = now
+			}
+			go bus.ping(node, bus.buildMessageLocked(msgType))
+		}
+		if !node.pingSent.IsZero() && now.Sub(node.pingSent) > bus.nodeTimeout &&
+			node.flags&(nodeFlagPFail|nodeFlagFail|nodeFlagHandshake) == 0 {
+			node.flags |= nodeFlagPFail
+			logger.Warn("cluster: node " + addr + " is possibly failing")
+		}
+	}
+	failed := bus.checkFailuresLocked(now)
+	if len(failed) > 0 {
+		changed = true
+	}
+	for addr, expire := range bus.blacklist {
+		if now.After(expire) {
+			delete(bus.blacklist, addr)
+		}
+	}
+	if changed {
+		bus.cluster.updatePeerPicker()
+	}
+	bus.mu.Unlock()
+
+	for _, addr := range failed {
+		bus.broadcastFail(addr)
+	}
+}
+
+// checkFailuresLocked 将超过半数节点（包括本节点）认为疑似下线的节点标记为下线，返回新下线的节点
+
+func (bus *clusterBus) checkFailuresLocked(now time.Time) []string {
+	needed := bus.quorumLocked()
+	validity := bus.nodeTimeout * failReportValidityMult
+	failed := make([]string, 0)
+	for addr, node := range bus.nodes {
+		for reporter, reportTime := range node.failReports {
+			if now.Sub(reportTime) > validity {
+				delete(node.failReports, reporter)
+			}
+		}
+		if node.flags&nodeFlagPFail == 0 || node.flags&nodeFlagFail > 0 {
+			continue
+		}
+		if len(node.failReports)+1 >= needed {
+			node.flags &^= nodeFlagPFail
+			node.flags |= nodeFlagFail
+			logger.Warn("cluster: marking node " + addr + " as failing (quorum reached)")
+			failed = append(failed, addr)
+		}
+	}
+	return failed
+}
+
+// quorumLocked 返回将节点标记为下线所需的票数：已完成握手的节点数量的一半加一
+
+func (bus *clusterBus) quorumLocked() int {
+	count := 0
+	for _, node := range bus.nodes {
+		if node.flags&nodeFlagHandshake == 0 {
+			count++
+		}
+	}
+	return count/2 + 1
+}
+
+// ping 发送一条 PING（或 MEET）并处理回复，在单独的协程中执行
+
+func (bus *clusterBus) ping(node *clusterNode, msg *busMessage) {
+	pong, err := bus.request(node, msg)
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	node.pinging = false
+	if bus.nodes[node.addr] != node { // 等待回复期间节点被移除了
+		if node.link != nil {
+			_ = node.link.conn.Close()
+			node.link = nil
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	changed := false
+	if pong.Sender != node.addr {
+		// 对方以其他地址标识自己（如 MEET 时使用了 localhost），以对方声明的地址为准
+		if node.flags&nodeFlagHandshake == 0 {
+			return
+		}
+		bus.removeNodeLocked(node)
+		known, ok := bus.nodes[pong.Sender]
+		if !ok {
+			if bus.isBlacklistedLocked(pong.Sender) {
+				return
+			}
+			known = bus.addNodeLocked(pong.Sender, pong.BusAddr, nodeFlagHandshake)
+		}
+		node = known
+	}
+	node.pingSent = time.Time{}
+	node.pongRecv = time.Now()
+	if node.flags&nodeFlagHandshake > 0 {
+		node.flags &^= nodeFlagHandshake
+		logger.Info("cluster: handshake with " + node.addr + " completed")
+		changed = true
+	}
+	if node.flags&nodeFlagPFail > 0 {
+		node.flags &^= nodeFlagPFail
+	}
+	if node.flags&nodeFlagFail > 0 {
+		node.flags &^= nodeFlagFail
+		logger.Info("cluster: node " + node.addr + " is reachable again, clearing FAIL state")
+		changed = true
+	}
+	if bus.processLocked(node, pong) {
+		changed = true
+	}
+	if changed {
+		bus.cluster.updatePeerPicker()
+	}
+}
+
+// request 通过发往 node 的连接发送一条消息并等待回复，只能由持有 node.pinging 的协程调用
+
+func (bus *clusterBus) request(node *clusterNode, msg *busMessage) (*busMessage, error) {
+	if node.link == nil {
+		conn, err := tlsutil.DialTimeout(node.busAddr, bus.nodeTimeout, tlsutil.ClusterConfig())
+		if err != nil {
+			return nil, err
+		}
+		node.link = makeBusLink(conn)
+	}
+	link := node.link
+	_ = link.conn.SetDeadline(time.Now().Add(bus.nodeTimeout))
+	pong := &busMessage{}
+	err := link.enc.Encode(msg)
+	if err == nil {
+		err = link.dec.Decode(pong)
+	}
+	if err != nil {
+		_ = link.conn.Close()
+		node.link = nil
+		return nil, err
+	}
+	return pong, nil
+}
+
+// broadcastFail 通知所有节点 failed 已经下线
+
+func (bus *clusterBus) broadcastFail(failed string) {
+	bus.mu.Lock()
+	msg := bus.buildMessageLocked(busMsgFail)
+	msg.Failed = failed
+	targets := make([]string, 0, len(bus.nodes))
+	for _, node := range bus.nodes {
+		if node != bus.myself && node.flags&(nodeFlagFail|nodeFlagHandshake) == 0 {
+			targets = append(targets, node.busAddr)
+		}
+	}
+	bus.mu.Unlock()
+	for _, busAddr := range targets {
+		go func(busAddr string) {
+			conn, err := tlsutil.DialTimeout(busAddr, bus.nodeTimeout, tlsutil.ClusterConfig())
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(bus.nodeTimeout))
+			_ = json.NewEncoder(conn).Encode(msg)
+		}(busAddr)
+	}
+}
+
+// buildMessageLocked 生成一条携带本节点状态的消息
+
+func (bus *clusterBus) buildMessageLocked(msgType string) *busMessage {
+	msg := &busMessage{
+		Type:         msgType,
+		Sender:       bus.myself.addr,
+		BusAddr:      bus.myself.busAddr,
+		CurrentEpoch: bus.currentEpoch,
+		ConfigEpoch:  bus.myself.configEpoch,
+	}
+	if bus.cluster.slots != nil {
+		for _, r := range bus.cluster.slots.ranges()[bus.myself.addr] {
+			msg.Slots = append(msg.Slots, [2]int{r.start, r.end})
+		}
+	}
+	for _, node := range bus.nodes {
+		if node == bus.myself || node.flags&nodeFlagHandshake > 0 {
+			continue
+		}
+		msg.Gossip = append(msg.Gossip, gossipInfo{
+			Addr:    node.addr,
+			BusAddr: node.busAddr,
+			Flags:   node.flags & (nodeFlagPFail | nodeFlagFail),
+		})
+	}
+	return msg
+}
+
+// handleMessage 处理其他节点发来的消息，返回需要回复的消息
+
+func (bus *clusterBus) handleMessage(msg *busMessage) *busMessage {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	changed := false
+	var pong *busMessage
+	switch msg.Type {
+	case busMsgPing, busMsgMeet:
+		sender, ok := bus.nodes[msg.Sender]
+		if !ok {
+			// 被 FORGET 的节点发来的消息不做回复，它会认为本节点已经下线
+			if bus.isBlacklistedLocked(msg.Sender) || msg.Sender == "" {
+				return nil
+			}
+			sender = bus.addNodeLocked(msg.Sender, msg.BusAddr, 0)
+			logger.Info("cluster: node " + msg.Sender + " joined via " + msg.Type)
+			changed = true
+		}
+		if bus.processLocked(sender, msg) {
+			changed = true
+		}
+		pong = bus.buildMessageLocked(busMsgPong)
+	case busMsgFail:
+		node, ok := bus.nodes[msg.Failed]
+		if ok && node != bus.myself && node.flags&nodeFlagFail == 0 {
+			node.flags &^= nodeFlagPFail
+			node.flags |= nodeFlagFail
+			logger.Warn("cluster: node " + msg.Failed + " marked as failing by " + msg.Sender)
+			changed = true
+		}
+	}
+	if changed {
+		bus.cluster.updatePeerPicker()
+	}
+	return pong
+}
+
+// processLocked 根据 sender 发来的消息更新 epoch、槽位归属和其他节点的状态，返回集群拓扑是否发生了变化
+
+func (bus *clusterBus) processLocked(sender *clusterNode, msg *busMessage) bool {
+	changed := false
+	if msg.CurrentEpoch > bus.currentEpoch {
+		bus.currentEpoch = msg.CurrentEpoch
+	}
+	sender.configEpoch = msg.ConfigEpoch
+	if msg.BusAddr != "" {
+		sender.busAddr = msg.BusAddr
+	}
+	if bus.updateSlotsLocked(sender, msg.Slots) {
+		changed = true
+	}
+	// configEpoch 冲突时由节点 ID 较小的一方递增 epoch，保证每个节点的 configEpoch 唯一
+	if sender.configEpoch == bus.myself.configEpoch && nodeID(sender.addr) > nodeID(bus.myself.addr) {
+		bus.currentEpoch++
+		bus.myself.configEpoch = bus.currentEpoch
+		logger.Info("cluster: configEpoch collision with " + sender.addr + ", new configEpoch " +
+			strconv.FormatUint(bus.myself.configEpoch, 10))
+	}
+
+	now := time.Now()
+	for _, info := range msg.Gossip {
+		if info.Addr == bus.myself.addr {
+			continue
+		}
+		node, ok := bus.nodes[info.Addr]
+		if !ok {
+			// 认识新的节点，先与它握手
+			if info.Flags&nodeFlagFail == 0 && !bus.isBlacklistedLocked(info.Addr) {
+				bus.addNodeLocked(info.Addr, info.BusAddr, nodeFlagHandshake)
+				logger.Info("cluster: discovered node " + info.Addr + " from " + sender.addr)
+			}
+			continue
+		}
+		// sender 认为该节点疑似下线时记录一份失败报告
+		if sender.flags&nodeFlagFail == 0 && info.Flags&(nodeFlagPFail|nodeFlagFail) > 0 {
+			node.failReports[sender.addr] = now
+		} else {
+			delete(node.failReports, sender.addr)
+		}
+	}
+	return changed
+}
+
+// updateSlotsLocked 当 sender 声明负责的槽位当前属于 configEpoch 更小的节点时，将这些槽位改为属于 sender
+// 本节点正在导入的槽位除外，它们的归属由 CLUSTER SETSLOT NODE 决定
+
+func (bus *clusterBus) updateSlotsLocked(sender *clusterNode, claims [][2]int) bool {
+	table := bus.cluster.slots
+	if table == nil {
+		return false
+	}
+	changed := false
+	for _, claim := range claims {
+		for s := claim[0]; s <= claim[1] && s < len(table.slots); s++ {
+			owner := table.nodeOf(s)
+			if owner == sender.addr || table.importingFrom(s) != "" {
+				continue
+			}
+			if owner != "" {
+				if current, ok := bus.nodes[owner]; ok && current.configEpoch >= sender.configEpoch {
+					continue
+				}
+			}
+			if owner == bus.myself.addr {
+				logger.Warn("cluster: slot " + strconv.Itoa(s) + " was taken over by " + sender.addr)
+			}
+			table.setNode(s, sender.addr)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// addNodeLocked 加入一个新节点
+
+func (bus *clusterBus) addNodeLocked(addr string, busAddr string, flags int) *clusterNode {
+	if busAddr == "" {
+		busAddr = defaultBusAddr(addr)
+	}
+	now := time.Now()
+	node := &clusterNode{
+		addr:        addr,
+		busAddr:     busAddr,
+		flags:       flags,
+		createTime:  now,
+		pongRecv:    now,
+		failReports: make(map[string]time.Time),
+	}
+	bus.nodes[addr] = node
+	return node
+}
+
+// removeNodeLocked 移除一个节点，并删除其他节点上由它提交的失败报告
+
+func (bus *clusterBus) removeNodeLocked(node *clusterNode) {
+	delete(bus.nodes, node.addr)
+	if !node.pinging && node.link != nil {
+		_ = node.link.conn.Close()
+		node.link = nil
+	}
+	for _, other := range bus.nodes {
+		delete(other.failReports, node.addr)
+	}
+}
+
+func (bus *clusterBus) isBlacklistedLocked(addr string) bool {
+	expire, ok := bus.blacklist[addr]
+	return ok && time.Now().Before(expire)
+}
+
+// meet 与 addr 上的节点握手，握手完成后双方会通过 gossip 将对方介绍给集群中的其他节点
+
+func (bus *clusterBus) meet(addr string, busAddr string) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	delete(bus.blacklist, addr)
+	if _, ok := bus.nodes[addr]; ok {
+		return
+	}
+	bus.addNodeLocked(addr, busAddr, nodeFlagHandshake)
+}
+
+// forget 将节点从本节点的成员列表中移除，它负责的槽位变为未分配，60 秒内不会因为 gossip 被重新加入
+
+func (bus *clusterBus) forget(addr string) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	node, ok := bus.nodes[addr]
+	if !ok {
+		return
+	}
+	bus.removeNodeLocked(node)
+	bus.blacklist[addr] = time.Now().Add(forgetBlacklistTTL)
+	if bus.cluster.slots != nil {
+		bus.cluster.slots.removeNode(addr)
+	}
+	bus.cluster.updatePeerPicker()
+	bus.cluster.closePeerPool(addr)
+}
+
+// bumpEpoch 为本节点分配一个新的、比集群中所有节点都大的 configEpoch，在本节点接管槽位时调用
+
+func (bus *clusterBus) bumpEpoch() {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	bus.currentEpoch++
+	bus.myself.configEpoch = bus.currentEpoch
+}
+
+// nodeByID 根据节点 ID 查找已知节点的地址
+
+func (bus *clusterBus) nodeByID(id string) (string, bool) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for addr := range bus.nodes {
+		if nodeID(addr) == id {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// knownNodesLocked 返回已完成握手的节点地址，按地址排序
+
+func (bus *clusterBus) knownNodesLocked() []string {
+	nodes := make([]string, 0, len(bus.nodes))
+	for addr, node := range bus.nodes {
+		if node.flags&nodeFlagHandshake == 0 {
+			nodes = append(nodes, addr)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// aliveNodes 返回已完成握手且没有下线的节点，按地址排序
+
+func (bus *clusterBus) aliveNodes() []string {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	return bus.aliveNodesLocked()
+}
+
+func (bus *clusterBus) aliveNodesLocked() []string {
+	nodes := make([]string, 0, len(bus.nodes))
+	for addr, node := range bus.nodes {
+		if node.flags&(nodeFlagHandshake|nodeFlagFail) == 0 {
+			nodes = append(nodes, addr)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// isFailed 判断节点是否已被标记为下线（FAIL）
+
+func (bus *clusterBus) isFailed(addr string) bool {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	node, ok := bus.nodes[addr]
+	return ok && node.flags&nodeFlagFail > 0
+}
+
+// nodeView 是 CLUSTER NODES 和 CLUSTER INFO 使用的节点状态快照
+
+type nodeView struct {
+	addr        string
+	busAddr     string
+	flags       int
+	configEpoch uint64
+	pingSent    time.Time
+	pongRecv    time.Time
+	connected   bool
+}
+
+// snapshot 返回全部节点的状态快照（按地址排序）以及 currentEpoch
+
+func (bus *clusterBus) snapshot() ([]nodeView, uint64) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	views := make([]nodeView, 0, len(bus.nodes))
+	for _, node := range bus.nodes {
+		views = append(views, nodeView{
+			addr:        node.addr,
+			busAddr:     node.busAddr,
+			flags:       node.flags,
+			configEpoch: node.configEpoch,
+			pingSent:    node.pingSent,
+			pongRecv:    node.pongRecv,
+			connected:   node == bus.myself || node.link != nil,
+		})
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].addr < views[j].addr
+	})
+	return views, bus.currentEpoch
+}
+
+// busHandler 处理其他节点建立的总线连接
+
+type busHandler struct {
+	bus         *clusterBus
+	activeConns sync.Map
+}
+
+func (h *busHandler) Handle(ctx context.Context, conn net.Conn) {
+	h.activeConns.Store(conn, struct{}{})
+	defer func() {
+		h.activeConns.Delete(conn)
+		_ = conn.Close()
+	}()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		msg := &busMessage{}
+		if err := dec.Decode(msg); err != nil {
+			return
+		}
+		pong := h.bus.handleMessage(msg)
+		if pong == nil {
+			continue
+		}
+		if err := enc.Encode(pong); err != nil {
+			return
+		}
+	}
+}
+
+func (h *busHandler) Close() error {
+	h.activeConns.Range(func(key, value interface{}) bool {
+		_ = key.(net.Conn).Close()
+		return true
+	})
+	return nil
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"errors"
 	pool "github.com/jolestar/go-commons-pool/v2"
+	"go-redis/lib/tlsutil"
+	"go-redis/lib/utils"
 	"go-redis/resp/client"
+	"go-redis/resp/reply"
 )
 
 type connectionFactory struct {
@@ -14,11 +17,17 @@ type connectionFactory struct {
 // MakeObject 新建客户端连接
 
 func (f connectionFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
-	c, err := client.MakeClient(f.Peer)
+	c, err := client.MakeTLSClient(f.Peer, tlsutil.ClusterConfig())
 	if err != nil {
 		return nil, err
 	}
 	c.Start()
+	// 节点之间转发指令的连接必须关闭重定向，否则配置了 cluster-redirect yes 的节点会把 MOVED 返回给转发方，
+	// 再原样返回给代理模式的客户端
+	if errReply, ok := c.Send(utils.ToCmdLine("CLIENT", "REDIRECT", "OFF")).(reply.ErrorReply); ok {
+		c.Close()
+		return nil, errors.New("disable redirect on " + f.Peer + " failed: " + errReply.Error())
+	}
 	return pool.NewPooledObject(c), nil
 }
 
@@ -0,0 +1,477 @@
+package cluster
+
+import (
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/consistenthash"
+	"go-redis/lib/slot"
+	"go-redis/resp/reply"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 集群总线端口与服务端口之间的偏移量，与 Redis Cluster 的约定一致，CLUSTER NODES 中会展示该端口
+const clusterBusPortOffset = 10000
+
+var slotModeDisabledErr = reply.MakeErrReply("ERR This instance has slot routing disabled, set cluster-mode to slot")
+
+// CLUSTER <subcommand> [args...]，供 Redis Cluster 客户端获取槽位分配和节点信息
+
+func execCluster(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("cluster")
+	}
+	subCmd := strings.ToLower(string(cmdArgs[1]))
+	args := cmdArgs[2:]
+	switch subCmd {
+	case "keyslot":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("cluster|keyslot")
+		}
+		return reply.MakeIntReply(int64(slot.HashSlot(string(args[0]))))
+	case "countkeysinslot":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("cluster|countkeysinslot")
+		}
+		s, ok := parseSlot(args[0])
+		if !ok {
+			return reply.MakeErrReply("ERR Invalid slot")
+		}
+		return reply.MakeIntReply(int64(len(cluster.keysInSlot(c.GetDBIndex(), s, -1))))
+	case "getkeysinslot":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("cluster|getkeysinslot")
+		}
+		s, ok := parseSlot(args[0])
+		if !ok {
+			return reply.MakeErrReply("ERR Invalid slot")
+		}
+		count, err := strconv.Atoi(string(args[1]))
+		if err != nil || count < 0 {
+			return reply.MakeErrReply("ERR Invalid number of keys")
+		}
+		keys := cluster.keysInSlot(c.GetDBIndex(), s, count)
+		result := make([][]byte, len(keys))
+		for i, key := range keys {
+			result[i] = []byte(key)
+		}
+		return reply.MakeMultiBulkReply(result)
+	case "myid":
+		if len(args) != 0 {
+			return reply.MakeArgNumErrReply("cluster|myid")
+		}
+		return reply.MakeBulkReply([]byte(nodeID(cluster.self)))
+	case "nodes":
+		if len(args) != 0 {
+			return reply.MakeArgNumErrReply("cluster|nodes")
+		}
+		return reply.MakeBulkReply([]byte(cluster.clusterNodes()))
+	case "info":
+		if len(args) != 0 {
+			return reply.MakeArgNumErrReply("cluster|info")
+		}
+		return reply.MakeBulkReply([]byte(cluster.clusterInfo()))
+	case "meet":
+		if len(args) != 2 && len(args) != 3 {
+			return reply.MakeArgNumErrReply("cluster|meet")
+		}
+		return cluster.execMeet(args)
+	case "forget":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply("cluster|forget")
+		}
+		return cluster.execForget(string(args[0]))
+	case "ring":
+		if len(args) != 0 {
+			return reply.MakeArgNumErrReply("cluster|ring")
+		}
+		return cluster.execClusterRing()
+	}
+
+	// 以下子命令描述或修改槽位的分配情况，只在槽位模式下可用
+	if cluster.slots == nil {
+		return slotModeDisabledErr
+	}
+	switch subCmd {
+	case "slots":
+		if len(args) != 0 {
+			return reply.MakeArgNumErrReply("cluster|slots")
+		}
+		return cluster.execClusterSlots()
+	case "shards":
+		if len(args) != 0 {
+			return reply.MakeArgNumErrReply("cluster|shards")
+		}
+		return cluster.execClusterShards()
+	case "setslot":
+		if len(args) < 2 {
+			return reply.MakeArgNumErrReply("cluster|setslot")
+		}
+		return cluster.execSetSlot(args)
+	case "rebalance":
+		if len(args) != 0 {
+			return reply.MakeArgNumErrReply("cluster|rebalance")
+		}
+		return cluster.execRebalance()
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(cmdArgs[1]) + "'")
+}
+
+// parseSlot 解析槽位编号，超出 [0, 16383] 时返回 false
+
+func parseSlot(arg []byte) (int, bool) {
+	s, err := strconv.Atoi(string(arg))
+	if err != nil || s < 0 || s >= slot.SlotCount {
+		return 0, false
+	}
+	return s, true
+}
+
+// keysInSlot 遍历本节点的子数据库，返回属于槽位 s 的 key，limit 小于 0 时不限制数量
+
+func (cluster *ClusterDatabase) keysInSlot(dbIndex int, s int, limit int) []string {
+	keys := make([]string, 0)
+	if limit == 0 {
+		return keys
+	}
+	cluster.db.ForEach(dbIndex, func(key string, entity *database.DataEntity) bool {
+		if slot.HashSlot(key) == s {
+			keys = append(keys, key)
+		}
+		return limit < 0 || len(keys) < limit
+	})
+	return keys
+}
+
+// nodeSlotRange 是某个节点负责的一段槽位
+
+type nodeSlotRange struct {
+	node string
+	slotRange
+}
+
+// sortedRanges 返回全部已分配的槽位区间，按起始槽位升序排列
+
+func (cluster *ClusterDatabase) sortedRanges() []nodeSlotRange {
+	result := make([]nodeSlotRange, 0)
+	for node, ranges := range cluster.slots.ranges() {
+		for _, r := range ranges {
+			result = append(result, nodeSlotRange{node: node, slotRange: r})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].start < result[j].start
+	})
+	return result
+}
+
+// CLUSTER SLOTS：每个槽位区间返回 [start, end, [host, port, id]]
+
+func (cluster *ClusterDatabase) execClusterSlots() resp.Reply {
+	ranges := cluster.sortedRanges()
+	result := make([]resp.Reply, 0, len(ranges))
+	for _, r := range ranges {
+		host, port := splitAddr(r.node)
+		result = append(result, reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeIntReply(int64(r.start)),
+			reply.MakeIntReply(int64(r.end)),
+			reply.MakeMultiRawReply([]resp.Reply{
+				reply.MakeBulkReply([]byte(host)),
+				reply.MakeIntReply(int64(port)),
+				reply.MakeBulkReply([]byte(nodeID(r.node))),
+			}),
+		}))
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+// CLUSTER RING：一致性哈希模式下返回 [virtual-nodes, [[host:port, weight] ...]]，
+// 客户端用相同的参数构建哈希环后即可直接访问负责 key 的节点
+
+func (cluster *ClusterDatabase) execClusterRing() resp.Reply {
+	ring, ok := cluster.peerPicker.(*consistenthash.NodeMap)
+	if !ok {
+		return reply.MakeErrReply("ERR This instance uses slot routing, use CLUSTER SLOTS")
+	}
+	nodes := ring.Nodes()
+	result := make([]resp.Reply, 0, len(nodes))
+	for _, node := range nodes {
+		result = append(result, reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeBulkReply([]byte(node)),
+			reply.MakeIntReply(int64(ring.Weight(node))),
+		}))
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeIntReply(int64(ring.Replicas())),
+		reply.MakeMultiRawReply(result),
+	})
+}
+
+// CLUSTER SHARDS：每个节点是一个分片，返回它负责的槽位区间和节点信息，RESP3 下分片和节点信息都是 map
+
+func (cluster *ClusterDatabase) execClusterShards() resp.Reply {
+	ranges := cluster.slots.ranges()
+	result := make([]resp.Reply, 0, len(ranges))
+	for _, node := range cluster.slots.Nodes() {
+		slots := make([]resp.Reply, 0, 2*len(ranges[node]))
+		for _, r := range ranges[node] {
+			slots = append(slots, reply.MakeIntReply(int64(r.start)), reply.MakeIntReply(int64(r.end)))
+		}
+		host, port := splitAddr(node)
+		nodeInfo := reply.MakeMapReply([]resp.Reply{
+			reply.MakeBulkReply([]byte("id")), reply.MakeBulkReply([]byte(nodeID(node))),
+			reply.MakeBulkReply([]byte("port")), reply.MakeIntReply(int64(port)),
+			reply.MakeBulkReply([]byte("ip")), reply.MakeBulkReply([]byte(host)),
+			reply.MakeBulkReply([]byte("endpoint")), reply.MakeBulkReply([]byte(host)),
+			reply.MakeBulkReply([]byte("role")), reply.MakeBulkReply([]byte("master")),
+			reply.MakeBulkReply([]byte("replication-offset")), reply.MakeIntReply(0),
+			reply.MakeBulkReply([]byte("health")), reply.MakeBulkReply([]byte("online")),
+		})
+		result = append(result, reply.MakeMapReply([]resp.Reply{
+			reply.MakeBulkReply([]byte("slots")), reply.MakeMultiRawReply(slots),
+			reply.MakeBulkReply([]byte("nodes")), reply.MakeMultiRawReply([]resp.Reply{nodeInfo}),
+		}))
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+// clusterNodes 生成 CLUSTER NODES 的内容，每个节点一行：
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <config-epoch> <link-state> <slot> <slot> ...
+
+func (cluster *ClusterDatabase) clusterNodes() string {
+	views, _ := cluster.bus.snapshot()
+	var ranges map[string][]slotRange
+	if cluster.slots != nil {
+		ranges = cluster.slots.ranges()
+	}
+	var sb strings.Builder
+	for _, view := range views {
+		_, busPort := splitAddr(view.busAddr)
+		linkState := "disconnected"
+		if view.connected {
+			linkState = "connected"
+		}
+		sb.WriteString(nodeID(view.addr) + " " + view.addr + "@" + strconv.Itoa(busPort) + " " + nodeFlagsString(view.flags) +
+			" - " + strconv.FormatInt(unixMilli(view.pingSent), 10) + " " + strconv.FormatInt(unixMilli(view.pongRecv), 10) +
+			" " + strconv.FormatUint(view.configEpoch, 10) + " " + linkState)
+		for _, r := range ranges[view.addr] {
+			sb.WriteString(" " + r.String())
+		}
+		if view.addr == cluster.self && cluster.slots != nil {
+			sb.WriteString(cluster.migrationInfo())
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// nodeFlagsString 返回 CLUSTER NODES 中节点的 flags 字段
+
+func nodeFlagsString(flags int) string {
+	names := make([]string, 0, 3)
+	if flags&nodeFlagMyself > 0 {
+		names = append(names, "myself")
+	}
+	names = append(names, "master")
+	if flags&nodeFlagPFail > 0 {
+		names = append(names, "fail?")
+	}
+	if flags&nodeFlagFail > 0 {
+		names = append(names, "fail")
+	}
+	if flags&nodeFlagHandshake > 0 {
+		names = append(names, "handshake")
+	}
+	return strings.Join(names, ",")
+}
+
+// unixMilli 返回毫秒时间戳，零值时间返回 0
+
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// clusterInfo 生成 CLUSTER INFO 的内容，槽位全部分配且负责它们的节点都没有下线时集群状态为 ok
+
+func (cluster *ClusterDatabase) clusterInfo() string {
+	views, currentEpoch := cluster.bus.snapshot()
+	assigned, ok, pfail, fail := 0, 0, 0, 0
+	size := 0
+	var myEpoch uint64
+	knownNodes := 0
+	var ranges map[string][]slotRange
+	if cluster.slots != nil {
+		ranges = cluster.slots.ranges()
+	}
+	for _, view := range views {
+		if view.addr == cluster.self {
+			myEpoch = view.configEpoch
+		}
+		if view.flags&nodeFlagHandshake > 0 {
+			continue
+		}
+		knownNodes++
+		count := 0
+		for _, r := range ranges[view.addr] {
+			count += r.end - r.start + 1
+		}
+		if count > 0 {
+			size++
+		}
+		assigned += count
+		switch {
+		case view.flags&nodeFlagFail > 0:
+			fail += count
+		case view.flags&nodeFlagPFail > 0:
+			pfail += count
+		default:
+			ok += count
+		}
+	}
+	state := "ok"
+	if cluster.slots != nil && (assigned < slot.SlotCount || fail > 0) {
+		state = "fail"
+	}
+	var sb strings.Builder
+	sb.WriteString("cluster_enabled:1\r\n")
+	sb.WriteString("cluster_state:" + state + "\r\n")
+	sb.WriteString("cluster_slots_assigned:" + strconv.Itoa(assigned) + "\r\n")
+	sb.WriteString("cluster_slots_ok:" + strconv.Itoa(ok) + "\r\n")
+	sb.WriteString("cluster_slots_pfail:" + strconv.Itoa(pfail) + "\r\n")
+	sb.WriteString("cluster_slots_fail:" + strconv.Itoa(fail) + "\r\n")
+	sb.WriteString("cluster_known_nodes:" + strconv.Itoa(knownNodes) + "\r\n")
+	sb.WriteString("cluster_size:" + strconv.Itoa(size) + "\r\n")
+	sb.WriteString("cluster_current_epoch:" + strconv.FormatUint(currentEpoch, 10) + "\r\n")
+	sb.WriteString("cluster_my_epoch:" + strconv.FormatUint(myEpoch, 10) + "\r\n")
+	return sb.String()
+}
+
+// CLUSTER MEET <ip> <port> [<cluster-bus-port>]，与指定节点握手，握手在后台进行
+
+func (cluster *ClusterDatabase) execMeet(args [][]byte) resp.Reply {
+	host := string(args[0])
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 || net.ParseIP(host) == nil {
+		return reply.MakeErrReply("ERR Invalid node address specified: " + host + ":" + string(args[1]))
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	busAddr := defaultBusAddr(addr)
+	if len(args) == 3 {
+		busPort, err := strconv.Atoi(string(args[2]))
+		if err != nil || busPort <= 0 || busPort > 65535 {
+			return reply.MakeErrReply("ERR Invalid cluster bus port specified: " + string(args[2]))
+		}
+		busAddr = net.JoinHostPort(host, strconv.Itoa(busPort))
+	}
+	if addr == cluster.self {
+		return reply.MakeOkReply()
+	}
+	cluster.bus.meet(addr, busAddr)
+	return reply.MakeOkReply()
+}
+
+// CLUSTER FORGET <node-id>，将节点从本节点的成员列表中移除，需要在集群中的每个节点上执行
+
+func (cluster *ClusterDatabase) execForget(id string) resp.Reply {
+	addr, ok := cluster.bus.nodeByID(id)
+	if !ok {
+		return reply.MakeErrReply("ERR Unknown node " + id)
+	}
+	if addr == cluster.self {
+		return reply.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	cluster.bus.forget(addr)
+	return reply.MakeOkReply()
+}
+
+// migrationInfo 按 CLUSTER NODES 的格式输出本节点的迁移状态：[slot->-目标节点 ID] 和 [slot-<-源节点 ID]
+
+func (cluster *ClusterDatabase) migrationInfo() string {
+	migrating, importing := cluster.slots.migrationStates()
+	states := make([]int, 0, len(migrating)+len(importing))
+	for s := range migrating {
+		states = append(states, s)
+	}
+	for s := range importing {
+		if _, ok := migrating[s]; !ok {
+			states = append(states, s)
+		}
+	}
+	sort.Ints(states)
+	var sb strings.Builder
+	for _, s := range states {
+		if node, ok := migrating[s]; ok {
+			sb.WriteString(" [" + strconv.Itoa(s) + "->-" + nodeID(node) + "]")
+		}
+		if node, ok := importing[s]; ok {
+			sb.WriteString(" [" + strconv.Itoa(s) + "-<-" + nodeID(node) + "]")
+		}
+	}
+	return sb.String()
+}
+
+// CLUSTER SETSLOT <slot> IMPORTING <node-id> | MIGRATING <node-id> | NODE <node-id> | STABLE
+
+func (cluster *ClusterDatabase) execSetSlot(args [][]byte) resp.Reply {
+	s, ok := parseSlot(args[0])
+	if !ok {
+		return reply.MakeErrReply("ERR Invalid or out of range slot")
+	}
+	action := strings.ToLower(string(args[1]))
+	if action == "stable" {
+		if len(args) != 2 {
+			return reply.MakeSyntaxErrReply()
+		}
+		cluster.slots.setStable(s)
+		return reply.MakeOkReply()
+	}
+	if len(args) != 3 {
+		return reply.MakeSyntaxErrReply()
+	}
+	node, ok := cluster.bus.nodeByID(string(args[2]))
+	if !ok {
+		return reply.MakeErrReply("ERR I don't know about node " + string(args[2]))
+	}
+	switch action {
+	case "migrating":
+		if cluster.slots.nodeOf(s) != cluster.self {
+			return reply.MakeErrReply("ERR I'm not the owner of hash slot " + strconv.Itoa(s))
+		}
+		if node == cluster.self {
+			return reply.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(s))
+		}
+		cluster.slots.setMigrating(s, node)
+	case "importing":
+		if cluster.slots.nodeOf(s) == cluster.self {
+			return reply.MakeErrReply("ERR I'm already the owner of hash slot " + strconv.Itoa(s))
+		}
+		if node == cluster.self {
+			return reply.MakeErrReply("ERR Target node is myself")
+		}
+		cluster.slots.setImporting(s, node)
+	case "node":
+		// 本节点仍持有该槽位的 key 时不能将其交给其他节点，否则这些 key 将无法访问
+		if node != cluster.self && cluster.slots.nodeOf(s) == cluster.self {
+			for i := 0; i < cluster.db.GetDBNum(); i++ {
+				if len(cluster.keysInSlot(i, s, 1)) > 0 {
+					return reply.MakeErrReply("ERR Can't assign hashslot " + strconv.Itoa(s) +
+						" to a different node while I still hold keys for this hash slot.")
+				}
+			}
+		}
+		// 本节点接管槽位时使用新的 configEpoch，使其他节点通过 gossip 接受新的归属
+		if node == cluster.self && cluster.slots.nodeOf(s) != cluster.self {
+			cluster.bus.bumpEpoch()
+		}
+		cluster.slots.setNode(s, node)
+	default:
+		return reply.MakeErrReply("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+	}
+	return reply.MakeOkReply()
+}
@@ -1,57 +1,94 @@
 package cluster
 
 import (
-	"context"
+	"fmt"
 	pool "github.com/jolestar/go-commons-pool/v2"
 	"go-redis/config"
 	database2 "go-redis/database"
+	"go-redis/datastruct/dict"
 	"go-redis/interface/database"
 	"go-redis/interface/resp"
 	"go-redis/lib/consistenthash"
 	"go-redis/lib/logger"
+	"go-redis/lib/slot"
 	"go-redis/resp/reply"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ClusterDatabase struct {
 	self           string                      // 记录节点自己的名称 or 地址
-	nodes          []string                    // 整个集群所有的节点，包括自己
-	peerPicker     *consistenthash.NodeMap     // peer 同辈；节点选择器,通过一致性哈希算法选择目标节点
+	bus            *clusterBus                 // 集群总线，维护集群中有哪些节点以及它们的状态
+	peerPicker     peerPicker                  // peer 同辈；节点选择器,通过一致性哈希环或槽位表选择目标节点
+	slots          *slotTable                  // 槽位表，仅在 cluster-mode 为 slot 时不为空
+	peerMu         sync.Mutex                  // 保护 peerConnection，集群成员变化时会增删连接池
 	peerConnection map[string]*pool.ObjectPool // 当前节点会为每个其他节点（如 node-2 和 node-3）维护一个独立的网络连接池，用于高效管理到这些节点的通信连接
-	db             database.Database
+	db             database.DBEngine
+	rebalancing    int32 // 为 1 时表示正在执行 CLUSTER REBALANCE
+
+	transactions *dict.SyncDict // 本节点参与的集群事务，事务 id -> *transaction
+	startTime    int64          // 启动时间，用于生成事务 id
 }
 
 func MakeClusterDatabase() *ClusterDatabase {
 	cluster := &ClusterDatabase{
 		self:           config.Properties.Self,            // 从配置中读取自身地址
 		db:             database2.NewStandaloneDatabase(), // 初始化本地数据库
-		peerPicker:     consistenthash.NewNodeMap(nil),    // 创建一致性哈希选择器
 		peerConnection: make(map[string]*pool.ObjectPool), // 初始化空连接池映射
+		transactions:   dict.MakeSyncDict(),
+		startTime:      time.Now().UnixNano(),
 	}
 
-	// 初始化 nodes
+	// 配置文件中的 peers 是集群的初始成员，之后的成员变化通过集群总线获知
 	nodes := make([]string, 0, len(config.Properties.Peers)+1) // len(config.Properties.Peers)+1 意味其余节点和自己
 	// 将 self 和 peers 都加入 nodes 中
 	for _, peer := range config.Properties.Peers {
-		nodes = append(nodes, peer)
+		if peer = strings.TrimSpace(peer); peer != "" && peer != config.Properties.Self {
+			nodes = append(nodes, peer)
+		}
 	}
 	nodes = append(nodes, config.Properties.Self)
-	cluster.peerPicker.AddNode(nodes...) // 构建一致性哈希环
-	cluster.nodes = nodes
+	if config.Properties.SlotMode() {
+		// 按 cluster-slots 配置构建槽位表，与 Redis Cluster 客户端的路由方式一致
+		table, err := makeSlotTable(nodes, config.Properties.ClusterSlots)
+		if err != nil {
+			panic(err)
+		}
+		cluster.slots = table
+		cluster.peerPicker = table
+		logSlotAssignment(table)
+	} else {
+		// 构建一致性哈希环，按配置的权重为每个节点放置虚拟节点
+		picker := consistenthash.NewNodeMapWithReplicas(config.Properties.VirtualNodes, nil)
+		weights := config.Properties.NodeWeightMap()
+		for _, node := range nodes {
+			weight, ok := weights[node]
+			if !ok {
+				weight = 1
+			}
+			picker.AddNodeWithWeight(node, weight)
+		}
+		cluster.peerPicker = picker
+		logDistribution(picker)
+	}
 
-	// 初始化连接池 peerConnection
-	ctx := context.Background()
-	for _, peer := range config.Properties.Peers {
-		cluster.peerConnection[peer] = pool.NewObjectPoolWithDefaultConfig( // 使用默认配置创建连接池，每个其他节点对应一个连接池，存储在 peerConnection 映射中
-			ctx,
-			&connectionFactory{Peer: peer})
+	// 连接池 peerConnection 在第一次访问某个节点时创建
+	cluster.bus = makeClusterBus(cluster, nodes)
+	if err := cluster.bus.start(); err != nil {
+		panic(err)
 	}
 	return cluster
 }
 
 type CmdFunc func(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply
 
-var router = makeRouter()
+var router map[string]CmdFunc
+
+// router 在 init 中初始化，避免与 CLUSTER REBALANCE 等通过 Exec 调用本节点指令的函数形成初始化循环
+func init() {
+	router = makeRouter()
+}
 
 func (cluster *ClusterDatabase) Exec(client resp.Connection, args [][]byte) (result resp.Reply) {
 	defer func() {
@@ -61,18 +98,89 @@ func (cluster *ClusterDatabase) Exec(client resp.Connection, args [][]byte) (res
 		}
 	}()
 	cmdName := strings.ToLower(string(args[0])) // 拿到指令名称
+	if client.InMultiState() && cmdName != "multi" && cmdName != "exec" && cmdName != "discard" {
+		return cluster.enqueueCmd(client, args) // 事务中的指令先入队，EXEC 时统一执行
+	}
 	cmdFunc, ok := router[cmdName]
 	if !ok {
-		return reply.MakeErrReply("not supported cmd")
+		cmdFunc = defaultFunc
 	}
 	result = cmdFunc(cluster, client, args)
+	if cmdName != "asking" {
+		client.SetAsking(false) // ASKING 只对紧随其后的一条指令有效
+	}
 	return
 }
 
 func (cluster *ClusterDatabase) Close() {
+	cluster.bus.close()
 	cluster.db.Close()
 }
 
 func (cluster *ClusterDatabase) AfterClientClose(c resp.Connection) {
 	cluster.db.AfterClientClose(c)
 }
+
+// updatePeerPicker 在集群成员发生变化后更新节点选择器，调用方需持有 bus.mu
+// 槽位模式下只更新节点列表，槽位的归属由槽位声明和 CLUSTER SETSLOT 决定；
+// 一致性哈希模式下哈希环包含所有已完成握手的节点，只在节点加入或被 FORGET 时改变：
+// 下线的节点仍然留在环上，访问它负责的 key 时返回 CLUSTERDOWN，
+// 否则这些 key 会被映射到没有数据的节点上，节点恢复后两边的数据也会不一致
+
+func (cluster *ClusterDatabase) updatePeerPicker() {
+	if cluster.slots != nil {
+		cluster.slots.setNodes(cluster.bus.knownNodesLocked())
+		return
+	}
+	ring, ok := cluster.peerPicker.(*consistenthash.NodeMap)
+	if !ok {
+		return
+	}
+	members := make(map[string]bool)
+	for _, node := range cluster.bus.knownNodesLocked() {
+		members[node] = true
+	}
+	changed := false
+	for _, node := range ring.Nodes() {
+		if !members[node] {
+			ring.RemoveNode(node)
+			changed = true
+		}
+		delete(members, node)
+	}
+	weights := config.Properties.NodeWeightMap()
+	for node := range members {
+		weight, ok := weights[node]
+		if !ok {
+			weight = 1
+		}
+		ring.AddNodeWithWeight(node, weight)
+		changed = true
+	}
+	if changed {
+		logDistribution(ring)
+	}
+}
+
+// logDistribution 输出每个节点负责的 key 的比例，便于检查虚拟节点数量和权重的配置是否合理
+func logDistribution(picker *consistenthash.NodeMap) {
+	distribution := picker.Distribution()
+	for _, node := range picker.Nodes() {
+		logger.Info(fmt.Sprintf("cluster: node %s owns %.2f%% of the keyspace", node, distribution[node]*100))
+	}
+}
+
+// logSlotAssignment 输出每个节点负责的槽位，存在未分配的槽位时给出警告
+func logSlotAssignment(table *slotTable) {
+	ranges := table.ranges()
+	for _, node := range table.Nodes() {
+		parts := make([]string, 0, len(ranges[node]))
+		for _, r := range ranges[node] {
+			parts = append(parts, r.String())
+		}
+		logger.Info(fmt.Sprintf("cluster: node %s owns slots [%s]", node, strings.Join(parts, " ")))
+	}
+	if assigned := table.assignedCount(); assigned < slot.SlotCount {
+		logger.Warn(fmt.Sprintf("cluster: %d slots are not assigned to any node", slot.SlotCount-assigned))
+	}
+}
@@ -3,6 +3,7 @@ package cluster
 import (
 	"context"
 	"errors"
+	pool "github.com/jolestar/go-commons-pool/v2"
 	"go-redis/interface/resp"
 	"go-redis/lib/utils"
 	"go-redis/resp/client"
@@ -13,10 +14,7 @@ import (
 // 从目标连接池中取到一个连接，入参是目标节点的地址
 
 func (cluster *ClusterDatabase) getPeerClient(peer string) (*client.Client, error) {
-	pool, ok := cluster.peerConnection[peer] // 拿到了当前节点维护的目标节点的连接池
-	if !ok {
-		return nil, errors.New("connection not found")
-	}
+	pool := cluster.getPeerPool(peer) // 拿到了当前节点维护的目标节点的连接池
 	// 从连接池中借用一个连接
 	object, err := pool.BorrowObject(context.Background())
 	if err != nil {
@@ -32,19 +30,63 @@ func (cluster *ClusterDatabase) getPeerClient(peer string) (*client.Client, erro
 // 将连接还回连接池
 
 func (cluster *ClusterDatabase) returnPeerClient(peer string, peerClient *client.Client) error {
+	cluster.peerMu.Lock()
 	pool, ok := cluster.peerConnection[peer] // 拿到还回的目标连接池
-	if !ok {
+	cluster.peerMu.Unlock()
+	if !ok { // 连接池已经随节点一起被移除
+		peerClient.Close()
 		return errors.New("connection not found")
 	}
 	return pool.ReturnObject(context.Background(), peerClient)
 }
 
+// getPeerPool 返回目标节点的连接池，不存在时使用默认配置创建
+
+func (cluster *ClusterDatabase) getPeerPool(peer string) *pool.ObjectPool {
+	cluster.peerMu.Lock()
+	defer cluster.peerMu.Unlock()
+	p, ok := cluster.peerConnection[peer]
+	if !ok {
+		p = pool.NewObjectPoolWithDefaultConfig(context.Background(), &connectionFactory{Peer: peer})
+		cluster.peerConnection[peer] = p
+	}
+	return p
+}
+
+// closePeerPool 关闭并移除目标节点的连接池，在节点被移出集群时调用
+
+func (cluster *ClusterDatabase) closePeerPool(peer string) {
+	cluster.peerMu.Lock()
+	p, ok := cluster.peerConnection[peer]
+	delete(cluster.peerConnection, peer)
+	cluster.peerMu.Unlock()
+	if ok {
+		go p.Close(context.Background())
+	}
+}
+
 // 将用户指令（args）通过连接（c）转发给目标节点（peer），并返回 reply
 
 func (cluster *ClusterDatabase) relay(peer string, c resp.Connection, args [][]byte) resp.Reply {
+	return cluster.doRelay(peer, c, args, false)
+}
+
+// relayAsking 转发指令前先发送 ASKING，用于访问目标节点正在导入的槽位
+
+func (cluster *ClusterDatabase) relayAsking(peer string, c resp.Connection, args [][]byte) resp.Reply {
+	return cluster.doRelay(peer, c, args, true)
+}
+
+func (cluster *ClusterDatabase) doRelay(peer string, c resp.Connection, args [][]byte, asking bool) resp.Reply {
+	if peer == "" { // 槽位没有分配给任何节点
+		return reply.MakeErrReply("CLUSTERDOWN Hash slot not served")
+	}
 	if peer == cluster.self { // 如果 peer 是自己，则直接执行指令
 		return cluster.db.Exec(c, args)
 	}
+	if cluster.bus.isFailed(peer) { // 下线的节点仍然负责它的 key，不能交给其他节点处理
+		return reply.MakeErrReply("CLUSTERDOWN The node " + peer + " serving the key is down")
+	}
 	peerClient, err := cluster.getPeerClient(peer) // 从目标连接池中取出一个连接
 	if err != nil {
 		return reply.MakeErrReply(err.Error())
@@ -53,6 +95,9 @@ func (cluster *ClusterDatabase) relay(peer string, c resp.Connection, args [][]b
 		_ = cluster.returnPeerClient(peer, peerClient) // 用于及时归还连接池连接
 	}()
 	peerClient.Send(utils.ToCmdLine("SELECT", strconv.Itoa(c.GetDBIndex()))) // 转发指令前，先转发“选择子数据库”指令
+	if asking {
+		peerClient.Send(utils.ToCmdLine("ASKING"))
+	}
 	return peerClient.Send(args)
 }
 
@@ -60,9 +105,27 @@ func (cluster *ClusterDatabase) relay(peer string, c resp.Connection, args [][]b
 
 func (cluster *ClusterDatabase) broadcast(c resp.Connection, args [][]byte) map[string]resp.Reply {
 	results := make(map[string]resp.Reply)
-	for _, node := range cluster.nodes {
-		result := cluster.relay(node, c, args)
+	for _, node := range cluster.bus.aliveNodes() {
+		result := cluster.relayLocal(node, c, args)
 		results[node] = result
 	}
 	return results
 }
+
+// relayLocal 让目标节点只在本地执行指令，不再按集群路由，避免广播类指令在节点之间循环转发
+
+func (cluster *ClusterDatabase) relayLocal(peer string, c resp.Connection, args [][]byte) resp.Reply {
+	if peer == cluster.self {
+		return cluster.db.Exec(c, args)
+	}
+	return cluster.relay(peer, c, append([][]byte{[]byte("LOCALEXEC")}, args...))
+}
+
+// LOCALEXEC cmd [arg ...]，节点间的内部指令，在本节点执行 cmd
+
+func execLocal(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("localexec")
+	}
+	return cluster.db.Exec(c, cmdArgs[1:])
+}
@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strconv"
+)
+
+// 游标的低 16 位是节点在 aliveNodes 中的下标，其余位是该节点返回的游标
+const scanNodeBits = 16
+
+// KEYS pattern，向所有节点广播并合并结果
+// 只保留由该节点负责的 key，迁移过程中残留在源节点上的 key 不会重复返回
+
+func execKeys(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 2 {
+		return reply.MakeArgNumErrReply("keys")
+	}
+	result := make([][]byte, 0)
+	for _, node := range cluster.bus.aliveNodes() {
+		r := cluster.relayLocal(node, c, cmdArgs)
+		if reply.IsErrorReply(r) {
+			return r
+		}
+		result = append(result, cluster.ownedKeys(node, multiBulkArgs(r))...)
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// DBSIZE，各节点 key 数量之和
+
+func execDBSize(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("dbsize")
+	}
+	var size int64
+	for _, node := range cluster.bus.aliveNodes() {
+		r := cluster.relayLocal(node, c, cmdArgs)
+		intReply, ok := r.(*reply.IntReply)
+		if !ok {
+			if reply.IsErrorReply(r) {
+				return r
+			}
+			return reply.MakeErrReply("ERR unexpected dbsize reply from " + node)
+		}
+		size += intReply.Code
+	}
+	return reply.MakeIntReply(size)
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]，按 aliveNodes 的顺序逐个节点遍历
+// 一个节点遍历结束（返回游标 0）后从下一个节点的游标 0 开始，遍历期间集群成员变化时可能遗漏或重复返回 key
+
+func execScan(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("scan")
+	}
+	cursor, err := strconv.ParseUint(string(cmdArgs[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	nodes := cluster.bus.aliveNodes()
+	index := int(cursor & (1<<scanNodeBits - 1))
+	nodeCursor := cursor >> scanNodeBits
+	if index >= len(nodes) {
+		return scanResult(0, nil)
+	}
+	node := nodes[index]
+	args := make([][]byte, len(cmdArgs))
+	copy(args, cmdArgs)
+	args[1] = []byte(strconv.FormatUint(nodeCursor, 10))
+	r := cluster.relayLocal(node, c, args)
+	if reply.IsErrorReply(r) {
+		return r
+	}
+	nodeCursor, keys, ok := parseScanReply(r)
+	if !ok {
+		return reply.MakeErrReply("ERR unexpected scan reply from " + node)
+	}
+	keys = cluster.ownedKeys(node, keys)
+	if nodeCursor == 0 {
+		index++
+		if index >= len(nodes) { // 所有节点都遍历完了
+			return scanResult(0, keys)
+		}
+	}
+	return scanResult(nodeCursor<<scanNodeBits|uint64(index), keys)
+}
+
+// ownedKeys 过滤出由 node 负责的 key
+
+func (cluster *ClusterDatabase) ownedKeys(node string, keys [][]byte) [][]byte {
+	result := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if cluster.peerPicker.PickNode(string(key)) == node {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// parseScanReply 解析节点返回的 [cursor, [key ...]]
+
+func parseScanReply(r resp.Reply) (uint64, [][]byte, bool) {
+	raw, ok := r.(*reply.MultiRawReply)
+	if !ok || len(raw.Replies) != 2 {
+		return 0, nil, false
+	}
+	cursorReply, ok := raw.Replies[0].(*reply.BulkReply)
+	if !ok {
+		return 0, nil, false
+	}
+	cursor, err := strconv.ParseUint(string(cursorReply.Arg), 10, 64)
+	if err != nil {
+		return 0, nil, false
+	}
+	return cursor, multiBulkArgs(raw.Replies[1]), true
+}
+
+func multiBulkArgs(r resp.Reply) [][]byte {
+	if multiBulk, ok := r.(*reply.MultiBulkReply); ok {
+		return multiBulk.Args
+	}
+	return nil
+}
+
+func scanResult(cursor uint64, keys [][]byte) resp.Reply {
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		reply.MakeMultiBulkReply(keys),
+	})
+}
@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"errors"
+	"go-redis/database"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strings"
+)
+
+var tryAgainErr = reply.MakeErrReply("TRYAGAIN Multiple keys request during rehashing of slot")
+
+// enqueueCmd 在事务中将指令入队，重定向模式下不属于本节点的 key 返回 MOVED，并在 EXEC 时放弃整个事务
+// 不在指令表中的指令（如 SELECT、不存在的指令）由 database.EnqueueCmd 决定是否入队
+
+func (cluster *ClusterDatabase) enqueueCmd(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	writeKeys, readKeys, errReply := database.GetRelatedKeys(cmdLine)
+	if errReply != nil {
+		return database.EnqueueCmd(c, cmdLine)
+	}
+	for _, key := range append(writeKeys, readKeys...) {
+		if r := cluster.redirect(c, key, cluster.peerPicker.PickNode(key)); r != nil {
+			c.AddTxError(errors.New(r.(reply.ErrorReply).Error()))
+			return r
+		}
+	}
+	return database.EnqueueCmd(c, cmdLine)
+}
+
+// EXEC，事务中的指令都由本节点负责时在本地原子地执行，否则作为协调者发起集群事务
+
+func execExec(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("exec")
+	}
+	if !c.InMultiState() {
+		return reply.MakeErrReply("ERR EXEC without MULTI")
+	}
+	cmdLines := c.GetQueuedCmdLine()
+	txErrors := c.GetTxErrors()
+	c.SetMultiState(false)
+	if len(txErrors) > 0 {
+		return reply.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	if len(cmdLines) == 0 {
+		return reply.MakeEmptyMultiBulkReply()
+	}
+
+	groups, errReply := cluster.groupCmdLines(c, cmdLines)
+	if errReply != nil {
+		return errReply
+	}
+	if len(groups) == 1 && groups[0].peer == cluster.self {
+		return cluster.db.ExecMulti(c, cmdLines)
+	}
+	groupResults, _, errReply := cluster.runTransaction(c.GetDBIndex(), groups)
+	if errReply != nil {
+		return errReply
+	}
+	results := make([]resp.Reply, len(cmdLines))
+	for i, group := range groups {
+		for j, index := range group.indexes {
+			results[index] = groupResults[i][j]
+		}
+	}
+	return reply.MakeMultiRawReply(results)
+}
+
+// groupCmdLines 按负责的节点对事务中的指令分组，不涉及 key 的指令在本节点执行
+// 一条指令涉及的 key 必须由同一个节点负责
+// SELECT 等数据库层指令只能在本节点执行，包含它们的事务涉及的 key 必须都由本节点负责
+
+func (cluster *ClusterDatabase) groupCmdLines(c resp.Connection, cmdLines [][][]byte) ([]*txGroup, resp.Reply) {
+	groups := make([]*txGroup, 0)
+	groupMap := make(map[string]*txGroup)
+	localOnly := ""
+	for i, cmdLine := range cmdLines {
+		var writeKeys, readKeys []string
+		if database.IsTxDatabaseCommend(string(cmdLine[0])) {
+			localOnly = strings.ToLower(string(cmdLine[0]))
+		} else {
+			var errReply resp.Reply
+			writeKeys, readKeys, errReply = database.GetRelatedKeys(cmdLine)
+			if errReply != nil {
+				return nil, errReply
+			}
+		}
+		peer := cluster.self
+		for j, key := range append(writeKeys, readKeys...) {
+			keyPeer, asking := cluster.locateKey(c, key)
+			if asking {
+				return nil, tryAgainErr
+			}
+			if j > 0 && keyPeer != peer {
+				return nil, reply.MakeErrReply("ERR keys of '" + strings.ToLower(string(cmdLine[0])) +
+					"' in a transaction must be owned by the same node")
+			}
+			peer = keyPeer
+		}
+		if peer == "" {
+			return nil, reply.MakeErrReply("CLUSTERDOWN Hash slot not served")
+		}
+		group, ok := groupMap[peer]
+		if !ok {
+			group = &txGroup{peer: peer}
+			groupMap[peer] = group
+			groups = append(groups, group)
+		}
+		group.indexes = append(group.indexes, i)
+		group.cmdLines = append(group.cmdLines, cmdLine)
+	}
+	if localOnly != "" && (len(groups) > 1 || groups[0].peer != cluster.self) {
+		return nil, reply.MakeErrReply("ERR '" + localOnly + "' in a transaction requires all keys to be owned by this node")
+	}
+	return groups, nil
+}
+
+// MSETNX k1 v1 k2 v2 ... key 分布在多个节点上时通过集群事务保证所有节点要么都写入，要么都不写入
+
+func msetnx(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 3 || len(cmdArgs)%2 != 1 {
+		return reply.MakeArgNumErrReply("msetnx")
+	}
+	keys := make([]string, 0, len(cmdArgs)/2)
+	for i := 1; i < len(cmdArgs); i += 2 {
+		keys = append(keys, string(cmdArgs[i]))
+	}
+	if r := cluster.multiKeyRedirect(c, keys, cmdArgs); r != nil {
+		return r
+	}
+	keyGroups := cluster.groupKeys(c, keys)
+	if len(keyGroups) == 1 { // 只涉及一个节点，由该节点保证原子性
+		return cluster.relayGroup(c, keyGroups[0], cmdArgs)
+	}
+	groups := make([]*txGroup, len(keyGroups))
+	for i, keyGroup := range keyGroups {
+		if keyGroup.asking {
+			return tryAgainErr
+		}
+		groups[i] = &txGroup{
+			peer:     keyGroup.peer,
+			cmdLines: [][][]byte{pickArgs("MSETNX", cmdArgs[1:], keyGroup, 2)},
+		}
+	}
+	_, aborted, errReply := cluster.runTransaction(c.GetDBIndex(), groups)
+	if errReply != nil {
+		return errReply
+	}
+	if aborted {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(1)
+}
+
+// DEL k1 k2 ..., UNLINK k1 k2 ... key 分布在多个节点上时通过集群事务删除，其他客户端不会看到只删除了一部分的中间状态
+
+func del(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	cmdName := strings.ToLower(string(cmdArgs[0]))
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply(cmdName)
+	}
+	keys := toKeys(cmdArgs[1:])
+	if r := cluster.multiKeyRedirect(c, keys, cmdArgs); r != nil {
+		return r
+	}
+	keyGroups := cluster.groupKeys(c, keys)
+	if len(keyGroups) == 1 {
+		return cluster.relayGroup(c, keyGroups[0], cmdArgs)
+	}
+	groups := make([]*txGroup, len(keyGroups))
+	for i, keyGroup := range keyGroups {
+		if keyGroup.asking {
+			return tryAgainErr
+		}
+		groups[i] = &txGroup{
+			peer:     keyGroup.peer,
+			cmdLines: [][][]byte{pickArgs("DEL", cmdArgs[1:], keyGroup, 1)},
+		}
+	}
+	results, _, errReply := cluster.runTransaction(c.GetDBIndex(), groups)
+	if errReply != nil {
+		return errReply
+	}
+	var count int64
+	for i, result := range results {
+		intReply, ok := result[0].(*reply.IntReply)
+		if !ok {
+			return reply.MakeErrReply("ERR unexpected reply of " + cmdName + " from " + groups[i].peer)
+		}
+		count += intReply.Code
+	}
+	return reply.MakeIntReply(count)
+}
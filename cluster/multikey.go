@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/slot"
+	"go-redis/resp/reply"
+	"strings"
+	"sync"
+)
+
+// keyGroup 是一条多 key 指令中由同一个节点处理的 key
+
+type keyGroup struct {
+	peer    string
+	asking  bool  // 槽位正在迁出，需要带上 ASKING 访问目标节点
+	indexes []int // key 在指令中的位置
+}
+
+// groupKeys 按处理节点对 key 分组，分组的顺序与 key 第一次出现的顺序一致
+
+func (cluster *ClusterDatabase) groupKeys(c resp.Connection, keys []string) []*keyGroup {
+	groups := make([]*keyGroup, 0)
+	groupMap := make(map[string]*keyGroup)
+	for i, key := range keys {
+		peer, asking := cluster.locateKey(c, key)
+		id := peer
+		if asking {
+			id = "asking:" + peer
+		}
+		group, ok := groupMap[id]
+		if !ok {
+			group = &keyGroup{peer: peer, asking: asking}
+			groupMap[id] = group
+			groups = append(groups, group)
+		}
+		group.indexes = append(group.indexes, i)
+	}
+	return groups
+}
+
+// scatter 并发地向每个分组的节点发送 makeArgs 生成的指令，返回的结果与分组一一对应
+
+func (cluster *ClusterDatabase) scatter(c resp.Connection, groups []*keyGroup, makeArgs func(group *keyGroup) [][]byte) []resp.Reply {
+	replies := make([]resp.Reply, len(groups))
+	if len(groups) == 1 { // 只涉及一个节点时不需要额外的协程
+		replies[0] = cluster.relayGroup(c, groups[0], makeArgs(groups[0]))
+		return replies
+	}
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group *keyGroup) {
+			defer wg.Done()
+			replies[i] = cluster.relayGroup(c, group, makeArgs(group))
+		}(i, group)
+	}
+	wg.Wait()
+	return replies
+}
+
+func (cluster *ClusterDatabase) relayGroup(c resp.Connection, group *keyGroup, args [][]byte) resp.Reply {
+	if group.asking {
+		return cluster.relayAsking(group.peer, c, args)
+	}
+	return cluster.relay(group.peer, c, args)
+}
+
+// multiKeyRedirect 处理重定向模式下的多 key 指令：与 Redis Cluster 相同，所有 key 必须属于同一个槽位，整条指令按第一个 key 路由
+// 返回 nil 表示连接没有开启重定向模式，由本节点拆分后转发
+
+func (cluster *ClusterDatabase) multiKeyRedirect(c resp.Connection, keys []string, cmdArgs [][]byte) resp.Reply {
+	if cluster.slots == nil || !c.IsRedirect() {
+		return nil
+	}
+	s := slot.HashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if slot.HashSlot(key) != s {
+			return reply.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	return cluster.routeKey(c, keys[0], cmdArgs)
+}
+
+// pickArgs 生成只包含分组中 key 的指令，每个 key 在指令中占 step 个参数，如 MSET 的 step 为 2
+
+func pickArgs(cmdName string, args [][]byte, group *keyGroup, step int) [][]byte {
+	result := make([][]byte, 0, len(group.indexes)*step+1)
+	result = append(result, []byte(cmdName))
+	for _, index := range group.indexes {
+		result = append(result, args[index*step:index*step+step]...)
+	}
+	return result
+}
+
+// MGET k1 k2 k3 ... 按节点拆分后并发执行，再按 key 原来的顺序合并结果
+
+func mget(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("mget")
+	}
+	keys := toKeys(cmdArgs[1:])
+	if r := cluster.multiKeyRedirect(c, keys, cmdArgs); r != nil {
+		return r
+	}
+	groups := cluster.groupKeys(c, keys)
+	replies := cluster.scatter(c, groups, func(group *keyGroup) [][]byte {
+		return pickArgs("MGET", cmdArgs[1:], group, 1)
+	})
+	result := make([][]byte, len(keys))
+	for i, group := range groups {
+		if reply.IsErrorReply(replies[i]) {
+			return replies[i]
+		}
+		values, ok := replies[i].(*reply.MultiBulkReply)
+		if !ok || len(values.Args) != len(group.indexes) {
+			return reply.MakeErrReply("ERR unexpected reply of mget from " + group.peer)
+		}
+		for j, index := range group.indexes {
+			result[index] = values.Args[j]
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// MSET k1 v1 k2 v2 ... 按节点拆分后并发执行
+// 每个节点上的 MSET 是原子的，但不同节点之间不是：某个节点失败时其他节点的写入不会撤销
+
+func mset(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 3 || len(cmdArgs)%2 != 1 {
+		return reply.MakeArgNumErrReply("mset")
+	}
+	keys := make([]string, 0, len(cmdArgs)/2)
+	for i := 1; i < len(cmdArgs); i += 2 {
+		keys = append(keys, string(cmdArgs[i]))
+	}
+	if r := cluster.multiKeyRedirect(c, keys, cmdArgs); r != nil {
+		return r
+	}
+	groups := cluster.groupKeys(c, keys)
+	replies := cluster.scatter(c, groups, func(group *keyGroup) [][]byte {
+		return pickArgs("MSET", cmdArgs[1:], group, 2)
+	})
+	for _, r := range replies {
+		if reply.IsErrorReply(r) {
+			return r
+		}
+	}
+	return reply.MakeOkReply()
+}
+
+// countKeys 用于 EXISTS、TOUCH 这类返回 key 个数的指令，按节点拆分后并发执行，返回各节点结果之和
+
+func countKeys(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	cmdName := strings.ToLower(string(cmdArgs[0]))
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply(cmdName)
+	}
+	keys := toKeys(cmdArgs[1:])
+	if r := cluster.multiKeyRedirect(c, keys, cmdArgs); r != nil {
+		return r
+	}
+	groups := cluster.groupKeys(c, keys)
+	replies := cluster.scatter(c, groups, func(group *keyGroup) [][]byte {
+		return pickArgs(cmdName, cmdArgs[1:], group, 1)
+	})
+	var count int64
+	for i, r := range replies {
+		if reply.IsErrorReply(r) {
+			return r
+		}
+		intReply, ok := r.(*reply.IntReply)
+		if !ok {
+			return reply.MakeErrReply("ERR unexpected reply of " + cmdName + " from " + groups[i].peer)
+		}
+		count += intReply.Code
+	}
+	return reply.MakeIntReply(count)
+}
+
+func toKeys(args [][]byte) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	return keys
+}
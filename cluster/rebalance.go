@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/lib/slot"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	migrateBatchSize = 100    // 每次 MIGRATE 迁移的 key 数量
+	migrateTimeout   = "5000" // MIGRATE 的 timeout 参数，单位毫秒
+)
+
+// slotMove 表示将槽位从 from 迁移到 to，from 为空表示该槽位尚未分配，直接分配给 to 即可
+
+type slotMove struct {
+	slot int
+	from string
+	to   string
+}
+
+// CLUSTER REBALANCE：在节点之间迁移槽位，使每个节点负责的槽位数量尽量相同，返回迁移的槽位数量
+// 每个槽位按照 Redis Cluster 的在线迁移步骤进行，迁移期间集群照常提供服务：
+//  1. 目标节点 SETSLOT IMPORTING，源节点 SETSLOT MIGRATING
+//  2. 在源节点上反复执行 GETKEYSINSLOT 和 MIGRATE，直到该槽位的 key 全部迁出
+//  3. 依次在目标节点、源节点以及其余节点上执行 SETSLOT NODE，宣告槽位的新归属
+
+func (cluster *ClusterDatabase) execRebalance() resp.Reply {
+	if !atomic.CompareAndSwapInt32(&cluster.rebalancing, 0, 1) {
+		return reply.MakeErrReply("ERR rebalance already in progress")
+	}
+	defer atomic.StoreInt32(&cluster.rebalancing, 0)
+
+	moves := planRebalance(cluster.bus.aliveNodes(), cluster.slots.ownedSlots())
+	for i, move := range moves {
+		if err := cluster.moveSlot(move); err != nil {
+			cluster.abortMove(move)
+			return reply.MakeErrReply("ERR moved " + strconv.Itoa(i) + " slots, failed to move slot " +
+				strconv.Itoa(move.slot) + ": " + err.Error())
+		}
+	}
+	return reply.MakeIntReply(int64(len(moves)))
+}
+
+// planRebalance 计算需要迁移的槽位：槽位多于平均值的节点从编号最大的槽位开始迁出，补给槽位少于平均值的节点
+// owned 中空字符串下记录的是未分配的槽位，会优先分配出去
+
+func planRebalance(nodes []string, owned map[string][]int) []slotMove {
+	if len(nodes) == 0 {
+		return nil
+	}
+	// 每个节点应负责的槽位数量，不能整除时排在前面的节点多负责一个
+	target := make(map[string]int, len(nodes))
+	for i, node := range nodes {
+		target[node] = slot.SlotCount / len(nodes)
+		if i < slot.SlotCount%len(nodes) {
+			target[node]++
+		}
+	}
+	// 可以迁出的槽位
+	spare := make([]slotMove, 0)
+	for _, s := range owned[""] {
+		spare = append(spare, slotMove{slot: s})
+	}
+	for _, node := range nodes {
+		slots := owned[node]
+		for i := len(slots) - 1; i >= target[node]; i-- {
+			spare = append(spare, slotMove{slot: slots[i], from: node})
+		}
+	}
+	moves := make([]slotMove, 0, len(spare))
+	for _, node := range nodes {
+		for count := len(owned[node]); count < target[node] && len(spare) > 0; count++ {
+			move := spare[0]
+			spare = spare[1:]
+			move.to = node
+			moves = append(moves, move)
+		}
+	}
+	return moves
+}
+
+// moveSlot 将一个槽位连同其中的 key 迁移到目标节点
+
+func (cluster *ClusterDatabase) moveSlot(move slotMove) error {
+	slotStr := strconv.Itoa(move.slot)
+	if move.from != "" {
+		if err := cluster.callNode(move.to, 0, "CLUSTER", "SETSLOT", slotStr, "IMPORTING", nodeID(move.from)); err != nil {
+			return err
+		}
+		if err := cluster.callNode(move.from, 0, "CLUSTER", "SETSLOT", slotStr, "MIGRATING", nodeID(move.to)); err != nil {
+			return err
+		}
+		host, port, err := net.SplitHostPort(move.to)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < cluster.db.GetDBNum(); i++ {
+			for {
+				keys, err := cluster.getKeysInSlot(move.from, i, slotStr)
+				if err != nil {
+					return err
+				}
+				if len(keys) == 0 {
+					break
+				}
+				args := []string{"MIGRATE", host, port, "", strconv.Itoa(i), migrateTimeout, "REPLACE", "KEYS"}
+				if err := cluster.callNode(move.from, i, append(args, keys...)...); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// 先通知目标节点和源节点，再通知其余节点
+	notify := []string{move.to}
+	if move.from != "" {
+		notify = append(notify, move.from)
+	}
+	for _, node := range cluster.bus.aliveNodes() {
+		if node != move.to && node != move.from {
+			notify = append(notify, node)
+		}
+	}
+	for _, node := range notify {
+		if err := cluster.callNode(node, 0, "CLUSTER", "SETSLOT", slotStr, "NODE", nodeID(move.to)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortMove 迁移失败时清除源节点和目标节点上的迁移状态，尚未迁出的 key 仍由源节点负责
+
+func (cluster *ClusterDatabase) abortMove(move slotMove) {
+	slotStr := strconv.Itoa(move.slot)
+	_ = cluster.callNode(move.to, 0, "CLUSTER", "SETSLOT", slotStr, "STABLE")
+	if move.from != "" {
+		_ = cluster.callNode(move.from, 0, "CLUSTER", "SETSLOT", slotStr, "STABLE")
+	}
+}
+
+// getKeysInSlot 获取节点 node 的子数据库 dbIndex 中属于某个槽位的一批 key
+
+func (cluster *ClusterDatabase) getKeysInSlot(node string, dbIndex int, slotStr string) ([]string, error) {
+	r := cluster.execOnNode(node, dbIndex, "CLUSTER", "GETKEYSINSLOT", slotStr, strconv.Itoa(migrateBatchSize))
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		return nil, errors.New(errReply.Error())
+	}
+	if _, ok := r.(*reply.EmptyMultiBulkReply); ok { // 解析器将空数组解析为 EmptyMultiBulkReply
+		return nil, nil
+	}
+	multiBulk, ok := r.(*reply.MultiBulkReply)
+	if !ok {
+		return nil, errors.New("unexpected reply of CLUSTER GETKEYSINSLOT")
+	}
+	keys := make([]string, len(multiBulk.Args))
+	for i, key := range multiBulk.Args {
+		keys[i] = string(key)
+	}
+	return keys, nil
+}
+
+// callNode 在节点上执行一条指令，指令返回错误时返回 error
+
+func (cluster *ClusterDatabase) callNode(node string, dbIndex int, args ...string) error {
+	r := cluster.execOnNode(node, dbIndex, args...)
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		return errors.New(errReply.Error())
+	}
+	return nil
+}
+
+// execOnNode 以子数据库 dbIndex 在节点 node 上执行一条指令，node 为本节点时直接执行
+
+func (cluster *ClusterDatabase) execOnNode(node string, dbIndex int, args ...string) resp.Reply {
+	return cluster.execLineOnNode(node, dbIndex, utils.ToCmdLine(args...))
+}
+
+func (cluster *ClusterDatabase) execLineOnNode(node string, dbIndex int, cmdLine [][]byte) resp.Reply {
+	c := connection.NewFakeConn()
+	c.SelectDB(dbIndex)
+	if node == cluster.self {
+		return cluster.Exec(c, cmdLine)
+	}
+	return cluster.relay(node, c, cmdLine)
+}
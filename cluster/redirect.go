@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/slot"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+// routeKey 将只涉及一个 key 的指令交给负责该 key 的节点处理
+// 槽位迁移期间的规则与 Redis Cluster 相同：
+//   - 源节点（MIGRATING）上 key 仍然存在时在本地执行，否则交给目标节点，重定向模式下返回 ASK <slot> <host:port>
+//   - 目标节点（IMPORTING）只为发送了 ASKING 的连接执行该槽位的指令，其余请求仍交给槽位的负责节点
+
+func (cluster *ClusterDatabase) routeKey(c resp.Connection, key string, cmdArgs [][]byte) resp.Reply {
+	peer, asking := cluster.locateKey(c, key)
+	if asking {
+		if c.IsRedirect() {
+			return reply.MakeErrReply("ASK " + strconv.Itoa(slot.HashSlot(key)) + " " + peer)
+		}
+		return cluster.relayAsking(peer, c, cmdArgs)
+	}
+	if errReply := cluster.redirect(c, key, peer); errReply != nil {
+		return errReply // 重定向模式下由客户端直接访问目标节点
+	}
+	return cluster.relay(peer, c, cmdArgs) // 调用 relay 方法将指令转发到目标节点
+}
+
+// locateKey 返回应当处理 key 的节点，asking 为 true 表示 key 所在的槽位正在迁出，需要带上 ASKING 访问目标节点
+
+func (cluster *ClusterDatabase) locateKey(c resp.Connection, key string) (peer string, asking bool) {
+	peer = cluster.peerPicker.PickNode(key) // 获取到该 key 哈希之后得到的哈希值对应的槽位对应的节点
+	if cluster.slots == nil {
+		return peer, false
+	}
+	s := slot.HashSlot(key)
+	if peer == cluster.self {
+		if target := cluster.slots.migratingTo(s); target != "" && !cluster.existsLocally(c, key) {
+			return target, true
+		}
+	} else if c.IsAsking() && cluster.slots.importingFrom(s) != "" {
+		return cluster.self, false
+	}
+	return peer, false
+}
+
+// existsLocally 判断 key 是否存在于本节点当前选择的子数据库中
+
+func (cluster *ClusterDatabase) existsLocally(c resp.Connection, key string) bool {
+	r := cluster.db.Exec(c, utils.ToCmdLine("EXISTS", key))
+	intReply, ok := r.(*reply.IntReply)
+	return ok && intReply.Code > 0
+}
+
+// redirect 在连接开启了重定向模式时，对不由本节点负责的 key 返回 MOVED <slot> <host:port>，
+// 支持集群协议的客户端收到后直接向负责节点重新发送指令，不再经过本节点代理转发
+// 返回 nil 表示由本节点继续处理（本地执行或代理转发）
+
+func (cluster *ClusterDatabase) redirect(c resp.Connection, key string, peer string) resp.Reply {
+	if cluster.slots == nil || !c.IsRedirect() || peer == "" || peer == cluster.self {
+		return nil
+	}
+	return reply.MakeErrReply("MOVED " + strconv.Itoa(slot.HashSlot(key)) + " " + peer)
+}
+
+// CLIENT REDIRECT ON|OFF，设置当前连接使用 MOVED 重定向还是代理转发
+
+func execClient(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("client")
+	}
+	subCmd := strings.ToLower(string(cmdArgs[1]))
+	if subCmd != "redirect" {
+		return reply.MakeErrReply("ERR unknown subcommand '" + string(cmdArgs[1]) + "'")
+	}
+	if len(cmdArgs) != 3 {
+		return reply.MakeArgNumErrReply("client|redirect")
+	}
+	switch strings.ToLower(string(cmdArgs[2])) {
+	case "on":
+		if cluster.slots == nil {
+			return slotModeDisabledErr
+		}
+		c.SetRedirect(true)
+	case "off":
+		c.SetRedirect(false)
+	default:
+		return reply.MakeSyntaxErrReply()
+	}
+	return reply.MakeOkReply()
+}
+
+// ASKING，允许下一条指令访问本节点正在导入的槽位
+
+func execAsking(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("asking")
+	}
+	if cluster.slots == nil {
+		return slotModeDisabledErr
+	}
+	c.SetAsking(true)
+	return reply.MakeOkReply()
+}
+
+// RESTORE-ASKING 与 RESTORE 相同，但隐含了 ASKING，MIGRATE 使用它向正在导入槽位的节点写入数据
+
+func restoreAsking(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if cluster.slots != nil {
+		c.SetAsking(true)
+	}
+	return defaultFunc(cluster, c, cmdArgs)
+}
@@ -2,22 +2,204 @@ package cluster
 
 import (
 	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
 	"go-redis/resp/reply"
+	"strconv"
+	"strings"
 )
 
-// rename k1 k2
+// rename k1 k2, renamenx k1 k2
+// 改名前后的 key 由同一个节点负责时直接转发给该节点，否则在两个节点之间搬运数据
 
 func rename(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	cmdName := strings.ToLower(string(cmdArgs[0]))
 	if len(cmdArgs) != 3 {
-		return reply.MakeErrReply("ERR Wrong number args")
+		return reply.MakeArgNumErrReply(cmdName)
 	}
-	src := string(cmdArgs[1])                     // 原来 key 的 name
-	dest := string(cmdArgs[2])                    // 修改后的 key 的 name
-	srcPeer := cluster.peerPicker.PickNode(src)   // 修改前该 key 所在的槽点对应的节点
-	destPeer := cluster.peerPicker.PickNode(dest) // 修改后该 key 所在的槽点对应的节点
-	// 如果改名前和改名后该key不隶属于同一个节点，则报错。其实也可以实现，在原节点删除该key，然后在新节点新增该key即可。
-	if srcPeer != destPeer {
-		return reply.MakeErrReply("ERR rename must within one peer")
+	src := string(cmdArgs[1])  // 原来 key 的 name
+	dest := string(cmdArgs[2]) // 修改后的 key 的 name
+	if r := cluster.multiKeyRedirect(c, []string{src, dest}, cmdArgs); r != nil {
+		return r
 	}
-	return cluster.relay(srcPeer, c, cmdArgs) // 调用 relay 转发
+	if group, ok := cluster.samePeer(c, src, dest); ok {
+		return cluster.relayGroup(c, group, cmdArgs) // 转发给负责该 key 的节点
+	}
+	if group := cluster.srcGroup(c, src); group != nil {
+		return cluster.relayGroup(c, group, cmdArgs) // 由负责 src 的节点搬运数据
+	}
+	dbIndex := c.GetDBIndex()
+	if cmdName == "renamenx" {
+		moved, errReply := cluster.transferKey(dbIndex, src, dbIndex, dest, false, false)
+		if errReply != nil {
+			return errReply
+		}
+		if !moved {
+			return reply.MakeIntReply(0)
+		}
+		return reply.MakeIntReply(1)
+	}
+	if _, errReply := cluster.transferKey(dbIndex, src, dbIndex, dest, true, false); errReply != nil {
+		return errReply
+	}
+	return reply.MakeOkReply()
+}
+
+// COPY src dest [DB destination-db] [REPLACE]
+
+func execCopy(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 3 {
+		return reply.MakeArgNumErrReply("copy")
+	}
+	src := string(cmdArgs[1])
+	dest := string(cmdArgs[2])
+	destIndex := c.GetDBIndex()
+	replace := false
+	for i := 3; i < len(cmdArgs); i++ {
+		switch strings.ToLower(string(cmdArgs[i])) {
+		case "db":
+			if i+1 >= len(cmdArgs) {
+				return reply.MakeSyntaxErrReply()
+			}
+			index, err := strconv.Atoi(string(cmdArgs[i+1]))
+			if err != nil || index < 0 {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			destIndex = index
+			i++
+		case "replace":
+			replace = true
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+	if r := cluster.multiKeyRedirect(c, []string{src, dest}, cmdArgs); r != nil {
+		return r
+	}
+	if group, ok := cluster.samePeer(c, src, dest); ok {
+		return cluster.relayGroup(c, group, cmdArgs)
+	}
+	if group := cluster.srcGroup(c, src); group != nil {
+		return cluster.relayGroup(c, group, cmdArgs)
+	}
+	copied, errReply := cluster.transferKey(c.GetDBIndex(), src, destIndex, dest, replace, true)
+	if errReply != nil {
+		if e, ok := errReply.(reply.ErrorReply); ok && e.Error() == noSuchKeyErr {
+			return reply.MakeIntReply(0) // COPY 的源 key 不存在时返回 0
+		}
+		return errReply
+	}
+	if !copied {
+		return reply.MakeIntReply(0)
+	}
+	return reply.MakeIntReply(1)
+}
+
+const noSuchKeyErr = "ERR no such key"
+
+// samePeer 判断 keys 是否都由同一个节点负责，是的话返回该节点
+
+func (cluster *ClusterDatabase) samePeer(c resp.Connection, keys ...string) (*keyGroup, bool) {
+	peer, asking := cluster.locateKey(c, keys[0])
+	for _, key := range keys[1:] {
+		p, a := cluster.locateKey(c, key)
+		if p != peer || a != asking {
+			return nil, false
+		}
+	}
+	return &keyGroup{peer: peer, asking: asking}, true
+}
+
+// srcGroup 在 src 不由本节点负责时返回负责它的节点，RENAME、COPY 需要转发给该节点执行，
+// 只有在本节点上才能在搬运期间锁住 src
+
+func (cluster *ClusterDatabase) srcGroup(c resp.Connection, src string) *keyGroup {
+	peer, asking := cluster.locateKey(c, src)
+	if peer == cluster.self {
+		return nil
+	}
+	return &keyGroup{peer: peer, asking: asking}
+}
+
+// transferKey 将本节点上的 src 复制或移动到其他节点：DUMP src，在目标节点 RESTORE，keepSrc 为 false 时最后删除 src
+// 整个过程持有 src 的写锁，其他客户端不能在 DUMP 和 DEL 之间修改 src，dest 则没有加锁，
+// 它所在的节点上的其他客户端仍然可以在 RESTORE 前后写入 dest
+// dest 已经存在且 replace 为 false 时不做任何修改，返回 false
+// 删除源 key 失败时恢复 dest 原来的值（或删除 dest），避免同一份数据同时留在两个节点上
+
+func (cluster *ClusterDatabase) transferKey(srcIndex int, src string, destIndex int, dest string,
+	replace bool, keepSrc bool) (bool, resp.Reply) {
+	// 先确定 dest 所在的节点，加锁之后再判断可能需要读取本节点上被锁住的 key
+	destConn := connection.NewFakeConn()
+	destConn.SelectDB(destIndex)
+	destPeer, destAsking := cluster.locateKey(destConn, dest)
+	execOnDest := func(args ...[]byte) resp.Reply {
+		return cluster.relayGroup(destConn, &keyGroup{peer: destPeer, asking: destAsking}, args)
+	}
+
+	srcConn := connection.NewFakeConn()
+	srcConn.SelectDB(srcIndex)
+	cluster.db.RWLocks(srcIndex, []string{src}, nil)
+	defer cluster.db.RWUnLocks(srcIndex, []string{src}, nil)
+	payload, errReply := dumpReply(cluster.db.ExecWithLock(srcConn, utils.ToCmdLine("DUMP", src)))
+	if errReply != nil {
+		return false, errReply
+	}
+	if payload == nil {
+		return false, reply.MakeErrReply(noSuchKeyErr)
+	}
+	// 记录 dest 原来的值，用于失败时回滚
+	oldPayload, errReply := dumpReply(execOnDest([]byte("DUMP"), []byte(dest)))
+	if errReply != nil {
+		return false, errReply
+	}
+	if oldPayload != nil && !replace {
+		return false, nil
+	}
+
+	restoreArgs := [][]byte{[]byte("RESTORE"), []byte(dest), []byte("0"), payload}
+	if replace {
+		restoreArgs = append(restoreArgs, []byte("REPLACE"))
+	}
+	r := execOnDest(restoreArgs...)
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		if strings.HasPrefix(errReply.Error(), "BUSYKEY") { // 在 DUMP 之后 dest 被其他客户端写入
+			return false, nil
+		}
+		return false, r
+	}
+	if keepSrc {
+		return true, nil
+	}
+
+	r = cluster.db.ExecWithLock(srcConn, utils.ToCmdLine("DEL", src))
+	if !reply.IsErrorReply(r) {
+		return true, nil
+	}
+	// 删除源 key 失败，撤销对 dest 的修改
+	var rollback resp.Reply
+	if oldPayload != nil {
+		rollback = execOnDest([]byte("RESTORE"), []byte(dest), []byte("0"), oldPayload, []byte("REPLACE"))
+	} else {
+		rollback = execOnDest([]byte("DEL"), []byte(dest))
+	}
+	if reply.IsErrorReply(rollback) {
+		logger.Error("rollback of " + dest + " failed, key exists on both " + src + " and " + dest + ": " +
+			rollback.(reply.ErrorReply).Error())
+	}
+	return false, r
+}
+
+// dumpReply 取出 DUMP 的序列化结果，key 不存在时返回 nil
+
+func dumpReply(r resp.Reply) ([]byte, resp.Reply) {
+	if reply.IsErrorReply(r) {
+		return nil, r
+	}
+	bulk, ok := r.(*reply.BulkReply)
+	if !ok || bulk.Arg == nil {
+		return nil, nil
+	}
+	return bulk.Arg, nil
 }
@@ -1,31 +1,90 @@
 package cluster
 
-import "go-redis/interface/resp"
+import (
+	database2 "go-redis/database"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+)
 
-// 指定指令和执行方式（relay or broadcast）的对应，入参是指令的名称，出参是“指令名称” -> “执行方式” 的哈希映射
+// 指定需要特殊处理的指令和执行方式的对应，入参是指令的名称，出参是“指令名称” -> “执行方式” 的哈希映射
+// 不在表中的指令由 defaultFunc 按照指令元数据中 key 的位置路由
 
 func makeRouter() map[string]CmdFunc {
 	routerMap := make(map[string]CmdFunc)
-	routerMap["exists"] = defaultFunc
-	routerMap["type"] = defaultFunc
-	routerMap["set"] = defaultFunc
-	routerMap["setnx"] = defaultFunc
-	routerMap["get"] = defaultFunc
-	routerMap["getset"] = defaultFunc
+	routerMap["exists"] = countKeys
+	routerMap["touch"] = countKeys
+	routerMap["mget"] = mget
+	routerMap["mset"] = mset
+	routerMap["msetnx"] = msetnx
 	routerMap["ping"] = ping
+	routerMap["hello"] = localFunc // 协议版本记录在连接上
 	routerMap["rename"] = rename
 	routerMap["renamenx"] = rename // 和 rename 一样
+	routerMap["copy"] = execCopy
 	routerMap["flushdb"] = flushdb
+	routerMap["flushall"] = flushdb // 和 flushdb 一样，广播给所有节点
+	routerMap["keys"] = execKeys
+	routerMap["scan"] = execScan
+	routerMap["dbsize"] = execDBSize
 	routerMap["del"] = del
+	routerMap["unlink"] = del // 和 del 一样，集群事务中统一用 DEL 删除
 	routerMap["select"] = execSelect
+	routerMap["save"] = localFunc
+	routerMap["bgsave"] = localFunc
+	routerMap["lastsave"] = localFunc
+	routerMap["bgrewriteaof"] = localFunc
+	routerMap["info"] = localFunc // 以下指令查看或修改本节点的状态和主从复制，不涉及 key
+	routerMap["role"] = localFunc
+	routerMap["wait"] = localFunc
+	routerMap["replicaof"] = localFunc
+	routerMap["slaveof"] = localFunc
+	routerMap["psync"] = localFunc
+	routerMap["replconf"] = localFunc
+	routerMap["cluster"] = execCluster
+	routerMap["client"] = execClient
+	routerMap["asking"] = execAsking
+	routerMap["restore-asking"] = restoreAsking
+	routerMap["migrate"] = localFunc // MIGRATE 迁移的是本节点上的 key
+	routerMap["multi"] = localFunc   // 事务状态记录在连接上，指令在 Exec 中入队
+	routerMap["discard"] = localFunc
+	routerMap["exec"] = execExec
+	routerMap["prepare"] = execPrepare // 以下是集群事务中协调者发给参与者的指令
+	routerMap["commit"] = execCommit
+	routerMap["rollback"] = execRollback
+	routerMap["localexec"] = execLocal // 广播类指令在目标节点本地执行
 
 	return routerMap
 }
 
-// 默认转发方法，走 relay
+// 默认转发方法，按照指令元数据（first-key、last-key、step）找到指令涉及的 key：
+// 不涉及 key 的指令在本节点执行，所有 key 由同一个节点负责时转发给该节点
 
 func defaultFunc(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
-	key := string(cmdArgs[1])
-	peer := cluster.peerPicker.PickNode(key) // 获取到该 key 哈希之后得到的哈希值对应的槽位对应的节点
-	return cluster.relay(peer, c, cmdArgs)   // 调用 relay 方法将指令转发到目标节点
+	writeKeys, readKeys, errReply := database2.GetRelatedKeys(cmdArgs)
+	if errReply != nil {
+		return errReply
+	}
+	keys := append(writeKeys, readKeys...)
+	switch len(keys) {
+	case 0:
+		return cluster.db.Exec(c, cmdArgs)
+	case 1:
+		return cluster.routeKey(c, keys[0], cmdArgs)
+	}
+	if r := cluster.multiKeyRedirect(c, keys, cmdArgs); r != nil {
+		return r
+	}
+	if group, ok := cluster.samePeer(c, keys...); ok {
+		return cluster.relayGroup(c, group, cmdArgs)
+	}
+	if cluster.slots != nil {
+		return reply.MakeErrReply("CROSSSLOT Keys in request don't hash to the same slot")
+	}
+	return reply.MakeErrReply("ERR Keys in request don't belong to the same node")
+}
+
+// 只在本节点执行的指令，如 SAVE、BGSAVE，各节点分别持久化自己的数据
+
+func localFunc(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	return cluster.db.Exec(c, cmdArgs)
 }
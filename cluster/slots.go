@@ -0,0 +1,318 @@
+package cluster
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"go-redis/lib/slot"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// peerPicker 根据 key 选出负责它的节点，一致性哈希环和槽位表都实现了该接口
+
+type peerPicker interface {
+	PickNode(key string) string
+}
+
+// slotRange 是一段连续的槽位 [start, end]
+
+type slotRange struct {
+	start int
+	end   int
+}
+
+// slotTable 记录每个槽位由哪个节点负责，与 Redis Cluster 一样使用 CRC16(key) mod 16384 计算 key 的槽位
+
+type slotTable struct {
+	mu    sync.RWMutex
+	nodes []string               // 集群中的全部节点，按地址排序
+	slots [slot.SlotCount]string // 槽位 -> 负责该槽位的节点地址，未分配的槽位为空字符串
+	// 迁移中的槽位：migrating 记录本节点正在迁出的槽位及目标节点，importing 记录本节点正在迁入的槽位及源节点
+	migrating map[int]string
+	importing map[int]string
+}
+
+// makeSlotTable 根据 cluster-slots 配置构建槽位表，assignments 为空时将槽位平均分配给 nodes
+
+func makeSlotTable(nodes []string, assignments []string) (*slotTable, error) {
+	table := &slotTable{
+		migrating: make(map[int]string),
+		importing: make(map[int]string),
+	}
+	table.nodes = make([]string, len(nodes))
+	copy(table.nodes, nodes)
+	sort.Strings(table.nodes)
+	if len(table.nodes) == 0 {
+		return table, nil
+	}
+
+	if len(assignments) == 0 {
+		// 每个节点都按相同的规则分配，保证集群中各节点得到的槽位表一致
+		n := len(table.nodes)
+		for i, node := range table.nodes {
+			start := i * slot.SlotCount / n
+			end := (i+1)*slot.SlotCount/n - 1
+			for s := start; s <= end; s++ {
+				table.slots[s] = node
+			}
+		}
+		return table, nil
+	}
+
+	known := make(map[string]bool, len(table.nodes))
+	for _, node := range table.nodes {
+		known[node] = true
+	}
+	for _, item := range assignments {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pivot := strings.LastIndex(item, "=")
+		if pivot <= 0 {
+			return nil, errors.New("invalid cluster slots: " + item)
+		}
+		node := item[:pivot]
+		if !known[node] {
+			return nil, errors.New("unknown node in cluster slots: " + node)
+		}
+		r, err := parseSlotRange(item[pivot+1:])
+		if err != nil {
+			return nil, errors.New("invalid cluster slots: " + item)
+		}
+		for s := r.start; s <= r.end; s++ {
+			if table.slots[s] != "" && table.slots[s] != node {
+				return nil, errors.New("slot " + strconv.Itoa(s) + " is assigned to more than one node")
+			}
+			table.slots[s] = node
+		}
+	}
+	return table, nil
+}
+
+// String 返回 "<start>-<end>"，只有一个槽位时返回 "<slot>"
+
+func (r slotRange) String() string {
+	if r.start == r.end {
+		return strconv.Itoa(r.start)
+	}
+	return strconv.Itoa(r.start) + "-" + strconv.Itoa(r.end)
+}
+
+// parseSlotRange 解析 "<start>-<end>" 或 "<slot>"
+
+func parseSlotRange(s string) (slotRange, error) {
+	var r slotRange
+	var err error
+	if pivot := strings.Index(s, "-"); pivot >= 0 {
+		r.start, err = strconv.Atoi(strings.TrimSpace(s[:pivot]))
+		if err != nil {
+			return r, err
+		}
+		r.end, err = strconv.Atoi(strings.TrimSpace(s[pivot+1:]))
+		if err != nil {
+			return r, err
+		}
+	} else {
+		r.start, err = strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return r, err
+		}
+		r.end = r.start
+	}
+	if r.start < 0 || r.end >= slot.SlotCount || r.start > r.end {
+		return r, errors.New("slot out of range")
+	}
+	return r, nil
+}
+
+// PickNode 返回 key 所在槽位的负责节点，槽位未分配时返回空字符串
+
+func (t *slotTable) PickNode(key string) string {
+	return t.nodeOf(slot.HashSlot(key))
+}
+
+// nodeOf 返回负责槽位 s 的节点
+
+func (t *slotTable) nodeOf(s int) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.slots[s]
+}
+
+// Nodes 返回全部节点，按地址排序
+
+func (t *slotTable) Nodes() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	nodes := make([]string, len(t.nodes))
+	copy(nodes, t.nodes)
+	return nodes
+}
+
+// ranges 返回每个节点负责的连续槽位区间，按起始槽位升序排列
+
+func (t *slotTable) ranges() map[string][]slotRange {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make(map[string][]slotRange, len(t.nodes))
+	for s := 0; s < slot.SlotCount; {
+		node := t.slots[s]
+		end := s
+		for end+1 < slot.SlotCount && t.slots[end+1] == node {
+			end++
+		}
+		if node != "" {
+			result[node] = append(result[node], slotRange{start: s, end: end})
+		}
+		s = end + 1
+	}
+	return result
+}
+
+// assignedCount 返回已分配给节点的槽位数量
+
+func (t *slotTable) assignedCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	count := 0
+	for _, node := range t.slots {
+		if node != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// ownedSlots 返回每个节点负责的全部槽位，未分配的槽位记在空字符串下
+
+func (t *slotTable) ownedSlots() map[string][]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	result := make(map[string][]int, len(t.nodes)+1)
+	for s, node := range t.slots {
+		result[node] = append(result[node], s)
+	}
+	return result
+}
+
+// migratingTo 返回槽位 s 正在迁往的节点，没有在迁出时返回空字符串
+
+func (t *slotTable) migratingTo(s int) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.migrating[s]
+}
+
+// importingFrom 返回槽位 s 的迁入源节点，没有在迁入时返回空字符串
+
+func (t *slotTable) importingFrom(s int) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.importing[s]
+}
+
+// setMigrating 将槽位 s 标记为正在迁往 node
+
+func (t *slotTable) setMigrating(s int, node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.migrating[s] = node
+}
+
+// setImporting 将槽位 s 标记为正在从 node 迁入
+
+func (t *slotTable) setImporting(s int, node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.importing[s] = node
+}
+
+// setNode 将槽位 s 分配给 node，同时结束该槽位的迁移状态
+
+func (t *slotTable) setNode(s int, node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.slots[s] = node
+	delete(t.migrating, s)
+	delete(t.importing, s)
+}
+
+// setStable 清除槽位 s 的迁移状态
+
+func (t *slotTable) setStable(s int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.migrating, s)
+	delete(t.importing, s)
+}
+
+// migrationStates 返回迁出和迁入状态的副本
+
+func (t *slotTable) migrationStates() (migrating map[int]string, importing map[int]string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	migrating = make(map[int]string, len(t.migrating))
+	for s, node := range t.migrating {
+		migrating[s] = node
+	}
+	importing = make(map[int]string, len(t.importing))
+	for s, node := range t.importing {
+		importing[s] = node
+	}
+	return migrating, importing
+}
+
+// setNodes 更新集群中的节点列表
+
+func (t *slotTable) setNodes(nodes []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes = make([]string, len(nodes))
+	copy(t.nodes, nodes)
+	sort.Strings(t.nodes)
+}
+
+// removeNode 将 node 负责的槽位变为未分配，并清除与它有关的迁移状态
+
+func (t *slotTable) removeNode(node string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for s, owner := range t.slots {
+		if owner == node {
+			t.slots[s] = ""
+		}
+	}
+	for s, target := range t.migrating {
+		if target == node {
+			delete(t.migrating, s)
+		}
+	}
+	for s, source := range t.importing {
+		if source == node {
+			delete(t.importing, s)
+		}
+	}
+}
+
+// nodeID 由节点地址生成 40 位的节点 ID，各节点对同一地址计算出的 ID 相同
+
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// splitAddr 将 "<host>:<port>" 拆分为 host 和 port
+
+func splitAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
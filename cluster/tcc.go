@@ -0,0 +1,353 @@
+package cluster
+
+import (
+	"go-redis/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/resp/connection"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 集群事务采用 TCC（Try-Confirm-Cancel）的方式，由接收用户指令的节点担任协调者：
+//   - Try：协调者向每个涉及的节点发送 PREPARE，节点锁住指令涉及的 key，记录用于撤销的 undo log，并检查执行的前提条件
+//   - Confirm：所有节点都准备成功后发送 COMMIT，节点执行指令并释放锁
+//   - Cancel：任一节点失败时向所有节点发送 ROLLBACK，已准备的节点释放锁，已提交的节点按 undo log 恢复数据
+// 准备完成后迟迟没有收到提交的事务（如协调者宕机）在 maxLockTime 后自动回滚，避免 key 被一直锁住
+
+const (
+	maxLockTime       = 3 * time.Second // 事务准备完成后等待提交的最长时间
+	waitBeforeCleanTx = 2 * maxLockTime // 事务结束后保留一段时间，协调者可能还会要求回滚已经提交的事务
+)
+
+const (
+	txCreated = iota
+	txPrepared
+	txCommitted
+	txRolledBack
+)
+
+// transaction 是集群事务在参与者上的状态
+
+type transaction struct {
+	id        string
+	cluster   *ClusterDatabase
+	conn      *connection.Connection // 记录事务所在的子数据库
+	cmdLines  [][][]byte
+	writeKeys []string
+	readKeys  []string
+	undoLogs  [][][]byte
+
+	mu     sync.Mutex
+	status int
+	timer  *time.Timer // 准备完成后开始计时，超时自动回滚
+}
+
+// PREPARE txid argc arg [arg ...] [argc arg [arg ...] ...]，在本节点准备事务
+// 返回 OK 表示准备成功，返回 0 表示指令的前提条件不满足（如 MSETNX 的 key 已经存在）
+
+func execPrepare(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 4 {
+		return reply.MakeArgNumErrReply("prepare")
+	}
+	txID := string(cmdArgs[1])
+	cmdLines, errReply := decodeCmdLines(cmdArgs[2:])
+	if errReply != nil {
+		return errReply
+	}
+	tx := &transaction{
+		id:       txID,
+		cluster:  cluster,
+		conn:     connection.NewFakeConn(),
+		cmdLines: cmdLines,
+		status:   txCreated,
+	}
+	tx.conn.SelectDB(c.GetDBIndex())
+	for _, cmdLine := range cmdLines {
+		writeKeys, readKeys, errReply := database.GetRelatedKeys(cmdLine)
+		if errReply != nil {
+			return errReply
+		}
+		tx.writeKeys = append(tx.writeKeys, writeKeys...)
+		tx.readKeys = append(tx.readKeys, readKeys...)
+	}
+	if cluster.transactions.PutIfAbsent(txID, tx) == 0 {
+		return reply.MakeErrReply("ERR transaction " + txID + " already exists")
+	}
+	return tx.prepare()
+}
+
+// prepare 先对 key 加锁再持有 tx.mu：等待其他指令释放 key 期间，rollback 和超时处理不会被阻塞在 tx.mu 上，
+// 拿到 key 锁后再检查事务是否已经被回滚
+
+func (tx *transaction) prepare() resp.Reply {
+	dbIndex := tx.conn.GetDBIndex()
+	tx.cluster.db.RWLocks(dbIndex, tx.writeKeys, tx.readKeys)
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != txCreated { // 等待加锁期间被回滚了
+		tx.cluster.db.RWUnLocks(dbIndex, tx.writeKeys, tx.readKeys)
+		return reply.MakeErrReply("ERR transaction " + tx.id + " has been rolled back")
+	}
+	if !tx.checkPrecondition() {
+		tx.cluster.db.RWUnLocks(dbIndex, tx.writeKeys, tx.readKeys)
+		tx.finishLocked(txRolledBack)
+		return reply.MakeIntReply(0)
+	}
+	tx.undoLogs = tx.cluster.db.GetUndoLogs(dbIndex, uniqueKeys(tx.writeKeys))
+	tx.status = txPrepared
+	tx.timer = time.AfterFunc(maxLockTime, func() {
+		if tx.rollback() {
+			logger.Warn("cluster: transaction " + tx.id + " timed out and was rolled back")
+		}
+	})
+	return reply.MakeOkReply()
+}
+
+// checkPrecondition 检查有条件执行的指令，调用方持有 key 的锁，检查通过后直到提交都不会被其他指令改变
+
+func (tx *transaction) checkPrecondition() bool {
+	for _, cmdLine := range tx.cmdLines {
+		if strings.ToLower(string(cmdLine[0])) != "msetnx" {
+			continue
+		}
+		existsArgs := [][]byte{[]byte("EXISTS")}
+		for i := 1; i < len(cmdLine); i += 2 {
+			existsArgs = append(existsArgs, cmdLine[i])
+		}
+		r, ok := tx.cluster.db.ExecWithLock(tx.conn, existsArgs).(*reply.IntReply)
+		if !ok || r.Code > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// COMMIT txid，执行已准备的事务，回复中依次是每条指令的回复编码后的结果
+
+func execCommit(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 2 {
+		return reply.MakeArgNumErrReply("commit")
+	}
+	txID := string(cmdArgs[1])
+	raw, ok := cluster.transactions.Get(txID)
+	if !ok {
+		return reply.MakeErrReply("ERR transaction " + txID + " not found")
+	}
+	return raw.(*transaction).commit()
+}
+
+func (tx *transaction) commit() resp.Reply {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != txPrepared {
+		return reply.MakeErrReply("ERR transaction " + tx.id + " is not prepared")
+	}
+	tx.timer.Stop()
+	results := make([][]byte, len(tx.cmdLines))
+	for i, cmdLine := range tx.cmdLines {
+		results[i] = tx.cluster.db.ExecWithLock(tx.conn, cmdLine).ToBytes()
+	}
+	tx.cluster.db.RWUnLocks(tx.conn.GetDBIndex(), tx.writeKeys, tx.readKeys)
+	tx.finishLocked(txCommitted)
+	return reply.MakeMultiBulkReply(results)
+}
+
+// ROLLBACK txid，回滚事务，事务不存在时视为已经回滚
+
+func execRollback(cluster *ClusterDatabase, c resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 2 {
+		return reply.MakeArgNumErrReply("rollback")
+	}
+	raw, ok := cluster.transactions.Get(string(cmdArgs[1]))
+	if ok {
+		raw.(*transaction).rollback()
+	}
+	return reply.MakeOkReply()
+}
+
+// rollback 释放已准备事务的锁，或者按 undo log 撤销已提交的事务，返回是否做了回滚
+
+func (tx *transaction) rollback() bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	dbIndex := tx.conn.GetDBIndex()
+	switch tx.status {
+	case txCreated: // prepare 还在等待加锁，等它拿到锁后会发现事务已经回滚
+	case txPrepared:
+		tx.timer.Stop()
+		tx.cluster.db.RWUnLocks(dbIndex, tx.writeKeys, tx.readKeys)
+	case txCommitted:
+		tx.cluster.db.RWLocks(dbIndex, tx.writeKeys, tx.readKeys)
+		for _, undoLog := range tx.undoLogs {
+			if r := tx.cluster.db.ExecWithLock(tx.conn, undoLog); reply.IsErrorReply(r) {
+				logger.Error("cluster: undo " + string(undoLog[0]) + " " + string(undoLog[1]) + " of transaction " +
+					tx.id + " failed: " + r.(reply.ErrorReply).Error())
+			}
+		}
+		tx.cluster.db.RWUnLocks(dbIndex, tx.writeKeys, tx.readKeys)
+	default:
+		return false
+	}
+	tx.finishLocked(txRolledBack)
+	return true
+}
+
+// finishLocked 记录事务的最终状态，一段时间后从事务表中删除，调用方需持有 tx.mu
+
+func (tx *transaction) finishLocked(status int) {
+	tx.status = status
+	time.AfterFunc(waitBeforeCleanTx, func() {
+		tx.cluster.transactions.Remove(tx.id)
+	})
+}
+
+// txGroup 是集群事务中由同一个节点执行的指令
+
+type txGroup struct {
+	peer     string
+	indexes  []int // 指令在事务中的位置
+	cmdLines [][][]byte
+}
+
+// runTransaction 作为协调者在各个节点上原子地执行事务，返回的结果与 groups 一一对应
+// aborted 为 true 表示某个节点上指令的前提条件不满足，事务没有执行
+
+func (cluster *ClusterDatabase) runTransaction(dbIndex int, groups []*txGroup) (results [][]resp.Reply, aborted bool, errReply resp.Reply) {
+	txID := cluster.nextTxID()
+	rollbackAll := func() {
+		for _, group := range groups {
+			if r := cluster.execLineOnNode(group.peer, dbIndex, [][]byte{[]byte("ROLLBACK"), []byte(txID)}); reply.IsErrorReply(r) {
+				logger.Error("cluster: rollback transaction " + txID + " on " + group.peer + " failed: " + r.(reply.ErrorReply).Error())
+			}
+		}
+	}
+
+	// Try
+	replies := cluster.callGroups(groups, func(group *txGroup) resp.Reply {
+		return cluster.execLineOnNode(group.peer, dbIndex, encodePrepare(txID, group.cmdLines))
+	})
+	for i, r := range replies {
+		if intReply, ok := r.(*reply.IntReply); ok && intReply.Code == 0 {
+			aborted = true
+		} else if !isOkReply(r) && errReply == nil {
+			errReply = reply.MakeErrReply("EXECABORT Transaction discarded because of: " + groups[i].peer + " " + replyString(r))
+		}
+	}
+	if aborted || errReply != nil {
+		rollbackAll()
+		return nil, aborted, errReply
+	}
+
+	// Confirm
+	replies = cluster.callGroups(groups, func(group *txGroup) resp.Reply {
+		return cluster.execLineOnNode(group.peer, dbIndex, [][]byte{[]byte("COMMIT"), []byte(txID)})
+	})
+	results = make([][]resp.Reply, len(groups))
+	for i, r := range replies {
+		encoded, ok := r.(*reply.MultiBulkReply)
+		if !ok || len(encoded.Args) != len(groups[i].cmdLines) {
+			errReply = reply.MakeErrReply("ERR transaction failed on " + groups[i].peer + " and was rolled back: " + replyString(r))
+			break
+		}
+		results[i] = make([]resp.Reply, len(encoded.Args))
+		for j, data := range encoded.Args {
+			result, err := parser.ParseOne(data)
+			if err != nil {
+				result = reply.MakeErrReply("ERR " + err.Error())
+			}
+			results[i][j] = result
+		}
+	}
+	if errReply != nil {
+		// Cancel：已提交的节点按 undo log 恢复
+		rollbackAll()
+		return nil, false, errReply
+	}
+	return results, false, nil
+}
+
+// callGroups 并发地对每个分组执行 call，返回的结果与分组一一对应
+
+func (cluster *ClusterDatabase) callGroups(groups []*txGroup, call func(group *txGroup) resp.Reply) []resp.Reply {
+	replies := make([]resp.Reply, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group *txGroup) {
+			defer wg.Done()
+			replies[i] = call(group)
+		}(i, group)
+	}
+	wg.Wait()
+	return replies
+}
+
+var txSeq uint64
+
+// nextTxID 生成集群内唯一的事务 id：协调者地址 + 启动时间 + 序号
+
+func (cluster *ClusterDatabase) nextTxID() string {
+	return cluster.self + "-" + strconv.FormatInt(cluster.startTime, 36) + "-" + strconv.FormatUint(atomic.AddUint64(&txSeq, 1), 10)
+}
+
+// encodePrepare 生成 PREPARE 指令，每条指令编码为参数个数加上参数
+
+func encodePrepare(txID string, cmdLines [][][]byte) [][]byte {
+	args := [][]byte{[]byte("PREPARE"), []byte(txID)}
+	for _, cmdLine := range cmdLines {
+		args = append(args, []byte(strconv.Itoa(len(cmdLine))))
+		args = append(args, cmdLine...)
+	}
+	return args
+}
+
+func decodeCmdLines(args [][]byte) ([][][]byte, resp.Reply) {
+	cmdLines := make([][][]byte, 0)
+	for i := 0; i < len(args); {
+		argc, err := strconv.Atoi(string(args[i]))
+		if err != nil || argc <= 0 || i+1+argc > len(args) {
+			return nil, reply.MakeSyntaxErrReply()
+		}
+		cmdLines = append(cmdLines, args[i+1:i+1+argc])
+		i += 1 + argc
+	}
+	return cmdLines, nil
+}
+
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]struct{}, len(keys))
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, key)
+	}
+	return result
+}
+
+// isOkReply 判断是否为 OK，转发得到的 +OK 被解析为 StatusReply
+
+func isOkReply(r resp.Reply) bool {
+	switch r := r.(type) {
+	case *reply.OkReply:
+		return true
+	case *reply.StatusReply:
+		return r.Status == "OK"
+	}
+	return false
+}
+
+func replyString(r resp.Reply) string {
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		return errReply.Error()
+	}
+	return strings.TrimSpace(string(r.ToBytes()))
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-redis/aof"
+	databaseface "go-redis/interface/database"
+	"go-redis/lib/utils"
+	"go-redis/lib/wildcard"
+	"go-redis/resp/reply"
+	"os"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// typeOf 返回值的类型名，与 TYPE 指令的返回一致
+func typeOf(entity *databaseface.DataEntity) string {
+	switch entity.Data.(type) {
+	case []byte:
+		return "string"
+	}
+	return "unknown"
+}
+
+// sizeOf 返回 key 和值占用的字节数
+func sizeOf(key string, entity *databaseface.DataEntity) int {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return len(key) + len(val)
+	}
+	return len(key)
+}
+
+func runKeys(args []string) error {
+	common := &commonFlags{}
+	fs := newFlagSet("keys", common)
+	pattern := fs.String("pattern", "*", "only list keys matching the glob-style pattern")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("keys requires exactly one file")
+	}
+	p, err := wildcard.CompilePattern(*pattern)
+	if err != nil {
+		return err
+	}
+	db, err := load(fs.Arg(0), common)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, i := range dbIndexes(db, common) {
+		keys := make([]string, 0)
+		db.ForEach(i, func(key string, entity *databaseface.DataEntity) bool {
+			if p.IsMatch(key) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		if len(keys) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(out, "# db%d (%d keys)\n", i, len(keys))
+		for _, key := range keys {
+			fmt.Fprintln(out, key)
+		}
+	}
+	return nil
+}
+
+func runGet(args []string) error {
+	common := &commonFlags{}
+	fs := newFlagSet("get", common)
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("get requires a file and a key")
+	}
+	if common.db < 0 {
+		common.db = 0
+	}
+	db, err := load(fs.Arg(0), common)
+	if err != nil {
+		return err
+	}
+	key := fs.Arg(1)
+	var found *databaseface.DataEntity
+	db.ForEach(common.db, func(k string, entity *databaseface.DataEntity) bool {
+		if k == key {
+			found = entity
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		return fmt.Errorf("key %s not found in db%d", key, common.db)
+	}
+	fmt.Printf("db:   %d\nkey:  %s\ntype: %s\nsize: %d\n", common.db, key, typeOf(found), sizeOf(key, found))
+	switch val := found.Data.(type) {
+	case []byte:
+		fmt.Printf("value: %s\n", strconv.Quote(string(val)))
+	}
+	return nil
+}
+
+/* ---- stats ---- */
+
+// 每个 key-value 在内存中除了数据本身之外的大致开销（sync.Map 节点、DataEntity 以及切片头等）
+const entryOverhead = 96
+
+// histogram 按 2 的幂次对 key-value 的大小分桶计数
+type histogram struct {
+	buckets []int // buckets[i] 统计大小落在 (2^(i-1), 2^i] 内的 key 数量
+}
+
+func (h *histogram) add(size int) {
+	i := 0
+	for 1<<i < size {
+		i++
+	}
+	for len(h.buckets) <= i {
+		h.buckets = append(h.buckets, 0)
+	}
+	h.buckets[i]++
+}
+
+type keySize struct {
+	db   int
+	key  string
+	size int
+}
+
+func runStats(args []string) error {
+	common := &commonFlags{}
+	fs := newFlagSet("stats", common)
+	top := fs.Int("top", 10, "number of biggest keys to print")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("stats requires exactly one file")
+	}
+	db, err := load(fs.Arg(0), common)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	total := &histogram{}
+	biggest := make([]keySize, 0)
+	totalKeys, totalBytes := 0, 0
+	fmt.Fprintf(out, "%-6s %10s %14s %14s\n", "db", "keys", "bytes", "est. memory")
+	for _, i := range dbIndexes(db, common) {
+		keys, bytes := 0, 0
+		db.ForEach(i, func(key string, entity *databaseface.DataEntity) bool {
+			size := sizeOf(key, entity)
+			keys++
+			bytes += size
+			total.add(size)
+			biggest = append(biggest, keySize{db: i, key: key, size: size})
+			return true
+		})
+		if keys == 0 {
+			continue
+		}
+		totalKeys += keys
+		totalBytes += bytes
+		fmt.Fprintf(out, "%-6s %10d %14d %14d\n", "db"+strconv.Itoa(i), keys, bytes, bytes+keys*entryOverhead)
+	}
+	fmt.Fprintf(out, "%-6s %10d %14d %14d\n", "total", totalKeys, totalBytes, totalBytes+totalKeys*entryOverhead)
+
+	fmt.Fprintln(out, "\nsize histogram (key + value bytes):")
+	for i, count := range total.buckets {
+		if count == 0 {
+			continue
+		}
+		low := 0
+		if i > 0 {
+			low = 1<<(i-1) + 1
+		}
+		fmt.Fprintf(out, "  %10d - %-10d %10d\n", low, 1<<i, count)
+	}
+
+	sort.Slice(biggest, func(a, b int) bool {
+		return biggest[a].size > biggest[b].size
+	})
+	if len(biggest) > *top {
+		biggest = biggest[:*top]
+	}
+	fmt.Fprintf(out, "\nbiggest %d keys:\n", len(biggest))
+	for _, ks := range biggest {
+		fmt.Fprintf(out, "  db%-3d %10d  %s\n", ks.db, ks.size, ks.key)
+	}
+	return nil
+}
+
+/* ---- export ---- */
+
+type jsonEntry struct {
+	DB       int    `json:"db"`
+	Key      string `json:"key"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding,omitempty"` // 值不是合法的 UTF-8 时以 base64 编码，此时为 "base64"
+}
+
+func runExport(args []string) error {
+	common := &commonFlags{}
+	fs := newFlagSet("export", common)
+	format := fs.String("format", "json", "output format: json or resp")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("export requires exactly one file")
+	}
+	if *format != "json" && *format != "resp" {
+		return errors.New("unknown format " + *format)
+	}
+	db, err := load(fs.Arg(0), common)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if *format == "resp" {
+		return exportRESP(out, db, common)
+	}
+	return exportJSON(out, db, common)
+}
+
+func exportJSON(out *bufio.Writer, db databaseface.DBEngine, common *commonFlags) error {
+	encoder := json.NewEncoder(out)
+	var err error
+	for _, i := range dbIndexes(db, common) {
+		db.ForEach(i, func(key string, entity *databaseface.DataEntity) bool {
+			e := jsonEntry{DB: i, Key: key, Type: typeOf(entity)}
+			if val, ok := entity.Data.([]byte); ok {
+				if utf8.Valid(val) {
+					e.Value = string(val)
+				} else {
+					e.Value = base64.StdEncoding.EncodeToString(val)
+					e.Encoding = "base64"
+				}
+			}
+			err = encoder.Encode(&e) // 每行一个 JSON 对象
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportRESP 导出为与 aof 格式相同的指令流，如 inspect export -format resp dump.rdb | nc host port
+func exportRESP(out *bufio.Writer, db databaseface.DBEngine, common *commonFlags) error {
+	var err error
+	for _, i := range dbIndexes(db, common) {
+		selected := false
+		db.ForEach(i, func(key string, entity *databaseface.DataEntity) bool {
+			cmd := aof.EntityToCmd(key, entity)
+			if cmd == nil {
+				return true
+			}
+			if !selected {
+				_, err = out.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(i))).ToBytes())
+				selected = true
+			}
+			if err == nil {
+				_, err = out.Write(cmd.ToBytes())
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
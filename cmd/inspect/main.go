@@ -0,0 +1,114 @@
+// inspect 是一个离线查看持久化文件的工具，无需启动服务即可查看 appendonly.aof 或 RDB 文件中的数据
+//
+// 用法：
+//
+//	inspect keys   [-db n] [-pattern p] <file>   列出每个子数据库中的 key
+//	inspect get    [-db n] <file> <key>          查看 key 的类型和值
+//	inspect stats  [-db n] [-top n] <file>       统计 key 数量、大小分布以及最大的 key
+//	inspect export [-db n] [-format json|resp] <file>
+//	                                             导出为 JSON，或导出为 RESP 指令流，可直接通过管道发送给其他服务
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go-redis/aof"
+	"go-redis/config"
+	"go-redis/database"
+	databaseface "go-redis/interface/database"
+	"go-redis/lib/logger"
+	"os"
+)
+
+const usage = `usage: inspect <command> [options] <file>
+
+commands:
+  keys     list keys of each db
+  get      print the type and value of a key
+  stats    print key count, size histogram and biggest keys
+  export   export data as json or as a RESP command stream
+
+run "inspect <command> -h" for the options of a command
+`
+
+// stderrLogger 将加载过程中的日志输出到 stderr，避免污染导出到 stdout 的数据
+type stderrLogger struct{}
+
+func (l stderrLogger) Output(level logger.LogLevel, callerDepth int, msg string) {
+	_, _ = fmt.Fprint(os.Stderr, msg)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	logger.DefaultLogger = stderrLogger{}
+
+	var err error
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "keys":
+		err = runKeys(args)
+	case "get":
+		err = runGet(args)
+	case "stats":
+		err = runStats(args)
+	case "export":
+		err = runExport(args)
+	case "-h", "--help", "help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "inspect: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// commonFlags 是各个子命令共用的参数
+type commonFlags struct {
+	db        int
+	databases int
+}
+
+func newFlagSet(name string, common *commonFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.IntVar(&common.db, "db", -1, "only inspect the given db, -1 means all dbs")
+	fs.IntVar(&common.databases, "databases", 16, "number of databases of the server which wrote the file")
+	return fs
+}
+
+// load 将 aof 或 RDB 文件加载到一个临时数据库中
+// RDB 文件等价于只有 RDB 前导的 aof 文件，因此两种文件都交给 aof.Replay 处理
+
+func load(filename string, common *commonFlags) (*database.StandaloneDatabase, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config.Properties.Databases = common.databases
+	db := database.NewBasicStandaloneDatabase()
+	if err := aof.Replay(file, db); err != nil {
+		return nil, err
+	}
+	if common.db >= db.GetDBNum() {
+		return nil, fmt.Errorf("db index %d is out of range", common.db)
+	}
+	return db, nil
+}
+
+// dbIndexes 返回需要查看的子数据库编号
+func dbIndexes(db databaseface.DBEngine, common *commonFlags) []int {
+	if common.db >= 0 {
+		return []int{common.db}
+	}
+	indexes := make([]int, db.GetDBNum())
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
@@ -0,0 +1,47 @@
+// sentinel 以哨兵模式启动，监控配置文件中的主节点，主节点下线后自动进行故障转移
+//
+// 用法：
+//
+//	sentinel [sentinel.conf]
+//
+// 客户端通过 SENTINEL get-master-addr-by-name <master-name> 获取当前主节点的地址
+package main
+
+import (
+	"fmt"
+	"go-redis/lib/logger"
+	"go-redis/resp/handler"
+	"go-redis/sentinel"
+	"go-redis/tcp"
+	"os"
+)
+
+const defaultConfigFile = "sentinel.conf"
+
+func main() {
+	logger.Setup(&logger.Settings{
+		Path:       "logs",
+		Name:       "sentinel",
+		Ext:        "log",
+		TimeFormat: "2006-01-02",
+	})
+
+	configFile := defaultConfigFile
+	if len(os.Args) > 1 {
+		configFile = os.Args[1]
+	}
+	cfg, err := sentinel.LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sentinel: "+err.Error())
+		os.Exit(1)
+	}
+
+	err = tcp.ListenAndServeWithSignal(
+		&tcp.Config{
+			Address: fmt.Sprintf("%s:%d", cfg.Bind, cfg.Port),
+		},
+		handler.MakeHandlerWithDB(sentinel.MakeSentinel(cfg)))
+	if err != nil {
+		logger.Error(err)
+	}
+}
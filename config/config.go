@@ -18,26 +18,130 @@ type ServerProperties struct {
 	// for Public configuration
 	Bind           string `cfg:"bind"`
 	Port           int    `cfg:"port"`
+	UnixSocket     string `cfg:"unixsocket"`     // Unix socket 的路径，不为空时在 TCP 端口之外同时监听该 socket
+	UnixSocketPerm string `cfg:"unixsocketperm"` // Unix socket 文件的权限，八进制，如 700
 	AppendOnly     bool   `cfg:"appendonly"`
 	AppendFilename string `cfg:"appendfilename"`
-	MaxClients     int    `cfg:"maxclients"`
+	MaxClients     int    `cfg:"maxclients"` // 最大客户端连接数量，为 0 时不限制
 	RequirePass    string `cfg:"requirepass"`
 	Databases      int    `cfg:"databases"`
 
+	// for persistence
+	Dir        string `cfg:"dir"`
+	DbFilename string `cfg:"dbfilename"`
+	Save       string `cfg:"save"` // 自动保存规则 "<seconds> <changes> ..."，多行 save 配置会被合并为一条
+	// 重写 AOF 时以 RDB 格式写入数据快照，之后再追加 RESP 格式的指令，加快重启时的加载速度
+	AofUseRdbPreamble bool `cfg:"aof-use-rdb-preamble"`
+
+	// for replication
+	ReplicaOf       string `cfg:"replicaof"` // 作为从节点启动时要复制的主节点 "<host> <port>"
+	MasterAuth      string `cfg:"masterauth"`
+	ReplicaReadOnly bool   `cfg:"replica-read-only"`
+	ReplBacklogSize int    `cfg:"repl-backlog-size"`
+	ReplTimeout     int    `cfg:"repl-timeout"` // 复制连接的超时时间，单位秒
+	// 在线且延迟不超过 MinReplicasMaxLag 秒的从节点少于 MinReplicasToWrite 个时，主节点拒绝写指令，任意一项为 0 时不做限制
+	MinReplicasToWrite int `cfg:"min-replicas-to-write"`
+	MinReplicasMaxLag  int `cfg:"min-replicas-max-lag"`
+
 	Peers []string `cfg:"peers"`
 	Self  string   `cfg:"self"`
+	// 没有配置 peers 时也以集群模式启动，之后通过 CLUSTER MEET 加入集群
+	ClusterEnabled bool `cfg:"cluster-enabled"`
+	// 集群总线的端口，节点之间通过它交换 PING/PONG 以维护成员关系，为 0 时使用服务端口 + 10000
+	ClusterPort int `cfg:"cluster-port"`
+	// 超过该时间（毫秒）没有回复 PING 的节点会被标记为疑似下线，为 0 时使用 15000
+	ClusterNodeTimeout int `cfg:"cluster-node-timeout"`
+
+	// 一致性哈希环上每个节点的虚拟节点数量，以及各节点的权重 "<addr>=<weight>,..."，未列出的节点权重为 1
+	// 集群中所有节点的这两项配置必须相同，否则各节点对 key 归属的判断会不一致
+	VirtualNodes int      `cfg:"virtual-nodes"`
+	NodeWeights  []string `cfg:"node-weights"`
+
+	// 集群的路由方式：hash 使用一致性哈希环（默认），slot 使用与 Redis Cluster 兼容的 16384 个槽位
+	ClusterMode string `cfg:"cluster-mode"`
+	// slot 模式下槽位到节点的分配 "<addr>=<start>-<end>,<addr>=<slot>,..."，同一节点可以出现多次
+	// 未配置时按节点地址排序后将全部槽位平均分配给各节点
+	ClusterSlots []string `cfg:"cluster-slots"`
+	// slot 模式下新连接默认是否使用 MOVED 重定向，客户端也可以通过 CLIENT REDIRECT ON|OFF 单独设置
+	ClusterRedirect bool `cfg:"cluster-redirect"`
+
+	// 协议的安全限制，超出限制的客户端会收到协议错误并被断开，避免一个请求头就让服务端分配大量内存
+	ProtoMaxBulkLen        int `cfg:"proto-max-bulk-len"`        // 单个参数的最大长度
+	ProtoMaxMultiBulkLen   int `cfg:"proto-max-multibulk-len"`   // 一条指令的最大参数个数
+	ClientQueryBufferLimit int `cfg:"client-query-buffer-limit"` // 一条指令占用的请求缓冲区的最大长度
+	// 连接数量达到 maxclients 后为本机（回环地址或 Unix socket）连接预留的名额，保证管理员仍然可以连接
+	AdminReservedClients int `cfg:"admin-reserved-clients"`
+	// 客户端空闲超过 timeout 秒后关闭连接，为 0 时不关闭；从节点、主节点的复制连接和正在执行指令（如 WAIT）的客户端除外
+	Timeout int `cfg:"timeout"`
+	// TCP keepalive 探测的间隔，单位秒，为 0 时关闭，与 Redis 相同默认为 300
+	TCPKeepalive int `cfg:"tcp-keepalive"`
+
+	// 网络模式：goroutine 为每个连接启动一个协程（默认），epoll 使用事件循环和 io-threads 个工作协程处理所有连接，只支持 Linux
+	IOMode    string `cfg:"io-mode"`
+	IOThreads int    `cfg:"io-threads"` // 为 0 时使用 CPU 核数
+
+	// TLS：tls-port 不为 0 时在该端口上监听 TLS 连接，port 为 0 时只接受 TLS 连接
+	// 证书文件被替换后自动重新加载
+	TLSPort        int    `cfg:"tls-port"`
+	TLSCertFile    string `cfg:"tls-cert-file"`
+	TLSKeyFile     string `cfg:"tls-key-file"`
+	TLSCACertFile  string `cfg:"tls-ca-cert-file"`
+	TLSAuthClients string `cfg:"tls-auth-clients"` // yes（默认）、optional 或 no，是否要求客户端出示证书
+	// 集群节点之间（转发指令、迁移数据和集群总线）使用 TLS，此时 self 和 peers 应配置为各节点的 tls-port
+	TLSCluster bool `cfg:"tls-cluster"`
+	// 从节点使用 TLS 连接主节点，此时 replicaof 应配置为主节点的 tls-port
+	TLSReplication bool `cfg:"tls-replication"`
 }
 
 // Properties holds global config properties
 var Properties *ServerProperties
 
+// repeatableKeys 中的配置项允许在配置文件中出现多次，多次出现的值以空格拼接
+var repeatableKeys = map[string]bool{
+	"save": true,
+}
+
+const defaultDbFilename = "dump.rdb"
+
+// 集群的路由方式
+const (
+	ClusterModeHash = "hash"
+	ClusterModeSlot = "slot"
+)
+
+// 协议安全限制的默认值，与 Redis 相同
+const (
+	DefaultProtoMaxBulkLen        = 512 * 1024 * 1024
+	DefaultProtoMaxMultiBulkLen   = 1024 * 1024
+	DefaultClientQueryBufferLimit = 1024 * 1024 * 1024
+)
+
+// SavePoint 是一条 RDB 自动保存规则：Seconds 秒内至少发生了 Changes 次写操作则触发 BGSAVE
+type SavePoint struct {
+	Seconds int64
+	Changes int64
+}
+
+// DefaultServerProperties 返回各配置项的默认值，配置文件中没有出现的配置项保持该值
+// 监听地址和端口不在其中，由使用方决定
+
+func DefaultServerProperties() *ServerProperties {
+	return &ServerProperties{
+		ReplicaReadOnly:        true,
+		MinReplicasMaxLag:      10,
+		ProtoMaxBulkLen:        DefaultProtoMaxBulkLen,
+		ProtoMaxMultiBulkLen:   DefaultProtoMaxMultiBulkLen,
+		ClientQueryBufferLimit: DefaultClientQueryBufferLimit,
+		AdminReservedClients:   4,
+		TCPKeepalive:           300,
+	}
+}
+
 func init() {
 	// default config
-	Properties = &ServerProperties{
-		Bind:       "127.0.0.1",
-		Port:       6379,
-		AppendOnly: false,
-	}
+	Properties = DefaultServerProperties()
+	Properties.Bind = "127.0.0.1"
+	Properties.Port = 6379
 }
 
 func SetupConfig(configFilename string) {
@@ -54,7 +158,7 @@ func SetupConfig(configFilename string) {
 }
 
 func parse(src io.Reader) *ServerProperties {
-	config := &ServerProperties{}
+	config := DefaultServerProperties()
 
 	// read config file
 	rawMap := make(map[string]string)
@@ -68,7 +172,11 @@ func parse(src io.Reader) *ServerProperties {
 		if pivot > 0 && pivot < len(line)-1 { // separator found
 			key := line[0:pivot]
 			value := strings.Trim(line[pivot+1:], " ")
-			rawMap[strings.ToLower(key)] = value
+			key = strings.ToLower(key)
+			if old, ok := rawMap[key]; ok && repeatableKeys[key] {
+				value = old + " " + value
+			}
+			rawMap[key] = value
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -93,9 +201,11 @@ func parse(src io.Reader) *ServerProperties {
 			case reflect.String:
 				fieldVal.SetString(value)
 			case reflect.Int:
-				intValue, err := strconv.ParseInt(value, 10, 64)
+				intValue, err := parseSize(value)
 				if err == nil {
 					fieldVal.SetInt(intValue)
+				} else {
+					logger.Warn("invalid config " + key + ": " + value)
 				}
 			case reflect.Bool:
 				boolValue := "yes" == value
@@ -110,3 +220,110 @@ func parse(src io.Reader) *ServerProperties {
 	}
 	return config
 }
+
+// parseSize 解析整数配置，与 Redis 相同支持 k、kb、m、mb、g、gb 单位，如 512mb，k 为 1000，kb 为 1024
+
+func parseSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	}
+	lower := strings.ToLower(value)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			n, err := strconv.ParseInt(lower[:len(lower)-len(unit.suffix)], 10, 64)
+			return n * unit.mul, err
+		}
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// MaxBulkLen 返回单个参数的最大长度，未配置时使用默认值
+func (p *ServerProperties) MaxBulkLen() int {
+	if p.ProtoMaxBulkLen <= 0 {
+		return DefaultProtoMaxBulkLen
+	}
+	return p.ProtoMaxBulkLen
+}
+
+// MaxMultiBulkLen 返回一条指令的最大参数个数，未配置时使用默认值
+func (p *ServerProperties) MaxMultiBulkLen() int {
+	if p.ProtoMaxMultiBulkLen <= 0 {
+		return DefaultProtoMaxMultiBulkLen
+	}
+	return p.ProtoMaxMultiBulkLen
+}
+
+// QueryBufferLimit 返回一条指令占用的请求缓冲区的最大长度，未配置时使用默认值
+func (p *ServerProperties) QueryBufferLimit() int {
+	if p.ClientQueryBufferLimit <= 0 {
+		return DefaultClientQueryBufferLimit
+	}
+	return p.ClientQueryBufferLimit
+}
+
+// TLSEnabled 返回是否配置了 TLS 证书
+func (p *ServerProperties) TLSEnabled() bool {
+	return p.TLSCertFile != ""
+}
+
+// RDBFilename 返回 RDB 文件的路径，由 dir 和 dbfilename 拼接而成
+func (p *ServerProperties) RDBFilename() string {
+	filename := p.DbFilename
+	if filename == "" {
+		filename = defaultDbFilename
+	}
+	return filepath.Join(p.Dir, filename)
+}
+
+// SavePoints 解析 save 配置，save "" 或未配置时返回空，表示关闭自动保存
+func (p *ServerProperties) SavePoints() []SavePoint {
+	fields := strings.Fields(strings.ReplaceAll(p.Save, "\"", ""))
+	points := make([]SavePoint, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		seconds, err1 := strconv.ParseInt(fields[i], 10, 64)
+		changes, err2 := strconv.ParseInt(fields[i+1], 10, 64)
+		if err1 != nil || err2 != nil || seconds <= 0 || changes <= 0 {
+			logger.Warn("invalid save point: " + fields[i] + " " + fields[i+1])
+			continue
+		}
+		points = append(points, SavePoint{Seconds: seconds, Changes: changes})
+	}
+	return points
+}
+
+// NodeWeightMap 解析 node-weights 配置，返回节点地址到权重的映射
+func (p *ServerProperties) NodeWeightMap() map[string]int {
+	weights := make(map[string]int, len(p.NodeWeights))
+	for _, item := range p.NodeWeights {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pivot := strings.LastIndex(item, "=")
+		if pivot <= 0 {
+			logger.Warn("invalid node weight: " + item)
+			continue
+		}
+		weight, err := strconv.Atoi(item[pivot+1:])
+		if err != nil || weight <= 0 {
+			logger.Warn("invalid node weight: " + item)
+			continue
+		}
+		weights[item[:pivot]] = weight
+	}
+	return weights
+}
+
+// IsCluster 判断是否以集群模式启动：配置了自身地址，并且配置了其他节点或开启了 cluster-enabled
+func (p *ServerProperties) IsCluster() bool {
+	return p.Self != "" && (len(p.Peers) > 0 || p.ClusterEnabled)
+}
+
+// SlotMode 判断集群是否使用槽位路由
+func (p *ServerProperties) SlotMode() bool {
+	return strings.ToLower(p.ClusterMode) == ClusterModeSlot
+}
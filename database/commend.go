@@ -1,23 +1,122 @@
 package database
 
-import "strings"
+import (
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strings"
+)
 
 // cmdTable 用于记录系统中所有的指令(GET, SET, PING等)与commend结构体的关系，即每一条指令都对应一个commend结构体
 var cmdTable = make(map[string]*commend)
 
+// 指令的属性标记
+const (
+	flagWrite    = 1 << iota // 写指令，会修改数据，只读的从节点会拒绝执行
+	flagReadOnly             // 只读指令
+)
+
 // 每一个指令(GET, SET等)都是一个结构体
 type commend struct {
 	executor ExecFunc // 执行方法
 	arity    int      // 参数的数量
+	flags    int      // 指令的属性，如 flagWrite
+	firstKey int      // 第一个 key 在指令中的位置，0 表示指令不涉及 key
+	lastKey  int      // 最后一个 key 的位置，负数表示从末尾倒数，如 -1 表示最后一个参数
+	keyStep  int      // 相邻两个 key 之间的距离，如 MSET k1 v1 k2 v2 为 2
+	keysFunc KeysFunc // key 的位置不固定时（如 MIGRATE）用于取出 key，设置后忽略 firstKey 等字段
 }
 
+// KeysFunc 从完整的指令（包含指令名称）中取出涉及的 key
+type KeysFunc func(cmdLine CmdLine) []string
+
 // RegisterCommend 用于注册一些指令的实现
-// 通过输入方法的名称、输入方法的执行函数、输入方法执行需要的参数个数，将上述三个参数封装成一个 commend 结构体，并注册到 cmdTable 中
+// 通过输入方法的名称、输入方法的执行函数、输入方法执行需要的参数个数以及指令的属性，将上述参数封装成一个 commend 结构体，并注册到 cmdTable 中
 
-func RegisterCommend(name string, executor ExecFunc, arity int) {
+func RegisterCommend(name string, executor ExecFunc, arity int, flags int) *commend {
 	name = strings.ToLower(name) // 转化成小写
-	cmdTable[name] = &commend{
+	cmd := &commend{
 		executor: executor,
 		arity:    arity,
+		flags:    flags,
+	}
+	cmdTable[name] = cmd
+	return cmd
+}
+
+// attachKeys 记录指令中 key 的位置，含义与 Redis COMMAND INFO 中的 first-key、last-key、step 相同
+
+func (cmd *commend) attachKeys(firstKey int, lastKey int, step int) *commend {
+	cmd.firstKey = firstKey
+	cmd.lastKey = lastKey
+	cmd.keyStep = step
+	return cmd
+}
+
+// attachKeysFunc 为 key 的位置取决于参数内容的指令设置取 key 的方法
+
+func (cmd *commend) attachKeysFunc(keysFunc KeysFunc) *commend {
+	cmd.keysFunc = keysFunc
+	return cmd
+}
+
+// extractKeys 按 key 的位置取出指令中的 key，cmdLine 包含指令名称
+
+func (cmd *commend) extractKeys(cmdLine CmdLine) []string {
+	if cmd.keysFunc != nil {
+		return cmd.keysFunc(cmdLine)
 	}
+	if cmd.firstKey <= 0 {
+		return nil
+	}
+	last := cmd.lastKey
+	if last < 0 {
+		last = len(cmdLine) + last
+	}
+	keys := make([]string, 0, (last-cmd.firstKey)/cmd.keyStep+1)
+	for i := cmd.firstKey; i <= last && i < len(cmdLine); i += cmd.keyStep {
+		keys = append(keys, string(cmdLine[i]))
+	}
+	return keys
+}
+
+// relatedKeys 返回指令会写入和读取的 key，写指令涉及的 key 都视为写入
+
+func (cmd *commend) relatedKeys(cmdLine CmdLine) (writeKeys []string, readKeys []string) {
+	keys := cmd.extractKeys(cmdLine)
+	if cmd.flags&flagWrite > 0 {
+		return keys, nil
+	}
+	return nil, keys
+}
+
+// lookupCommend 查找指令并校验参数个数
+
+func lookupCommend(cmdLine CmdLine) (*commend, resp.Reply) {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := cmdTable[cmdName]
+	if !ok {
+		return nil, reply.MakeErrReply("ERR unknown command '" + cmdName + "'")
+	}
+	if !validateArity(cmd.arity, cmdLine) {
+		return nil, reply.MakeArgNumErrReply(cmdName)
+	}
+	return cmd, nil
+}
+
+// GetRelatedKeys 返回指令会写入和读取的 key，供事务加锁和集群路由使用，指令不存在或参数个数错误时返回错误
+
+func GetRelatedKeys(cmdLine CmdLine) (writeKeys []string, readKeys []string, errReply resp.Reply) {
+	cmd, errReply := lookupCommend(cmdLine)
+	if errReply != nil {
+		return nil, nil, errReply
+	}
+	writeKeys, readKeys = cmd.relatedKeys(cmdLine)
+	return writeKeys, readKeys, nil
+}
+
+// isWriteCommend 判断指令是否会修改数据
+
+func isWriteCommend(name string) bool {
+	cmd, ok := cmdTable[strings.ToLower(name)]
+	return ok && cmd.flags&flagWrite > 0
 }
@@ -2,18 +2,20 @@ package database
 
 import (
 	"go-redis/datastruct/dict"
+	"go-redis/datastruct/lock"
 	"go-redis/interface/database"
 	"go-redis/interface/resp"
-	"go-redis/resp/reply"
-	"strings"
 )
 
 type DB struct {
 	index  int
 	data   dict.Dict
+	locker *lock.Locks // 按 key 加锁，保证事务中的多条指令执行期间不会被其他指令打断
 	addAof func(line CmdLine)
 }
 
+const lockerSize = 1024
+
 type ExecFunc func(db *DB, args [][]byte) resp.Reply // redis 所有指令的函数规范，入参是 db 和指令，出参是 reply
 
 type CmdLine = [][]byte
@@ -21,26 +23,44 @@ type CmdLine = [][]byte
 func MakeDB() *DB {
 	db := &DB{
 		data:   dict.MakeSyncDict(),
+		locker: lock.Make(lockerSize),
 		addAof: func(line CmdLine) {},
 	}
 	return db
 }
 
 func (db *DB) Exec(c resp.Connection, cmdLine CmdLine) resp.Reply {
-	// 获取指令的第一个成员（如 SET, SETNX, PING）
-	cmdName := strings.ToLower(string(cmdLine[0]))
-	cmd, ok := cmdTable[cmdName]
-	if !ok {
-		return reply.MakeErrReply("ERR unknown commend" + cmdName)
+	// 获取指令的第一个成员（如 SET, SETNX, PING）对应的 commend，并校验参数个数是否合法
+	cmd, errReply := lookupCommend(cmdLine)
+	if errReply != nil {
+		return errReply
 	}
-	// 校验参数个数是否合法
-	if !validateArity(cmd.arity, cmdLine) {
-		return reply.MakeArgNumErrReply(cmdName)
-	}
-	// 获取指令对应的执行方法
-	function := cmd.executor
+	// 对指令涉及的 key 加锁，与正在执行的事务互斥
+	writeKeys, readKeys := cmd.relatedKeys(cmdLine)
+	db.RWLocks(writeKeys, readKeys)
+	defer db.RWUnLocks(writeKeys, readKeys)
 	// cmdLine 的第一个已经使用过了，假设是 set key value，前面的 cmdName 已经取到了 set，因此只需要传递指令剩下的内容即可
-	return function(db, cmdLine[1:])
+	return cmd.executor(db, cmdLine[1:])
+}
+
+// execWithLock 执行指令，调用方已经对指令涉及的 key 加锁
+
+func (db *DB) execWithLock(cmdLine CmdLine) resp.Reply {
+	cmd, errReply := lookupCommend(cmdLine)
+	if errReply != nil {
+		return errReply
+	}
+	return cmd.executor(db, cmdLine[1:])
+}
+
+// RWLocks 对 writeKeys 加写锁，对 readKeys 加读锁
+
+func (db *DB) RWLocks(writeKeys []string, readKeys []string) {
+	db.locker.RWLocks(writeKeys, readKeys)
+}
+
+func (db *DB) RWUnLocks(writeKeys []string, readKeys []string) {
+	db.locker.RWUnLocks(writeKeys, readKeys)
 }
 
 // validateArity 用于校验参数个数是否合法
@@ -100,3 +120,16 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 func (db *DB) Flush() {
 	db.data.Clear()
 }
+
+// ForEach 遍历子数据库中所有的 key-value，cb 返回 false 时停止遍历
+
+func (db *DB) ForEach(cb func(key string, entity *database.DataEntity) bool) {
+	stopped := false
+	db.data.ForEach(func(key string, val interface{}) bool {
+		if stopped {
+			return false
+		}
+		stopped = !cb(key, val.(*database.DataEntity))
+		return !stopped
+	})
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+// ServerVersion 是 HELLO 返回的版本号，客户端据此判断服务端是否支持 RESP3 等特性
+const ServerVersion = "6.2.0"
+
+// ExecHello 实现 HELLO [protover [AUTH username password] [SETNAME clientname]]
+// 切换连接的协议版本，并以 map 返回服务端信息，RESP2 连接上 map 展开为数组
+// mode 为 standalone、cluster 或 sentinel，role 为 master 或 replica
+
+func ExecHello(c resp.Connection, args [][]byte, mode string, role string) resp.Reply {
+	protocol := c.GetProtocol()
+	if len(args) > 0 {
+		ver, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return reply.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if ver != resp.RESP2 && ver != resp.RESP3 {
+			return reply.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		protocol = ver
+	}
+	name, setName := "", false
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "auth" && i+2 < len(args):
+			if !checkPassword(string(args[i+1]), string(args[i+2])) {
+				return reply.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+			}
+			i += 2
+		case option == "setname" && i+1 < len(args):
+			name, setName = string(args[i+1]), true
+			if strings.ContainsAny(name, " \n") {
+				return reply.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			i++
+		default:
+			return reply.MakeErrReply("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+		}
+	}
+
+	// 所有选项都检查通过后才修改连接的状态
+	c.SetProtocol(protocol)
+	if setName {
+		c.SetName(name)
+	}
+	return reply.MakeMapReply([]resp.Reply{
+		reply.MakeBulkReply([]byte("server")), reply.MakeBulkReply([]byte("redis")),
+		reply.MakeBulkReply([]byte("version")), reply.MakeBulkReply([]byte(ServerVersion)),
+		reply.MakeBulkReply([]byte("proto")), reply.MakeIntReply(int64(protocol)),
+		reply.MakeBulkReply([]byte("id")), reply.MakeIntReply(c.GetID()),
+		reply.MakeBulkReply([]byte("mode")), reply.MakeBulkReply([]byte(mode)),
+		reply.MakeBulkReply([]byte("role")), reply.MakeBulkReply([]byte(role)),
+		reply.MakeBulkReply([]byte("modules")), reply.MakeEmptyMultiBulkReply(),
+	})
+}
+
+// checkPassword 校验 HELLO AUTH 的用户名和密码，只有 default 一个用户，密码为 requirepass，未配置 requirepass 时不校验密码
+
+func checkPassword(username string, password string) bool {
+	if username != "default" {
+		return false
+	}
+	return config.Properties.RequirePass == "" || password == config.Properties.RequirePass
+}
+
+// execHello 按本节点的运行模式和复制角色回复 HELLO
+
+func (database *StandaloneDatabase) execHello(c resp.Connection, args [][]byte) resp.Reply {
+	mode := "standalone"
+	if config.Properties.IsCluster() {
+		mode = "cluster"
+	}
+	role := "master"
+	if database.repl.isSlave() {
+		role = "replica"
+	}
+	return ExecHello(c, args, mode, role)
+}
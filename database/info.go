@@ -0,0 +1,109 @@
+package database
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execInfo 实现 INFO [section]，目前提供 clients、stats 和 replication 三节，哨兵通过 replication 获取节点的角色以及从节点列表
+// 不带参数、参数为 all/default/everything 时返回全部内容，未知的 section 返回空字符串
+
+func (database *StandaloneDatabase) execInfo(args [][]byte) resp.Reply {
+	section := "all"
+	if len(args) == 1 {
+		section = strings.ToLower(string(args[0]))
+	}
+	var sb strings.Builder
+	all := section == "all" || section == "default" || section == "everything"
+	if all || section == "clients" {
+		writeClientsInfo(&sb)
+	}
+	if all || section == "stats" {
+		writeStatsInfo(&sb)
+	}
+	if all || section == "replication" {
+		database.repl.writeInfo(&sb)
+	}
+	return reply.MakeVerbatimReply("txt", []byte(sb.String())) // RESP2 下是普通的数据块
+}
+
+// writeClientsInfo 输出 INFO clients，连接数量由 handler 统计
+
+func writeClientsInfo(sb *strings.Builder) {
+	sb.WriteString("# Clients" + reply.CRLF)
+	sb.WriteString("connected_clients:" + strconv.FormatInt(connection.ConnectedClients(), 10) + reply.CRLF)
+	sb.WriteString("maxclients:" + strconv.Itoa(config.Properties.MaxClients) + reply.CRLF)
+	sb.WriteString(reply.CRLF)
+}
+
+// writeStatsInfo 输出 INFO stats
+
+func writeStatsInfo(sb *strings.Builder) {
+	sb.WriteString("# Stats" + reply.CRLF)
+	sb.WriteString("total_connections_received:" + strconv.FormatInt(connection.TotalConnections(), 10) + reply.CRLF)
+	sb.WriteString("rejected_connections:" + strconv.FormatInt(connection.RejectedConnections(), 10) + reply.CRLF)
+	sb.WriteString(reply.CRLF)
+}
+
+// writeInfo 以 INFO replication 的格式输出复制状态
+
+func (repl *replication) writeInfo(sb *strings.Builder) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	field := func(key string, value string) {
+		sb.WriteString(key + ":" + value + reply.CRLF)
+	}
+	sb.WriteString("# Replication" + reply.CRLF)
+	if repl.role == roleSlave {
+		field("role", "slave")
+		field("master_host", repl.masterHost)
+		field("master_port", strconv.Itoa(repl.masterPort))
+		linkStatus := "down"
+		if repl.linkState == linkStateConnected {
+			linkStatus = "up"
+		}
+		field("master_link_status", linkStatus)
+		field("master_sync_in_progress", boolToFlag(repl.linkState == linkStateSync))
+		field("slave_repl_offset", strconv.FormatInt(repl.backlog.offset, 10))
+		field("slave_read_only", boolToFlag(config.Properties.ReplicaReadOnly))
+	} else {
+		field("role", "master")
+	}
+	lines := make([]string, 0, len(repl.replicas))
+	for _, r := range repl.replicas {
+		if r.state == replicaStateHandshake {
+			continue
+		}
+		state := "online"
+		if r.state == replicaStateWaitBgsave {
+			state = "wait_bgsave"
+		}
+		lines = append(lines, "ip="+r.ip()+",port="+strconv.Itoa(r.listeningPort)+",state="+state+
+			",offset="+strconv.FormatInt(r.ackOffset, 10)+",lag="+strconv.FormatInt(int64(time.Since(r.ackTime)/time.Second), 10))
+	}
+	field("connected_slaves", strconv.Itoa(len(lines)))
+	for i, line := range lines {
+		field("slave"+strconv.Itoa(i), line)
+	}
+	field("master_replid", repl.replId)
+	replId2 := repl.replId2
+	if replId2 == "" {
+		replId2 = strings.Repeat("0", replIdLen)
+	}
+	field("master_replid2", replId2)
+	field("master_repl_offset", strconv.FormatInt(repl.backlog.offset, 10))
+	field("second_repl_offset", strconv.FormatInt(repl.secondReplOffset, 10))
+	field("repl_backlog_size", strconv.Itoa(len(repl.backlog.buf)))
+}
+
+func boolToFlag(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -1,10 +1,13 @@
 package database
 
 import (
+	"go-redis/interface/database"
 	"go-redis/interface/resp"
 	"go-redis/lib/utils"
 	"go-redis/lib/wildcard"
 	"go-redis/resp/reply"
+	"strconv"
+	"strings"
 )
 
 // DEL k1, k2, k3
@@ -36,6 +39,26 @@ func execExists(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeIntReply(result)
 }
 
+// UNLINK k1 k2 k3 ... 与 DEL 相同，当前实现中删除本身就很快，不需要放到后台进行
+
+func execUnlink(db *DB, args [][]byte) resp.Reply {
+	keys := make([]string, len(args))
+	for i, v := range args {
+		keys[i] = string(v)
+	}
+	deleted := db.Removes(keys...)
+	if deleted > 0 {
+		db.addAof(utils.ToCmdLine2("unlink", args...))
+	}
+	return reply.MakeIntReply(int64(deleted))
+}
+
+// TOUCH k1 k2 k3 ... 返回存在的 key 的个数，当前实现没有记录 key 的访问时间
+
+func execTouch(db *DB, args [][]byte) resp.Reply {
+	return execExists(db, args)
+}
+
 // FLUSHDB 清空数据库
 
 func execFlushDB(db *DB, args [][]byte) resp.Reply {
@@ -44,6 +67,12 @@ func execFlushDB(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeOkReply()
 }
 
+// DBSIZE 返回当前子数据库中 key 的数量
+
+func execDBSize(db *DB, args [][]byte) resp.Reply {
+	return reply.MakeIntReply(int64(db.data.Len()))
+}
+
 // TYPE k1 用于查看键对应的值的数据类型
 
 func execType(db *DB, args [][]byte) resp.Reply {
@@ -52,12 +81,21 @@ func execType(db *DB, args [][]byte) resp.Reply {
 	if !exist {
 		return reply.MakeStatusReply("none")
 	}
+	name := typeName(entity)
+	if name == "" {
+		return reply.MakeUnknownErrReply()
+	}
+	return reply.MakeStatusReply(name) // 回复键的类型，如 string
+}
+
+// typeName 返回值的类型名称，与 TYPE 的回复相同
+
+func typeName(entity *database.DataEntity) string {
 	switch entity.Data.(type) {
 	case []byte:
-		reply.MakeStatusReply("string") // 回复键的类型为 string
+		return "string"
 	}
-	// TODO
-	return reply.MakeUnknownErrReply()
+	return ""
 }
 
 // RENAME k1 k2 用于将 k1 重命名为 k2
@@ -67,7 +105,7 @@ func execRename(db *DB, args [][]byte) resp.Reply {
 	dest := string(args[1])
 	entity, exist := db.GetEntity(src)
 	if !exist {
-		return reply.MakeErrReply("no such key")
+		return reply.MakeErrReply("ERR no such key")
 	}
 	db.PutEntity(dest, entity)
 	db.Removes(src)
@@ -88,7 +126,7 @@ func execRenameNX(db *DB, args [][]byte) resp.Reply {
 
 	entity, exist := db.GetEntity(src)
 	if !exist {
-		return reply.MakeErrReply("no such key")
+		return reply.MakeErrReply("ERR no such key")
 	}
 	db.PutEntity(dest, entity)
 	db.Removes(src)
@@ -96,6 +134,67 @@ func execRenameNX(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeIntReply(1)
 }
 
+// COPY src dest [DB destination-db] [REPLACE] 将 src 的值复制到 dest，dest 已存在且没有指定 REPLACE 时返回 0
+// 指定 DB 选项时由 StandaloneDatabase 找到目标子数据库，这里只处理同一个子数据库内的复制
+
+func execCopy(db *DB, args [][]byte) resp.Reply {
+	destIndex, replace, errReply := parseCopyArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	if destIndex >= 0 && destIndex != db.index {
+		return reply.MakeErrReply("ERR DB index is out of range")
+	}
+	return copyEntity(db, db, args, replace)
+}
+
+// parseCopyArgs 解析 COPY 的可选参数，没有指定 DB 时 destIndex 为 -1
+
+func parseCopyArgs(args [][]byte) (destIndex int, replace bool, errReply resp.Reply) {
+	destIndex = -1
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "db":
+			if i+1 >= len(args) {
+				return 0, false, reply.MakeSyntaxErrReply()
+			}
+			index, err := strconv.Atoi(string(args[i+1]))
+			if err != nil || index < 0 {
+				return 0, false, reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			destIndex = index
+			i++
+		case "replace":
+			replace = true
+		default:
+			return 0, false, reply.MakeSyntaxErrReply()
+		}
+	}
+	return destIndex, replace, nil
+}
+
+// copyEntity 将 srcDB 中的 src 复制到 destDB 中的 dest，AOF 记录在源子数据库中
+
+func copyEntity(srcDB *DB, destDB *DB, args [][]byte, replace bool) resp.Reply {
+	src := string(args[0])
+	dest := string(args[1])
+	if srcDB == destDB && src == dest {
+		return reply.MakeErrReply("ERR source and destination objects are the same")
+	}
+	entity, exist := srcDB.GetEntity(src)
+	if !exist {
+		return reply.MakeIntReply(0)
+	}
+	if _, exist := destDB.GetEntity(dest); exist && !replace {
+		return reply.MakeIntReply(0)
+	}
+	value := make([]byte, len(entity.Data.([]byte)))
+	copy(value, entity.Data.([]byte))
+	destDB.PutEntity(dest, &database.DataEntity{Data: value})
+	srcDB.addAof(utils.ToCmdLine2("copy", args...))
+	return reply.MakeIntReply(1)
+}
+
 // KEYS * 列出该DB种所有的 KEY
 
 func execKeys(db *DB, args [][]byte) resp.Reply {
@@ -111,11 +210,16 @@ func execKeys(db *DB, args [][]byte) resp.Reply {
 }
 
 func init() {
-	RegisterCommend("DEL", execDel, -2)
-	RegisterCommend("EXISTS", execExists, -2)
-	RegisterCommend("FLUSHDB", execFlushDB, -1)
-	RegisterCommend("TYPE", execType, 2)
-	RegisterCommend("RENAME", execRename, 3)
-	RegisterCommend("RENAMENX", execRenameNX, 3)
-	RegisterCommend("KEYS", execKeys, 2) // 第一个参数是 keys，第二个参数是通配符，比如 *
+	RegisterCommend("DEL", execDel, -2, flagWrite).attachKeys(1, -1, 1)
+	RegisterCommend("UNLINK", execUnlink, -2, flagWrite).attachKeys(1, -1, 1)
+	RegisterCommend("EXISTS", execExists, -2, flagReadOnly).attachKeys(1, -1, 1)
+	RegisterCommend("TOUCH", execTouch, -2, flagReadOnly).attachKeys(1, -1, 1)
+	RegisterCommend("FLUSHDB", execFlushDB, -1, flagWrite)
+	RegisterCommend("TYPE", execType, 2, flagReadOnly).attachKeys(1, 1, 1)
+	RegisterCommend("RENAME", execRename, 3, flagWrite).attachKeys(1, 2, 1)
+	RegisterCommend("RENAMENX", execRenameNX, 3, flagWrite).attachKeys(1, 2, 1)
+	RegisterCommend("COPY", execCopy, -3, flagWrite).attachKeys(1, 2, 1)
+	RegisterCommend("KEYS", execKeys, 2, flagReadOnly) // 第一个参数是 keys，第二个参数是通配符，比如 *
+	RegisterCommend("SCAN", execScan, -2, flagReadOnly)
+	RegisterCommend("DBSIZE", execDBSize, 1, flagReadOnly)
 }
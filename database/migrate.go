@@ -0,0 +1,290 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/tlsutil"
+	"go-redis/lib/utils"
+	"go-redis/rdb"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DUMP key，将 key 的值序列化为与 Redis 相同的 DUMP 格式
+
+func execDump(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+	entity, exist := db.GetEntity(key)
+	if !exist {
+		return reply.MakeNullBulkReply()
+	}
+	payload, err := rdb.DumpValue(entity.Data)
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeBulkReply(payload)
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL] [IDLETIME seconds] [FREQ frequency]
+// 当前实现不支持过期时间，ttl 必须为 0；IDLETIME 和 FREQ 只做语法检查
+
+func execRestore(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return reply.MakeErrReply("ERR Invalid TTL value, must be >= 0")
+	}
+	if ttl > 0 {
+		return reply.MakeErrReply("ERR key expiration is not supported")
+	}
+	replace := false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "replace":
+			replace = true
+		case "absttl":
+		case "idletime", "freq":
+			if i+1 >= len(args) {
+				return reply.MakeSyntaxErrReply()
+			}
+			if _, err := strconv.ParseInt(string(args[i+1]), 10, 64); err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			i++
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+	if _, exist := db.GetEntity(key); exist && !replace {
+		return reply.MakeErrReply("BUSYKEY Target key name already exists.")
+	}
+	value, err := rdb.RestoreValue(args[2])
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	db.PutEntity(key, &database.DataEntity{Data: value})
+	db.addAof(utils.ToCmdLine2("restore", args...))
+	return reply.MakeOkReply()
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [KEYS key [key ...]]
+// 将 key 序列化后通过 RESTORE-ASKING 写入目标节点，成功后删除本地的 key（指定 COPY 时保留）
+// 使用 RESTORE-ASKING 使目标节点在槽位处于 IMPORTING 状态时也能接收数据
+// 连接目标节点以及每条指令的发送和回复都不超过 timeout 毫秒
+// 与目标节点通信期间不持有任何锁：先在锁内 DUMP，通信完成后再加锁删除本地的 key，
+// 期间被其他客户端修改过的 key 保留在本地，不会因为删除而丢失新写入的数据
+
+func (database *StandaloneDatabase) execMigrate(c resp.Connection, args [][]byte) resp.Reply {
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+	destDB, err := strconv.Atoi(string(args[3]))
+	if err != nil || destDB < 0 {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeoutMs, err := strconv.ParseInt(string(args[4]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	if timeoutMs <= 0 { // 与 Redis 相同，默认 1 秒
+		timeoutMs = 1000
+	}
+	keys := make([]string, 0)
+	if len(args[2]) > 0 {
+		keys = append(keys, string(args[2]))
+	}
+	copyKey, replace := false, false
+	password := ""
+	for i := 5; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "copy":
+			copyKey = true
+		case "replace":
+			replace = true
+		case "auth":
+			if i+1 >= len(args) {
+				return reply.MakeSyntaxErrReply()
+			}
+			password = string(args[i+1])
+			i++
+		case "keys":
+			if len(args[2]) > 0 {
+				return reply.MakeErrReply("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, key := range args[i+1:] {
+				keys = append(keys, string(key))
+			}
+			i = len(args)
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+
+	// 只迁移实际存在的 key
+	dbIndex := c.GetDBIndex()
+	db := database.dbSet[dbIndex]
+	database.RWLocks(dbIndex, nil, keys)
+	migrated, payloads, errReply := dumpKeys(db, keys)
+	database.RWUnLocks(dbIndex, nil, keys)
+	if errReply != nil {
+		return errReply
+	}
+	if len(migrated) == 0 {
+		return reply.MakeStatusReply("NOKEY")
+	}
+
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	conn, err := tlsutil.DialTimeout(addr, timeout, tlsutil.ClusterConfig())
+	if err != nil {
+		return reply.MakeErrReply("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+	target := &migrateConn{conn: conn, reader: bufio.NewReader(conn), timeout: timeout}
+	// 目标节点不负责 key 所在的槽位时回复 MOVED，而不是把 RESTORE-ASKING 转发回本节点，
+	// 单机和一致性哈希模式的节点不支持重定向，忽略它们的错误回复
+	if _, errReply := target.command(utils.ToCmdLine("CLIENT", "REDIRECT", "ON")); isIOErr(errReply) {
+		return errReply
+	}
+	if password != "" {
+		if _, errReply := target.command(utils.ToCmdLine("AUTH", password)); errReply != nil {
+			return errReply
+		}
+	}
+	if _, errReply := target.command(utils.ToCmdLine("SELECT", strconv.Itoa(destDB))); errReply != nil {
+		return errReply
+	}
+	for i, key := range migrated {
+		cmdLine := [][]byte{[]byte("RESTORE-ASKING"), []byte(key), []byte("0"), payloads[i]}
+		if replace {
+			cmdLine = append(cmdLine, []byte("REPLACE"))
+		}
+		if _, errReply := target.command(cmdLine); errReply != nil {
+			// 已经写入目标节点的 key 在本地删除，避免两边同时存在
+			if !copyKey && i > 0 {
+				database.removeUnchanged(dbIndex, migrated[:i], payloads[:i])
+			}
+			return errReply
+		}
+	}
+	if !copyKey {
+		database.removeUnchanged(dbIndex, migrated, payloads)
+	}
+	return reply.MakeOkReply()
+}
+
+// dumpKeys 序列化 keys 中存在的 key，调用方持有这些 key 的锁
+
+func dumpKeys(db *DB, keys []string) ([]string, [][]byte, resp.Reply) {
+	dumped := make([]string, 0, len(keys))
+	payloads := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		entity, exist := db.GetEntity(key)
+		if !exist {
+			continue
+		}
+		payload, err := rdb.DumpValue(entity.Data)
+		if err != nil {
+			return nil, nil, reply.MakeErrReply("ERR " + err.Error())
+		}
+		dumped = append(dumped, key)
+		payloads = append(payloads, payload)
+	}
+	return dumped, payloads, nil
+}
+
+// removeUnchanged 删除迁移完成的 key，DUMP 之后被修改或删除的 key 不做处理
+
+func (database *StandaloneDatabase) removeUnchanged(dbIndex int, keys []string, payloads [][]byte) {
+	db := database.dbSet[dbIndex]
+	database.RWLocks(dbIndex, keys, nil)
+	defer database.RWUnLocks(dbIndex, keys, nil)
+	removed := make([]string, 0, len(keys))
+	for i, key := range keys {
+		entity, exist := db.GetEntity(key)
+		if !exist {
+			continue
+		}
+		if payload, err := rdb.DumpValue(entity.Data); err != nil || !bytes.Equal(payload, payloads[i]) {
+			continue
+		}
+		removed = append(removed, key)
+	}
+	if len(removed) > 0 {
+		db.Removes(removed...)
+		db.addAof(utils.ToCmdLine(append([]string{"del"}, removed...)...))
+	}
+}
+
+// migrateConn 是 MIGRATE 与目标节点之间的连接，回复都是单行的状态或错误
+
+type migrateConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+// command 发送一条指令并读取回复，目标节点回复错误或通信失败时返回错误回复
+
+func (m *migrateConn) command(cmdLine CmdLine) (string, resp.Reply) {
+	_ = m.conn.SetDeadline(time.Now().Add(m.timeout))
+	if _, err := m.conn.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes()); err != nil {
+		return "", reply.MakeErrReply("IOERR error or timeout writing to target instance")
+	}
+	line, err := m.reader.ReadString('\n')
+	if err != nil {
+		return "", reply.MakeErrReply("IOERR error or timeout reading to target instance")
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return "", reply.MakeErrReply("ERR Target instance replied with error: " + line[1:])
+	}
+	return line, nil
+}
+
+// isIOErr 判断是否为与目标节点通信失败的错误
+
+func isIOErr(r resp.Reply) bool {
+	errReply, ok := r.(reply.ErrorReply)
+	return ok && strings.HasPrefix(errReply.Error(), "IOERR")
+}
+
+// execMigrateInMulti 是 MIGRATE 在指令表中的执行方法，指令表只用于校验参数个数和取出 key：
+// MIGRATE 需要在不持有锁的情况下与目标节点通信，由 StandaloneDatabase.Exec 直接处理，也不能在事务中入队
+
+func execMigrateInMulti(db *DB, args [][]byte) resp.Reply {
+	return reply.MakeErrReply("ERR MIGRATE is not allowed in transactions")
+}
+
+// migrateKeys 取出 MIGRATE 迁移的 key：第 3 个参数不为空时就是要迁移的 key，否则为 KEYS 之后的所有参数
+
+func migrateKeys(cmdLine CmdLine) []string {
+	keys := make([]string, 0)
+	if len(cmdLine) > 3 && len(cmdLine[3]) > 0 {
+		keys = append(keys, string(cmdLine[3]))
+	}
+	for i := 6; i < len(cmdLine); i++ {
+		switch strings.ToLower(string(cmdLine[i])) {
+		case "auth":
+			i++ // 跳过密码，密码可能恰好是 keys
+		case "keys":
+			for _, key := range cmdLine[i+1:] {
+				keys = append(keys, string(key))
+			}
+			return keys
+		}
+	}
+	return keys
+}
+
+func init() {
+	RegisterCommend("DUMP", execDump, 2, flagReadOnly).attachKeys(1, 1, 1)
+	RegisterCommend("RESTORE", execRestore, -4, flagWrite).attachKeys(1, 1, 1)
+	RegisterCommend("RESTORE-ASKING", execRestore, -4, flagWrite).attachKeys(1, 1, 1)
+	RegisterCommend("MIGRATE", execMigrateInMulti, -6, flagWrite).attachKeysFunc(migrateKeys)
+}
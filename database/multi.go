@@ -0,0 +1,244 @@
+package database
+
+import (
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+var queuedReply = reply.MakeStatusReply("QUEUED")
+
+// MULTI 开启事务，之后的指令入队，直到 EXEC 或 DISCARD
+
+func execMulti(c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 0 {
+		return reply.MakeArgNumErrReply("multi")
+	}
+	if c.InMultiState() {
+		return reply.MakeErrReply("ERR MULTI calls can not be nested")
+	}
+	c.SetMultiState(true)
+	return reply.MakeOkReply()
+}
+
+// DISCARD 放弃事务中已入队的指令
+
+func execDiscard(c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 0 {
+		return reply.MakeArgNumErrReply("discard")
+	}
+	if !c.InMultiState() {
+		return reply.MakeErrReply("ERR DISCARD without MULTI")
+	}
+	c.SetMultiState(false)
+	return reply.MakeOkReply()
+}
+
+// txDatabaseCommends 是事务中可以使用的数据库层指令及其参数个数（含义与 commend.arity 相同），
+// 它们不在 cmdTable 中，EXEC 时与其他指令一起按顺序执行，如 SELECT 切换之后的指令所在的子数据库
+var txDatabaseCommends = map[string]int{
+	"select":   2,
+	"info":     -1,
+	"role":     1,
+	"lastsave": 1,
+}
+
+// noMultiCommends 是不能在事务中执行的指令，如需要在不持有锁的情况下等待或进行网络通信的指令
+var noMultiCommends = map[string]struct{}{
+	"save": {}, "bgsave": {}, "bgrewriteaof": {}, "flushall": {},
+	"replicaof": {}, "slaveof": {}, "psync": {}, "replconf": {},
+	"hello": {}, "wait": {}, "migrate": {},
+}
+
+// EnqueueCmd 在事务中将指令入队，指令不存在或参数个数错误时记录错误，EXEC 时放弃整个事务
+// 不能在事务中执行的指令直接返回错误，不影响事务中的其他指令
+
+func EnqueueCmd(c resp.Connection, cmdLine [][]byte) resp.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	if _, ok := noMultiCommends[cmdName]; ok {
+		return reply.MakeErrReply("ERR Command not allowed inside a transaction")
+	}
+	if arity, ok := txDatabaseCommends[cmdName]; ok {
+		if !validateArity(arity, cmdLine) {
+			errReply := reply.MakeArgNumErrReply(cmdName)
+			c.AddTxError(errors.New(errReply.Error()))
+			return errReply
+		}
+		c.EnqueueCmd(cmdLine)
+		return queuedReply
+	}
+	if _, errReply := lookupCommend(cmdLine); errReply != nil {
+		c.AddTxError(errors.New(errReply.(reply.ErrorReply).Error()))
+		return errReply
+	}
+	c.EnqueueCmd(cmdLine)
+	return queuedReply
+}
+
+// IsTxDatabaseCommend 判断指令是否为事务中可以使用的数据库层指令，它们只能在接收事务的节点上执行
+
+func IsTxDatabaseCommend(cmdName string) bool {
+	_, ok := txDatabaseCommends[strings.ToLower(cmdName)]
+	return ok
+}
+
+// EXEC 原子地执行事务中已入队的指令
+
+func (database *StandaloneDatabase) execExec(c resp.Connection, args [][]byte) resp.Reply {
+	if len(args) != 0 {
+		return reply.MakeArgNumErrReply("exec")
+	}
+	if !c.InMultiState() {
+		return reply.MakeErrReply("ERR EXEC without MULTI")
+	}
+	cmdLines := c.GetQueuedCmdLine()
+	txErrors := c.GetTxErrors()
+	c.SetMultiState(false)
+	if len(txErrors) > 0 {
+		return reply.MakeErrReply("EXECABORT Transaction discarded because of previous errors.")
+	}
+	return database.ExecMulti(c, cmdLines)
+}
+
+// ExecMulti 对所有指令涉及的 key 加锁后依次执行，执行期间其他指令不能访问这些 key
+// 事务中的 SELECT 会改变之后的指令所在的子数据库，因此按子数据库分别收集 key，并按子数据库的编号依次加锁
+// 与 Redis 相同，某条指令执行出错不会撤销其他指令
+
+func (database *StandaloneDatabase) ExecMulti(c resp.Connection, cmdLines []CmdLine) resp.Reply {
+	if errReply := database.checkWritable(cmdLines); errReply != nil {
+		return errReply
+	}
+	database.writeMu.RLock()
+	defer database.writeMu.RUnlock()
+	writeKeys := make([][]string, len(database.dbSet))
+	readKeys := make([][]string, len(database.dbSet))
+	dbIndex := c.GetDBIndex()
+	for _, cmdLine := range cmdLines {
+		cmdName := strings.ToLower(string(cmdLine[0]))
+		if cmdName == "select" {
+			if index, err := strconv.Atoi(string(cmdLine[1])); err == nil && index >= 0 && index < len(database.dbSet) {
+				dbIndex = index
+			}
+			continue
+		}
+		if IsTxDatabaseCommend(cmdName) {
+			continue
+		}
+		cmd, errReply := lookupCommend(cmdLine)
+		if errReply != nil {
+			return reply.MakeErrReply("EXECABORT Transaction discarded because of: " + errReply.(reply.ErrorReply).Error())
+		}
+		w, r := cmd.relatedKeys(cmdLine)
+		writeKeys[dbIndex] = append(writeKeys[dbIndex], w...)
+		readKeys[dbIndex] = append(readKeys[dbIndex], r...)
+	}
+	for i, db := range database.dbSet {
+		db.RWLocks(writeKeys[i], readKeys[i])
+	}
+	defer func() {
+		for i := len(database.dbSet) - 1; i >= 0; i-- {
+			database.dbSet[i].RWUnLocks(writeKeys[i], readKeys[i])
+		}
+	}()
+	results := make([]resp.Reply, len(cmdLines))
+	for i, cmdLine := range cmdLines {
+		if IsTxDatabaseCommend(string(cmdLine[0])) {
+			results[i] = database.execTxDatabaseCommend(c, cmdLine)
+			continue
+		}
+		results[i] = database.dbSet[c.GetDBIndex()].execWithLock(cmdLine)
+	}
+	return reply.MakeMultiRawReply(results)
+}
+
+// execTxDatabaseCommend 在事务中执行 txDatabaseCommends 中的指令
+
+func (database *StandaloneDatabase) execTxDatabaseCommend(c resp.Connection, cmdLine CmdLine) resp.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	switch cmdName {
+	case "select":
+		return execSelect(c, database, cmdLine[1:])
+	case "info":
+		if len(cmdLine) > 2 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return database.execInfo(cmdLine[1:])
+	case "role":
+		return database.execRole()
+	case "lastsave":
+		return reply.MakeIntReply(database.lastSave.Load())
+	}
+	return reply.MakeErrReply("ERR unknown command '" + cmdName + "'")
+}
+
+// checkWritable 在只读的从节点或健康的从节点数量不足时拒绝包含写指令的事务
+
+func (database *StandaloneDatabase) checkWritable(cmdLines []CmdLine) resp.Reply {
+	if database.repl == nil {
+		return nil
+	}
+	for _, cmdLine := range cmdLines {
+		if !isWriteCommend(string(cmdLine[0])) {
+			continue
+		}
+		if database.repl.isReadOnlyReplica() {
+			return reply.MakeErrReply("READONLY You can't write against a read only replica.")
+		}
+		if !database.repl.hasEnoughGoodReplicas() {
+			return reply.MakeErrReply("NOREPLICAS Not enough good replicas to write.")
+		}
+	}
+	return nil
+}
+
+// ExecWithLock 执行指令，调用方已经通过 RWLocks 对指令涉及的 key 加锁，用于集群事务的提交和回滚
+// RWLocks 已经持有 writeMu 的读锁，这里不再加锁，否则全量同步等待 writeMu 时会与持有 key 锁的调用方互相等待
+
+func (database *StandaloneDatabase) ExecWithLock(c resp.Connection, cmdLine CmdLine) resp.Reply {
+	if errReply := database.checkWritable([]CmdLine{cmdLine}); errReply != nil {
+		return errReply
+	}
+	return database.dbSet[c.GetDBIndex()].execWithLock(cmdLine)
+}
+
+// RWLocks 与 Exec、ExecMulti 的加锁顺序相同：先持有 writeMu 的读锁再对 key 加锁，直到 RWUnLocks 才释放
+
+func (database *StandaloneDatabase) RWLocks(dbIndex int, writeKeys []string, readKeys []string) {
+	database.writeMu.RLock()
+	database.dbSet[dbIndex].RWLocks(writeKeys, readKeys)
+}
+
+func (database *StandaloneDatabase) RWUnLocks(dbIndex int, writeKeys []string, readKeys []string) {
+	database.dbSet[dbIndex].RWUnLocks(writeKeys, readKeys)
+	database.writeMu.RUnlock()
+}
+
+// GetUndoLogs 返回将 keys 恢复到当前状态的指令：存在的 key 用 RESTORE 恢复原值，不存在的 key 删除
+// 调用方需持有这些 key 的锁
+
+func (database *StandaloneDatabase) GetUndoLogs(dbIndex int, keys []string) []CmdLine {
+	db := database.dbSet[dbIndex]
+	undoLogs := make([]CmdLine, 0, len(keys))
+	for _, key := range keys {
+		r := execDump(db, [][]byte{[]byte(key)})
+		bulk, ok := r.(*reply.BulkReply)
+		if !ok || bulk.Arg == nil {
+			undoLogs = append(undoLogs, CmdLine{[]byte("DEL"), []byte(key)})
+			continue
+		}
+		undoLogs = append(undoLogs, CmdLine{[]byte("RESTORE"), []byte(key), []byte("0"), bulk.Arg, []byte("REPLACE")})
+	}
+	return undoLogs
+}
+
+// isTxCommend 判断指令是否用于控制事务本身
+
+func isTxCommend(cmdName string) bool {
+	switch strings.ToLower(cmdName) {
+	case "multi", "exec", "discard":
+		return true
+	}
+	return false
+}
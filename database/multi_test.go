@@ -0,0 +1,110 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"testing"
+)
+
+func makeTestDatabase() *StandaloneDatabase {
+	database := NewBasicStandaloneDatabase()
+	database.repl = makeReplication()
+	return database
+}
+
+// execAll 依次执行指令，返回最后一条指令的回复
+func execAll(database *StandaloneDatabase, c resp.Connection, cmdLines ...[]string) resp.Reply {
+	var r resp.Reply
+	for _, cmdLine := range cmdLines {
+		r = database.Exec(c, utils.ToCmdLine(cmdLine...))
+	}
+	return r
+}
+
+func assertReply(t *testing.T, r resp.Reply, expected string) {
+	t.Helper()
+	if string(r.ToBytes()) != expected {
+		t.Errorf("got %q, expected %q", r.ToBytes(), expected)
+	}
+}
+
+func TestMultiSelect(t *testing.T) {
+	database := makeTestDatabase()
+	c := connection.NewFakeConn()
+	r := execAll(database, c,
+		[]string{"MULTI"},
+		[]string{"SET", "k", "0"},
+		[]string{"SELECT", "1"},
+		[]string{"SET", "k", "1"},
+		[]string{"GET", "k"},
+		[]string{"EXEC"},
+	)
+	assertReply(t, r, "*4\r\n+OK\r\n+OK\r\n+OK\r\n$1\r\n1\r\n")
+	// SELECT 在事务结束后仍然有效
+	if c.GetDBIndex() != 1 {
+		t.Errorf("db index is %d after EXEC", c.GetDBIndex())
+	}
+	assertReply(t, execAll(database, c, []string{"SELECT", "0"}, []string{"GET", "k"}), "$1\r\n0\r\n")
+
+	// 编号超出范围的 SELECT 在 EXEC 时返回错误，之后的指令仍在原来的子数据库中执行
+	r = execAll(database, c,
+		[]string{"MULTI"},
+		[]string{"SELECT", "100"},
+		[]string{"GET", "k"},
+		[]string{"EXEC"},
+	)
+	assertReply(t, r, "*2\r\n-ERR DB index is out of range\r\n$1\r\n0\r\n")
+}
+
+func TestMultiDatabaseCommends(t *testing.T) {
+	database := makeTestDatabase()
+	c := connection.NewFakeConn()
+	execAll(database, c, []string{"MULTI"})
+	for _, cmdLine := range [][]string{{"PING"}, {"INFO", "replication"}, {"ROLE"}, {"LASTSAVE"}} {
+		assertReply(t, execAll(database, c, cmdLine), "+QUEUED\r\n")
+	}
+	r, ok := execAll(database, c, []string{"EXEC"}).(*reply.MultiRawReply)
+	if !ok || len(r.Replies) != 4 {
+		t.Fatalf("unexpected EXEC reply %q", r.ToBytes())
+	}
+	for i, result := range r.Replies {
+		if reply.IsErrorReply(result) {
+			t.Errorf("command %d failed: %q", i, result.ToBytes())
+		}
+	}
+}
+
+func TestMultiNotAllowed(t *testing.T) {
+	database := makeTestDatabase()
+	c := connection.NewFakeConn()
+	execAll(database, c, []string{"MULTI"}, []string{"SET", "k", "v"})
+	// 不能在事务中执行的指令返回错误，但不会导致事务被放弃
+	for _, cmdLine := range [][]string{{"WAIT", "0", "0"}, {"HELLO"}, {"SAVE"}, {"FLUSHALL"},
+		{"MIGRATE", "127.0.0.1", "6379", "k", "0", "1000"}} {
+		assertReply(t, execAll(database, c, cmdLine), "-ERR Command not allowed inside a transaction\r\n")
+	}
+	assertReply(t, execAll(database, c, []string{"EXEC"}), "*1\r\n+OK\r\n")
+}
+
+func TestMultiAbort(t *testing.T) {
+	database := makeTestDatabase()
+	c := connection.NewFakeConn()
+	tests := [][]string{
+		{"NOSUCHCOMMAND"},
+		{"SELECT"},
+		{"SELECT", "1", "2"},
+		{"ROLE", "x"},
+		{"GET"},
+	}
+	for _, cmdLine := range tests {
+		execAll(database, c, []string{"MULTI"}, []string{"SET", "k", "v"})
+		if r := execAll(database, c, cmdLine); !reply.IsErrorReply(r) {
+			t.Errorf("%q: expected error, got %q", cmdLine, r.ToBytes())
+		}
+		assertReply(t, execAll(database, c, []string{"EXEC"}),
+			"-EXECABORT Transaction discarded because of previous errors.\r\n")
+	}
+	assertReply(t, execAll(database, c, []string{"EXISTS", "k"}), ":0\r\n")
+}
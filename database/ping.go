@@ -11,5 +11,5 @@ func Ping(db *DB, args [][]byte) resp.Reply {
 
 // 程序启动时将 ping 方法注册到全局方法表中
 func init() {
-	RegisterCommend("ping", Ping, 1)
+	RegisterCommend("ping", Ping, 1, flagReadOnly)
 }
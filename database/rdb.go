@@ -0,0 +1,164 @@
+package database
+
+import (
+	"go-redis/config"
+	databaseface "go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/rdb"
+	"go-redis/resp/reply"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var errSaveInProgress = reply.MakeErrReply("ERR Background save already in progress")
+
+// SAVE 同步保存 RDB，保存期间阻塞当前客户端
+
+func execSave(database *StandaloneDatabase) resp.Reply {
+	if err := database.saveRDB(); err != nil {
+		if err == errSaveInProgress {
+			return errSaveInProgress
+		}
+		logger.Error("save rdb failed: " + err.Error())
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeOkReply()
+}
+
+// BGSAVE 在后台协程中保存 RDB，立即返回
+
+func execBgSave(database *StandaloneDatabase) resp.Reply {
+	if database.saving.Load() {
+		return errSaveInProgress
+	}
+	go func() {
+		if err := database.saveRDB(); err != nil && err != errSaveInProgress {
+			logger.Error("background save rdb failed: " + err.Error())
+		}
+	}()
+	return reply.MakeStatusReply("Background saving started")
+}
+
+// BGREWRITEAOF 在后台协程中重写 aof 文件
+
+func execBgRewriteAof(database *StandaloneDatabase) resp.Reply {
+	if database.aofHandler == nil {
+		return reply.MakeErrReply("ERR Append only file is disabled")
+	}
+	go func() {
+		if err := database.aofHandler.Rewrite(); err != nil {
+			logger.Error("background aof rewrite failed: " + err.Error())
+		}
+	}()
+	return reply.MakeStatusReply("Background append only file rewriting started")
+}
+
+// saveRDB 将所有子数据库的快照写入临时文件，写入成功后再重命名为目标文件，保证 RDB 文件总是完整的
+
+func (database *StandaloneDatabase) saveRDB() error {
+	if !database.saving.CompareAndSwap(false, true) {
+		return errSaveInProgress
+	}
+	defer database.saving.Store(false)
+
+	start := time.Now()
+	dirtyBefore := database.dirty.Load() // 保存期间发生的写操作不一定进入了快照，只扣除保存开始前的次数
+	filename := config.Properties.RDBFilename()
+	tmpFile, err := os.CreateTemp(filepath.Dir(filename), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name()) // 重命名成功后该文件已不存在，忽略错误
+	}()
+	err = rdb.Dump(tmpFile, database, nil)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), filename); err != nil {
+		return err
+	}
+	database.dirty.Add(-dirtyBefore)
+	database.lastSave.Store(time.Now().Unix())
+	logger.Info("DB saved on disk in " + time.Since(start).String())
+	return nil
+}
+
+// loadRDB 在启动时从 RDB 文件中恢复数据，文件不存在时直接跳过
+
+func (database *StandaloneDatabase) loadRDB(filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error(err)
+		}
+		return
+	}
+	defer file.Close()
+	start := time.Now()
+	count, err := database.loadRDBFrom(file)
+	if err != nil {
+		logger.Error("load rdb failed: " + err.Error())
+		return
+	}
+	logger.Info("DB loaded from disk: " + strconv.Itoa(count) + " keys in " + time.Since(start).String())
+}
+
+// loadRDBFrom 将 reader 中的 RDB 数据加载到各个子数据库中，返回加载的 key 数量
+
+func (database *StandaloneDatabase) loadRDBFrom(reader io.Reader) (int, error) {
+	count := 0
+	now := time.Now().UnixMilli()
+	err := rdb.NewDecoder(reader).Parse(func(o *rdb.Object) bool {
+		if o.DB >= len(database.dbSet) {
+			logger.Warn("rdb: db index " + strconv.Itoa(o.DB) + " out of range, key " + o.Key + " skipped")
+			return true
+		}
+		if o.ExpireAt > 0 && o.ExpireAt <= now { // 已经过期的 key 不再加载
+			return true
+		}
+		database.dbSet[o.DB].PutEntity(o.Key, &databaseface.DataEntity{Data: o.Value})
+		count++
+		return true
+	})
+	return count, err
+}
+
+// serverCron 每秒检查一次自动保存规则，满足任意一条规则时触发后台保存
+
+func (database *StandaloneDatabase) serverCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-database.closeChan:
+			return
+		case <-ticker.C:
+		}
+		database.replicationCron()
+		if len(database.savePoints) == 0 || database.saving.Load() {
+			continue
+		}
+		dirty := database.dirty.Load()
+		elapsed := time.Now().Unix() - database.lastSave.Load()
+		for _, sp := range database.savePoints {
+			if dirty >= sp.Changes && elapsed >= sp.Seconds {
+				logger.Info(strconv.FormatInt(sp.Changes, 10) + " changes in " +
+					strconv.FormatInt(sp.Seconds, 10) + " seconds. Saving...")
+				execBgSave(database)
+				break
+			}
+		}
+	}
+}
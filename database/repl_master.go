@@ -0,0 +1,403 @@
+package database
+
+import (
+	"bytes"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/rdb"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"time"
+)
+
+/* ---- replication backlog ---- */
+
+// replBacklog 是一个环形缓冲区，保存复制流中最近的一段数据，从节点短暂断线重连后可以从中续传，无需全量同步
+// 偏移量从 1 开始计数，offset 为已写入复制流的总字节数
+
+type replBacklog struct {
+	buf     []byte
+	idx     int   // 下一个写入位置
+	histLen int   // 缓冲区中有效数据的长度
+	offset  int64 // 复制流的总字节数，即 master_repl_offset
+}
+
+func makeReplBacklog(size int) *replBacklog {
+	return &replBacklog{
+		buf: make([]byte, size),
+	}
+}
+
+func (b *replBacklog) write(p []byte) {
+	b.offset += int64(len(p))
+	size := len(b.buf)
+	if len(p) >= size { // 数据比缓冲区还大，只保留末尾的部分
+		copy(b.buf, p[len(p)-size:])
+		b.idx = 0
+		b.histLen = size
+		return
+	}
+	n := copy(b.buf[b.idx:], p)
+	if n < len(p) {
+		copy(b.buf, p[n:])
+	}
+	b.idx = (b.idx + len(p)) % size
+	b.histLen += len(p)
+	if b.histLen > size {
+		b.histLen = size
+	}
+}
+
+// readFrom 返回从 offset（包含）开始到末尾的数据，offset 已不在缓冲区中时返回 false
+
+func (b *replBacklog) readFrom(offset int64) ([]byte, bool) {
+	first := b.offset - int64(b.histLen) + 1
+	if offset < first || offset > b.offset+1 {
+		return nil, false
+	}
+	n := int(b.offset - offset + 1)
+	out := make([]byte, n)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	k := copy(out, b.buf[start:])
+	if k < n {
+		copy(out[k:], b.buf[:n-k])
+	}
+	return out, true
+}
+
+// reset 清空缓冲区，并将偏移量设置为 offset，从节点全量同步后调用
+
+func (b *replBacklog) reset(offset int64) {
+	b.idx = 0
+	b.histLen = 0
+	b.offset = offset
+}
+
+/* ---- replica ---- */
+
+// 主节点眼中从节点的状态
+const (
+	replicaStateHandshake  = iota // 已发送 REPLCONF，尚未发送 PSYNC
+	replicaStateWaitBgsave        // 正在进行全量同步
+	replicaStateOnline            // 正在接收指令流
+)
+
+// 从节点发送队列的长度，从节点消费过慢导致队列堆满时断开该从节点，让它之后重新同步
+const replicaSendQueueSize = 1 << 14
+
+// replica 是主节点上记录的一个从节点
+
+type replica struct {
+	conn          resp.Connection
+	listeningPort int
+	state         int
+	ackOffset     int64
+	ackTime       time.Time
+	sendChan      chan []byte // 由独立的协程写入连接，避免慢速的从节点阻塞主节点的写操作
+}
+
+func (r *replica) ip() string {
+	if addr, ok := r.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+func (r *replica) handleSend() {
+	for data := range r.sendChan {
+		if err := r.conn.Write(data); err != nil {
+			_ = r.conn.Close() // 关闭后连接的处理协程会调用 AfterClientClose 移除该从节点，这里继续消费直到 sendChan 被关闭
+		}
+	}
+}
+
+// enqueue 将数据放入发送队列，队列已满时断开从节点
+
+func (r *replica) enqueue(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	select {
+	case r.sendChan <- data:
+	default:
+		logger.Warn("replica " + r.ip() + ":" + strconv.Itoa(r.listeningPort) + " send queue overflow, closing link")
+		go func() {
+			_ = r.conn.Close()
+		}()
+	}
+}
+
+// getOrMakeReplica 获取连接对应的从节点记录，不存在时新建，调用方需持有 repl.mu
+
+func (repl *replication) getOrMakeReplica(c resp.Connection) *replica {
+	r, ok := repl.replicas[c]
+	if !ok {
+		r = &replica{
+			conn:     c,
+			state:    replicaStateHandshake,
+			ackTime:  time.Now(),
+			sendChan: make(chan []byte, replicaSendQueueSize),
+		}
+		repl.replicas[c] = r
+		go r.handleSend()
+	}
+	return r
+}
+
+// removeReplica 在从节点断开连接时移除其记录
+
+func (repl *replication) removeReplica(c resp.Connection) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	r, ok := repl.replicas[c]
+	if !ok {
+		return
+	}
+	delete(repl.replicas, c)
+	close(r.sendChan)
+	logger.Info("replica " + r.ip() + ":" + strconv.Itoa(r.listeningPort) + " lost")
+}
+
+// disconnectReplicas 断开所有从节点，调用方需持有 repl.mu
+// 节点改为复制另一个主节点时，它的复制流发生了变化，从节点需要重新同步
+
+func (repl *replication) disconnectReplicas() {
+	for _, r := range repl.replicas {
+		conn := r.conn
+		go func() {
+			_ = conn.Close()
+		}()
+	}
+}
+
+/* ---- feed ---- */
+
+// feedCommand 将主节点执行的写指令写入复制流，由子数据库的 addAof 调用
+
+func (repl *replication) feedCommand(dbIndex int, cmdLine CmdLine) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.role != roleMaster { // 从节点的复制流直接来自主节点，见 feedRaw
+		return
+	}
+	repl.feedCommandLocked(dbIndex, cmdLine)
+}
+
+// feedCommandLocked 同 feedCommand，dbIndex 为 -1 时表示该指令与子数据库无关（如 PING），调用方需持有 repl.mu
+
+func (repl *replication) feedCommandLocked(dbIndex int, cmdLine CmdLine) {
+	if dbIndex >= 0 && dbIndex != repl.streamDB {
+		repl.feedRawLocked(reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", strconv.Itoa(dbIndex))).ToBytes())
+		repl.streamDB = dbIndex
+	}
+	repl.feedRawLocked(reply.MakeMultiBulkReply(cmdLine).ToBytes())
+}
+
+// feedRawLocked 将一段复制流写入积压缓冲区，并发送给所有在线的从节点，调用方需持有 repl.mu
+
+func (repl *replication) feedRawLocked(data []byte) {
+	repl.backlog.write(data)
+	for _, r := range repl.replicas {
+		if r.state == replicaStateOnline {
+			r.enqueue(data)
+		}
+	}
+}
+
+/* ---- psync ---- */
+
+// execPSync 实现 PSYNC replid offset
+// 能够从积压缓冲区续传时回复 +CONTINUE 并发送缺失的数据，否则回复 +FULLRESYNC 并发送 RDB 快照，
+// 快照之后的指令从积压缓冲区中补发
+
+func (database *StandaloneDatabase) execPSync(c resp.Connection, args [][]byte) resp.Reply {
+	repl := database.repl
+	replId := string(args[0])
+	psyncOffset, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	c.SetSlave()
+
+	// 暂停写操作，直到取得快照：快照中的数据恰好是偏移量 offset 之前的写操作的结果，
+	// 从节点加载快照后从 offset+1 开始接收指令，不会重复执行快照中已经包含的写操作
+	database.writeMu.Lock()
+	repl.mu.Lock()
+	if repl.role == roleSlave && repl.linkState != linkStateConnected {
+		repl.mu.Unlock()
+		database.writeMu.Unlock()
+		return reply.MakeErrReply("NOMASTERLINK Can't SYNC while not connected with my master")
+	}
+	if repl.tryPartialSyncLocked(c, replId, psyncOffset) {
+		repl.mu.Unlock()
+		database.writeMu.Unlock()
+		return &reply.NoReply{}
+	}
+	r := repl.getOrMakeReplica(c)
+	r.state = replicaStateWaitBgsave
+	repl.streamDB = -1 // 从节点从 0 号子数据库开始接收指令流，之后的第一条指令前必须写入 SELECT
+	replId, offset := repl.replId, repl.backlog.offset
+	repl.mu.Unlock()
+	snapshot := rdb.TakeSnapshot(database)
+	database.writeMu.Unlock()
+
+	logger.Info("replica " + r.ip() + ":" + strconv.Itoa(r.listeningPort) + " asks for synchronization, starting full resync")
+	if err := c.Write([]byte("+FULLRESYNC " + replId + " " + strconv.FormatInt(offset, 10) + reply.CRLF)); err != nil {
+		return &reply.NoReply{}
+	}
+	var buf bytes.Buffer
+	if err := snapshot.Dump(&buf, nil); err != nil {
+		logger.Error("full resync: dump rdb failed: " + err.Error())
+		_ = c.Close()
+		return &reply.NoReply{}
+	}
+	if err := c.Write([]byte("$" + strconv.Itoa(buf.Len()) + reply.CRLF)); err != nil {
+		return &reply.NoReply{}
+	}
+	if err := c.Write(buf.Bytes()); err != nil {
+		return &reply.NoReply{}
+	}
+
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if _, ok := repl.replicas[c]; !ok { // 传输期间从节点断开了
+		return &reply.NoReply{}
+	}
+	data, ok := repl.backlog.readFrom(offset + 1)
+	if !ok {
+		logger.Warn("full resync: backlog overflowed during transfer, closing replica link")
+		_ = c.Close()
+		return &reply.NoReply{}
+	}
+	r.state = replicaStateOnline
+	r.enqueue(data)
+	logger.Info("synchronization with replica " + r.ip() + ":" + strconv.Itoa(r.listeningPort) + " succeeded")
+	return &reply.NoReply{}
+}
+
+// tryPartialSyncLocked 尝试部分重同步，调用方需持有 repl.mu
+// +CONTINUE 和缺失的数据都放入从节点的发送队列，由发送协程按顺序写入连接，持有锁期间不做网络写操作
+
+func (repl *replication) tryPartialSyncLocked(c resp.Connection, replId string, psyncOffset int64) bool {
+	if replId != repl.replId && (replId != repl.replId2 || psyncOffset > repl.secondReplOffset) {
+		return false
+	}
+	data, ok := repl.backlog.readFrom(psyncOffset)
+	if !ok {
+		return false
+	}
+	r := repl.getOrMakeReplica(c)
+	r.state = replicaStateOnline
+	r.enqueue([]byte("+CONTINUE " + repl.replId + reply.CRLF))
+	r.enqueue(data)
+	logger.Info("partial resynchronization accepted, sending " + strconv.Itoa(len(data)) + " bytes of backlog")
+	return true
+}
+
+/* ---- ack ---- */
+
+// ack 记录从节点通过 REPLCONF ACK 上报的偏移量，并唤醒等待中的 WAIT
+
+func (repl *replication) ack(c resp.Connection, offset int64) {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	r, ok := repl.replicas[c]
+	if !ok {
+		return
+	}
+	if offset > r.ackOffset {
+		r.ackOffset = offset
+	}
+	r.ackTime = time.Now()
+	close(repl.ackNotify)
+	repl.ackNotify = make(chan struct{})
+}
+
+// countAckedLocked 返回已确认收到 offset 之前全部复制流的在线从节点数量，调用方需持有 repl.mu
+
+func (repl *replication) countAckedLocked(offset int64) int {
+	count := 0
+	for _, r := range repl.replicas {
+		if r.state == replicaStateOnline && r.ackOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// hasEnoughGoodReplicas 检查 min-replicas-to-write 限制，延迟不超过 min-replicas-max-lag 秒的在线从节点才算健康
+
+func (repl *replication) hasEnoughGoodReplicas() bool {
+	minReplicas, maxLag := config.Properties.MinReplicasToWrite, config.Properties.MinReplicasMaxLag
+	if minReplicas <= 0 || maxLag <= 0 {
+		return true
+	}
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.role != roleMaster {
+		return true
+	}
+	good := 0
+	for _, r := range repl.replicas {
+		if r.state == replicaStateOnline && time.Since(r.ackTime) <= time.Duration(maxLag)*time.Second {
+			good++
+		}
+	}
+	return good >= minReplicas
+}
+
+// execWait 实现 WAIT numreplicas timeout
+// 阻塞客户端，直到至少 numreplicas 个从节点确认收到了当前为止的全部复制流，或者超时（timeout 为 0 时一直等待），
+// 返回已确认的从节点数量
+
+func (database *StandaloneDatabase) execWait(args [][]byte) resp.Reply {
+	numReplicas, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return reply.MakeErrReply("ERR timeout is negative")
+	}
+	repl := database.repl
+	repl.mu.Lock()
+	if repl.role == roleSlave {
+		repl.mu.Unlock()
+		return reply.MakeErrReply("ERR WAIT cannot be used with replica instances")
+	}
+	target := repl.backlog.offset
+	if len(repl.replicas) > 0 && repl.countAckedLocked(target) < numReplicas {
+		// 让从节点立即上报偏移量，而不是等待下一次定期的 ACK
+		repl.feedCommandLocked(-1, utils.ToCmdLine("REPLCONF", "GETACK", "*"))
+	}
+	repl.mu.Unlock()
+
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer t.Stop()
+		timer = t.C
+	}
+	for {
+		repl.mu.Lock()
+		acked := repl.countAckedLocked(target)
+		notify := repl.ackNotify
+		repl.mu.Unlock()
+		if acked >= numReplicas {
+			return reply.MakeIntReply(int64(acked))
+		}
+		select {
+		case <-notify:
+		case <-timer:
+			return reply.MakeIntReply(int64(acked))
+		case <-database.closeChan:
+			return reply.MakeIntReply(int64(acked))
+		}
+	}
+}
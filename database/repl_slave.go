@@ -0,0 +1,360 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"go-redis/config"
+	"go-redis/lib/logger"
+	"go-redis/lib/tlsutil"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// startReplication 开始复制 host:port，已经在复制该主节点时返回 false
+
+func (database *StandaloneDatabase) startReplication(host string, port int) bool {
+	repl := database.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.role == roleSlave && repl.masterHost == host && repl.masterPort == port {
+		return false
+	}
+	repl.stopLinkLocked()
+	if repl.role == roleMaster {
+		// 之前作为主节点时的 replid 与偏移量保留下来，若新的主节点恰好是之前的从节点晋升而来，可以直接续传
+		repl.disconnectReplicas()
+	}
+	repl.role = roleSlave
+	repl.masterHost = host
+	repl.masterPort = port
+	repl.linkState = linkStateConnect
+	version := repl.linkVersion
+	logger.Info("connecting to master " + host + ":" + strconv.Itoa(port))
+	go database.replicationLoop(version)
+	return true
+}
+
+// becomeMaster 实现 REPLICAOF NO ONE：断开与主节点的连接并晋升为主节点
+// 旧的复制流 id 保存为 replId2，其他跟随同一个旧主节点的从节点改为复制本节点时仍然可以部分重同步
+
+func (repl *replication) becomeMaster() {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.role == roleMaster {
+		return
+	}
+	repl.stopLinkLocked()
+	repl.role = roleMaster
+	repl.replId2 = repl.replId
+	repl.secondReplOffset = repl.backlog.offset + 1
+	repl.replId = utils.RandHexString(replIdLen)
+	repl.streamDB = -1
+	repl.masterHost = ""
+	repl.masterPort = 0
+	repl.disconnectReplicas() // 级联的从节点重新连接后通过 replId2 续传
+	logger.Info("MASTER MODE enabled, new replication id " + repl.replId)
+}
+
+// stopLinkLocked 让正在运行的同步协程退出，调用方需持有 repl.mu
+
+func (repl *replication) stopLinkLocked() {
+	repl.linkVersion++
+	if repl.masterConn != nil {
+		_ = repl.masterConn.Close()
+		repl.masterConn = nil
+	}
+}
+
+func (repl *replication) isLinkActive(version int) bool {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	return repl.linkVersion == version
+}
+
+// replicationLoop 持续与主节点保持同步，连接断开后每秒重试一次，直到执行了新的 REPLICAOF
+
+func (database *StandaloneDatabase) replicationLoop(version int) {
+	for database.repl.isLinkActive(version) {
+		err := database.syncWithMaster(version)
+		if !database.repl.isLinkActive(version) {
+			return
+		}
+		if err != nil {
+			logger.Error("replication: " + err.Error())
+		}
+		database.repl.mu.Lock()
+		if database.repl.linkVersion == version {
+			database.repl.linkState = linkStateConnect
+		}
+		database.repl.mu.Unlock()
+		time.Sleep(time.Second)
+	}
+}
+
+// deadlineReader 在每次读取前刷新读超时，主节点长时间没有数据（包括定期的 PING）时判定连接已断开
+
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	_ = r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+// masterLink 封装了与主节点之间的一条复制连接
+
+type masterLink struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (link *masterLink) sendCommand(args ...string) error {
+	_, err := link.conn.Write(reply.MakeMultiBulkReply(utils.ToCmdLine(args...)).ToBytes())
+	return err
+}
+
+func (link *masterLink) readLine() (string, error) {
+	line, err := link.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// command 发送一条指令并读取单行回复，回复为错误时返回 error
+func (link *masterLink) command(args ...string) (string, error) {
+	if err := link.sendCommand(args...); err != nil {
+		return "", err
+	}
+	line, err := link.readLine()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(line, "-") {
+		return "", errors.New(args[0] + " failed: " + line[1:])
+	}
+	return line, nil
+}
+
+// syncWithMaster 完成一次与主节点的握手、同步，然后持续接收指令流，直到连接断开
+
+func (database *StandaloneDatabase) syncWithMaster(version int) error {
+	repl := database.repl
+	repl.mu.Lock()
+	addr := net.JoinHostPort(repl.masterHost, strconv.Itoa(repl.masterPort))
+	repl.mu.Unlock()
+	conn, err := tlsutil.DialTimeout(addr, replTimeout(), tlsutil.ReplicationConfig())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	repl.mu.Lock()
+	if repl.linkVersion != version {
+		repl.mu.Unlock()
+		return nil
+	}
+	repl.masterConn = conn
+	repl.linkState = linkStateConnecting
+	replId, offset := repl.replId, repl.backlog.offset
+	repl.mu.Unlock()
+
+	link := &masterLink{
+		conn:   conn,
+		reader: bufio.NewReader(&deadlineReader{conn: conn, timeout: replTimeout()}),
+	}
+	// 1. 握手
+	if _, err := link.command("PING"); err != nil {
+		return err
+	}
+	if config.Properties.MasterAuth != "" {
+		if _, err := link.command("AUTH", config.Properties.MasterAuth); err != nil {
+			return err
+		}
+	}
+	if _, err := link.command("REPLCONF", "listening-port", strconv.Itoa(config.Properties.Port)); err != nil {
+		return err
+	}
+	if _, err := link.command("REPLCONF", "capa", "psync2"); err != nil {
+		return err
+	}
+
+	// 2. 先尝试从自己的偏移量续传，主节点无法续传时会进行全量同步
+	line, err := link.command("PSYNC", replId, strconv.FormatInt(offset+1, 10))
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(line, "+FULLRESYNC"):
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return errors.New("invalid FULLRESYNC reply: " + line)
+		}
+		masterOffset, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return errors.New("invalid FULLRESYNC reply: " + line)
+		}
+		if err := database.fullSync(link, version, fields[1], masterOffset); err != nil {
+			return err
+		}
+	case strings.HasPrefix(line, "+CONTINUE"):
+		fields := strings.Fields(line)
+		repl.mu.Lock()
+		if len(fields) == 2 && fields[1] != repl.replId { // 主节点发生过切换，复制流换了 id
+			repl.replId2 = repl.replId
+			repl.secondReplOffset = repl.backlog.offset + 1
+			repl.replId = fields[1]
+		}
+		if repl.masterFake == nil {
+			repl.masterFake = newMasterFakeConn()
+		}
+		repl.mu.Unlock()
+		logger.Info("successful partial resynchronization with master " + addr)
+	default:
+		return errors.New("unexpected PSYNC reply: " + line)
+	}
+
+	repl.mu.Lock()
+	if repl.linkVersion != version {
+		repl.mu.Unlock()
+		return nil
+	}
+	repl.linkState = linkStateConnected
+	repl.mu.Unlock()
+	// 3. 接收指令流
+	return database.receiveCommands(link, version)
+}
+
+func newMasterFakeConn() *connection.Connection {
+	c := connection.NewFakeConn()
+	c.SetMaster()
+	return c
+}
+
+// fullSync 接收主节点发来的 RDB 并替换本地的全部数据
+
+func (database *StandaloneDatabase) fullSync(link *masterLink, version int, replId string, offset int64) error {
+	repl := database.repl
+	repl.mu.Lock()
+	repl.linkState = linkStateSync
+	repl.mu.Unlock()
+
+	// 主节点生成 RDB 期间可能会发送换行符保活
+	var header string
+	for header == "" {
+		line, err := link.readLine()
+		if err != nil {
+			return err
+		}
+		header = line
+	}
+	if header[0] != '$' {
+		return errors.New("invalid RDB transfer header: " + header)
+	}
+	size, err := strconv.ParseInt(header[1:], 10, 64)
+	if err != nil || size < 0 {
+		return errors.New("invalid RDB transfer header: " + header)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(link.reader, data); err != nil {
+		return err
+	}
+	if !repl.isLinkActive(version) {
+		return nil
+	}
+
+	start := time.Now()
+	for _, db := range database.dbSet {
+		db.Flush()
+	}
+	count, err := database.loadRDBFrom(bytes.NewReader(data))
+	if err != nil {
+		return errors.New("load RDB from master failed: " + err.Error())
+	}
+	if database.aofHandler != nil {
+		if err := database.aofHandler.ResetWithRDB(data); err != nil {
+			logger.Error("replication: reset aof failed: " + err.Error())
+		}
+	}
+
+	repl.mu.Lock()
+	repl.replId = replId
+	repl.replId2 = ""
+	repl.secondReplOffset = -1
+	repl.backlog.reset(offset)
+	repl.masterFake = newMasterFakeConn()
+	repl.mu.Unlock()
+	logger.Info("MASTER <-> REPLICA sync: loaded " + strconv.Itoa(count) + " keys in " + time.Since(start).String())
+	return nil
+}
+
+// receiveCommands 执行主节点发来的指令流，同时将其原样写入本节点的复制流
+
+func (database *StandaloneDatabase) receiveCommands(link *masterLink, version int) error {
+	repl := database.repl
+	ch := parser.ParseStream(link.reader)
+	defer func() {
+		_ = link.conn.Close()
+		go func() {
+			for range ch { // 让解析协程能够退出
+			}
+		}()
+	}()
+	for payload := range ch {
+		if payload.Err != nil {
+			return payload.Err
+		}
+		cmd, ok := payload.Data.(*reply.MultiBulkReply)
+		if !ok || len(cmd.Args) == 0 {
+			continue
+		}
+		raw := cmd.ToBytes()
+		repl.mu.Lock()
+		if repl.linkVersion != version {
+			repl.mu.Unlock()
+			return nil
+		}
+		fakeConn := repl.masterFake
+		repl.mu.Unlock()
+
+		cmdName := strings.ToLower(string(cmd.Args[0]))
+		// 主节点通过 REPLCONF GETACK 要求从节点立即上报偏移量，该指令同样计入复制流
+		getAck := cmdName == "replconf" && len(cmd.Args) == 3 && strings.ToLower(string(cmd.Args[1])) == "getack"
+		if cmdName != "ping" && !getAck {
+			result := database.Exec(fakeConn, cmd.Args)
+			if result != nil && reply.IsErrorReply(result) {
+				logger.Warn("replication: command from master failed: " + string(result.ToBytes()))
+			}
+		}
+
+		repl.mu.Lock()
+		if repl.linkVersion == version {
+			repl.feedRawLocked(raw)
+		}
+		offset := repl.backlog.offset
+		repl.mu.Unlock()
+		if getAck {
+			if err := sendAck(link.conn, offset); err != nil {
+				return err
+			}
+		}
+	}
+	return io.EOF
+}
+
+// sendAck 向主节点上报本节点已经处理到的复制偏移量
+
+func sendAck(conn net.Conn, offset int64) error {
+	_, err := conn.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("REPLCONF", "ACK", strconv.FormatInt(offset, 10))).ToBytes())
+	return err
+}
@@ -0,0 +1,211 @@
+package database
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 节点在主从复制中的角色
+const (
+	roleMaster = iota
+	roleSlave
+)
+
+// 从节点与主节点之间复制连接的状态，与 ROLE 指令中的状态保持一致
+const (
+	linkStateConnect    = "connect"    // 等待连接主节点
+	linkStateConnecting = "connecting" // 正在与主节点握手
+	linkStateSync       = "sync"       // 正在接收主节点的 RDB
+	linkStateConnected  = "connected"  // 正在接收主节点的指令流
+)
+
+const (
+	defaultReplBacklogSize = 1 << 20 // 复制积压缓冲区默认 1MB
+	defaultReplTimeout     = 60 * time.Second
+	replPingPeriod         = 10 * time.Second // 主节点向从节点发送 PING 的间隔
+	replIdLen              = 40
+)
+
+// replication 记录主从复制的状态，主节点和从节点共用同一套 replication id、偏移量以及积压缓冲区：
+// 主节点把自己执行的写指令编码后写入复制流；从节点把从主节点收到的复制流原样写入自己的复制流，
+// 因此从节点的偏移量与主节点一致，它自己的从节点（级联复制）以及故障转移后的部分重同步都可以直接使用
+
+type replication struct {
+	mu               sync.Mutex
+	role             int
+	replId           string       // 当前复制流的 id
+	replId2          string       // 晋升为主节点之前所跟随的复制流的 id
+	secondReplOffset int64        // replId2 最多可以续传到的偏移量，-1 表示 replId2 无效
+	backlog          *replBacklog // 复制积压缓冲区，其 offset 即为 master_repl_offset
+	streamDB         int          // 复制流中最后一次 SELECT 的子数据库，-1 表示下一条指令前必须先写入 SELECT
+
+	// 主节点侧：已连接的从节点
+	replicas  map[resp.Connection]*replica
+	lastPing  time.Time
+	ackNotify chan struct{} // 每收到一次 REPLCONF ACK 就关闭并替换，用于唤醒阻塞在 WAIT 上的客户端
+
+	// 从节点侧：与主节点的连接
+	masterHost  string
+	masterPort  int
+	linkState   string
+	linkVersion int      // 每次执行 REPLICAOF 都会加一，旧的同步协程据此退出
+	masterConn  net.Conn // 当前与主节点的连接，切换主节点时关闭它以打断同步协程
+	masterFake  resp.Connection
+}
+
+func makeReplication() *replication {
+	backlogSize := config.Properties.ReplBacklogSize
+	if backlogSize <= 0 {
+		backlogSize = defaultReplBacklogSize
+	}
+	return &replication{
+		role:             roleMaster,
+		replId:           utils.RandHexString(replIdLen),
+		secondReplOffset: -1,
+		backlog:          makeReplBacklog(backlogSize),
+		streamDB:         -1,
+		replicas:         make(map[resp.Connection]*replica),
+		ackNotify:        make(chan struct{}),
+	}
+}
+
+func replTimeout() time.Duration {
+	if config.Properties.ReplTimeout > 0 {
+		return time.Duration(config.Properties.ReplTimeout) * time.Second
+	}
+	return defaultReplTimeout
+}
+
+// isSlave 判断当前节点是否为从节点
+
+func (repl *replication) isSlave() bool {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	return repl.role == roleSlave
+}
+
+// isReadOnlyReplica 判断当前节点是否为只读的从节点
+
+func (repl *replication) isReadOnlyReplica() bool {
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	return repl.role == roleSlave && config.Properties.ReplicaReadOnly
+}
+
+// execRole 实现 ROLE 指令
+// 主节点：["master", offset, [[ip, port, offset], ...]]
+// 从节点：["slave", master-ip, master-port, state, offset]
+
+func (database *StandaloneDatabase) execRole() resp.Reply {
+	repl := database.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.role == roleSlave {
+		return reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeBulkReply([]byte("slave")),
+			reply.MakeBulkReply([]byte(repl.masterHost)),
+			reply.MakeIntReply(int64(repl.masterPort)),
+			reply.MakeBulkReply([]byte(repl.linkState)),
+			reply.MakeIntReply(repl.backlog.offset),
+		})
+	}
+	replicas := make([]resp.Reply, 0, len(repl.replicas))
+	for _, r := range repl.replicas {
+		if r.state == replicaStateHandshake {
+			continue
+		}
+		replicas = append(replicas, reply.MakeMultiBulkReply([][]byte{
+			[]byte(r.ip()),
+			[]byte(strconv.Itoa(r.listeningPort)),
+			[]byte(strconv.FormatInt(r.ackOffset, 10)),
+		}))
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte("master")),
+		reply.MakeIntReply(repl.backlog.offset),
+		reply.MakeMultiRawReply(replicas),
+	})
+}
+
+// execReplicaOf 实现 REPLICAOF host port 以及 REPLICAOF NO ONE
+
+func (database *StandaloneDatabase) execReplicaOf(args [][]byte) resp.Reply {
+	if strings.ToLower(string(args[0])) == "no" && strings.ToLower(string(args[1])) == "one" {
+		database.repl.becomeMaster()
+		return reply.MakeOkReply()
+	}
+	host := string(args[0])
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return reply.MakeErrReply("ERR Invalid master port")
+	}
+	if !database.startReplication(host, port) {
+		return reply.MakeStatusReply("OK Already connected to specified master")
+	}
+	return reply.MakeOkReply()
+}
+
+// execReplConf 实现 REPLCONF，从节点在握手阶段通过它告知主节点自己的监听端口等信息，
+// 之后通过 REPLCONF ACK offset 定期上报自己已经处理到的偏移量
+
+func (database *StandaloneDatabase) execReplConf(c resp.Connection, args [][]byte) resp.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeSyntaxErrReply()
+	}
+	repl := database.repl
+	if strings.ToLower(string(args[0])) == "ack" {
+		// 主节点不回复 ACK，否则回复会混入发往从节点的复制流
+		if offset, err := strconv.ParseInt(string(args[1]), 10, 64); err == nil {
+			repl.ack(c, offset)
+		}
+		return &reply.NoReply{}
+	}
+	for i := 0; i < len(args); i += 2 {
+		option := strings.ToLower(string(args[i]))
+		value := string(args[i+1])
+		switch option {
+		case "listening-port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			repl.mu.Lock()
+			repl.getOrMakeReplica(c).listeningPort = port
+			repl.mu.Unlock()
+		case "capa", "ip-address":
+			// 本实现总是支持 psync2，无需记录
+		default:
+			return reply.MakeErrReply("ERR Unrecognized REPLCONF option: " + option)
+		}
+	}
+	return reply.MakeOkReply()
+}
+
+// replicationCron 每秒由 serverCron 调用一次，主节点定期向从节点发送 PING，从节点据此判断连接是否存活；
+// 从节点每秒向主节点发送一次 REPLCONF ACK，主节点据此计算从节点的延迟
+
+func (database *StandaloneDatabase) replicationCron() {
+	repl := database.repl
+	repl.mu.Lock()
+	defer repl.mu.Unlock()
+	if repl.role == roleSlave {
+		if repl.linkState == linkStateConnected && repl.masterConn != nil {
+			_ = sendAck(repl.masterConn, repl.backlog.offset)
+		}
+		return
+	}
+	if len(repl.replicas) == 0 {
+		return
+	}
+	if time.Since(repl.lastPing) >= replPingPeriod {
+		repl.lastPing = time.Now()
+		repl.feedCommandLocked(-1, utils.ToCmdLine("PING"))
+	}
+}
@@ -0,0 +1,109 @@
+package database
+
+import (
+	"go-redis/interface/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/wildcard"
+	"go-redis/resp/reply"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultScanCount = 10
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+// 游标是 key 的 32 位哈希值：每次返回哈希值不小于游标的 count 个 key，下一次从最后一个 key 的哈希值 + 1 开始，返回 0 表示遍历结束
+// 与 Redis 相同，整个遍历期间一直存在的 key 一定会被返回，遍历期间新增或删除的 key 可能返回也可能不返回
+
+func execScan(db *DB, args [][]byte) resp.Reply {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	count := defaultScanCount
+	var pattern *wildcard.Pattern
+	typeFilter := ""
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return reply.MakeSyntaxErrReply()
+		}
+		value := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern, err = wildcard.CompilePattern(value)
+			if err != nil {
+				return reply.MakeErrReply("ERR invalid pattern")
+			}
+		case "count":
+			count, err = strconv.Atoi(value)
+			if err != nil || count < 1 {
+				return reply.MakeSyntaxErrReply()
+			}
+		case "type":
+			typeFilter = strings.ToLower(value)
+		default:
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+	if cursor > math.MaxUint32 {
+		return scanReply(0, nil)
+	}
+
+	type hashedKey struct {
+		key  string
+		hash uint32
+	}
+	candidates := make([]hashedKey, 0)
+	db.ForEach(func(key string, entity *database.DataEntity) bool {
+		if hash := keyHash(key); uint64(hash) >= cursor {
+			candidates = append(candidates, hashedKey{key: key, hash: hash})
+		}
+		return true
+	})
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].hash < candidates[j].hash
+	})
+	// 哈希值相同的 key 必须在同一次返回，否则下一次的游标会跳过它们
+	end := count
+	if end > len(candidates) {
+		end = len(candidates)
+	}
+	for end > 0 && end < len(candidates) && candidates[end].hash == candidates[end-1].hash {
+		end++
+	}
+	var next uint64
+	if end < len(candidates) {
+		next = uint64(candidates[end-1].hash) + 1
+	}
+
+	keys := make([][]byte, 0, end)
+	for _, candidate := range candidates[:end] {
+		if pattern != nil && !pattern.IsMatch(candidate.key) {
+			continue
+		}
+		if typeFilter != "" {
+			entity, exist := db.GetEntity(candidate.key)
+			if !exist || typeName(entity) != typeFilter {
+				continue
+			}
+		}
+		keys = append(keys, []byte(candidate.key))
+	}
+	return scanReply(next, keys)
+}
+
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func scanReply(cursor uint64, keys [][]byte) resp.Reply {
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		reply.MakeMultiBulkReply(keys),
+	})
+}
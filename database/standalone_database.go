@@ -3,11 +3,16 @@ package database
 import (
 	"go-redis/aof"
 	"go-redis/config"
+	databaseface "go-redis/interface/database"
 	"go-redis/interface/resp"
 	"go-redis/lib/logger"
+	"go-redis/lib/utils"
 	"go-redis/resp/reply"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // redis 数据库， 下辖多个子数据库 db
@@ -15,9 +20,24 @@ import (
 type StandaloneDatabase struct {
 	dbSet      []*DB // 子数据库，默认16个，通过参数 Databases，于 redis.conf 中进行修改
 	aofHandler *aof.AofHandler
+
+	dirty      atomic.Int64 // 上一次成功保存 RDB 之后发生的写操作次数
+	lastSave   atomic.Int64 // 上一次成功保存 RDB 的 unix 时间戳（秒）
+	saving     atomic.Bool  // 是否有正在进行的 RDB 保存
+	savePoints []config.SavePoint
+	closeChan  chan struct{} // 关闭时通知后台定时任务退出
+	closeOnce  sync.Once     // 服务关闭时 Close 可能被并发调用多次
+
+	repl *replication // 主从复制的状态
+	// 写指令执行期间持有读锁；全量同步时持有写锁暂停所有写操作，
+	// 使 RDB 快照与复制偏移量对应同一时刻，快照之后的写指令才会从积压缓冲区补发
+	writeMu sync.RWMutex
 }
 
-func NewStandaloneDatabase() *StandaloneDatabase {
+// NewBasicStandaloneDatabase 创建一个只包含子数据库的实例，不加载持久化文件，也不开启 AOF 和自动保存
+// 用于 AOF 重写、离线工具等需要一个临时数据库的场景
+
+func NewBasicStandaloneDatabase() *StandaloneDatabase {
 	database := &StandaloneDatabase{}
 	if config.Properties.Databases == 0 {
 		config.Properties.Databases = 16
@@ -29,30 +49,57 @@ func NewStandaloneDatabase() *StandaloneDatabase {
 		db.index = i
 		database.dbSet[i] = db
 	}
-	// 初始化 aof
+	return database
+}
+
+func NewStandaloneDatabase() *StandaloneDatabase {
+	database := NewBasicStandaloneDatabase()
+	// 初始化 aof，开启 AOF 时从 AOF 文件恢复数据，否则从 RDB 文件恢复数据
 	if config.Properties.AppendOnly {
-		aofHandler, err := aof.NewAofHandler(database)
+		aofHandler, err := aof.NewAofHandler(database, func() databaseface.DBEngine {
+			return NewBasicStandaloneDatabase()
+		})
 		if err != nil {
 			panic(err)
 		}
 		database.aofHandler = aofHandler
-		for _, db := range database.dbSet {
-			// 定义每个子数据库的 addAof 方法，
-			// addAof 和 AddAof 不是同一个方法，而是子数据库db层的addAof去调用Database层的AddAof
-			// 实现子数据库db往aof管道中写入指令
-
-			// 注意闭包引发的bug
-			// 创建局部变量，固定当前迭代的 db,防止直接引用 db 造成内存逃逸
-			// 当循环结束后，所有闭包中的 db 都指向最后一次迭代的db（即第 16 个数据库，索引为 15）。因此调用时所有闭包都会使用索引15
-			//建一个中间变量 currentDB
-			currentDB := db
-			currentDB.addAof = func(line CmdLine) {
+	} else {
+		database.loadRDB(config.Properties.RDBFilename())
+	}
+	// 数据加载完成后再初始化复制状态，repl 为 nil 时 Exec 不检查 READONLY 和 NOREPLICAS，
+	// 否则配置了 min-replicas-to-write 时重放 AOF 的写指令会被拒绝，导致重启后数据丢失
+	database.repl = makeReplication()
+	for _, db := range database.dbSet {
+		// 定义每个子数据库的 addAof 方法，
+		// addAof 和 AddAof 不是同一个方法，而是子数据库db层的addAof去调用Database层的AddAof
+		// 实现子数据库db往aof管道中写入指令，同时记录写操作的次数供 RDB 自动保存使用
+
+		// 注意闭包引发的bug
+		// 创建局部变量，固定当前迭代的 db,防止直接引用 db 造成内存逃逸
+		// 当循环结束后，所有闭包中的 db 都指向最后一次迭代的db（即第 16 个数据库，索引为 15）。因此调用时所有闭包都会使用索引15
+		//建一个中间变量 currentDB
+		currentDB := db
+		currentDB.addAof = func(line CmdLine) {
+			database.dirty.Add(1)
+			database.repl.feedCommand(currentDB.index, line)
+			if database.aofHandler != nil {
 				// AddAof(db.index, line) 中的 db 引用了外部 for 中的 db 造成内存逃逸，for 中的 db 变量逃逸到堆上
 				// database.aofHandler.AddAof(db.index, line)
 				database.aofHandler.AddAof(currentDB.index, line)
 			}
 		}
 	}
+	// 初始化 RDB 自动保存
+	database.lastSave.Store(time.Now().Unix())
+	database.savePoints = config.Properties.SavePoints()
+	database.closeChan = make(chan struct{})
+	go database.serverCron()
+	// 配置了 replicaof 时以从节点身份启动
+	if fields := strings.Fields(config.Properties.ReplicaOf); len(fields) == 2 {
+		if reply.IsErrorReply(database.execReplicaOf(utils.ToCmdLine(fields...))) {
+			logger.Error("invalid replicaof config: " + config.Properties.ReplicaOf)
+		}
+	}
 	return database
 }
 
@@ -66,21 +113,171 @@ func (database *StandaloneDatabase) Exec(client resp.Connection, args [][]byte)
 		}
 	}()
 	cmdName := strings.ToLower(string(args[0])) // 取出第一个参数，如 get, set 等
-	if cmdName == "select" {                    // 当前指令用于选择子数据库
+	// 事务中的指令先入队，EXEC 时统一执行
+	if client.InMultiState() && !isTxCommend(cmdName) {
+		return EnqueueCmd(client, args)
+	}
+	switch cmdName {
+	case "multi":
+		return execMulti(client, args[1:])
+	case "exec":
+		return database.execExec(client, args[1:])
+	case "discard":
+		return execDiscard(client, args[1:])
+	case "select": // 当前指令用于选择子数据库
 		if len(args) != 2 { // 选择子数据库只用 2 个参数，如 select 10
 			return reply.MakeArgNumErrReply("select")
 		}
 		return execSelect(client, database, args[1:])
+	case "save":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return execSave(database)
+	case "bgsave":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return execBgSave(database)
+	case "bgrewriteaof":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return execBgRewriteAof(database)
+	case "lastsave":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return reply.MakeIntReply(database.lastSave.Load())
+	case "replicaof", "slaveof":
+		if len(args) != 3 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return database.execReplicaOf(args[1:])
+	case "psync":
+		if len(args) != 3 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return database.execPSync(client, args[1:])
+	case "replconf":
+		if len(args) < 3 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return database.execReplConf(client, args[1:])
+	case "role":
+		if len(args) != 1 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return database.execRole()
+	case "hello":
+		return database.execHello(client, args[1:])
+	case "info":
+		if len(args) > 2 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return database.execInfo(args[1:])
+	case "wait":
+		if len(args) != 3 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return database.execWait(args[1:])
+	case "migrate": // 与目标节点通信期间不能持有锁，由 execMigrate 自己分阶段加锁
+		if _, errReply := lookupCommend(args); errReply != nil {
+			return errReply
+		}
+		if errReply := database.checkWritable([]CmdLine{args}); errReply != nil {
+			return errReply
+		}
+		return database.execMigrate(client, args[1:])
+	}
+	isWrite := isWriteCommend(cmdName) || cmdName == "flushall"
+	// 只读的从节点只接受来自主节点的写指令
+	if database.repl != nil && isWrite && !client.IsMaster() && database.repl.isReadOnlyReplica() {
+		return reply.MakeErrReply("READONLY You can't write against a read only replica.")
+	}
+	// 健康的从节点数量不足 min-replicas-to-write 时拒绝写指令
+	if database.repl != nil && isWrite && !database.repl.hasEnoughGoodReplicas() {
+		return reply.MakeErrReply("NOREPLICAS Not enough good replicas to write.")
+	}
+	if isWrite {
+		database.writeMu.RLock()
+		defer database.writeMu.RUnlock()
+	}
+	if cmdName == "flushall" {
+		return database.execFlushAll(args[1:])
 	}
 	// 修改子数据库以外的命令的处理逻辑如下
 	dbIndex := client.GetDBIndex()
 	db := database.dbSet[dbIndex]
+	if cmdName == "copy" && len(args) > 3 {
+		return database.execCopy(db, args[1:])
+	}
 	return db.Exec(client, args)
 }
 
-func (database *StandaloneDatabase) Close() {}
+// Close 停止后台定时任务，配置了自动保存规则时在退出前做一次同步保存
+
+func (database *StandaloneDatabase) Close() {
+	if database.closeChan == nil { // 临时数据库没有后台任务
+		return
+	}
+	database.closeOnce.Do(func() {
+		close(database.closeChan)
+		if len(database.savePoints) > 0 {
+			if err := database.saveRDB(); err != nil {
+				logger.Error("save rdb before shutdown failed: " + err.Error())
+			}
+		}
+	})
+}
+
+func (database *StandaloneDatabase) GetDBNum() int {
+	return len(database.dbSet)
+}
+
+func (database *StandaloneDatabase) ForEach(dbIndex int, cb func(key string, entity *databaseface.DataEntity) bool) {
+	database.dbSet[dbIndex].ForEach(cb)
+}
+
+func (database *StandaloneDatabase) AfterClientClose(c resp.Connection) {
+	if c.IsSlave() && database.repl != nil {
+		database.repl.removeReplica(c)
+	}
+}
 
-func (database *StandaloneDatabase) AfterClientClose(c resp.Connection) {}
+// COPY src dest DB destination-db [REPLACE]，复制到其他子数据库时需要在这一层找到目标子数据库
+
+func (database *StandaloneDatabase) execCopy(db *DB, args [][]byte) resp.Reply {
+	destIndex, replace, errReply := parseCopyArgs(args)
+	if errReply != nil {
+		return errReply
+	}
+	destDB := db
+	if destIndex >= 0 {
+		if destIndex >= len(database.dbSet) {
+			return reply.MakeErrReply("ERR DB index is out of range")
+		}
+		destDB = database.dbSet[destIndex]
+	}
+	return copyEntity(db, destDB, args, replace)
+}
+
+// FLUSHALL [ASYNC|SYNC] 清空所有子数据库，每个子数据库分别记录 FLUSHDB
+
+func (database *StandaloneDatabase) execFlushAll(args [][]byte) resp.Reply {
+	if len(args) > 1 {
+		return reply.MakeArgNumErrReply("flushall")
+	}
+	if len(args) == 1 {
+		if mode := strings.ToLower(string(args[0])); mode != "async" && mode != "sync" {
+			return reply.MakeSyntaxErrReply()
+		}
+	}
+	for _, db := range database.dbSet {
+		execFlushDB(db, nil)
+	}
+	return reply.MakeOkReply()
+}
 
 // 用户选择子db
 func execSelect(c resp.Connection, database *StandaloneDatabase, args [][]byte) resp.Reply {
@@ -88,7 +285,7 @@ func execSelect(c resp.Connection, database *StandaloneDatabase, args [][]byte)
 	if err != nil { // 用户输入的子数据库编号不是数字，报错
 		return reply.MakeErrReply("ERR invalid DB index")
 	}
-	if dbIndex >= len(database.dbSet) { // 用户输入的子数据库编号大于子数据库数量，报错
+	if dbIndex < 0 || dbIndex >= len(database.dbSet) { // 用户输入的子数据库编号超出子数据库数量，报错
 		return reply.MakeErrReply("ERR DB index is out of range")
 	}
 	c.SelectDB(dbIndex) // 更改用户连接中的子数据库编号字段
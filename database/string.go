@@ -55,21 +55,66 @@ func execGetSet(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeBulkReply(entity.Data.([]byte))
 }
 
-// STRLEN
+// STRLEN key 不存在时返回 0
 func execStrLen(db *DB, args [][]byte) resp.Reply {
 	key := string(args[0])
 	entity, exist := db.GetEntity(key)
 	if !exist {
-		return reply.MakeNullBulkReply()
+		return reply.MakeIntReply(0)
 	}
 	bytes := entity.Data.([]byte)
 	return reply.MakeIntReply(int64(len(bytes)))
 }
 
+// MGET k1 k2 k3 ... 不存在的 key 返回空值
+func execMGet(db *DB, args [][]byte) resp.Reply {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		entity, exist := db.GetEntity(string(arg))
+		if !exist {
+			continue
+		}
+		result[i] = entity.Data.([]byte)
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+// MSET k1 v1 k2 v2 ...
+func execMSet(db *DB, args [][]byte) resp.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeArgNumErrReply("mset")
+	}
+	for i := 0; i < len(args); i += 2 {
+		db.PutEntity(string(args[i]), &database.DataEntity{Data: args[i+1]})
+	}
+	db.addAof(utils.ToCmdLine2("mset", args...))
+	return reply.MakeOkReply()
+}
+
+// MSETNX k1 v1 k2 v2 ... 只有所有 key 都不存在时才写入，返回 1，否则不做任何修改，返回 0
+func execMSetNX(db *DB, args [][]byte) resp.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeArgNumErrReply("msetnx")
+	}
+	for i := 0; i < len(args); i += 2 {
+		if _, exist := db.GetEntity(string(args[i])); exist {
+			return reply.MakeIntReply(0)
+		}
+	}
+	for i := 0; i < len(args); i += 2 {
+		db.PutEntity(string(args[i]), &database.DataEntity{Data: args[i+1]})
+	}
+	db.addAof(utils.ToCmdLine2("msetnx", args...))
+	return reply.MakeIntReply(1)
+}
+
 func init() {
-	RegisterCommend("get", execGet, 2)
-	RegisterCommend("set", execSet, 3)
-	RegisterCommend("setnx", execSetNX, 3)
-	RegisterCommend("getset", execGetSet, 3)
-	RegisterCommend("strlen", execGet, 2)
+	RegisterCommend("get", execGet, 2, flagReadOnly).attachKeys(1, 1, 1)
+	RegisterCommend("set", execSet, 3, flagWrite).attachKeys(1, 1, 1)
+	RegisterCommend("setnx", execSetNX, 3, flagWrite).attachKeys(1, 1, 1)
+	RegisterCommend("getset", execGetSet, 3, flagWrite).attachKeys(1, 1, 1)
+	RegisterCommend("mget", execMGet, -2, flagReadOnly).attachKeys(1, -1, 1)
+	RegisterCommend("mset", execMSet, -3, flagWrite).attachKeys(1, -1, 2)
+	RegisterCommend("msetnx", execMSetNX, -3, flagWrite).attachKeys(1, -1, 2)
+	RegisterCommend("strlen", execStrLen, 2, flagReadOnly).attachKeys(1, 1, 1)
 }
@@ -0,0 +1,94 @@
+package lock
+
+import (
+	"sort"
+	"sync"
+)
+
+// Locks 是按 key 分段的读写锁，同一段内的 key 共用一把锁
+// 事务需要同时锁住多个 key，加锁时按段的下标排序，避免两个事务以相反的顺序加锁造成死锁
+
+type Locks struct {
+	table []*sync.RWMutex
+}
+
+const prime32 = uint32(16777619)
+
+func fnv32(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash *= prime32
+		hash ^= uint32(key[i])
+	}
+	return hash
+}
+
+// Make 创建包含 tableSize 段的锁
+
+func Make(tableSize int) *Locks {
+	table := make([]*sync.RWMutex, tableSize)
+	for i := range table {
+		table[i] = &sync.RWMutex{}
+	}
+	return &Locks{table: table}
+}
+
+func (locks *Locks) spread(key string) uint32 {
+	return fnv32(key) % uint32(len(locks.table))
+}
+
+// toLockIndices 返回 key 所在段的下标，去重后排序，reverse 为 true 时倒序，用于解锁
+
+func (locks *Locks) toLockIndices(keys []string, reverse bool) []uint32 {
+	indexMap := make(map[uint32]struct{})
+	for _, key := range keys {
+		indexMap[locks.spread(key)] = struct{}{}
+	}
+	indices := make([]uint32, 0, len(indexMap))
+	for index := range indexMap {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		if reverse {
+			return indices[i] > indices[j]
+		}
+		return indices[i] < indices[j]
+	})
+	return indices
+}
+
+// RWLocks 对 writeKeys 加写锁，对 readKeys 加读锁，两者落在同一段时加写锁
+
+func (locks *Locks) RWLocks(writeKeys []string, readKeys []string) {
+	keys := append(append([]string{}, writeKeys...), readKeys...)
+	writeIndices := locks.writeIndexSet(writeKeys)
+	for _, index := range locks.toLockIndices(keys, false) {
+		if _, w := writeIndices[index]; w {
+			locks.table[index].Lock()
+		} else {
+			locks.table[index].RLock()
+		}
+	}
+}
+
+// RWUnLocks 释放 RWLocks 加上的锁
+
+func (locks *Locks) RWUnLocks(writeKeys []string, readKeys []string) {
+	keys := append(append([]string{}, writeKeys...), readKeys...)
+	writeIndices := locks.writeIndexSet(writeKeys)
+	for _, index := range locks.toLockIndices(keys, true) {
+		if _, w := writeIndices[index]; w {
+			locks.table[index].Unlock()
+		} else {
+			locks.table[index].RUnlock()
+		}
+	}
+}
+
+func (locks *Locks) writeIndexSet(writeKeys []string) map[uint32]struct{} {
+	indices := make(map[uint32]struct{}, len(writeKeys))
+	for _, key := range writeKeys {
+		indices[locks.spread(key)] = struct{}{}
+	}
+	return indices
+}
@@ -1 +1,5 @@
 module go-redis
+
+go 1.27.1
+
+require github.com/jolestar/go-commons-pool/v2 v2.1.2
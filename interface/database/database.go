@@ -10,6 +10,21 @@ type Database interface {
 	AfterClientClose(c resp.Connection) // 关闭后的工作，如痕迹抹除
 }
 
+// DBEngine 在 Database 的基础上提供遍历数据的能力，供 RDB 持久化、AOF 重写等模块使用
+
+type DBEngine interface {
+	Database
+	GetDBNum() int                                                     // 子数据库的数量
+	ForEach(dbIndex int, cb func(key string, entity *DataEntity) bool) // 遍历某个子数据库，cb 返回 false 时停止遍历
+
+	// 以下方法供集群事务使用，由协调者分阶段控制加锁、执行和回滚
+	ExecMulti(c resp.Connection, cmdLines []CmdLine) resp.Reply // 加锁后原子地执行一组指令
+	ExecWithLock(c resp.Connection, cmdLine CmdLine) resp.Reply // 执行指令，调用方已经对涉及的 key 加锁
+	RWLocks(dbIndex int, writeKeys []string, readKeys []string) // 对 key 加锁，同时暂停全量同步，直到 RWUnLocks
+	RWUnLocks(dbIndex int, writeKeys []string, readKeys []string)
+	GetUndoLogs(dbIndex int, keys []string) []CmdLine // 生成将 keys 恢复到当前状态的指令
+}
+
 // 指代 redis 的数据结构，即 List, string等
 
 type DataEntity struct {
@@ -1,8 +1,41 @@
 package resp
 
+import "net"
+
+// 客户端通过 HELLO 协商的协议版本，新连接默认使用 RESP2
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
 // Connection 代表与Redis客户端的连接
 type Connection interface {
 	Write([]byte) error
+	Close() error
+	RemoteAddr() net.Addr
 	GetDBIndex() int // 获取库的index
 	SelectDB(int)    // 根据 index 选择库
+
+	SetSlave()      // 标记该连接来自从节点（从节点发来了 PSYNC）
+	IsSlave() bool  // 该连接是否来自从节点
+	SetMaster()     // 标记该连接是从节点与主节点之间的复制连接
+	IsMaster() bool // 该连接是否来自主节点，来自主节点的写指令不受只读限制
+
+	SetRedirect(on bool) // 开启或关闭重定向模式
+	IsRedirect() bool    // 集群模式下是否对不属于本节点的 key 返回 MOVED，而不是代理转发
+	SetAsking(on bool)   // 设置或清除 ASKING 标记
+	IsAsking() bool      // 客户端是否在上一条指令发送了 ASKING
+
+	InMultiState() bool          // 是否处于 MULTI 开启的事务中
+	SetMultiState(on bool)       // 开启或结束事务，同时清空已入队的指令和错误
+	EnqueueCmd(cmdLine [][]byte) // 将事务中的指令入队，等待 EXEC 时执行
+	GetQueuedCmdLine() [][][]byte
+	AddTxError(err error) // 记录入队时发现的错误，EXEC 时放弃整个事务
+	GetTxErrors() []error
+
+	GetID() int64        // 连接的唯一编号
+	SetProtocol(ver int) // 设置回复使用的协议版本，RESP2 或 RESP3
+	GetProtocol() int    // 回复使用的协议版本
+	SetName(name string) // 设置客户端名称，如 HELLO SETNAME
+	GetName() string
 }
@@ -10,3 +10,17 @@ type Handler interface {
 	Handle(ctx context.Context, conn net.Conn)
 	Close() error
 }
+
+// EventHandler 是支持事件驱动网络模式的 Handler：连接不再由一个协程阻塞地读取，
+// 而是在有数据可读时由工作协程调用 Session.OnReadable 处理，空闲连接不占用协程
+type EventHandler interface {
+	Handler
+	OnOpen(conn net.Conn) Session // 返回 nil 表示拒绝该连接，连接已被关闭
+}
+
+// Session 是事件驱动模式下一个连接的处理状态
+type Session interface {
+	// OnReadable 处理连接上已经到达的数据，直到读取连接返回 syscall.EAGAIN 时返回 nil；
+	// 返回 error 表示连接已被关闭
+	OnReadable() error
+}
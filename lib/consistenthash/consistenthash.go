@@ -3,22 +3,42 @@ package consistenthash
 import (
 	"hash/crc32"
 	"sort"
+	"strconv"
+	"sync"
 )
 
 type HashFunc func(data []byte) uint32
 
+// DefaultReplicas 是每个节点（权重为 1 时）在哈希环上的虚拟节点数量
+const DefaultReplicas = 160
+
 // redis 节点
+// 每个节点在哈希环上放置 replicas * weight 个虚拟节点，节点数量较少时 key 也能比较均匀地分布到各个节点上
 
 type NodeMap struct {
+	mu          sync.RWMutex
 	hashFunc    HashFunc       // 哈希函数
-	nodeHashs   []int          // 该节点负责的槽位
-	nodehashMap map[int]string // 槽位 -> 节点的映射，根据该槽位来查由哪个节点负责
+	replicas    int            // 权重为 1 的节点拥有的虚拟节点数量
+	nodeHashs   []int          // 所有虚拟节点的哈希值，即哈希环，升序排列
+	nodehashMap map[int]string // 虚拟节点的哈希值 -> 节点的映射，根据该哈希值来查由哪个节点负责
+	weights     map[string]int // 节点 -> 权重
 }
 
 func NewNodeMap(fn HashFunc) *NodeMap {
+	return NewNodeMapWithReplicas(DefaultReplicas, fn)
+}
+
+// NewNodeMapWithReplicas 创建一个哈希环，每个节点（权重为 1 时）拥有 replicas 个虚拟节点，replicas 不大于 0 时使用默认值
+
+func NewNodeMapWithReplicas(replicas int, fn HashFunc) *NodeMap {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
 	m := &NodeMap{
 		hashFunc:    fn,
+		replicas:    replicas,
 		nodehashMap: make(map[int]string),
+		weights:     make(map[string]int),
 	}
 	if m.hashFunc == nil {
 		m.hashFunc = crc32.ChecksumIEEE
@@ -26,39 +46,143 @@ func NewNodeMap(fn HashFunc) *NodeMap {
 	return m
 }
 
-// 某节点负责的槽位是否为空，即判断某节点是否没有被分配槽位
+// 哈希环是否为空，即判断是否还没有加入任何节点
 
 func (m *NodeMap) IsEmpty() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	return len(m.nodeHashs) == 0
 }
 
-// 增加节点，并给该节点分配槽位
+// 增加权重为 1 的节点，并在哈希环上为该节点放置虚拟节点
 
 func (m *NodeMap) AddNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, key := range keys {
 		if key == "" {
 			continue
 		}
-		hash := int(m.hashFunc([]byte(key)))
-		m.nodeHashs = append(m.nodeHashs, hash)
-		m.nodehashMap[hash] = key
+		m.weights[key] = 1
+	}
+	m.rebuild()
+}
+
+// AddNodeWithWeight 增加一个节点，权重为 weight 的节点拥有 weight 倍的虚拟节点，负责大约 weight 倍的 key
+// 节点已存在时更新它的权重
+
+func (m *NodeMap) AddNodeWithWeight(key string, weight int) {
+	if key == "" || weight <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.weights[key] = weight
+	m.rebuild()
+}
+
+// RemoveNode 将节点及其全部虚拟节点从哈希环上移除，原本由它负责的 key 会分散到其余节点
+
+func (m *NodeMap) RemoveNode(keys ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.weights, key)
+	}
+	m.rebuild()
+}
+
+// Nodes 返回哈希环上的全部节点
+
+func (m *NodeMap) Nodes() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	nodes := make([]string, 0, len(m.weights))
+	for node := range m.weights {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Replicas 返回权重为 1 的节点拥有的虚拟节点数量
+
+func (m *NodeMap) Replicas() int {
+	return m.replicas
+}
+
+// Weight 返回节点的权重，节点不在哈希环上时返回 0
+
+func (m *NodeMap) Weight(node string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.weights[node]
+}
+
+// rebuild 根据当前的节点和权重重新生成哈希环，调用方需持有写锁
+// 虚拟节点的哈希值发生冲突时归属于名称较小的节点，保证集群中每个节点构建出的哈希环相同，与节点加入的顺序无关
+
+func (m *NodeMap) rebuild() {
+	m.nodeHashs = m.nodeHashs[:0]
+	m.nodehashMap = make(map[int]string)
+	for node, weight := range m.weights {
+		for i := 0; i < m.replicas*weight; i++ {
+			hash := int(m.hashFunc([]byte(strconv.Itoa(i) + "#" + node)))
+			if owner, ok := m.nodehashMap[hash]; ok {
+				if owner < node {
+					continue
+				}
+			} else {
+				m.nodeHashs = append(m.nodeHashs, hash)
+			}
+			m.nodehashMap[hash] = node
+		}
 	}
 	sort.Ints(m.nodeHashs)
 }
 
-// 将key做哈希映射到槽位上，再按槽位找到该槽位对应的节点，按照 key 查找该 key-value 属于哪个节点
+// 将key做哈希映射到哈希环上，再按顺时针方向找到第一个虚拟节点，该虚拟节点所属的节点负责这个 key
 
 func (m *NodeMap) PickNode(key string) string {
-	if m.IsEmpty() { // 如果该节点没有被分配槽位
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.nodeHashs) == 0 { // 哈希环上还没有节点
 		return ""
 	}
 	hash := int(m.hashFunc([]byte(key))) // 将key做哈希映射
-	// 通过二分查找第一个大于等于 key 哈希的槽位，若未找到则取第一个槽位（形成环）
+	// 通过二分查找第一个大于等于 key 哈希的虚拟节点，若未找到则取第一个虚拟节点（形成环）
 	idx := sort.Search(len(m.nodeHashs), func(i int) bool {
 		return m.nodeHashs[i] >= hash
-	}) // 用 key 的哈希值得到对应的节点序号
+	}) // 用 key 的哈希值得到对应的虚拟节点序号
 	if idx == len(m.nodeHashs) { // 类似取模操作
 		idx = 0
 	}
 	return m.nodehashMap[m.nodeHashs[idx]] // 到 nodehashMap 中得到节点的名称
 }
+
+// Distribution 返回每个节点在哈希环上负责的区间占整个哈希空间的比例，即各节点预期分到的 key 的比例
+
+func (m *NodeMap) Distribution() map[string]float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	result := make(map[string]float64, len(m.weights))
+	for node := range m.weights {
+		result[node] = 0
+	}
+	n := len(m.nodeHashs)
+	if n == 0 {
+		return result
+	}
+	const space = float64(1 << 32)
+	// 每个虚拟节点负责 (前一个虚拟节点, 自己] 这一段，第一个虚拟节点还负责环尾部绕回来的一段
+	for i, hash := range m.nodeHashs {
+		var span float64
+		if i == 0 {
+			span = float64(hash) + space - float64(m.nodeHashs[n-1])
+		} else {
+			span = float64(hash - m.nodeHashs[i-1])
+		}
+		result[m.nodehashMap[hash]] += span / space
+	}
+	return result
+}
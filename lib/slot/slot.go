@@ -0,0 +1,56 @@
+// Package slot 实现与 Redis Cluster 相同的槽位计算：CRC16(key) mod 16384，并支持 {hash tag}
+package slot
+
+// SlotCount 是槽位的总数
+const SlotCount = 16384
+
+// crc16Table 是 CRC16-CCITT（XMODEM，多项式 0x1021）的查找表，与 Redis Cluster 使用的算法一致
+var crc16Table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+// CRC16 计算 data 的 CRC16-CCITT 校验值
+func CRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b]
+	}
+	return crc
+}
+
+// HashTag 返回 key 中参与计算槽位的部分：key 中包含非空的 {...} 时只使用第一对花括号之间的内容，
+// 这样 {user1000}.following 和 {user1000}.followers 会落在同一个槽位上
+func HashTag(key string) string {
+	for i := 0; i < len(key); i++ {
+		if key[i] != '{' {
+			continue
+		}
+		for j := i + 1; j < len(key); j++ {
+			if key[j] == '}' {
+				if j == i+1 { // {} 为空时使用整个 key
+					return key
+				}
+				return key[i+1 : j]
+			}
+		}
+		return key
+	}
+	return key
+}
+
+// HashSlot 返回 key 所在的槽位
+func HashSlot(key string) int {
+	return int(CRC16([]byte(HashTag(key)))) & (SlotCount - 1)
+}
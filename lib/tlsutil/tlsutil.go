@@ -0,0 +1,210 @@
+// Package tlsutil 管理 TLS 证书，为服务端监听、集群节点之间以及主从之间的连接提供 tls.Config
+// 证书文件被替换后会在下一次握手时自动重新加载，不需要重启服务
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"go-redis/config"
+	"go-redis/lib/logger"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 客户端证书的校验方式，与 Redis 的 tls-auth-clients 相同
+const (
+	AuthClientsYes      = "yes"      // 客户端必须提供由 CA 签发的证书
+	AuthClientsOptional = "optional" // 客户端提供证书时校验，不提供时也可以连接
+	AuthClientsNo       = "no"       // 不要求客户端证书
+)
+
+// reloadInterval 是检查证书文件是否被修改的最短间隔，避免每次握手都读取文件状态
+const reloadInterval = time.Second
+
+// Store 保存当前使用的证书和 CA，文件的修改时间变化后重新加载，加载失败时继续使用旧的证书
+
+type Store struct {
+	certFile    string
+	keyFile     string
+	caFile      string
+	authClients tls.ClientAuthType
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	caPool    *x509.CertPool // 未配置 CA 文件时为 nil，即使用系统的根证书
+	modTimes  [3]time.Time   // certFile、keyFile、caFile 的修改时间
+	checkedAt time.Time
+}
+
+// MakeStore 加载证书、私钥和 CA 证书，authClients 为 AuthClients* 之一，为空时等同于 yes
+
+func MakeStore(certFile, keyFile, caFile, authClients string) (*Store, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required")
+	}
+	s := &Store{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	switch authClients {
+	case AuthClientsYes, "":
+		s.authClients = tls.RequireAndVerifyClientCert
+	case AuthClientsOptional:
+		s.authClients = tls.VerifyClientCertIfGiven
+	case AuthClientsNo:
+		s.authClients = tls.NoClientCert
+	default:
+		return nil, errors.New("invalid tls-auth-clients: " + authClients)
+	}
+	if s.authClients != tls.NoClientCert && caFile == "" {
+		return nil, errors.New("tls-ca-cert-file is required to authenticate clients")
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load 读取全部文件，调用者需要持有 mu 或确保没有并发访问
+
+func (s *Store) load() error {
+	modTimes, err := s.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	var caPool *x509.CertPool
+	if s.caFile != "" {
+		pem, err := os.ReadFile(s.caFile)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificate found in " + s.caFile)
+		}
+	}
+	s.cert = &cert
+	s.caPool = caPool
+	s.modTimes = modTimes
+	s.checkedAt = time.Now()
+	return nil
+}
+
+func (s *Store) stat() ([3]time.Time, error) {
+	var modTimes [3]time.Time
+	for i, file := range []string{s.certFile, s.keyFile, s.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// current 返回当前的证书和 CA，距上次检查超过 reloadInterval 且文件被修改过时先重新加载
+
+func (s *Store) current() (*tls.Certificate, *x509.CertPool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.checkedAt) >= reloadInterval {
+		s.checkedAt = time.Now()
+		if modTimes, err := s.stat(); err == nil && modTimes != s.modTimes {
+			if err := s.load(); err != nil {
+				logger.Warn("tls: reload certificates failed, keep using the old ones: " + err.Error())
+			} else {
+				logger.Info("tls: certificates reloaded")
+			}
+		}
+	}
+	return s.cert, s.caPool
+}
+
+// ServerConfig 返回监听端使用的配置，每次握手时取用当前的证书和 CA
+
+func (s *Store) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, caPool := s.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientAuth:   s.authClients,
+				ClientCAs:    caPool,
+			}, nil
+		},
+	}
+}
+
+// ClientConfig 返回连接其他节点时使用的配置：用 CA 校验对方的证书，并出示自己的证书以满足对方的双向认证
+
+func (s *Store) ClientConfig() *tls.Config {
+	_, caPool := s.current()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    caPool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := s.current()
+			return cert, nil
+		},
+	}
+}
+
+var defaultStore *Store
+
+// Setup 创建全局的 Store，供服务端监听、集群和复制连接使用，只在启动时调用
+
+func Setup(certFile, keyFile, caFile, authClients string) error {
+	store, err := MakeStore(certFile, keyFile, caFile, authClients)
+	if err != nil {
+		return err
+	}
+	defaultStore = store
+	return nil
+}
+
+// Default 返回 Setup 创建的 Store，未启用 TLS 时为 nil
+
+func Default() *Store {
+	return defaultStore
+}
+
+// ClusterConfig 返回集群节点之间连接使用的配置，未开启 tls-cluster 时返回 nil，即使用明文连接
+
+func ClusterConfig() *tls.Config {
+	if !config.Properties.TLSCluster || defaultStore == nil {
+		return nil
+	}
+	return defaultStore.ClientConfig()
+}
+
+// ReplicationConfig 返回从节点连接主节点使用的配置，未开启 tls-replication 时返回 nil
+
+func ReplicationConfig() *tls.Config {
+	if !config.Properties.TLSReplication || defaultStore == nil {
+		return nil
+	}
+	return defaultStore.ClientConfig()
+}
+
+// DialTimeout 连接 addr，tlsConfig 为 nil 时使用明文连接
+
+func DialTimeout(addr string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if tlsConfig == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
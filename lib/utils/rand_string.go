@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	mathrand "math/rand"
+)
+
+// RandHexString 生成长度为 n 的随机十六进制字符串，用作 replication id、run id、节点 id 等
+func RandHexString(n int) string {
+	buf := make([]byte, (n+1)/2)
+	if _, err := rand.Read(buf); err != nil {
+		// crypto/rand 几乎不会失败，失败时退化为 math/rand
+		for i := range buf {
+			buf[i] = byte(mathrand.Intn(256))
+		}
+	}
+	return hex.EncodeToString(buf)[:n]
+}
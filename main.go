@@ -4,18 +4,16 @@ import (
 	"fmt"
 	"go-redis/config"
 	"go-redis/lib/logger"
+	"go-redis/lib/tlsutil"
 	"go-redis/resp/handler"
 	"go-redis/tcp"
 	"os"
+	"strconv"
+	"time"
 )
 
 const configFile string = "redis.conf"
 
-var defaultProperties = &config.ServerProperties{ // 如果 configFile 不存在，使用该默认配置
-	Bind: "0.0.0.0",
-	Port: 6379,
-}
-
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
 	return err == nil && !info.IsDir()
@@ -31,14 +29,47 @@ func main() {
 
 	if fileExists(configFile) { // 判断配置文件是否存在，不存在则使用默认配置
 		config.SetupConfig(configFile)
-	} else {
-		config.Properties = defaultProperties
+	} else { // 配置文件不存在时使用默认配置，监听所有网卡
+		props := config.DefaultServerProperties()
+		props.Bind = "0.0.0.0"
+		props.Port = 6379
+		config.Properties = props
+	}
+
+	props := config.Properties
+	tcpConfig := &tcp.Config{
+		EventLoop:  props.IOMode == "epoll",
+		Workers:    props.IOThreads,
+		UnixSocket: props.UnixSocket,
+		KeepAlive:  -1,
+	}
+	if props.TCPKeepalive > 0 {
+		tcpConfig.KeepAlive = time.Duration(props.TCPKeepalive) * time.Second
+	}
+	if props.UnixSocketPerm != "" {
+		perm, err := strconv.ParseUint(props.UnixSocketPerm, 8, 32)
+		if err != nil {
+			logger.Fatal("invalid unixsocketperm: " + props.UnixSocketPerm)
+			os.Exit(1)
+		}
+		tcpConfig.UnixPerm = os.FileMode(perm)
+	}
+	if props.Port != 0 || (props.TLSPort == 0 && props.UnixSocket == "") { // port 为 0 表示只接受 TLS 或 Unix socket 连接
+		tcpConfig.Address = fmt.Sprintf("%s:%d", props.Bind, props.Port) // IP:Port
+	}
+	if props.TLSEnabled() { // 在创建 handler 之前加载证书，集群和复制连接也会用到
+		if err := tlsutil.Setup(props.TLSCertFile, props.TLSKeyFile, props.TLSCACertFile, props.TLSAuthClients); err != nil {
+			logger.Fatal("tls: " + err.Error())
+			os.Exit(1)
+		}
+		if props.TLSPort != 0 {
+			tcpConfig.TLSAddress = fmt.Sprintf("%s:%d", props.Bind, props.TLSPort)
+			tcpConfig.TLSConfig = tlsutil.Default().ServerConfig()
+		}
 	}
 
 	err := tcp.ListenAndServeWithSignal(
-		&tcp.Config{
-			Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port), // IP:Port
-		},
+		tcpConfig,
 		handler.MakeHandler())
 	if err != nil {
 		logger.Error(err)
@@ -0,0 +1,321 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Decoder 从 io.Reader 中解析 RDB 数据
+// 若传入的是 *bufio.Reader，解析到 EOF 标记和校验和后便不再多读，调用方可以继续从该 Reader 中读取后续内容（如 AOF 的 RDB 前导）
+
+type Decoder struct {
+	r       *bufio.Reader
+	crc     uint64
+	version int
+	Aux     map[string]string // 解析到的辅助字段
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	bufReader, ok := r.(*bufio.Reader)
+	if !ok {
+		bufReader = bufio.NewReader(r)
+	}
+	return &Decoder{
+		r:   bufReader,
+		Aux: make(map[string]string),
+	}
+}
+
+// Version 返回解析到的 RDB 版本号，需在 Parse 之后调用
+func (dec *Decoder) Version() int {
+	return dec.version
+}
+
+func (dec *Decoder) readFull(buf []byte) error {
+	_, err := io.ReadFull(dec.r, buf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	dec.crc = crc64Update(dec.crc, buf)
+	return nil
+}
+
+// maxPrealloc 是按长度编码一次性分配的最大字节数，更长的字符串随读取逐步扩容，
+// 长度来自不可信的输入（如 RESTORE 的参数），不能直接按它分配内存
+const maxPrealloc = 64 * 1024
+
+// readBytes 读取 n 个字节，数据不足时返回 io.ErrUnexpectedEOF，分配的内存不会超过实际读到的数据太多
+
+func (dec *Decoder) readBytes(n uint64) ([]byte, error) {
+	if n <= maxPrealloc {
+		buf := make([]byte, n)
+		if err := dec.readFull(buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	buf := make([]byte, 0, maxPrealloc)
+	for remain := n; remain > 0; {
+		chunk := uint64(maxPrealloc)
+		if remain < chunk {
+			chunk = remain
+		}
+		start := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		if err := dec.readFull(buf[start:]); err != nil {
+			return nil, err
+		}
+		remain -= chunk
+	}
+	return buf, nil
+}
+
+func (dec *Decoder) readByte() (byte, error) {
+	var buf [1]byte
+	err := dec.readFull(buf[:])
+	return buf[0], err
+}
+
+// readLength 读取一个长度编码，isEncoded 表示读到的是特殊编码的字符串（此时返回值为编码类型）
+
+func (dec *Decoder) readLength() (length uint64, isEncoded bool, err error) {
+	first, err := dec.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case len6Bit:
+		return uint64(first & 0x3f), false, nil
+	case len14Bit:
+		next, err := dec.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3f)<<8 | uint64(next), false, nil
+	case lenEncVal:
+		return uint64(first & 0x3f), true, nil
+	}
+	switch first {
+	case len32Bit:
+		buf := make([]byte, 4)
+		if err := dec.readFull(buf); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf := make([]byte, 8)
+		if err := dec.readFull(buf); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	}
+	return 0, false, fmt.Errorf("rdb: invalid length encoding 0x%x", first)
+}
+
+func (dec *Decoder) readPlainLength() (uint64, error) {
+	length, isEncoded, err := dec.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if isEncoded {
+		return 0, errors.New("rdb: unexpected encoded length")
+	}
+	return length, nil
+}
+
+// readString 读取一个字符串，包括普通字符串、整数编码的字符串以及 LZF 压缩的字符串
+
+func (dec *Decoder) readString() ([]byte, error) {
+	length, isEncoded, err := dec.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !isEncoded {
+		return dec.readBytes(length)
+	}
+	switch length {
+	case encInt8:
+		b, err := dec.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int8(b)))), nil
+	case encInt16:
+		buf := make([]byte, 2)
+		if err := dec.readFull(buf); err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(buf))))), nil
+	case encInt32:
+		buf := make([]byte, 4)
+		if err := dec.readFull(buf); err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(buf))))), nil
+	case encLZF:
+		compressedLen, err := dec.readPlainLength()
+		if err != nil {
+			return nil, err
+		}
+		rawLen, err := dec.readPlainLength()
+		if err != nil {
+			return nil, err
+		}
+		compressed, err := dec.readBytes(compressedLen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, rawLen)
+	}
+	return nil, errUnsupportedEnc
+}
+
+// Parse 依次解析 RDB 中的每一条记录并交给 cb 处理，cb 返回 false 时停止解析
+// 读到 EOF 标记后会校验文件末尾的校验和（校验和为 0 表示生成方未开启校验）
+
+func (dec *Decoder) Parse(cb func(o *Object) bool) error {
+	header := make([]byte, 9)
+	if err := dec.readFull(header); err != nil {
+		return err
+	}
+	if string(header[:5]) != magic {
+		return errInvalidMagic
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < MinVersion || version > MaxVersion {
+		return fmt.Errorf("rdb: unsupported version %s", string(header[5:]))
+	}
+	dec.version = version
+
+	dbIndex := 0
+	var expireAt int64
+	for {
+		opCode, err := dec.readByte()
+		if err != nil {
+			return err
+		}
+		switch opCode {
+		case opCodeEOF:
+			return dec.verifyChecksum()
+		case opCodeSelectDB:
+			index, err := dec.readPlainLength()
+			if err != nil {
+				return err
+			}
+			dbIndex = int(index)
+		case opCodeResizeDB:
+			// 只是用于预分配空间的提示信息，直接丢弃
+			if _, err := dec.readPlainLength(); err != nil {
+				return err
+			}
+			if _, err := dec.readPlainLength(); err != nil {
+				return err
+			}
+		case opCodeSlotInfo:
+			for i := 0; i < 3; i++ { // slot id, slot size, expires slot size
+				if _, err := dec.readPlainLength(); err != nil {
+					return err
+				}
+			}
+		case opCodeAux:
+			key, err := dec.readString()
+			if err != nil {
+				return err
+			}
+			value, err := dec.readString()
+			if err != nil {
+				return err
+			}
+			dec.Aux[string(key)] = string(value)
+		case opCodeExpireTimeMs:
+			buf := make([]byte, 8)
+			if err := dec.readFull(buf); err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+		case opCodeExpireTime:
+			buf := make([]byte, 4)
+			if err := dec.readFull(buf); err != nil {
+				return err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case opCodeIdle:
+			if _, err := dec.readPlainLength(); err != nil {
+				return err
+			}
+		case opCodeFreq:
+			if _, err := dec.readByte(); err != nil {
+				return err
+			}
+		case opCodeFunction2:
+			// 函数库的源码，本实现不支持 FUNCTION，直接跳过
+			if _, err := dec.readString(); err != nil {
+				return err
+			}
+		case opCodeFunctionPre, opCodeModuleAux:
+			return fmt.Errorf("rdb: unsupported opcode %d", opCode)
+		default:
+			o, err := dec.readObject(opCode)
+			if err != nil {
+				return err
+			}
+			o.DB = dbIndex
+			o.ExpireAt = expireAt
+			expireAt = 0
+			if !cb(o) {
+				return nil
+			}
+		}
+	}
+}
+
+// readObject 读取 key 以及对应类型的 value
+
+func (dec *Decoder) readObject(objType byte) (*Object, error) {
+	key, err := dec.readString()
+	if err != nil {
+		return nil, err
+	}
+	value, err := dec.readValue(objType)
+	if err != nil {
+		return nil, fmt.Errorf("%w of key %s", err, string(key))
+	}
+	return &Object{
+		Key:   string(key),
+		Type:  int(objType),
+		Value: value,
+	}, nil
+}
+
+// readValue 读取对应类型的值，不包含类型字节和 key
+
+func (dec *Decoder) readValue(objType byte) (interface{}, error) {
+	switch objType {
+	case TypeString:
+		return dec.readString()
+	}
+	return nil, fmt.Errorf("%w %d", errUnsupported, objType)
+}
+
+func (dec *Decoder) verifyChecksum() error {
+	if dec.version < 5 { // RDB 5 之前没有校验和
+		return nil
+	}
+	expected := dec.crc
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(dec.r, buf); err != nil {
+		return err
+	}
+	checksum := binary.LittleEndian.Uint64(buf)
+	if checksum != 0 && checksum != expected {
+		return errChecksum
+	}
+	return nil
+}
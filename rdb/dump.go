@@ -0,0 +1,73 @@
+package rdb
+
+import (
+	"go-redis/interface/database"
+	"io"
+)
+
+type entry struct {
+	key    string
+	entity *database.DataEntity
+}
+
+// Snapshot 保存某一时刻全部子数据库中 key 与 entity 的对应关系
+// value 在写入时总是被整体替换而不会原地修改，因此快照中引用的 entity 不会受到后续写操作的影响，
+// 取得快照之后编码期间无需阻塞其他客户端
+
+type Snapshot struct {
+	dbs [][]entry // 下标为子数据库编号
+}
+
+// TakeSnapshot 遍历 engine 的每个子数据库，只复制 key 和 entity 的引用，不编码
+// 调用方暂停写操作时，得到的快照与某一个时刻的数据完全一致
+
+func TakeSnapshot(engine database.DBEngine) *Snapshot {
+	s := &Snapshot{dbs: make([][]entry, engine.GetDBNum())}
+	for i := range s.dbs {
+		snapshot := make([]entry, 0)
+		engine.ForEach(i, func(key string, entity *database.DataEntity) bool {
+			snapshot = append(snapshot, entry{key: key, entity: entity})
+			return true
+		})
+		s.dbs[i] = snapshot
+	}
+	return s
+}
+
+// Dump 将快照以 RDB 格式写入 w，aux 为额外写入的辅助字段
+
+func (s *Snapshot) Dump(w io.Writer, aux map[string]string) error {
+	enc := NewEncoder(w)
+	if err := enc.WriteHeader(); err != nil {
+		return err
+	}
+	if err := enc.WriteDefaultAux(); err != nil {
+		return err
+	}
+	for k, v := range aux {
+		if err := enc.WriteAux(k, v); err != nil {
+			return err
+		}
+	}
+	for i, snapshot := range s.dbs {
+		if len(snapshot) == 0 {
+			continue
+		}
+		if err := enc.WriteDBHeader(i, uint64(len(snapshot)), 0); err != nil {
+			return err
+		}
+		for _, e := range snapshot {
+			if err := enc.WriteObject(e.key, e.entity.Data, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return enc.WriteEnd()
+}
+
+// Dump 将 engine 中的全部数据以 RDB 格式写入 w，aux 为额外写入的辅助字段
+// 每个子数据库先遍历出一份快照再编码，不同子数据库的快照不是同一时刻取得的
+
+func Dump(w io.Writer, engine database.DBEngine, aux map[string]string) error {
+	return TakeSnapshot(engine).Dump(w, aux)
+}
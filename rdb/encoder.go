@@ -0,0 +1,204 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Encoder 将数据以 RDB 格式写入 io.Writer，写入的同时计算校验和
+
+type Encoder struct {
+	w   io.Writer
+	crc uint64
+	buf [9]byte // 长度编码等小块数据的临时缓冲，避免频繁分配
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (enc *Encoder) write(p []byte) error {
+	_, err := enc.w.Write(p)
+	if err != nil {
+		return err
+	}
+	enc.crc = crc64Update(enc.crc, p)
+	return nil
+}
+
+func (enc *Encoder) writeByte(b byte) error {
+	enc.buf[0] = b
+	return enc.write(enc.buf[:1])
+}
+
+// writeLength 按照 RDB 的长度编码写入一个长度值
+
+func (enc *Encoder) writeLength(length uint64) error {
+	var buf []byte
+	switch {
+	case length < 1<<6:
+		buf = enc.buf[:1]
+		buf[0] = byte(length) | len6Bit<<6
+	case length < 1<<14:
+		buf = enc.buf[:2]
+		buf[0] = byte(length>>8) | len14Bit<<6
+		buf[1] = byte(length)
+	case length <= 0xffffffff:
+		buf = enc.buf[:5]
+		buf[0] = len32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+	default:
+		buf = enc.buf[:9]
+		buf[0] = len64Bit
+		binary.BigEndian.PutUint64(buf[1:], length)
+	}
+	return enc.write(buf)
+}
+
+// writeString 写入一个字符串，能够用整数表示的字符串会被编码为整数以节约空间
+
+func (enc *Encoder) writeString(s []byte) error {
+	if len(s) <= 11 {
+		if ok, err := enc.tryWriteIntString(s); ok || err != nil {
+			return err
+		}
+	}
+	if err := enc.writeLength(uint64(len(s))); err != nil {
+		return err
+	}
+	return enc.write(s)
+}
+
+func (enc *Encoder) tryWriteIntString(s []byte) (bool, error) {
+	val, err := strconv.ParseInt(string(s), 10, 32)
+	if err != nil || strconv.FormatInt(val, 10) != string(s) { // 只编码规范形式的整数，如 "01" 需要原样保存
+		return false, nil
+	}
+	var buf []byte
+	switch {
+	case val >= -1<<7 && val < 1<<7:
+		buf = enc.buf[:2]
+		buf[0] = lenEncVal<<6 | encInt8
+		buf[1] = byte(int8(val))
+	case val >= -1<<15 && val < 1<<15:
+		buf = enc.buf[:3]
+		buf[0] = lenEncVal<<6 | encInt16
+		binary.LittleEndian.PutUint16(buf[1:], uint16(int16(val)))
+	default:
+		buf = enc.buf[:5]
+		buf[0] = lenEncVal<<6 | encInt32
+		binary.LittleEndian.PutUint32(buf[1:], uint32(int32(val)))
+	}
+	return true, enc.write(buf)
+}
+
+// WriteHeader 写入文件头 "REDIS0009"
+
+func (enc *Encoder) WriteHeader() error {
+	return enc.write([]byte(fmt.Sprintf("%s%04d", magic, Version)))
+}
+
+// WriteAux 写入一个辅助字段，如 redis-ver、ctime
+
+func (enc *Encoder) WriteAux(key string, value string) error {
+	if err := enc.writeByte(opCodeAux); err != nil {
+		return err
+	}
+	if err := enc.writeString([]byte(key)); err != nil {
+		return err
+	}
+	return enc.writeString([]byte(value))
+}
+
+// WriteDefaultAux 写入 Redis 通常会写入的辅助字段
+
+func (enc *Encoder) WriteDefaultAux() error {
+	aux := [][2]string{
+		{"redis-ver", "7.0.0"},
+		{"redis-bits", strconv.Itoa(strconv.IntSize)},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	for _, kv := range aux {
+		if err := enc.WriteAux(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteDBHeader 写入 SELECTDB 以及 RESIZEDB，标识后续的 key 属于哪一个子数据库
+
+func (enc *Encoder) WriteDBHeader(dbIndex int, keyCount uint64, ttlCount uint64) error {
+	if err := enc.writeByte(opCodeSelectDB); err != nil {
+		return err
+	}
+	if err := enc.writeLength(uint64(dbIndex)); err != nil {
+		return err
+	}
+	if err := enc.writeByte(opCodeResizeDB); err != nil {
+		return err
+	}
+	if err := enc.writeLength(keyCount); err != nil {
+		return err
+	}
+	return enc.writeLength(ttlCount)
+}
+
+// WriteObject 写入一条 key-value 记录，expireAt 为 unix 毫秒时间戳，0 表示永不过期
+
+func (enc *Encoder) WriteObject(key string, value interface{}, expireAt int64) error {
+	if expireAt > 0 {
+		if err := enc.writeByte(opCodeExpireTimeMs); err != nil {
+			return err
+		}
+		buf := enc.buf[:8]
+		binary.LittleEndian.PutUint64(buf, uint64(expireAt))
+		if err := enc.write(buf); err != nil {
+			return err
+		}
+	}
+	objType, err := valueType(value)
+	if err != nil {
+		return err
+	}
+	if err := enc.writeByte(objType); err != nil {
+		return err
+	}
+	if err := enc.writeString([]byte(key)); err != nil {
+		return err
+	}
+	return enc.writeValue(value)
+}
+
+// valueType 返回值在 RDB 中对应的对象类型
+func valueType(value interface{}) (byte, error) {
+	switch value.(type) {
+	case []byte:
+		return TypeString, nil
+	}
+	return 0, errUnsupported
+}
+
+// writeValue 写入值本身，不包含类型字节和 key
+func (enc *Encoder) writeValue(value interface{}) error {
+	switch val := value.(type) {
+	case []byte:
+		return enc.writeString(val)
+	}
+	return errUnsupported
+}
+
+// WriteEnd 写入结束标记 EOF 以及 8 字节的校验和
+
+func (enc *Encoder) WriteEnd() error {
+	if err := enc.writeByte(opCodeEOF); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, enc.crc)
+	_, err := enc.w.Write(buf) // 校验和本身不参与校验和的计算
+	return err
+}
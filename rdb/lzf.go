@@ -0,0 +1,55 @@
+package rdb
+
+import "errors"
+
+var errLZFCorrupted = errors.New("rdb: corrupted lzf data")
+
+// maxLZFRatio 是 LZF 的最大压缩比：一个 3 字节的回溯引用最多展开为 264 字节
+const maxLZFRatio = 88
+
+// lzfDecompress 解压 Redis 使用的 LZF 压缩字符串，rawLen 为解压后的长度
+// rawLen 来自输入数据，超出压缩比上限时直接判定为损坏，避免按伪造的长度分配内存
+
+func lzfDecompress(in []byte, rawLen uint64) ([]byte, error) {
+	if rawLen > uint64(len(in))*maxLZFRatio {
+		return nil, errLZFCorrupted
+	}
+	out := make([]byte, 0, rawLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 { // 字面量，后面紧跟 ctrl+1 个原样字节
+			length := ctrl + 1
+			if ip+length > len(in) {
+				return nil, errLZFCorrupted
+			}
+			out = append(out, in[ip:ip+length]...)
+			ip += length
+			continue
+		}
+		// 回溯引用：从已解压的数据中复制一段
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, errLZFCorrupted
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLZFCorrupted
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[ip]) - 1
+		ip++
+		if ref < 0 {
+			return nil, errLZFCorrupted
+		}
+		for i := 0; i < length+2; i++ { // 引用区间可能与输出区间重叠，只能逐字节复制
+			out = append(out, out[ref+i])
+		}
+	}
+	if uint64(len(out)) != rawLen {
+		return nil, errLZFCorrupted
+	}
+	return out, nil
+}
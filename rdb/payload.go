@@ -0,0 +1,70 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// DUMP 生成的序列化数据由以下几部分组成，与 Redis 的格式一致，可以在两者之间互相 RESTORE：
+// <对象类型 1 字节><RDB 编码的值><RDB 版本号 2 字节，小端序><CRC64 校验和 8 字节，小端序>
+// 校验和覆盖前面的全部内容
+
+var errBadPayload = errors.New("DUMP payload version or checksum are wrong")
+
+// DumpValue 将一个值序列化为 DUMP 格式
+
+func DumpValue(value interface{}) ([]byte, error) {
+	objType, err := valueType(value)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	if err := enc.writeByte(objType); err != nil {
+		return nil, err
+	}
+	if err := enc.writeValue(value); err != nil {
+		return nil, err
+	}
+	version := enc.buf[:2]
+	binary.LittleEndian.PutUint16(version, Version)
+	if err := enc.write(version); err != nil {
+		return nil, err
+	}
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, enc.crc)
+	buf.Write(checksum)
+	return buf.Bytes(), nil
+}
+
+// RestoreValue 解析 DUMP 格式的数据，版本号高于 MaxVersion 或校验和不匹配时返回错误
+
+func RestoreValue(payload []byte) (interface{}, error) {
+	if len(payload) < 10 {
+		return nil, errBadPayload
+	}
+	footer := payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(footer[:2])
+	if version > MaxVersion {
+		return nil, errBadPayload
+	}
+	checksum := binary.LittleEndian.Uint64(footer[2:])
+	if checksum != 0 && checksum != Checksum(payload[:len(payload)-8]) {
+		return nil, errBadPayload
+	}
+	body := payload[:len(payload)-10]
+	dec := NewDecoder(bytes.NewReader(body))
+	objType, err := dec.readByte()
+	if err != nil {
+		return nil, errBadPayload
+	}
+	value, err := dec.readValue(objType)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.r.ReadByte(); err == nil { // 值之后不应该还有多余的数据
+		return nil, errBadPayload
+	}
+	return value, nil
+}
@@ -0,0 +1,93 @@
+// rdb 包实现了 Redis RDB 快照文件的编码与解码，格式兼容 Redis RDB version 9 及以上版本
+
+package rdb
+
+import (
+	"errors"
+	"hash/crc64"
+)
+
+const (
+	// Version 是写出 RDB 文件时使用的版本号
+	Version = 9
+	// MaxVersion 是能够读取的最高 RDB 版本号
+	MaxVersion = 12
+	// MinVersion 是能够读取的最低 RDB 版本号
+	MinVersion = 1
+
+	magic = "REDIS"
+)
+
+// 对象类型，即 RDB 中 key-value 记录开头的 type 字节
+const (
+	TypeString = 0
+	TypeList   = 1
+	TypeSet    = 2
+	TypeZSet   = 3
+	TypeHash   = 4
+)
+
+// 特殊操作码
+const (
+	opCodeSlotInfo     = 244
+	opCodeFunction2    = 245
+	opCodeFunctionPre  = 246
+	opCodeModuleAux    = 247
+	opCodeIdle         = 248
+	opCodeFreq         = 249
+	opCodeAux          = 250
+	opCodeResizeDB     = 251
+	opCodeExpireTimeMs = 252
+	opCodeExpireTime   = 253
+	opCodeSelectDB     = 254
+	opCodeEOF          = 255
+)
+
+// 长度编码，取首字节的高两位
+const (
+	len6Bit      = 0
+	len14Bit     = 1
+	len32Or64Bit = 2
+	lenEncVal    = 3
+
+	len32Bit = 0x80
+	len64Bit = 0x81
+)
+
+// 长度编码为 lenEncVal 时，低 6 位表示字符串的特殊编码方式
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+// Object 是从 RDB 中解析出的一条 key-value 记录
+type Object struct {
+	DB       int         // 所属的子数据库
+	Key      string      // 键
+	Type     int         // 对象类型，如 TypeString
+	Value    interface{} // 值，string 类型为 []byte
+	ExpireAt int64       // 过期时间（unix 毫秒时间戳），0 表示永不过期
+}
+
+var (
+	errInvalidMagic   = errors.New("rdb: invalid magic header")
+	errChecksum       = errors.New("rdb: checksum mismatch")
+	errUnsupported    = errors.New("rdb: unsupported object type")
+	errUnsupportedEnc = errors.New("rdb: unsupported string encoding")
+)
+
+// Redis 使用的 CRC-64/Jones 多项式（位反转形式），初始值与结果异或值均为 0
+var crcTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// crc64Update 在 crc 的基础上继续计算 p 的校验和
+// 标准库的 crc64.Update 会在计算前后各取一次反，这里抵消掉这两次取反
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crcTable, p)
+}
+
+// Checksum 计算 p 的 CRC-64/Jones 校验和
+func Checksum(p []byte) uint64 {
+	return crc64Update(0, p)
+}
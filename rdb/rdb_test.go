@@ -0,0 +1,244 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	// CRC-64/Jones 的标准校验值，与 Redis 源码 crc64.c 中的测试一致
+	if got := Checksum([]byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Errorf("checksum of 123456789 is %x", got)
+	}
+	if got := Checksum(nil); got != 0 {
+		t.Errorf("checksum of empty input is %x", got)
+	}
+	// 分段计算与一次计算的结果相同
+	data := []byte("This is a test of the emergency broadcast system.")
+	if crc64Update(crc64Update(0, data[:10]), data[10:]) != Checksum(data) {
+		t.Error("incremental checksum mismatch")
+	}
+}
+
+func TestRestoreRedisPayload(t *testing.T) {
+	// Redis 对 SET mykey 10 执行 DUMP 得到的数据
+	payload := []byte("\x00\xc0\n\n\x00n\x9fWE\x0e\xaec\xbb")
+	value, err := RestoreValue(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value.([]byte)) != "10" {
+		t.Errorf("restored %q", value)
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	values := []string{
+		"",
+		"hello",
+		"10",
+		"-129",
+		"32768",
+		"-2147483648",
+		"2147483648", // 超出 int32，按字符串保存
+		"01",         // 非规范形式的整数，按字符串保存
+		strings.Repeat("x", 100),
+		strings.Repeat("y", 20000),
+		strings.Repeat("z", maxPrealloc*3+7),
+	}
+	for _, value := range values {
+		payload, err := DumpValue([]byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := RestoreValue(payload)
+		if err != nil {
+			t.Errorf("restore %.20q: %v", value, err)
+			continue
+		}
+		if string(restored.([]byte)) != value {
+			t.Errorf("restore %.20q got %.20q", value, restored)
+		}
+	}
+}
+
+func TestRestoreBadPayload(t *testing.T) {
+	payload, err := DumpValue([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	withFooter := func(body []byte, version uint16) []byte {
+		p := append([]byte{}, body...)
+		p = append(p, 0, 0)
+		binary.LittleEndian.PutUint16(p[len(p)-2:], version)
+		checksum := make([]byte, 8)
+		binary.LittleEndian.PutUint64(checksum, Checksum(p))
+		return append(p, checksum...)
+	}
+	body := payload[:len(payload)-10]
+
+	corrupted := append([]byte{}, payload...)
+	corrupted[2] ^= 0xff
+	badChecksum := append([]byte{}, payload...)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"corrupted value", corrupted},
+		{"bad checksum", badChecksum},
+		{"too short", payload[:9]},
+		{"newer version", withFooter(body, MaxVersion+1)},
+		{"trailing data", withFooter(append(append([]byte{}, body...), 'x'), Version)},
+		{"truncated value", withFooter(body[:len(body)-1], Version)},
+		{"unsupported type", withFooter([]byte{TypeList, 0}, Version)},
+	}
+	for _, tt := range tests {
+		if _, err := RestoreValue(tt.payload); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestRestoreHugeLength(t *testing.T) {
+	// 声称长度为 4GB 的字符串，校验和为 0 时不做校验，解析时不能按声称的长度分配内存
+	payload := []byte{TypeString, len32Bit, 0xff, 0xff, 0xff, 0xff, 'a', 'b'}
+	payload = append(payload, Version, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	if _, err := RestoreValue(payload); err == nil {
+		t.Error("expected error")
+	}
+	lzf := []byte{TypeString, lenEncVal<<6 | encLZF, 2, len32Bit, 0xff, 0xff, 0xff, 0xff, 0, 'a'}
+	lzf = append(lzf, Version, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	if _, err := RestoreValue(lzf); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestLZFDecompress(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"literal", []byte{2, 'a', 'b', 'c'}, "abc"},
+		// 字面量 "a" 之后引用距离为 1、长度为 7+21+2 的重叠区间
+		{"long overlapping ref", []byte{0, 'a', 7 << 5, 21, 0}, strings.Repeat("a", 31)},
+		// 字面量 "abc" 之后引用距离为 3、长度为 1+2 的区间
+		{"short ref", []byte{2, 'a', 'b', 'c', 1 << 5, 2, 0, 'd'}, "abcabcd"},
+		{"empty", nil, ""},
+	}
+	for _, tt := range tests {
+		got, err := lzfDecompress(tt.in, uint64(len(tt.want)))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	corrupted := []struct {
+		name   string
+		in     []byte
+		rawLen uint64
+	}{
+		{"truncated literal", []byte{5, 'a', 'b'}, 6},
+		{"ref before start", []byte{0, 'a', 1 << 5, 5}, 4},
+		{"missing ref offset", []byte{0, 'a', 1 << 5}, 4},
+		{"missing long length", []byte{0, 'a', 7 << 5}, 4},
+		{"length mismatch", []byte{2, 'a', 'b', 'c'}, 4},
+		{"impossible raw length", []byte{2, 'a', 'b', 'c'}, 1 << 40},
+	}
+	for _, tt := range corrupted {
+		if _, err := lzfDecompress(tt.in, tt.rawLen); err != errLZFCorrupted {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestRestoreLZFString(t *testing.T) {
+	// Redis 对较长的字符串使用 LZF 压缩
+	compressed := []byte{0, 'a', 7 << 5, 21, 0}
+	body := []byte{TypeString, lenEncVal<<6 | encLZF, byte(len(compressed)), 31}
+	body = append(body, compressed...)
+	body = append(body, Version, 0)
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, Checksum(body))
+	value, err := RestoreValue(append(body, checksum...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value.([]byte)) != strings.Repeat("a", 31) {
+		t.Errorf("restored %q", value)
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+	steps := []func() error{
+		enc.WriteHeader,
+		enc.WriteDefaultAux,
+		func() error { return enc.WriteAux("custom", "value") },
+		func() error { return enc.WriteDBHeader(0, 2, 1) },
+		func() error { return enc.WriteObject("a", []byte("1"), 0) },
+		func() error { return enc.WriteObject("b", []byte("hello"), 1700000000000) },
+		func() error { return enc.WriteDBHeader(3, 1, 0) },
+		func() error { return enc.WriteObject("c", []byte(strings.Repeat("c", 70000)), 0) },
+		enc.WriteEnd,
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := buf.Bytes()
+
+	objects := make([]*Object, 0)
+	dec := NewDecoder(bytes.NewReader(data))
+	err := dec.Parse(func(o *Object) bool {
+		objects = append(objects, o)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Version() != Version {
+		t.Errorf("version %d", dec.Version())
+	}
+	if dec.Aux["custom"] != "value" || dec.Aux["redis-ver"] == "" {
+		t.Errorf("aux %v", dec.Aux)
+	}
+	expected := []Object{
+		{DB: 0, Key: "a", Value: []byte("1")},
+		{DB: 0, Key: "b", Value: []byte("hello"), ExpireAt: 1700000000000},
+		{DB: 3, Key: "c", Value: []byte(strings.Repeat("c", 70000))},
+	}
+	if len(objects) != len(expected) {
+		t.Fatalf("decoded %d objects", len(objects))
+	}
+	for i, o := range objects {
+		e := expected[i]
+		if o.DB != e.DB || o.Key != e.Key || o.Type != TypeString || o.ExpireAt != e.ExpireAt ||
+			!bytes.Equal(o.Value.([]byte), e.Value.([]byte)) {
+			t.Errorf("object %d: got db=%d key=%s expire=%d", i, o.DB, o.Key, o.ExpireAt)
+		}
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-20] ^= 0xff // 修改最后一个 value 中的数据
+	err = NewDecoder(bytes.NewReader(corrupted)).Parse(func(o *Object) bool { return true })
+	if !errors.Is(err, errChecksum) {
+		t.Errorf("expected checksum error, got %v", err)
+	}
+
+	// 截断的文件
+	err = NewDecoder(bytes.NewReader(data[:len(data)/2])).Parse(func(o *Object) bool { return true })
+	if err == nil {
+		t.Error("expected error on truncated file")
+	}
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
 	"go-redis/interface/resp"
 	"go-redis/lib/logger"
@@ -28,6 +29,7 @@ type Client struct {
 	waitingReqs chan *request // waiting response
 	ticker      *time.Ticker
 	addr        string
+	tlsConfig   *tls.Config // nil for plaintext connections
 
 	status  int32
 	working *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
@@ -39,6 +41,7 @@ type request struct {
 	args      [][]byte
 	reply     resp.Reply
 	heartbeat bool
+	asking    bool // send ASKING right before args on the same connection
 	waiting   *wait.Wait
 	err       error
 }
@@ -48,19 +51,49 @@ const (
 	maxWait  = 3 * time.Second
 )
 
-// MakeClient creates a new client
+// error messages of requests that did not get a reply from server
+const (
+	closedErrMsg  = "client closed"
+	timeoutErrMsg = "server time out"
+	failedErrMsg  = "request failed "
+)
+
+// unixScheme is the prefix of unix socket addresses accepted by MakeClient
+const unixScheme = "unix://"
+
+// MakeClient creates a new client, addr is host:port or unix:///path/to/socket
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
-	return &Client{
+	return MakeTLSClient(addr, nil)
+}
+
+// MakeTLSClient creates a new client connecting with TLS, a nil tlsConfig means plaintext like MakeClient.
+// The same config is used when reconnecting.
+func MakeTLSClient(addr string, tlsConfig *tls.Config) (*Client, error) {
+	client := &Client{
 		addr:        addr,
-		conn:        conn,
+		tlsConfig:   tlsConfig,
 		pendingReqs: make(chan *request, chanSize),
 		waitingReqs: make(chan *request, chanSize),
 		working:     &sync.WaitGroup{},
-	}, nil
+	}
+	conn, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	client.conn = conn
+	return client, nil
+}
+
+// dial connects to addr, an address like unix:///tmp/redis.sock connects to the unix socket
+func (client *Client) dial() (net.Conn, error) {
+	network, address := "tcp", client.addr
+	if strings.HasPrefix(address, unixScheme) {
+		network, address = "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	if client.tlsConfig != nil {
+		return tls.Dial(network, address, client.tlsConfig)
+	}
+	return net.Dial(network, address)
 }
 
 func (client *Client) RemoteAddress() string {
@@ -76,9 +109,11 @@ func (client *Client) Start() {
 	atomic.StoreInt32(&client.status, running)
 }
 
-// Close stops asynchronous goroutines and close connection
+// Close stops asynchronous goroutines and close connection, it is safe to call Close more than once
 func (client *Client) Close() {
-	atomic.StoreInt32(&client.status, closed)
+	if !atomic.CompareAndSwapInt32(&client.status, running, closed) {
+		return
+	}
 	client.ticker.Stop()
 	// stop new request
 	close(client.pendingReqs)
@@ -91,6 +126,12 @@ func (client *Client) Close() {
 	close(client.waitingReqs)
 }
 
+// IsClosed returns true if the client has been closed, e.g. by Close or after reconnecting failed,
+// a closed client cannot be used anymore and should be replaced by a new one
+func (client *Client) IsClosed() bool {
+	return atomic.LoadInt32(&client.status) == closed
+}
+
 func (client *Client) reconnect() {
 	logger.Info("reconnect with: " + client.addr)
 	_ = client.conn.Close() // ignore possible errors from repeated closes
@@ -98,7 +139,7 @@ func (client *Client) reconnect() {
 	var conn net.Conn
 	for i := 0; i < 3; i++ {
 		var err error
-		conn, err = net.Dial("tcp", client.addr)
+		conn, err = client.dial()
 		if err != nil {
 			logger.Error("reconnect error: " + err.Error())
 			time.Sleep(time.Second)
@@ -111,6 +152,10 @@ func (client *Client) reconnect() {
 		client.Close()
 		return
 	}
+	if client.IsClosed() { // closed by others while reconnecting
+		_ = conn.Close()
+		return
+	}
 	client.conn = conn
 
 	close(client.waitingReqs)
@@ -137,12 +182,23 @@ func (client *Client) handleWrite() {
 
 // Send sends a request to redis server
 func (client *Client) Send(args [][]byte) resp.Reply {
+	return client.send(args, false)
+}
+
+// SendAsking sends ASKING immediately followed by args, no other request can be sent between them,
+// it is used to follow an ASK redirection of redis cluster
+func (client *Client) SendAsking(args [][]byte) resp.Reply {
+	return client.send(args, true)
+}
+
+func (client *Client) send(args [][]byte, asking bool) resp.Reply {
 	if atomic.LoadInt32(&client.status) != running {
-		return reply.MakeErrReply("client closed")
+		return reply.MakeErrReply(closedErrMsg)
 	}
 	req := &request{
 		args:      args,
 		heartbeat: false,
+		asking:    asking,
 		waiting:   &wait.Wait{},
 	}
 	req.waiting.Add(1)
@@ -151,10 +207,10 @@ func (client *Client) Send(args [][]byte) resp.Reply {
 	client.pendingReqs <- req
 	timeout := req.waiting.WaitWithTimeout(maxWait)
 	if timeout {
-		return reply.MakeErrReply("server time out")
+		return reply.MakeErrReply(timeoutErrMsg)
 	}
 	if req.err != nil {
-		return reply.MakeErrReply("request failed " + req.err.Error())
+		return reply.MakeErrReply(failedErrMsg + req.err.Error())
 	}
 	return req.reply
 }
@@ -178,6 +234,9 @@ func (client *Client) doRequest(req *request) {
 	}
 	re := reply.MakeMultiBulkReply(req.args)
 	bytes := re.ToBytes()
+	if req.asking {
+		bytes = append(reply.MakeMultiBulkReply([][]byte{[]byte("ASKING")}).ToBytes(), bytes...)
+	}
 	var err error
 	for i := 0; i < 3; i++ { // only retry, waiting for handleRead
 		_, err = client.conn.Write(bytes)
@@ -188,6 +247,9 @@ func (client *Client) doRequest(req *request) {
 		}
 	}
 	if err == nil {
+		if req.asking {
+			client.waitingReqs <- &request{heartbeat: true} // reply of ASKING is dropped
+		}
 		client.waitingReqs <- req
 	} else {
 		req.err = err
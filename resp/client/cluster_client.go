@@ -0,0 +1,519 @@
+package client
+
+import (
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/lib/consistenthash"
+	"go-redis/lib/logger"
+	"go-redis/lib/slot"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxRedirects       = 5
+	minRefreshInterval = time.Second
+)
+
+// ClusterClient is a client of go-redis cluster, it sends each request to the node serving its key.
+// Topology comes from CLUSTER SLOTS when the cluster uses slot routing, or from CLUSTER RING when it uses
+// the consistent hash ring. Every node has its own pipeline Client.
+//
+// In slot mode connections are switched to redirect mode (CLIENT REDIRECT ON), so the client follows
+// MOVED and ASK itself; in hash mode nodes proxy mis-routed requests, so a stale ring only costs an extra hop.
+// Requests are routed by their first argument after the command name; SELECT, MULTI and other connection-state
+// commands are not supported because a request may be sent through any connection.
+type ClusterClient struct {
+	seeds []string
+
+	mu      sync.RWMutex
+	clients map[string]*Client
+	nodes   []string                // nodes of current topology
+	slots   []string                // slot -> node, used in slot mode
+	ring    *consistenthash.NodeMap // used in hash mode
+
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+	closed      int32
+}
+
+// MakeClusterClient creates a cluster client and loads topology from seeds, seeds are addresses of any nodes of the cluster
+func MakeClusterClient(seeds []string) (*ClusterClient, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no seed nodes")
+	}
+	cluster := &ClusterClient{
+		seeds:   seeds,
+		clients: make(map[string]*Client),
+	}
+	if err := cluster.Refresh(); err != nil {
+		cluster.Close()
+		return nil, err
+	}
+	return cluster, nil
+}
+
+// Close closes connections to all nodes
+func (cluster *ClusterClient) Close() {
+	if !atomic.CompareAndSwapInt32(&cluster.closed, 0, 1) {
+		return
+	}
+	cluster.mu.Lock()
+	clients := cluster.clients
+	cluster.clients = make(map[string]*Client)
+	cluster.mu.Unlock()
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+// Nodes returns nodes of current topology
+func (cluster *ClusterClient) Nodes() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return append([]string{}, cluster.nodes...)
+}
+
+// Refresh reloads topology, it asks known nodes first and then seeds
+func (cluster *ClusterClient) Refresh() error {
+	cluster.refreshMu.Lock()
+	defer cluster.refreshMu.Unlock()
+	return cluster.refresh()
+}
+
+// refreshIfStale reloads topology unless it has been reloaded recently,
+// so that a burst of MOVED or connection errors causes only one reload
+func (cluster *ClusterClient) refreshIfStale() {
+	cluster.refreshMu.Lock()
+	defer cluster.refreshMu.Unlock()
+	if time.Since(cluster.lastRefresh) < minRefreshInterval {
+		return
+	}
+	if err := cluster.refresh(); err != nil {
+		logger.Error("refresh cluster topology failed: " + err.Error())
+	}
+}
+
+func (cluster *ClusterClient) refresh() error {
+	cluster.lastRefresh = time.Now()
+	candidates := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, addr := range append(cluster.Nodes(), cluster.seeds...) {
+		if !seen[addr] {
+			seen[addr] = true
+			candidates = append(candidates, addr)
+		}
+	}
+	var lastErr error
+	for _, addr := range candidates {
+		client, err := cluster.getClient(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if lastErr = cluster.loadTopology(client); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// loadTopology asks node for slot assignment, or for the hash ring if the cluster does not use slot routing
+func (cluster *ClusterClient) loadTopology(client *Client) error {
+	var slots []string
+	var ring *consistenthash.NodeMap
+	var nodes []string
+	var err error
+	r := client.Send([][]byte{[]byte("CLUSTER"), []byte("SLOTS")})
+	if errReply, ok := r.(reply.ErrorReply); ok && strings.Contains(errReply.Error(), "slot routing disabled") {
+		ring, nodes, err = parseRing(client.Send([][]byte{[]byte("CLUSTER"), []byte("RING")}))
+	} else {
+		slots, nodes, err = parseSlots(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	current := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		current[node] = true
+	}
+	cluster.mu.Lock()
+	cluster.slots = slots
+	cluster.ring = ring
+	cluster.nodes = nodes
+	stale := make([]*Client, 0)
+	for addr, c := range cluster.clients {
+		if !current[addr] {
+			stale = append(stale, c)
+			delete(cluster.clients, addr)
+		}
+	}
+	cluster.mu.Unlock()
+	for _, c := range stale {
+		c.Close()
+	}
+	return nil
+}
+
+// parseSlots parses reply of CLUSTER SLOTS: [[start, end, [host, port, id]] ...]
+func parseSlots(r resp.Reply) ([]string, []string, error) {
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		return nil, nil, errors.New(errReply.Error())
+	}
+	slots := make([]string, slot.SlotCount)
+	nodes := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, item := range replyElems(r) {
+		elems := replyElems(item)
+		if len(elems) < 3 {
+			return nil, nil, errors.New("invalid CLUSTER SLOTS reply")
+		}
+		start, ok1 := elems[0].(*reply.IntReply)
+		end, ok2 := elems[1].(*reply.IntReply)
+		nodeInfo := replyElems(elems[2])
+		if !ok1 || !ok2 || len(nodeInfo) < 2 || start.Code < 0 || end.Code >= slot.SlotCount || start.Code > end.Code {
+			return nil, nil, errors.New("invalid CLUSTER SLOTS reply")
+		}
+		host, ok1 := nodeInfo[0].(*reply.BulkReply)
+		port, ok2 := nodeInfo[1].(*reply.IntReply)
+		if !ok1 || !ok2 {
+			return nil, nil, errors.New("invalid CLUSTER SLOTS reply")
+		}
+		addr := string(host.Arg) + ":" + strconv.FormatInt(port.Code, 10)
+		for s := start.Code; s <= end.Code; s++ {
+			slots[s] = addr
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			nodes = append(nodes, addr)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, nil, errors.New("no slot is served")
+	}
+	return slots, nodes, nil
+}
+
+// parseRing parses reply of CLUSTER RING: [virtual-nodes, [[host:port, weight] ...]]
+func parseRing(r resp.Reply) (*consistenthash.NodeMap, []string, error) {
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		return nil, nil, errors.New(errReply.Error())
+	}
+	elems := replyElems(r)
+	if len(elems) != 2 {
+		return nil, nil, errors.New("invalid CLUSTER RING reply")
+	}
+	replicas, ok := elems[0].(*reply.IntReply)
+	if !ok {
+		return nil, nil, errors.New("invalid CLUSTER RING reply")
+	}
+	ring := consistenthash.NewNodeMapWithReplicas(int(replicas.Code), nil)
+	nodes := make([]string, 0)
+	for _, item := range replyElems(elems[1]) {
+		nodeInfo := replyElems(item)
+		if len(nodeInfo) != 2 {
+			return nil, nil, errors.New("invalid CLUSTER RING reply")
+		}
+		addr, ok1 := nodeInfo[0].(*reply.BulkReply)
+		weight, ok2 := nodeInfo[1].(*reply.IntReply)
+		if !ok1 || !ok2 {
+			return nil, nil, errors.New("invalid CLUSTER RING reply")
+		}
+		ring.AddNodeWithWeight(string(addr.Arg), int(weight.Code))
+		nodes = append(nodes, string(addr.Arg))
+	}
+	if len(nodes) == 0 {
+		return nil, nil, errors.New("hash ring is empty")
+	}
+	return ring, nodes, nil
+}
+
+// replyElems returns elements of an array reply
+func replyElems(r resp.Reply) []resp.Reply {
+	switch r := r.(type) {
+	case *reply.MultiRawReply:
+		return r.Replies
+	case *reply.MultiBulkReply:
+		elems := make([]resp.Reply, len(r.Args))
+		for i, arg := range r.Args {
+			elems[i] = reply.MakeBulkReply(arg)
+		}
+		return elems
+	}
+	return nil
+}
+
+// getClient returns the pipeline client of node addr, connects to it if necessary
+func (cluster *ClusterClient) getClient(addr string) (*Client, error) {
+	cluster.mu.RLock()
+	client, ok := cluster.clients[addr]
+	cluster.mu.RUnlock()
+	if ok && !client.IsClosed() {
+		return client, nil
+	}
+	if atomic.LoadInt32(&cluster.closed) == 1 {
+		return nil, errors.New("cluster client closed")
+	}
+
+	client, err := MakeClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	client.Start()
+	// nodes in hash mode reject it and keep proxying requests, which is what we want.
+	// If the connection is re-established later it goes back to proxy mode, results are still correct.
+	client.Send([][]byte{[]byte("CLIENT"), []byte("REDIRECT"), []byte("ON")})
+
+	cluster.mu.Lock()
+	if existing, ok := cluster.clients[addr]; ok && !existing.IsClosed() {
+		cluster.mu.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	cluster.clients[addr] = client
+	cluster.mu.Unlock()
+	return client, nil
+}
+
+// dropClient closes the client of a node that cannot be reached
+func (cluster *ClusterClient) dropClient(addr string, client *Client) {
+	cluster.mu.Lock()
+	if cluster.clients[addr] == client {
+		delete(cluster.clients, addr)
+	}
+	cluster.mu.Unlock()
+	client.Close()
+}
+
+// pickNode returns the node serving key according to current topology
+func (cluster *ClusterClient) pickNode(key string) string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	var node string
+	if cluster.slots != nil {
+		node = cluster.slots[slot.HashSlot(key)]
+	} else if cluster.ring != nil {
+		node = cluster.ring.PickNode(key)
+	}
+	if node == "" && len(cluster.nodes) > 0 {
+		node = cluster.nodes[0]
+	}
+	return node
+}
+
+// groupID returns the routing unit of key: the slot in slot mode, the node in hash mode.
+// In slot mode keys of one multi-key request must be in the same slot, even if they are served by the same node
+func (cluster *ClusterClient) groupID(key string) string {
+	cluster.mu.RLock()
+	slotMode := cluster.slots != nil
+	cluster.mu.RUnlock()
+	if slotMode {
+		return strconv.Itoa(slot.HashSlot(key))
+	}
+	return cluster.pickNode(key)
+}
+
+// Send sends a request to the node serving its key, and follows redirections.
+// MGET, MSET, DEL, UNLINK, EXISTS and TOUCH are split by node (by slot in slot mode) and their results merged
+func (cluster *ClusterClient) Send(args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeErrReply("ERR empty command")
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "mget":
+		return cluster.mget(args)
+	case "mset":
+		return cluster.mset(args)
+	case "del", "unlink", "exists", "touch":
+		return cluster.countKeys(args)
+	}
+	key := ""
+	if len(args) > 1 {
+		key = string(args[1])
+	}
+	return cluster.sendByKey(key, args)
+}
+
+// sendByKey sends args to the node serving key, following MOVED and ASK at most maxRedirects times
+func (cluster *ClusterClient) sendByKey(key string, args [][]byte) resp.Reply {
+	addr := cluster.pickNode(key)
+	asking := false
+	var r resp.Reply
+	for i := 0; i <= maxRedirects; i++ {
+		if addr == "" {
+			return reply.MakeErrReply("CLUSTERDOWN no node available")
+		}
+		client, err := cluster.getClient(addr)
+		if err != nil {
+			cluster.refreshIfStale()
+			addr, asking = cluster.pickNode(key), false
+			r = reply.MakeErrReply("ERR " + err.Error())
+			continue
+		}
+		if asking {
+			r = client.SendAsking(args)
+		} else {
+			r = client.Send(args)
+		}
+		errReply, ok := r.(reply.ErrorReply)
+		if !ok {
+			return r
+		}
+		msg := errReply.Error()
+		if isConnErr(msg) {
+			if client.IsClosed() {
+				cluster.dropClient(addr, client)
+			}
+			cluster.refreshIfStale()
+			addr, asking = cluster.pickNode(key), false
+			continue
+		}
+		fields := strings.Fields(msg)
+		switch {
+		case len(fields) == 3 && fields[0] == "MOVED":
+			cluster.updateSlot(fields[1], fields[2])
+			go cluster.refreshIfStale()
+			addr, asking = fields[2], false
+		case len(fields) == 3 && fields[0] == "ASK":
+			addr, asking = fields[2], true
+		case len(fields) > 0 && fields[0] == "TRYAGAIN": // keys are being migrated, try again later
+			time.Sleep(10 * time.Millisecond)
+		default:
+			return r
+		}
+	}
+	return r
+}
+
+// updateSlot records the new owner of a slot received from MOVED
+func (cluster *ClusterClient) updateSlot(slotArg string, addr string) {
+	s, err := strconv.Atoi(slotArg)
+	if err != nil || s < 0 || s >= slot.SlotCount {
+		return
+	}
+	cluster.mu.Lock()
+	if cluster.slots != nil {
+		cluster.slots[s] = addr
+	}
+	cluster.mu.Unlock()
+}
+
+// isConnErr reports whether msg is an error of the connection rather than a reply from server
+func isConnErr(msg string) bool {
+	return msg == closedErrMsg || msg == timeoutErrMsg || strings.HasPrefix(msg, failedErrMsg)
+}
+
+// scatter groups keys by groupID, sends the request made by makeArgs for each group concurrently,
+// and returns the key indexes and reply of every group
+func (cluster *ClusterClient) scatter(keys []string, makeArgs func(indexes []int) [][]byte) ([][]int, []resp.Reply) {
+	groups := make([][]int, 0)
+	groupMap := make(map[string]int)
+	for i, key := range keys {
+		id := cluster.groupID(key)
+		g, ok := groupMap[id]
+		if !ok {
+			g = len(groups)
+			groupMap[id] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	replies := make([]resp.Reply, len(groups))
+	var wg sync.WaitGroup
+	for i, indexes := range groups {
+		wg.Add(1)
+		go func(i int, indexes []int) {
+			defer wg.Done()
+			replies[i] = cluster.sendByKey(keys[indexes[0]], makeArgs(indexes))
+		}(i, indexes)
+	}
+	wg.Wait()
+	return groups, replies
+}
+
+// pick returns cmdName followed by the arguments of keys at indexes, every key takes step arguments
+func pick(cmdName []byte, args [][]byte, indexes []int, step int) [][]byte {
+	result := make([][]byte, 0, len(indexes)*step+1)
+	result = append(result, cmdName)
+	for _, index := range indexes {
+		result = append(result, args[index*step:index*step+step]...)
+	}
+	return result
+}
+
+func (cluster *ClusterClient) mget(args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("mget")
+	}
+	keys := toKeys(args[1:], 1)
+	groups, replies := cluster.scatter(keys, func(indexes []int) [][]byte {
+		return pick(args[0], args[1:], indexes, 1)
+	})
+	result := make([][]byte, len(keys))
+	for i, r := range replies {
+		values := replyElems(r)
+		if len(values) != len(groups[i]) {
+			if reply.IsErrorReply(r) {
+				return r
+			}
+			return reply.MakeErrReply("ERR unexpected MGET reply")
+		}
+		for j, index := range groups[i] {
+			if bulk, ok := values[j].(*reply.BulkReply); ok {
+				result[index] = bulk.Arg
+			}
+		}
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+func (cluster *ClusterClient) mset(args [][]byte) resp.Reply {
+	if len(args) < 3 || len(args)%2 != 1 {
+		return reply.MakeArgNumErrReply("mset")
+	}
+	_, replies := cluster.scatter(toKeys(args[1:], 2), func(indexes []int) [][]byte {
+		return pick(args[0], args[1:], indexes, 2)
+	})
+	for _, r := range replies {
+		if reply.IsErrorReply(r) {
+			return r
+		}
+	}
+	return reply.MakeOkReply()
+}
+
+// countKeys executes DEL, UNLINK, EXISTS or TOUCH on every node and sums the results
+func (cluster *ClusterClient) countKeys(args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply(strings.ToLower(string(args[0])))
+	}
+	_, replies := cluster.scatter(toKeys(args[1:], 1), func(indexes []int) [][]byte {
+		return pick(args[0], args[1:], indexes, 1)
+	})
+	var count int64
+	for _, r := range replies {
+		intReply, ok := r.(*reply.IntReply)
+		if !ok {
+			if reply.IsErrorReply(r) {
+				return r
+			}
+			return reply.MakeErrReply("ERR unexpected reply")
+		}
+		count += intReply.Code
+	}
+	return reply.MakeIntReply(count)
+}
+
+// toKeys returns every step-th argument, starting from the first one
+func toKeys(args [][]byte, step int) []string {
+	keys := make([]string, 0, len(args)/step)
+	for i := 0; i < len(args); i += step {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
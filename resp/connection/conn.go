@@ -1,31 +1,76 @@
 package connection
 
 import (
+	"go-redis/interface/resp"
 	"go-redis/lib/sync/wait"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	flagSlave    = 1 << iota // 连接来自从节点
+	flagMaster               // 连接是与主节点之间的复制连接
+	flagRedirect             // 集群模式下对不属于本节点的 key 返回 MOVED 重定向，而不是代理转发
+	flagAsking               // 客户端发送了 ASKING，下一条指令可以访问本节点正在导入的槽位
+	flagMulti                // 连接处于 MULTI 开启的事务中
+)
+
 // Connection 用于述客户端连接
 type Connection struct {
 	conn         net.Conn
 	waitingReply wait.Wait  // 给客户端回发数据时，如果要杀掉程序，需要等待数据回发结束
 	mu           sync.Mutex // 锁，操作一个连接时，需要对其上锁
 	selectedDB   int        // 指示用户正在操作哪一个 DB
+	flags        uint64     // 连接的角色标记，如 flagSlave
+	id           int64      // 连接的唯一编号，从 1 开始递增
+	protocol     int        // HELLO 协商的协议版本
+	name         string     // 客户端名称
+	wbuf         []byte     // WriteBuffered 暂存的回复，Flush 时一次性写入连接
+
+	lastInteraction int64 // 上一次收到指令的时间，UnixNano，用于关闭空闲的连接
+	busy            int32 // 为 1 时正在执行指令，如阻塞在 WAIT 中，不算空闲
+
+	queue    [][][]byte // MULTI 之后入队的指令
+	txErrors []error    // 指令入队时发现的错误
 }
 
+var connCounter int64 // 已创建的连接数量，用于为连接分配编号
+
+const (
+	maxWriteBuffer = 64 * 1024   // 暂存的回复超过该大小时立即写入连接，与 Redis 的 NET_MAX_WRITES_PER_EVENT 相同
+	maxIdleBuffer  = 1024 * 1024 // 写入后缓冲区容量超过该大小则释放，避免一次大回复之后长期占用内存
+)
+
 func NewConn(conn net.Conn) *Connection {
 	return &Connection{
-		conn: conn,
+		conn:            conn,
+		id:              atomic.AddInt64(&connCounter, 1),
+		protocol:        resp.RESP2,
+		lastInteraction: time.Now().UnixNano(),
+	}
+}
+
+// NewFakeConn 创建一个没有网络连接的连接，用于加载 aof、执行主节点同步来的指令等场景，写入的回复会被丢弃
+func NewFakeConn() *Connection {
+	return &Connection{
+		protocol: resp.RESP2,
 	}
 }
 
 func (c *Connection) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
 	return c.conn.RemoteAddr()
 }
 
 func (c *Connection) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	_ = c.Flush() // 关闭前发出暂存的回复，如协议错误前已执行的指令的回复
 	c.waitingReply.WaitWithTimeout(10 * time.Second)
 	_ = c.conn.Close()
 	return nil
@@ -33,7 +78,7 @@ func (c *Connection) Close() error {
 
 // 给客户端发送（写）数据
 func (c *Connection) Write(bytes []byte) error {
-	if len(bytes) == 0 {
+	if len(bytes) == 0 || c.conn == nil {
 		return nil
 	}
 	c.mu.Lock()           // 加锁，同一时间只能有一个协程对客户端进行写数据
@@ -42,10 +87,57 @@ func (c *Connection) Write(bytes []byte) error {
 		c.waitingReply.Done()
 		c.mu.Unlock()
 	}()
+	if len(c.wbuf) > 0 { // 先发出暂存的回复，保证回复的顺序与指令的顺序一致
+		c.wbuf = append(c.wbuf, bytes...)
+		return c.flushLocked()
+	}
 	_, err := c.conn.Write(bytes)
 	return err
 }
 
+// WriteBuffered 暂存一条回复，直到调用 Flush 或暂存的数据超过 maxWriteBuffer 时才写入连接
+// 客户端使用管道一次发送多条指令时，这些指令的回复只需要一次系统调用
+func (c *Connection) WriteBuffered(bytes []byte) error {
+	if len(bytes) == 0 || c.conn == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wbuf = append(c.wbuf, bytes...)
+	if len(c.wbuf) < maxWriteBuffer {
+		return nil
+	}
+	c.waitingReply.Add(1)
+	defer c.waitingReply.Done()
+	return c.flushLocked()
+}
+
+// Flush 将暂存的回复写入连接
+func (c *Connection) Flush() error {
+	if c.conn == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.wbuf) == 0 {
+		return nil
+	}
+	c.waitingReply.Add(1)
+	defer c.waitingReply.Done()
+	return c.flushLocked()
+}
+
+// flushLocked 写出 wbuf 并清空，调用者需要持有 mu
+func (c *Connection) flushLocked() error {
+	_, err := c.conn.Write(c.wbuf)
+	if cap(c.wbuf) > maxIdleBuffer {
+		c.wbuf = nil
+	} else {
+		c.wbuf = c.wbuf[:0]
+	}
+	return err
+}
+
 func (c *Connection) GetDBIndex() int {
 	return c.selectedDB
 }
@@ -53,3 +145,116 @@ func (c *Connection) GetDBIndex() int {
 func (c *Connection) SelectDB(dbNum int) {
 	c.selectedDB = dbNum
 }
+
+func (c *Connection) SetSlave() {
+	c.flags |= flagSlave
+}
+
+func (c *Connection) IsSlave() bool {
+	return c.flags&flagSlave > 0
+}
+
+func (c *Connection) SetMaster() {
+	c.flags |= flagMaster
+}
+
+func (c *Connection) IsMaster() bool {
+	return c.flags&flagMaster > 0
+}
+
+// SetRedirect 开启或关闭该连接的重定向模式
+func (c *Connection) SetRedirect(on bool) {
+	if on {
+		c.flags |= flagRedirect
+	} else {
+		c.flags &^= flagRedirect
+	}
+}
+
+func (c *Connection) IsRedirect() bool {
+	return c.flags&flagRedirect > 0
+}
+
+// SetAsking 设置或清除 ASKING 标记
+func (c *Connection) SetAsking(on bool) {
+	if on {
+		c.flags |= flagAsking
+	} else {
+		c.flags &^= flagAsking
+	}
+}
+
+func (c *Connection) IsAsking() bool {
+	return c.flags&flagAsking > 0
+}
+
+// SetMultiState 开启或结束事务，已入队的指令和错误都会被清空
+func (c *Connection) SetMultiState(on bool) {
+	if on {
+		c.flags |= flagMulti
+	} else {
+		c.flags &^= flagMulti
+	}
+	c.queue = nil
+	c.txErrors = nil
+}
+
+func (c *Connection) InMultiState() bool {
+	return c.flags&flagMulti > 0
+}
+
+func (c *Connection) EnqueueCmd(cmdLine [][]byte) {
+	c.queue = append(c.queue, cmdLine)
+}
+
+func (c *Connection) GetQueuedCmdLine() [][][]byte {
+	return c.queue
+}
+
+func (c *Connection) AddTxError(err error) {
+	c.txErrors = append(c.txErrors, err)
+}
+
+func (c *Connection) GetTxErrors() []error {
+	return c.txErrors
+}
+
+func (c *Connection) GetID() int64 {
+	return c.id
+}
+
+// SetProtocol 设置回复使用的协议版本，之后的回复按该版本编码
+func (c *Connection) SetProtocol(ver int) {
+	c.protocol = ver
+}
+
+func (c *Connection) GetProtocol() int {
+	return c.protocol
+}
+
+func (c *Connection) SetName(name string) {
+	c.name = name
+}
+
+func (c *Connection) GetName() string {
+	return c.name
+}
+
+// SetBusy 在开始执行指令时设置为 true，执行完后设置为 false，同时记录交互时间
+func (c *Connection) SetBusy(busy bool) {
+	atomic.StoreInt64(&c.lastInteraction, time.Now().UnixNano())
+	if busy {
+		atomic.StoreInt32(&c.busy, 1)
+	} else {
+		atomic.StoreInt32(&c.busy, 0)
+	}
+}
+
+func (c *Connection) IsBusy() bool {
+	return atomic.LoadInt32(&c.busy) == 1
+}
+
+// IdleTime 返回距上一次交互（开始或结束执行指令）的时间
+func (c *Connection) IdleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.lastInteraction))
+}
@@ -0,0 +1,233 @@
+package connection
+
+import (
+	"bytes"
+	"go-redis/resp/reply"
+	"io"
+	"net"
+	"testing"
+)
+
+// recordConn 记录每次 Write 写入的数据，每次 Write 对应一次系统调用
+type recordConn struct {
+	net.Conn
+	writes [][]byte
+	closed bool
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.writes = append(c.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func (c *recordConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func (c *recordConn) written() []byte {
+	return bytes.Join(c.writes, nil)
+}
+
+func TestFlush(t *testing.T) {
+	raw := &recordConn{}
+	conn := NewConn(raw)
+	replies := [][]byte{
+		reply.MakeOkReply().ToBytes(),
+		reply.MakeBulkReply([]byte("value")).ToBytes(),
+		reply.MakeIntReply(42).ToBytes(),
+	}
+	for _, r := range replies {
+		if err := conn.WriteBuffered(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(raw.writes) != 0 {
+		t.Fatalf("buffered replies should not be written before Flush, got %d writes", len(raw.writes))
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.writes) != 1 || !bytes.Equal(raw.written(), bytes.Join(replies, nil)) {
+		t.Fatalf("expected one write with all replies, got %q", raw.writes)
+	}
+	// 没有暂存的回复时 Flush 不写入
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.writes) != 1 {
+		t.Errorf("empty Flush should not write, got %d writes", len(raw.writes))
+	}
+}
+
+func TestWriteBufferedThreshold(t *testing.T) {
+	raw := &recordConn{}
+	conn := NewConn(raw)
+	data := reply.MakeBulkReply(bytes.Repeat([]byte("v"), 1000)).ToBytes()
+	total := 0
+	for total+len(data) < maxWriteBuffer {
+		if err := conn.WriteBuffered(data); err != nil {
+			t.Fatal(err)
+		}
+		total += len(data)
+	}
+	if len(raw.writes) != 0 {
+		t.Fatalf("replies below %d bytes should stay buffered, got %d writes", maxWriteBuffer, len(raw.writes))
+	}
+	// 超过阈值时自动写出，不需要调用 Flush
+	if err := conn.WriteBuffered(data); err != nil {
+		t.Fatal(err)
+	}
+	total += len(data)
+	if len(raw.writes) != 1 || len(raw.writes[0]) != total {
+		t.Fatalf("expected one write of %d bytes, got %d writes", total, len(raw.writes))
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.writes) != 1 {
+		t.Errorf("nothing should be left after the automatic flush, got %d writes", len(raw.writes))
+	}
+}
+
+func TestWriteKeepsOrder(t *testing.T) {
+	raw := &recordConn{}
+	conn := NewConn(raw)
+	first := reply.MakeOkReply().ToBytes()
+	second := reply.MakeIntReply(1).ToBytes()
+	if err := conn.WriteBuffered(first); err != nil {
+		t.Fatal(err)
+	}
+	// Write 先发出暂存的回复，两者合并为一次写入
+	if err := conn.Write(second); err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.writes) != 1 || !bytes.Equal(raw.written(), append(first, second...)) {
+		t.Fatalf("got %q", raw.writes)
+	}
+}
+
+func TestCloseFlushes(t *testing.T) {
+	raw := &recordConn{}
+	conn := NewConn(raw)
+	data := reply.MakeErrReply("ERR Protocol error").ToBytes()
+	if err := conn.WriteBuffered(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !raw.closed || !bytes.Equal(raw.written(), data) {
+		t.Errorf("Close should flush buffered replies, got %q", raw.writes)
+	}
+}
+
+func TestFakeConn(t *testing.T) {
+	conn := NewFakeConn()
+	if err := conn.WriteBuffered([]byte("+OK\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Write([]byte("+OK\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingConn 统计写操作的次数
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+// dial 创建一对本机 TCP 连接，返回服务端一侧的连接和客户端一侧的 net.Conn
+func dial(b *testing.B) (*countingConn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			b.Error(err)
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		b.FailNow()
+	}
+	return &countingConn{Conn: server}, client
+}
+
+// benchWrite 模拟客户端使用管道一次发送 pipeline 条 GET，服务端通过本机 TCP 连接回写 pipeline 条回复，
+// 客户端读完整批回复后开始下一次迭代，额外输出每批回复的写操作次数
+func benchWrite(b *testing.B, pipeline int, buffered bool) {
+	data := reply.MakeBulkReply(bytes.Repeat([]byte("v"), 64)).ToBytes()
+	counter, client := dial(b)
+	server := NewConn(counter)
+	defer client.Close()
+	defer server.Close()
+
+	// 客户端在另一个协程中读取回复，避免整批回复超出 socket 缓冲区时写操作阻塞
+	batch := make([]byte, pipeline*len(data))
+	done := make(chan error, 1)
+	go func() {
+		for {
+			_, err := io.ReadFull(client, batch)
+			done <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(batch)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < pipeline; j++ {
+			var err error
+			if buffered {
+				err = server.WriteBuffered(data)
+			} else {
+				err = server.Write(data)
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if buffered {
+			if err := server.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(counter.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchWrite(b, 100, false)
+}
+
+func BenchmarkWriteBuffered(b *testing.B) {
+	benchWrite(b, 100, true)
+}
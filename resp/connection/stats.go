@@ -0,0 +1,33 @@
+package connection
+
+import "sync/atomic"
+
+// 客户端连接的统计信息，由 handler 在接受、拒绝和关闭连接时更新，INFO 的 clients 和 stats 两节输出这些数据
+
+var (
+	connectedClients    int64 // 当前的客户端连接数量
+	rejectedConnections int64 // 因为超过 maxclients 被拒绝的连接数量
+)
+
+// AddConnected 将当前的连接数量加上 delta，返回加上之后的值
+func AddConnected(delta int64) int64 {
+	return atomic.AddInt64(&connectedClients, delta)
+}
+
+func ConnectedClients() int64 {
+	return atomic.LoadInt64(&connectedClients)
+}
+
+// AddRejected 记录一次被拒绝的连接
+func AddRejected() {
+	atomic.AddInt64(&rejectedConnections, 1)
+}
+
+func RejectedConnections() int64 {
+	return atomic.LoadInt64(&rejectedConnections)
+}
+
+// TotalConnections 返回启动以来接受的连接数量，包括被拒绝的连接
+func TotalConnections() int64 {
+	return atomic.LoadInt64(&connCounter) + RejectedConnections()
+}
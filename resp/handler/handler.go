@@ -2,43 +2,92 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"go-redis/cluster"
 	"go-redis/config"
 	"go-redis/database"
 	databaseface "go-redis/interface/database"
+	"go-redis/interface/tcp"
 	"go-redis/lib/logger"
 	"go-redis/lib/sync/atomic"
 	"go-redis/resp/connection"
 	"go-redis/resp/parser"
 	"go-redis/resp/reply"
-	"io"
 	"net"
-	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var (
-	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+	unknownErrReplyBytes    = []byte("-ERR unknown\r\n")
+	maxClientsErrReplyBytes = []byte("-ERR max number of clients reached\r\n")
 )
 
 type RespHandler struct {
 	activeConn sync.Map
 	db         databaseface.Database // db 实际上是一个接口，可以进行不同的实现
 	closing    atomic.Boolean        // 标识是否正在关闭中
+	closeChan  chan struct{}         // 关闭时通知 sweeper 退出
+	closeOnce  sync.Once
 }
 
+// sweepInterval 是检查空闲连接的间隔
+const sweepInterval = time.Second
+
 func MakeHandler() *RespHandler {
 	var db databaseface.Database
 	//db = database.NewStandaloneDatabase()
 	// 启动集群版 Redis
-	if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
+	if config.Properties.IsCluster() {
 		db = cluster.MakeClusterDatabase()
 	} else {
 		// 单机版 redis
 		db = database.NewStandaloneDatabase()
 	}
-	return &RespHandler{
-		db: db,
+	return makeHandler(db)
+}
+
+// MakeHandlerWithDB 使用指定的 Database 实现创建 handler，如哨兵模式下的 sentinel.Sentinel
+
+func MakeHandlerWithDB(db databaseface.Database) *RespHandler {
+	return makeHandler(db)
+}
+
+func makeHandler(db databaseface.Database) *RespHandler {
+	r := &RespHandler{
+		db:        db,
+		closeChan: make(chan struct{}),
+	}
+	go r.sweep()
+	return r
+}
+
+// sweep 定期关闭空闲时间超过 timeout 的客户端
+// 从节点和主节点的复制连接只在复制流中交互，正在执行指令的客户端（如阻塞在 WAIT 中）也不算空闲
+
+func (r *RespHandler) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.closeChan:
+			return
+		}
+		timeout := time.Duration(config.Properties.Timeout) * time.Second
+		if timeout <= 0 {
+			continue
+		}
+		r.activeConn.Range(func(key, value interface{}) bool {
+			client := key.(*connection.Connection)
+			if client.IsSlave() || client.IsMaster() || client.IsBusy() || client.IdleTime() < timeout {
+				return true
+			}
+			logger.Info("closing idle client: " + client.RemoteAddr().String())
+			r.closeClient(client)
+			return true
+		})
 	}
 }
 
@@ -46,63 +95,155 @@ func MakeHandler() *RespHandler {
 
 func (r *RespHandler) closeClient(client *connection.Connection) {
 	_ = client.Close()
-	r.db.AfterClientClose(client)
-	r.activeConn.Delete(client)
+	if _, ok := r.activeConn.LoadAndDelete(client); ok { // 关闭 handler 时连接可能被关闭两次，只清理一次
+		r.db.AfterClientClose(client)
+		connection.AddConnected(-1)
+	}
 }
 
 func (r *RespHandler) Handle(ctx context.Context, conn net.Conn) {
+	s := r.open(conn)
+	if s == nil {
+		return
+	}
+	_ = s.serve() // 阻塞地读取连接，直到连接关闭或出错
+}
+
+// OnOpen 在事件驱动模式下接受一个连接，返回的会话在连接可读时由工作协程调用
+
+func (r *RespHandler) OnOpen(conn net.Conn) tcp.Session {
+	s := r.open(conn)
+	if s == nil {
+		return nil
+	}
+	return s
+}
+
+// session 是一个客户端连接的处理状态，goroutine 模式下由 Handle 一直持有，事件驱动模式下在两次可读事件之间保存解析进度
+
+type session struct {
+	handler *RespHandler
+	client  *connection.Connection
+	decoder *parser.RequestDecoder
+}
+
+func (r *RespHandler) open(conn net.Conn) *session {
 	if r.closing.Get() {
 		_ = conn.Close()
+		return nil
+	}
+	if !admit(conn) {
+		connection.AddRejected()
+		_, _ = conn.Write(maxClientsErrReplyBytes)
+		_ = conn.Close()
+		logger.Warn("max number of clients reached, rejected " + conn.RemoteAddr().String())
+		return nil
 	}
 	client := connection.NewConn(conn)
+	if config.Properties.ClusterRedirect {
+		client.SetRedirect(true)
+	}
 	r.activeConn.Store(client, struct{}{})
-	ch := parser.ParseStream(conn) // 开始处理解析连接发来的数据
-	for payload := range ch {
-		// 出错
-		if payload.Err != nil {
-			// 用户正在四次挥手关闭连接
-			if payload.Err == io.EOF ||
-				payload.Err == io.ErrUnexpectedEOF ||
-				// 使用了一个已关闭的连接
-				strings.Contains(payload.Err.Error(), "use of closed network connection") {
-				r.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
-				return
-			}
-			// 一般的协议出错，回写错误
-			errReply := reply.MakeErrReply(payload.Err.Error())
-			err := client.Write(errReply.ToBytes())
-			// 回写错误时出错了
-			if err != nil {
-				r.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
-				return
-			}
-			continue
-		}
-		// 正常执行
-		if payload.Data == nil {
-			continue
+	return &session{
+		handler: r,
+		client:  client,
+		// 开始处理解析连接发来的数据，支持内联指令
+		// 回复先暂存在连接中，解析器读完已收到的数据、需要再次读取连接时才一起写出，
+		// 管道中的多条指令只需要一次写操作
+		decoder: parser.NewRequestDecoder(&flushReader{conn: conn, client: client}),
+	}
+}
+
+// admit 检查 maxclients 限制，允许连接时计入当前的连接数量
+// 连接数量达到 maxclients 后，本机（回环地址或 Unix socket）的连接仍然可以使用 admin-reserved-clients 个预留名额，
+// 以便管理员在客户端占满连接时登录排查
+
+func admit(conn net.Conn) bool {
+	n := connection.AddConnected(1)
+	limit := int64(config.Properties.MaxClients)
+	if limit <= 0 || n <= limit {
+		return true
+	}
+	if isLocal(conn.RemoteAddr()) && n <= limit+int64(config.Properties.AdminReservedClients) {
+		return true
+	}
+	connection.AddConnected(-1)
+	return false
+}
+
+func isLocal(addr net.Addr) bool {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+// OnReadable 执行连接上已经到达的指令，非阻塞的连接没有更多数据时返回 nil，连接关闭后返回 error
+
+func (s *session) OnReadable() error {
+	err := s.serve()
+	if errors.Is(err, syscall.EAGAIN) {
+		return nil
+	}
+	return err
+}
+
+// serve 依次执行解析出的指令，读取连接出错时返回错误，除 EAGAIN 外都会关闭连接
+func (s *session) serve() error {
+	client := s.client
+	for {
+		args, err := s.decoder.Next()
+		if errors.Is(err, syscall.EAGAIN) {
+			return err // 非阻塞的连接上暂时没有数据，flushReader 已经写出了回复
 		}
-		reply, ok := payload.Data.(*reply.MultiBulkReply) // 类型断言，因为 Exec 需要的是 Args [][]byte
-		if !ok {
-			logger.Error("require multi bulk reply")
-			continue
+		if err != nil {
+			// 协议出错，回写错误后关闭连接，与 Redis 相同，出错之后的数据无法可靠地解析
+			if protocolErr, ok := err.(*parser.ProtocolError); ok {
+				_ = client.Write(reply.MakeErrReply(protocolErr.Error()).ToBytes())
+				logger.Warn("protocol error from " + client.RemoteAddr().String() + ": " + protocolErr.Msg)
+			}
+			// 用户正在四次挥手关闭连接，或者使用了一个已关闭的连接
+			s.handler.closeClient(client)
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			return err
 		}
-		result := r.db.Exec(client, reply.Args) // 让 redis 内核去执行该条解析出来的指令
-		if result != nil {                      // 解析结果不为空
-			_ = client.Write(result.ToBytes())
+		client.SetBusy(true)
+		result := s.handler.db.Exec(client, args) // 让 redis 内核去执行该条解析出来的指令
+		client.SetBusy(false)
+		if result != nil { // 解析结果不为空
+			_ = client.WriteBuffered(reply.Encode(result, client.GetProtocol())) // 按连接协商的协议版本编码
 		} else { // 解析结果为空
-			_ = client.Write(unknownErrReplyBytes)
+			_ = client.WriteBuffered(unknownErrReplyBytes)
 		}
 	}
 }
 
+// flushReader 在每次读取连接前写出暂存的回复：解析器只有在缓冲区中的数据都已处理完（或只剩半条指令）时才会读取连接，
+// 此时客户端可能正在等待回复，必须先发出去
+
+type flushReader struct {
+	conn   net.Conn
+	client *connection.Connection
+}
+
+func (r *flushReader) Read(p []byte) (int, error) {
+	if err := r.client.Flush(); err != nil {
+		return 0, err
+	}
+	return r.conn.Read(p)
+}
+
 // Close 关闭 handler 及所有连接
 
 func (r *RespHandler) Close() error {
 	logger.Info("handler shutting down")
 	r.closing.Set(true)
+	r.closeOnce.Do(func() {
+		close(r.closeChan)
+	})
 	r.activeConn.Range(
 		func(key, value interface{}) bool {
 			client := key.(*connection.Connection)
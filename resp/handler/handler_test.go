@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"context"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// okDB 对所有指令回复 OK
+type okDB struct{}
+
+func (okDB) Exec(client resp.Connection, args [][]byte) resp.Reply {
+	return reply.MakeOkReply()
+}
+
+func (okDB) Close() {}
+
+func (okDB) AfterClientClose(c resp.Connection) {}
+
+func TestProtocolLimits(t *testing.T) {
+	saved := *config.Properties
+	defer func() { *config.Properties = saved }()
+	config.Properties.ProtoMaxBulkLen = 1024
+	config.Properties.ProtoMaxMultiBulkLen = 16
+	config.Properties.ClientQueryBufferLimit = 4096
+
+	value := strings.Repeat("v", 1000)
+	tests := []struct {
+		name    string
+		request string
+		reply   string
+	}{
+		{
+			name:    "bulk",
+			request: "*2\r\n$3\r\nGET\r\n$2048\r\n",
+			reply:   "-ERR Protocol error: invalid bulk length\r\n",
+		},
+		{
+			name:    "multibulk",
+			request: "*17\r\n",
+			reply:   "-ERR Protocol error: invalid multibulk length\r\n",
+		},
+		{
+			name: "query buffer",
+			// 每个参数都在 proto-max-bulk-len 之内，但整条指令超过 client-query-buffer-limit
+			request: "*6\r\n$4\r\nMSET\r\n" + strings.Repeat("$1000\r\n"+value+"\r\n", 5),
+			reply:   "-ERR Protocol error: query buffer limit exceeded\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := makeHandler(okDB{})
+			defer h.Close()
+			server, client := net.Pipe()
+			defer client.Close()
+			done := make(chan struct{})
+			go func() {
+				h.Handle(context.Background(), server)
+				close(done)
+			}()
+			// 之前的指令正常执行，回复在协议错误之前发出
+			go func() {
+				_, _ = io.WriteString(client, "*1\r\n$4\r\nPING\r\n"+tt.request)
+			}()
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			// 服务端回复错误后关闭连接，读到 EOF 说明连接已关闭
+			received, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatalf("connection is not closed: %v, received %q", err, received)
+			}
+			if string(received) != "+OK\r\n"+tt.reply {
+				t.Errorf("received %q", received)
+			}
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Error("Handle did not return")
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"go-redis/config"
+	"io"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// RequestDecoder 是服务端专用的请求解析器，与解析回复的 ParseStream 分开：
+//   - 同步地返回指令，不需要为每个连接启动解析协程和管道
+//   - 从连接读到的数据放在可重用的缓冲区中，按行切分时不分配内存
+//   - 一条指令的全部参数拷贝到同一块内存中，每条指令只分配两次内存（参数内容和参数切片），
+//     返回的参数不引用缓冲区，数据库、AOF 和事务队列可以直接保存它们
+//   - 参数个数、参数长度和一条指令占用的缓冲区大小受配置限制，缓冲区随着数据到达逐步扩容，
+//     不会因为一个 $9999999999 之类的请求头就分配大量内存
+//   - reader 可以是非阻塞的：读取返回 syscall.EAGAIN 时 Next 返回该错误并回到未完成指令的开头，
+//     数据到达后再次调用 Next 即可继续；此时若没有未完成的指令，缓冲区会归还到 bufferPool，空闲连接不占用缓冲区
+//
+// 请求只有两种格式：* 开头的数组，以及 telnet 等客户端发送的内联指令
+
+type RequestDecoder struct {
+	reader io.Reader
+	buf    []byte
+	mark   int // 正在解析的指令的起始位置，整理缓冲区时保留 buf[mark:end]
+	start  int // buf[start:end] 是已经读入但还没有解析的数据
+	end    int
+	err    error // 读取连接时发生的错误，缓冲区中的数据解析完后返回
+	spans  []span
+
+	maxBulkLen       int // 单个参数的最大长度，即 proto-max-bulk-len
+	maxMultiBulkLen  int // 一条指令的最大参数个数，即 proto-max-multibulk-len
+	queryBufferLimit int // 一条指令占用的缓冲区的最大长度，即 client-query-buffer-limit
+}
+
+// span 是一个参数在缓冲区中的位置，offset 相对于 mark，整理缓冲区后仍然有效
+
+type span struct {
+	offset int
+	length int
+}
+
+const defaultBufferSize = 16 * 1024 // 与 Redis 的 PROTO_IOBUF_LEN 相同
+
+// bufferPool 保存默认大小的缓冲区，供非阻塞模式下的空闲连接归还和重新取用
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, defaultBufferSize)
+	},
+}
+
+// ProtocolError 表示客户端发来的数据不符合协议，服务端回复错误后关闭连接
+
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "ERR Protocol error: " + e.Msg
+}
+
+func NewRequestDecoder(reader io.Reader) *RequestDecoder {
+	return &RequestDecoder{
+		reader:           reader,
+		buf:              bufferPool.Get().([]byte),
+		maxBulkLen:       config.Properties.MaxBulkLen(),
+		maxMultiBulkLen:  config.Properties.MaxMultiBulkLen(),
+		queryBufferLimit: config.Properties.QueryBufferLimit(),
+	}
+}
+
+// Next 读取下一条指令，连接关闭时返回 io.EOF，数据不符合协议时返回 *ProtocolError，之后不能再调用 Next
+// 非阻塞的 reader 暂时没有数据时返回 syscall.EAGAIN，之后可以继续调用 Next
+
+func (d *RequestDecoder) Next() ([][]byte, error) {
+	args, err := d.next()
+	if err == nil {
+		d.shrink() // 扩容后的缓冲区可能已经读入了之后的指令，只有解析完所有数据后才能缩小
+	}
+	if err != nil && errors.Is(err, syscall.EAGAIN) {
+		// 已经读入的半条指令保留在缓冲区中，下次从指令开头重新解析
+		d.err = nil
+		d.start = d.mark
+		if d.start == d.end && d.buf != nil {
+			if len(d.buf) == defaultBufferSize { // 扩容过的缓冲区直接丢弃
+				bufferPool.Put(d.buf)
+			}
+			d.buf = nil
+			d.mark, d.start, d.end = 0, 0, 0
+		}
+	}
+	return args, err
+}
+
+func (d *RequestDecoder) next() ([][]byte, error) {
+	for {
+		d.shrink()
+		d.mark = d.start
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 { // 忽略空行
+			continue
+		}
+		if line[0] != '*' {
+			args, err := splitArgs(line)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) == 0 {
+				continue
+			}
+			return args, nil
+		}
+		count, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil || count > int64(d.maxMultiBulkLen) {
+			return nil, &ProtocolError{Msg: "invalid multibulk length"}
+		}
+		if count <= 0 { // *0 和 *-1 不是指令
+			continue
+		}
+		return d.readArgs(int(count))
+	}
+}
+
+// readArgs 读取数组中的 count 个数据块，先记录每个参数在缓冲区中的位置，读完后一次性拷贝出来
+
+func (d *RequestDecoder) readArgs(count int) ([][]byte, error) {
+	if cap(d.spans) < count {
+		d.spans = make([]span, count)
+	}
+	spans := d.spans[:count]
+	total := 0
+	for i := range spans {
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, &ProtocolError{Msg: "expected '$'"}
+		}
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 || n > d.maxBulkLen {
+			return nil, &ProtocolError{Msg: "invalid bulk length"}
+		}
+		if err := d.fill(n + 2); err != nil {
+			return nil, err
+		}
+		if d.buf[d.start+n] != '\r' || d.buf[d.start+n+1] != '\n' {
+			return nil, &ProtocolError{Msg: "invalid bulk format"}
+		}
+		spans[i] = span{offset: d.start - d.mark, length: n}
+		total += n
+		d.start += n + 2
+	}
+
+	block := make([]byte, total)
+	args := make([][]byte, count)
+	offset := 0
+	for i, s := range spans {
+		copy(block[offset:], d.buf[d.mark+s.offset:d.mark+s.offset+s.length])
+		args[i] = block[offset : offset+s.length : offset+s.length] // 限制容量，避免 append 覆盖后面的参数
+		offset += s.length
+	}
+	return args, nil
+}
+
+// readLine 返回缓冲区中的下一行（不含行尾的 \r\n 或 \n），返回的切片引用缓冲区，只在下一次读取前有效
+// 一行的长度不能超过 maxInlineSize
+
+func (d *RequestDecoder) readLine() ([]byte, error) {
+	scanned := 0
+	for {
+		if i := bytes.IndexByte(d.buf[d.start+scanned:d.end], '\n'); i >= 0 {
+			lineEnd := d.start + scanned + i
+			if lineEnd-d.start > maxInlineSize { // 整行可能在一次读取中全部到达
+				return nil, &ProtocolError{Msg: "too big inline request"}
+			}
+			line := d.buf[d.start:lineEnd]
+			d.start = lineEnd + 1
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			return line, nil
+		}
+		scanned = d.end - d.start
+		if scanned > maxInlineSize {
+			return nil, &ProtocolError{Msg: "too big inline request"}
+		}
+		if err := d.fill(scanned + 1); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// fill 读取连接直到缓冲区中至少有 n 字节未解析的数据
+// 缓冲区写满时先把正在解析的指令移到缓冲区头部，仍然不够时扩容一倍，
+// 缓冲区的大小随实际收到的数据增长，而不是按请求头中声明的长度一次性分配
+
+func (d *RequestDecoder) fill(n int) error {
+	if d.start-d.mark+n > d.queryBufferLimit {
+		return &ProtocolError{Msg: "query buffer limit exceeded"}
+	}
+	for d.end-d.start < n {
+		if d.err != nil {
+			if d.err == io.EOF && d.end > d.mark {
+				return io.ErrUnexpectedEOF
+			}
+			return d.err
+		}
+		if d.buf == nil {
+			d.buf = bufferPool.Get().([]byte)
+		}
+		if d.end == len(d.buf) {
+			need := d.start - d.mark + n
+			buf := d.buf
+			if need > len(buf) {
+				// 不能只扩容到 need：读取一行时 need 只比已有的数据多一个字节，每次读取都要重新分配和复制
+				buf = make([]byte, 2*len(buf))
+			}
+			copy(buf, d.buf[d.mark:d.end])
+			d.buf = buf
+			d.start -= d.mark
+			d.end -= d.mark
+			d.mark = 0
+		}
+		var read int
+		read, d.err = d.reader.Read(d.buf[d.end:])
+		d.end += read
+	}
+	return nil
+}
+
+// shrink 在解析完过大的指令后，若缓冲区中没有未解析的数据，则换回默认大小的缓冲区，避免长期占用内存
+
+func (d *RequestDecoder) shrink() {
+	if d.start == d.end {
+		d.mark, d.start, d.end = 0, 0, 0
+		if len(d.buf) > 4*defaultBufferSize {
+			d.buf = bufferPool.Get().([]byte)
+		}
+		if cap(d.spans) > 1024 {
+			d.spans = nil
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package parser
+
+import (
+	"bytes"
+	"go-redis/resp/reply"
+	"io"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+)
+
+// chunkReader 依次返回 chunks 中的数据，nil 表示此时没有数据（返回 EAGAIN），模拟非阻塞连接
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	chunk := r.chunks[0]
+	if chunk == nil {
+		r.chunks = r.chunks[1:]
+		return 0, syscall.EAGAIN
+	}
+	n := copy(p, chunk)
+	if n == len(chunk) {
+		r.chunks = r.chunks[1:]
+	} else {
+		r.chunks[0] = chunk[n:]
+	}
+	return n, nil
+}
+
+func encode(args ...string) []byte {
+	return reply.MakeMultiBulkReply(toArgs(args...)).ToBytes()
+}
+
+func toArgs(args ...string) [][]byte {
+	result := make([][]byte, len(args))
+	for i, arg := range args {
+		result[i] = []byte(arg)
+	}
+	return result
+}
+
+// decodeAll 读取 reader 中的全部指令，直到 io.EOF
+func decodeAll(t *testing.T, decoder *RequestDecoder) [][][]byte {
+	t.Helper()
+	commands := make([][][]byte, 0)
+	for {
+		args, err := decoder.Next()
+		if err == io.EOF {
+			return commands
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, args)
+	}
+}
+
+func assertCommands(t *testing.T, got [][][]byte, expected [][]string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("decoded %d commands, expected %d", len(got), len(expected))
+	}
+	for i, args := range got {
+		if len(args) != len(expected[i]) {
+			t.Fatalf("command %d: got %q, expected %q", i, args, expected[i])
+		}
+		for j, arg := range args {
+			if string(arg) != expected[i][j] {
+				t.Fatalf("command %d: got %q, expected %q", i, args, expected[i])
+			}
+		}
+	}
+}
+
+func pipeline() ([]byte, [][]string) {
+	big := strings.Repeat("v", 3*defaultBufferSize+5) // 超过默认缓冲区，需要扩容
+	expected := [][]string{
+		{"SET", "key", "value"},
+		{"GET", "key"},
+		{"SET", "empty", ""},
+		{"PING"},
+		{"SET", "big", big},
+		{"SET", "binary", "a\r\nb\x00c"},
+		{"SET", "k", "hello world"},
+		{"MSET", "a", "1", "b", "2"},
+	}
+	var buf bytes.Buffer
+	buf.Write(encode(expected[0]...))
+	buf.Write(encode(expected[1]...))
+	buf.Write(encode(expected[2]...))
+	buf.WriteString("\r\n*0\r\n*-1\r\nPING\r\n") // 空行、空数组和内联指令
+	buf.Write(encode(expected[4]...))
+	buf.Write(encode(expected[5]...))
+	buf.WriteString("SET k \"hello world\"\n")
+	buf.Write(encode(expected[7]...))
+	return buf.Bytes(), expected
+}
+
+func TestRequestDecoderPipeline(t *testing.T) {
+	data, expected := pipeline()
+	decoder := NewRequestDecoder(bytes.NewReader(data))
+	assertCommands(t, decodeAll(t, decoder), expected)
+}
+
+func TestRequestDecoderSplitReads(t *testing.T) {
+	data, expected := pipeline()
+	// 每次只读到一个字节，指令在任意位置被截断
+	decoder := NewRequestDecoder(iotest.OneByteReader(bytes.NewReader(data)))
+	assertCommands(t, decodeAll(t, decoder), expected)
+	// 每次读到的数据大小不同
+	decoder = NewRequestDecoder(iotest.HalfReader(bytes.NewReader(data)))
+	assertCommands(t, decodeAll(t, decoder), expected)
+}
+
+func TestRequestDecoderUnexpectedEOF(t *testing.T) {
+	data := encode("SET", "key", "value")
+	for i := 1; i < len(data); i++ {
+		decoder := NewRequestDecoder(bytes.NewReader(data[:i]))
+		if _, err := decoder.Next(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("truncated at %d: got %v", i, err)
+		}
+	}
+}
+
+func TestRequestDecoderEAGAIN(t *testing.T) {
+	data, expected := pipeline()
+	// 在每个字节之后都插入一次 EAGAIN
+	chunks := make([][]byte, 0, 2*len(data))
+	for i := range data {
+		chunks = append(chunks, data[i:i+1], nil)
+	}
+	decoder := NewRequestDecoder(&chunkReader{chunks: chunks})
+	got := make([][][]byte, 0)
+	for {
+		args, err := decoder.Next()
+		if err == syscall.EAGAIN {
+			continue
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, args)
+	}
+	assertCommands(t, got, expected)
+}
+
+func TestRequestDecoderReleaseBuffer(t *testing.T) {
+	first := encode("SET", "key", "value")
+	second := encode("GET", "key")
+	reader := &chunkReader{chunks: [][]byte{first, nil, second[:5], nil, second[5:], nil}}
+	decoder := NewRequestDecoder(reader)
+
+	if _, err := decoder.Next(); err != nil {
+		t.Fatal(err)
+	}
+	// 没有未完成的指令时缓冲区归还到 bufferPool
+	if _, err := decoder.Next(); err != syscall.EAGAIN {
+		t.Fatalf("expected EAGAIN, got %v", err)
+	}
+	if decoder.buf != nil {
+		t.Error("idle decoder should release its buffer")
+	}
+	// 读到半条指令时保留缓冲区
+	if _, err := decoder.Next(); err != syscall.EAGAIN {
+		t.Fatalf("expected EAGAIN, got %v", err)
+	}
+	if decoder.buf == nil || decoder.end-decoder.mark != 5 {
+		t.Error("partial command should stay in the buffer")
+	}
+	args, err := decoder.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertCommands(t, [][][]byte{args}, [][]string{{"GET", "key"}})
+	if _, err := decoder.Next(); err != syscall.EAGAIN || decoder.buf != nil {
+		t.Errorf("expected EAGAIN and released buffer, got %v", err)
+	}
+}
+
+func TestRequestDecoderBufferReuse(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		buf.Write(encode("SET", "key"+strconv.Itoa(i), "value"+strconv.Itoa(i)))
+	}
+	decoder := NewRequestDecoder(iotest.HalfReader(&buf))
+	commands := decodeAll(t, decoder)
+	// 返回的参数不引用缓冲区，缓冲区被后面的指令重用后仍然有效
+	for i, args := range commands {
+		if string(args[1]) != "key"+strconv.Itoa(i) || string(args[2]) != "value"+strconv.Itoa(i) {
+			t.Fatalf("command %d was overwritten: %q", i, args)
+		}
+	}
+	// 向一个参数追加数据不会覆盖同一条指令中的其他参数
+	args := commands[0]
+	_ = append(args[1], "xxxxxxxx"...)
+	if string(args[2]) != "value0" {
+		t.Errorf("append to an argument overwrote the next one: %q", args[2])
+	}
+}
+
+func TestRequestDecoderShrink(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(encode("SET", "big", strings.Repeat("v", 8*defaultBufferSize)))
+	buf.Write(encode("GET", "big"))
+	decoder := NewRequestDecoder(&buf)
+	if _, err := decoder.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoder.buf) <= 4*defaultBufferSize {
+		t.Fatalf("buffer should grow for the big argument, size %d", len(decoder.buf))
+	}
+	if _, err := decoder.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoder.buf) != defaultBufferSize {
+		t.Errorf("buffer should shrink after the big command, size %d", len(decoder.buf))
+	}
+}
+
+func TestRequestDecoderProtocolError(t *testing.T) {
+	inputs := []string{
+		"*1\r\nGET\r\n",            // 缺少 $
+		"*abc\r\n",                 // 参数个数不是整数
+		"*1\r\n$abc\r\n",           // 参数长度不是整数
+		"*1\r\n$-1\r\n",            // 参数长度为负数
+		"*1\r\n$3\r\nGETX\r\n",     // 参数长度与内容不符
+		"SET k \"unbalanced\r\n",   // 引号不匹配
+		strings.Repeat("a", 70000), // 内联指令过长
+	}
+	for _, input := range inputs {
+		decoder := NewRequestDecoder(strings.NewReader(input))
+		if _, err := decoder.Next(); err == nil {
+			t.Errorf("%.20q: expected error", input)
+		} else if _, ok := err.(*ProtocolError); !ok {
+			t.Errorf("%.20q: expected protocol error, got %v", input, err)
+		}
+	}
+}
+
+// makeRequests 生成 n 条 SET key value，argCount 大于 3 时为 MSET
+func makeRequests(n int, valueSize int, argCount int) []byte {
+	value := strings.Repeat("v", valueSize)
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		args := []string{"SET"}
+		if argCount > 3 {
+			args[0] = "MSET"
+		}
+		for len(args) < argCount {
+			args = append(args, "key:"+strconv.Itoa(i)+":"+strconv.Itoa(len(args)), value)
+		}
+		buf.Write(encode(args[:argCount]...))
+	}
+	return buf.Bytes()
+}
+
+var benchCases = []struct {
+	name      string
+	valueSize int
+	argCount  int
+}{
+	{"set-64B", 64, 3},
+	{"set-4KB", 4096, 3},
+	{"mset-10", 64, 21},
+}
+
+// 每次迭代解析 1000 条指令，对比通用的 ParseStream 与服务端专用的 RequestDecoder
+
+const benchCommands = 1000
+
+func BenchmarkParseStream(b *testing.B) {
+	for _, bc := range benchCases {
+		data := makeRequests(benchCommands, bc.valueSize, bc.argCount)
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				count := 0
+				for payload := range ParseStream(bytes.NewReader(data)) {
+					if payload.Err != nil {
+						if payload.Err != io.EOF {
+							b.Fatal(payload.Err)
+						}
+						continue
+					}
+					count++
+				}
+				if count != benchCommands {
+					b.Fatalf("parsed %d commands", count)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRequestDecoder(b *testing.B) {
+	for _, bc := range benchCases {
+		data := makeRequests(benchCommands, bc.valueSize, bc.argCount)
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				decoder := NewRequestDecoder(bytes.NewReader(data))
+				count := 0
+				for {
+					_, err := decoder.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					count++
+				}
+				if count != benchCommands {
+					b.Fatalf("parsed %d commands", count)
+				}
+			}
+		})
+	}
+}
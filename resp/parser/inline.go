@@ -0,0 +1,121 @@
+package parser
+
+// 内联指令：不以 * 开头的请求按空格切分为参数，如在 telnet 中输入 SET key "hello world"
+// 切分规则与 redis-cli 相同：
+//   - 双引号中支持 \n \r \t \b \a \\ \" 和 \xHH 转义
+//   - 单引号中只支持 \' 转义
+//   - 引号结束后必须是空白或行尾
+
+// maxInlineSize 是内联指令一行的最大长度，与 Redis 的 PROTO_INLINE_MAX_SIZE 相同
+const maxInlineSize = 64 * 1024
+
+var errUnbalancedQuotes = &ProtocolError{Msg: "unbalanced quotes in request"}
+
+// splitArgs 切分一行内联指令，返回的参数个数为 0 表示空行
+
+func splitArgs(line []byte) ([][]byte, *ProtocolError) {
+	args := make([][]byte, 0)
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+		arg := make([]byte, 0)
+		inDouble, inSingle := false, false
+		for done := false; !done; {
+			if inDouble {
+				if i >= len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				switch {
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]):
+					arg = append(arg, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					arg = append(arg, unescape(line[i]))
+				case line[i] == '"':
+					// 引号结束后必须是空白或行尾
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else if inSingle {
+				if i >= len(line) {
+					return nil, errUnbalancedQuotes
+				}
+				switch {
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					arg = append(arg, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errUnbalancedQuotes
+					}
+					done = true
+				default:
+					arg = append(arg, line[i])
+				}
+			} else {
+				if i >= len(line) {
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDouble = true
+				case '\'':
+					inSingle = true
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, arg)
+	}
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func isHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+func hexValue(b byte) byte {
+	switch {
+	case b >= '0' && b <= '9':
+		return b - '0'
+	case b >= 'a' && b <= 'f':
+		return b - 'a' + 10
+	}
+	return b - 'A' + 10
+}
+
+// unescape 返回双引号中 \ 之后的字符转义后的值
+func unescape(b byte) byte {
+	switch b {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	}
+	return b
+}
@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		args []string // nil 表示应当返回错误
+	}{
+		{"", []string{}},
+		{"   \t ", []string{}},
+		{"PING", []string{"PING"}},
+		{"SET key value", []string{"SET", "key", "value"}},
+		{"  SET\tkey   value  \r", []string{"SET", "key", "value"}},
+		// 双引号
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`"a\nb\r\tc\bd\ae"`, []string{"a\nb\r\tc\bd\ae"}},
+		{`"quote\"backslash\\"`, []string{`quote"backslash\`}},
+		{`"\q"`, []string{"q"}}, // 未知的转义保留原字符
+		// \xHH
+		{`"\x41\x6a\x00\xFF"`, []string{"Aj\x00\xff"}},
+		{`"\x4"`, []string{"x4"}},   // 不足两位十六进制数字时按普通转义处理
+		{`"\xZZ"`, []string{"xZZ"}}, // 不是十六进制数字
+		{`\x41`, []string{`\x41`}},  // 引号之外不转义
+		// 单引号
+		{`SET k 'hello world'`, []string{"SET", "k", "hello world"}},
+		{`'it\'s'`, []string{"it's"}},
+		{`'a\nb'`, []string{`a\nb`}}, // 单引号中只支持 \'
+		{`''`, []string{""}},
+		{`'a"b'`, []string{`a"b`}},
+		{`"a'b"`, []string{"a'b"}},
+		// 引号不匹配
+		{`"unterminated`, nil},
+		{`'unterminated`, nil},
+		{`SET k "abc\`, nil},
+		{`"a"b`, nil}, // 引号结束后必须是空白或行尾
+		{`'a'b`, nil},
+	}
+	for _, tt := range tests {
+		args, err := splitArgs([]byte(tt.line))
+		if tt.args == nil {
+			if err != errUnbalancedQuotes {
+				t.Errorf("%q: expected unbalanced quotes error, got %q", tt.line, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if len(args) != len(tt.args) {
+			t.Errorf("%q: got %q, expected %q", tt.line, args, tt.args)
+			continue
+		}
+		for i, arg := range args {
+			if string(arg) != tt.args[i] {
+				t.Errorf("%q: got %q, expected %q", tt.line, args, tt.args)
+				break
+			}
+		}
+	}
+}
+
+func TestInlineSizeLimit(t *testing.T) {
+	// 不超过 maxInlineSize 的内联指令可以解析
+	value := strings.Repeat("v", maxInlineSize-10)
+	decoder := NewRequestDecoder(strings.NewReader("SET k " + value + "\r\n"))
+	args, err := decoder.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 3 || string(args[2]) != value {
+		t.Errorf("got %d args", len(args))
+	}
+
+	// 超过 maxInlineSize 仍未读到行尾
+	decoder = NewRequestDecoder(strings.NewReader("SET k " + strings.Repeat("v", maxInlineSize+1) + "\r\n"))
+	_, err = decoder.Next()
+	if protocolErr, ok := err.(*ProtocolError); !ok || protocolErr.Msg != "too big inline request" {
+		t.Errorf("expected too big inline request, got %v", err)
+	}
+}
@@ -4,11 +4,14 @@ package parser
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"go-redis/interface/resp"
 	"go-redis/lib/logger"
 	"go-redis/resp/reply"
 	"io"
+	"math"
+	"math/big"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -24,11 +27,27 @@ type Payload struct {
 // readState 是解析器 parser 的状态
 
 type readState struct {
-	readingMultiLine  bool     // 标识解析器解析的是单行数据还是多行数据
-	expectedArgsCount int      // 标识正在读取的数据包含多少个指令，即 * 号后的数字是多少
-	msgType           byte     // 标识消息的类型，* 表示在读一个数组（一个数组中有多条指令），$ 表示在读一条指令
-	args              [][]byte // 已解析的传来的具体指令
-	bulkLen           int64    // 传来的字节组（数据块）的长度，即 $ 符号后面跟着的数字
+	readingMultiLine  bool            // 标识解析器解析的是单行数据还是多行数据
+	expectedArgsCount int             // 标识正在读取的数据包含多少个指令，即 * 号后的数字是多少
+	msgType           byte            // 标识消息的类型，* 表示在读一个数组（一个数组中有多条指令），$ 表示在读一条指令
+	args              [][]byte        // 已解析的传来的具体指令
+	bulkLen           int64           // 传来的字节组（数据块）的长度，即 $ 符号后面跟着的数字
+	readingBody       bool            // 已经读到了 $ 头部，下一次按 bulkLen 严格读取数据块的内容（包括长度为 0 的数据块）
+	bulkType          byte            // 正在读取的数据块的类型：$ 字符串，= 带格式的字符串（RESP3），! 错误（RESP3）
+	elems             []resp.Reply    // 数组中出现整数、状态、错误或嵌套数组时，用它记录数组的全部元素
+	attrs             *reply.MapReply // RESP3 属性，附加到数组中的下一个元素上
+}
+
+// RESP3 中的聚合类型：* 数组，% map，~ 集合，> 推送，| 属性，map 和属性的每一项包含 key 和 value 两个元素
+
+func isAggregateType(b byte) bool {
+	return b == '*' || b == '%' || b == '~' || b == '>' || b == '|'
+}
+
+// 数据块类型，头部之后按长度读取内容
+
+func isBlobType(b byte) bool {
+	return b == '$' || b == '=' || b == '!'
 }
 
 // 判断解析器是否完成
@@ -37,6 +56,85 @@ func (s *readState) finished() bool {
 	return s.expectedArgsCount > 0 && len(s.args) == s.expectedArgsCount
 }
 
+// appendArg 向数组中追加一个数据块，arg 为 nil 表示空元素（$-1）
+
+func (s *readState) appendArg(arg []byte) {
+	if s.attrs != nil {
+		s.appendElem(bulkElem(arg))
+		return
+	}
+	s.args = append(s.args, arg)
+	if s.elems != nil {
+		s.elems = append(s.elems, bulkElem(arg))
+	}
+}
+
+// appendElem 向数组中追加一个数据块以外的元素，之后整个数组解析为 MultiRawReply
+
+func (s *readState) appendElem(elem resp.Reply) {
+	if s.attrs != nil {
+		elem = reply.MakeAttributeReply(s.attrs, elem)
+		s.attrs = nil
+	}
+	if s.elems == nil {
+		s.elems = make([]resp.Reply, 0, s.expectedArgsCount)
+		for _, arg := range s.args {
+			s.elems = append(s.elems, bulkElem(arg))
+		}
+	}
+	s.args = append(s.args, nil)
+	s.elems = append(s.elems, elem)
+}
+
+func bulkElem(arg []byte) resp.Reply {
+	if arg == nil {
+		return &reply.NullBulkReply{}
+	}
+	return reply.MakeBulkReply(arg)
+}
+
+// result 返回解析完成的回复
+
+func (s *readState) result() resp.Reply {
+	if isBlobType(s.msgType) {
+		if s.elems != nil {
+			return s.elems[0]
+		}
+		return reply.MakeBulkReply(s.args[0])
+	}
+	if s.msgType == '*' {
+		if s.elems != nil {
+			return reply.MakeMultiRawReply(s.elems)
+		}
+		return reply.MakeMultiBulkReply(s.args)
+	}
+	elems := s.elems
+	if elems == nil {
+		elems = make([]resp.Reply, 0, len(s.args))
+		for _, arg := range s.args {
+			elems = append(elems, bulkElem(arg))
+		}
+	}
+	return makeAggregate(s.msgType, elems)
+}
+
+// makeAggregate 按类型生成 RESP3 聚合类型的回复，属性解析为 MapReply，由调用方附加到下一个回复上
+
+func makeAggregate(msgType byte, elems []resp.Reply) resp.Reply {
+	switch msgType {
+	case '%', '|':
+		return reply.MakeMapReply(elems)
+	case '~':
+		return reply.MakeSetReply(elems)
+	case '>':
+		return reply.MakePushReply(elems)
+	}
+	if len(elems) == 0 {
+		return &reply.EmptyMultiBulkReply{}
+	}
+	return reply.MakeMultiRawReply(elems)
+}
+
 // 上层调用 parseStream 会返回一个 channel，上层非同步阻塞、异步地从 channel 中读取指令
 // ParseStream 用于并发解析指令，从 io.Reader 读取数据并通过通道（channel）发送解析后的有效载荷（Payloads）
 // ParseStream 首字母大写，用作协议层对外的接口
@@ -48,6 +146,20 @@ func ParseStream(reader io.Reader) <-chan *Payload {
 	return ch
 }
 
+// ParseOne 解析 data 中的第一个回复，用于解码以字节形式保存的回复
+
+func ParseOne(data []byte) (resp.Reply, error) {
+	ch := make(chan *Payload)
+	go parse0(bytes.NewReader(data), ch)
+	payload := <-ch
+	for range ch { // 读完剩余的结果，解析协程在读到 EOF 后关闭 ch 并退出
+	}
+	if payload.Err != nil {
+		return nil, payload.Err
+	}
+	return payload.Data, nil
+}
+
 // 指令解析逻辑，解析发来的指令
 
 func parse0(reader io.Reader, ch chan<- *Payload) {
@@ -58,8 +170,29 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 	}()
 	bufReader := bufio.NewReader(reader)
 	var state readState
+	var stack []readState     // 正在解析的外层数组，用于解析嵌套的数组
+	var attrs *reply.MapReply // RESP3 属性，附加到下一个回复上
 	var err error
 	var msg []byte
+	// emit 输出一个完整的回复
+	emit := func(result resp.Reply) {
+		if attrs != nil {
+			result = reply.MakeAttributeReply(attrs, result)
+			attrs = nil
+		}
+		ch <- &Payload{
+			Data: result,
+		}
+	}
+	// protocolError 输出协议错误，并清空解析器的状态
+	protocolError := func(msg []byte) {
+		ch <- &Payload{
+			Err: errors.New("protocol error" + string(msg)),
+		}
+		state = readState{}
+		stack = nil
+		attrs = nil
+	}
 	for true {
 		var ioErr bool
 		msg, ioErr, err = readLine(bufReader, &state) // 读入一行数据
@@ -76,74 +209,90 @@ func parse0(reader io.Reader, ch chan<- *Payload) {
 				Err: err,
 			}
 			state = readState{} // 清空当前解析器的状态，清空之前读取的数据的信息
-			continue            // 继续监听用户后续的指令
+			stack = nil
+			attrs = nil
+			continue // 继续监听用户后续的指令
 		}
 
 		// 判断是否为多行解析模式（* 开头 和 $ 开头都是多行，+OK 和 -Err 不是多行。有1个以上的\r\n换行符，就是多行。）
 		if !state.readingMultiLine { // 不是多行解析模式，或者是多行但是还没初始化
-			if msg[0] == '*' { // 如果解析器还没初始化，但实际上是 * 开头的多行，则这里启动多行模式
+			if isAggregateType(msg[0]) { // 如果解析器还没初始化，但实际上是 * 开头的多行，则这里启动多行模式
 				err = parseMultiBulkHeader(msg, &state)
 				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error" + string(msg)),
-					}
-					state = readState{}
+					protocolError(msg)
 					continue
 				}
 				if state.expectedArgsCount == 0 { // 当出现 *0\r\n 的情况
-					ch <- &Payload{
-						Data: &reply.EmptyMultiBulkReply{},
+					if msg[0] == '|' {
+						attrs = reply.MakeMapReply(nil)
+					} else {
+						emit(makeAggregate(msg[0], nil))
 					}
 					state = readState{}
 					continue
 				}
-			} else if msg[0] == '$' { // 如果解析器还没初始化，但实际上是 $ 开头的多行，则启动多行模式
+			} else if isBlobType(msg[0]) { // 如果解析器还没初始化，但实际上是 $ 开头的多行，则启动多行模式
 				err = parseBulkHeader(msg, &state)
 				if err != nil {
-					ch <- &Payload{
-						Err: errors.New("protocol error" + string(msg)),
-					}
-					state = readState{}
+					protocolError(msg)
 					continue
 				}
 				if state.bulkLen == -1 { // 当出现 $-1\r\n 的情况
-					ch <- &Payload{
-						Data: &reply.EmptyMultiBulkReply{},
-					}
+					emit(&reply.NullBulkReply{})
 					state = readState{}
 					continue
 				}
 			} else { //如果解析器还没初始化，"+OK\r\n" 和 "-err\r\n" 和 ":5\r\n" 这三种单行指令，则启动单行模式
 				result, err := parseSingleLineReply(msg)
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
+				if err != nil {
+					protocolError(msg)
+					continue
 				}
+				emit(result)
 				state = readState{}
 				continue
 			}
 		} else { // 已经初始化为了多行模式，例如"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n"，之前已经读过一个*了，现在处理到 $ 了
-			err := readBody(msg, &state) // 先读 $3\r\n， 下一次调用再接着读 SET\r\n，以此类推
-			if err != nil {
-				ch <- &Payload{
-					Err: errors.New("protocol error" + string(msg)),
+			if !state.readingBody && isAggregateType(msg[0]) { // 数组中嵌套的数组，如 SCAN 的回复
+				var nested readState
+				if err := parseMultiBulkHeader(msg, &nested); err != nil {
+					protocolError(msg)
+					continue
 				}
-				state = readState{}
+				if nested.expectedArgsCount > 0 {
+					stack = append(stack, state)
+					state = nested
+					continue
+				}
+				if msg[0] == '|' {
+					state.attrs = reply.MakeMapReply(nil)
+				} else {
+					state.appendElem(makeAggregate(msg[0], nil))
+				}
+			} else if err := readBody(msg, &state); err != nil { // 先读 $3\r\n， 下一次调用再接着读 SET\r\n，以此类推
+				protocolError(msg)
 				continue
 			}
-			if state.finished() { // 每次到该else分支调用readBody结束后，都要判断一下是否读完了整行数据
-				var result resp.Reply
-				// 如果读完了整行数据，判断一下这行数据是 * 开头的还是 $ 开头的，根据不同情况返回 args
-				if state.msgType == '*' {
-					result = reply.MakeMultiBulkReply(state.args)
-				} else if state.msgType == '$' {
-					result = reply.MakeBulkReply(state.args[0])
+			// 每次读完一行都要判断是否读完了整个数组，读完的嵌套数组作为元素加入外层数组
+			for state.finished() {
+				result := state.result()
+				isAttrs := state.msgType == '|'
+				if len(stack) == 0 {
+					if isAttrs { // 属性附加到紧随其后的回复上
+						attrs = result.(*reply.MapReply)
+					} else {
+						emit(result)
+					}
+					state = readState{}
+					break
 				}
-				ch <- &Payload{
-					Data: result,
-					Err:  err,
+				state = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				if isAttrs {
+					state.attrs = result.(*reply.MapReply)
+				} else {
+					state.appendElem(result)
 				}
-				state = readState{}
 			}
 		}
 	}
@@ -156,34 +305,70 @@ func readLine(bufReader *bufio.Reader, state *readState) ([]byte, bool, error) {
 	var err error
 
 	// 1. 没有读到 $ 指明指令长度时，直接按 \r\n 切分
-	if state.bulkLen == 0 {
+	if !state.readingBody {
 		msg, err = bufReader.ReadBytes('\n')
 		if err != nil {
 			return nil, true, err
 		}
-		if len(msg) == 0 || msg[len(msg)-2] != '\r' {
+		if len(msg) < 2 || msg[len(msg)-2] != '\r' {
 			return nil, false, errors.New("protocol error" + string(msg))
 		}
 		// 2. 读到 $ 时，严格读取相应的字符个数，哪怕遇到 \r\n 也要读入
 	} else {
-		msg = make([]byte, state.bulkLen+2)
-		_, err = io.ReadFull(bufReader, msg)
+		msg, err = readFull(bufReader, state.bulkLen+2)
 		if err != nil {
 			return nil, true, err
 		}
 		if len(msg) == 0 || msg[len(msg)-2] != '\r' || msg[len(msg)-1] != '\n' {
 			return nil, false, errors.New("protocol error" + string(msg))
 		}
-		state.bulkLen = 0
 	}
 	return msg, false, nil
 }
 
+// maxPreallocBody 是按数据块头部的长度一次性分配的最大字节数，更长的数据块随读取逐步扩容
+// ParseStream 解析的是其他节点的回复和 AOF 文件，不限制数据块的长度，但长度由对端给出，不能直接按它分配内存
+const maxPreallocBody = 64 * 1024
+
+// readFull 读取 n 个字节，分配的内存不会超过实际读到的数据太多
+
+func readFull(reader io.Reader, n int64) ([]byte, error) {
+	if n <= maxPreallocBody {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	}
+	buf := make([]byte, 0, maxPreallocBody)
+	for remain := n; remain > 0; {
+		chunk := int64(maxPreallocBody)
+		if remain < chunk {
+			chunk = remain
+		}
+		start := len(buf)
+		buf = append(buf, make([]byte, chunk)...)
+		if _, err := io.ReadFull(reader, buf[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		remain -= chunk
+	}
+	return buf, nil
+}
+
 // parseMultiBulkHeader 用于解析处理 readLine 中读取到的 "*<number>/r/n"
 
 func parseMultiBulkHeader(msg []byte, state *readState) error {
 	var err error
 	var expectedLine uint64 // 存储 * 号后的数字，如 *3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n 中开头的 3, 即后面包含多少个指令
+	// *-1\r\n，空数组，按长度为 0 的数组处理
+	if string(msg[1:len(msg)-2]) == "-1" {
+		state.expectedArgsCount = 0
+		return nil
+	}
 	expectedLine, err = strconv.ParseUint(string(msg[1:len(msg)-2]), 10, 32)
 	if err != nil {
 		return errors.New("protocol error" + string(msg))
@@ -194,14 +379,25 @@ func parseMultiBulkHeader(msg []byte, state *readState) error {
 	} else if expectedLine > 0 {
 		state.msgType = msg[0]        // 标识为 *，表示在读数组
 		state.readingMultiLine = true // 表示在读数组，包含有多个指令
+		if msg[0] == '%' || msg[0] == '|' {
+			expectedLine *= 2 // map 和属性的每一项包含 key 和 value
+		}
 		state.expectedArgsCount = int(expectedLine)
-		state.args = make([][]byte, 0, expectedLine)
+		// 数组长度由对端给出，预分配的容量设上限，避免一个数组头就分配大量内存
+		capacity := expectedLine
+		if capacity > maxPreallocArgs {
+			capacity = maxPreallocArgs
+		}
+		state.args = make([][]byte, 0, capacity)
 		return nil
 	} else { // expectedLine < 0
 		return errors.New("protocol error" + string(msg))
 	}
 }
 
+// maxPreallocArgs 是按数组头预分配的参数切片的最大容量，更长的数组在读取时再扩容
+const maxPreallocArgs = 1024
+
 // $4\r\nPING\r\n
 
 func parseBulkHeader(msg []byte, state *readState) error {
@@ -212,18 +408,20 @@ func parseBulkHeader(msg []byte, state *readState) error {
 	}
 	if state.bulkLen == -1 {
 		return nil
-	} else if state.bulkLen > 0 {
-		state.msgType = msg[0]        // 标识为 $，表示在读数组
+	} else if state.bulkLen >= 0 {
+		state.msgType = msg[0] // 标识为 $，表示在读数组
+		state.bulkType = msg[0]
 		state.readingMultiLine = true // 表示在读数组，包含有多个指令
 		state.expectedArgsCount = 1
 		state.args = make([][]byte, 0, 1)
+		state.readingBody = true
 		return nil
 	} else {
 		return errors.New("protocol error" + string(msg))
 	}
 }
 
-// parseSingleLineReply 用于处理 "+OK\r\n" 和 "-err\r\n" 和 ":5\r\n" 这三种单行指令
+// parseSingleLineReply 用于处理 "+OK\r\n" 和 "-err\r\n" 和 ":5\r\n" 这三种单行指令，以及 RESP3 中的 _、#、, 和 ( 开头的单行回复
 
 func parseSingleLineReply(msg []byte) (resp.Reply, error) {
 	str := strings.TrimSuffix(string(msg), "\r\n") // 剪切掉 \r\n
@@ -239,28 +437,101 @@ func parseSingleLineReply(msg []byte) (resp.Reply, error) {
 			return nil, errors.New("protocol error" + string(msg))
 		}
 		result = reply.MakeIntReply(val)
+	case '_':
+		result = reply.MakeNullReply()
+	case '#':
+		switch str[1:] {
+		case "t":
+			result = reply.MakeBooleanReply(true)
+		case "f":
+			result = reply.MakeBooleanReply(false)
+		default:
+			return nil, errors.New("protocol error" + string(msg))
+		}
+	case ',':
+		val, err := parseDouble(str[1:])
+		if err != nil {
+			return nil, errors.New("protocol error" + string(msg))
+		}
+		result = reply.MakeDoubleReply(val)
+	case '(':
+		if _, ok := new(big.Int).SetString(str[1:], 10); !ok {
+			return nil, errors.New("protocol error" + string(msg))
+		}
+		result = reply.MakeBigNumberReply(str[1:])
 	}
 	return result, nil
 }
 
+// parseDouble 解析 RESP3 的浮点数，inf 和 -inf 表示无穷大
+
+func parseDouble(str string) (float64, error) {
+	switch strings.ToLower(str) {
+	case "inf", "+inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(str, 64)
+}
+
+// parseVerbatim 解析 RESP3 带格式的字符串的内容，如 txt:Some string
+
+func parseVerbatim(line []byte) (resp.Reply, error) {
+	if len(line) < 4 || line[3] != ':' {
+		return nil, errors.New("protocol error" + string(line))
+	}
+	return reply.MakeVerbatimReply(string(line[:3]), line[4:]), nil
+}
+
 // readBody 用于提取 $4\r\nPING\r\n
 
 func readBody(msg []byte, state *readState) error {
 	line := msg[0 : len(msg)-2] // 去掉末尾的 \r\n
 	var err error
-	// 遇到的第一个字符是 $
-	if line[0] == '$' {
+	// 按 $ 头部的长度读到的数据块内容，即使以 $ 开头也不是头部
+	if state.readingBody {
+		state.readingBody = false
+		state.bulkLen = 0
+		switch state.bulkType {
+		case '=':
+			elem, err := parseVerbatim(line)
+			if err != nil {
+				return err
+			}
+			state.appendElem(elem)
+		case '!':
+			state.appendElem(reply.MakeErrReply(string(line)))
+		default:
+			state.appendArg(line)
+		}
+		return nil
+	}
+	// 遇到的第一个字符是 $，或者 RESP3 中的 = 和 !
+	if len(line) > 0 && isBlobType(line[0]) {
 		state.bulkLen, err = strconv.ParseInt(string(line[1:]), 10, 64)
-		if err != nil {
+		if err != nil || state.bulkLen < -1 {
 			return errors.New("protocol error" + string(msg))
 		}
-		// $0\r\n
-		if state.bulkLen <= 0 {
-			state.args = append(state.args, []byte{})
+		state.bulkType = line[0]
+		// $-1\r\n，数组中的空元素，用 nil 与长度为 0 的数据块区分，如 MGET 中不存在的 key
+		if state.bulkLen == -1 {
+			state.appendArg(nil)
 			state.bulkLen = 0
+		} else {
+			state.readingBody = true // $0\r\n 之后仍有一个 \r\n 需要读取
 		}
-	} else {
-		state.args = append(state.args, line)
+		return nil
+	}
+	// 数组中的整数、状态和错误，如 EXEC 的回复，以及 RESP3 中的空值、布尔值、浮点数和大整数
+	if len(line) > 0 && strings.IndexByte(":+-_#,(", line[0]) >= 0 {
+		elem, err := parseSingleLineReply(msg)
+		if err != nil {
+			return err
+		}
+		state.appendElem(elem)
+		return nil
 	}
+	state.appendArg(line)
 	return nil
 }
@@ -0,0 +1,68 @@
+package parser
+
+import (
+	"bytes"
+	"go-redis/config"
+	"go-redis/resp/reply"
+	"io"
+	"strings"
+	"testing"
+)
+
+// parseAll 读取 ParseStream 输出的全部结果，直到 I/O 错误关闭通道
+func parseAll(data []byte) []*Payload {
+	payloads := make([]*Payload, 0)
+	for payload := range ParseStream(bytes.NewReader(data)) {
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
+
+func TestParseStreamIgnoresRequestLimits(t *testing.T) {
+	// proto-max-bulk-len 只限制客户端的请求，其他节点的回复和 AOF 文件中的指令不受限制
+	saved := *config.Properties
+	defer func() { *config.Properties = saved }()
+	config.Properties.ProtoMaxBulkLen = 16
+
+	value := strings.Repeat("v", 100)
+	var buf bytes.Buffer
+	buf.Write(reply.MakeBulkReply([]byte(value)).ToBytes())
+	buf.Write(reply.MakeMultiBulkReply(toArgs("SET", "k", value)).ToBytes())
+	payloads := parseAll(buf.Bytes())
+	if len(payloads) != 3 || payloads[2].Err != io.EOF {
+		t.Fatalf("got %d payloads", len(payloads))
+	}
+	for _, payload := range payloads[:2] {
+		if payload.Err != nil {
+			t.Fatal(payload.Err)
+		}
+	}
+	if bulk, ok := payloads[0].Data.(*reply.BulkReply); !ok || string(bulk.Arg) != value {
+		t.Errorf("got %q", payloads[0].Data.ToBytes())
+	}
+	if multi, ok := payloads[1].Data.(*reply.MultiBulkReply); !ok || string(multi.Args[2]) != value {
+		t.Errorf("got %q", payloads[1].Data.ToBytes())
+	}
+}
+
+func TestParseStreamLargeBulk(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), maxPreallocBody/5+3)
+	data := reply.MakeBulkReply(value).ToBytes()
+	payloads := parseAll(data)
+	if payloads[0].Err != nil {
+		t.Fatal(payloads[0].Err)
+	}
+	if bulk, ok := payloads[0].Data.(*reply.BulkReply); !ok || !bytes.Equal(bulk.Arg, value) {
+		t.Error("large bulk was not parsed correctly")
+	}
+
+	// 头部声称的长度远大于实际的数据
+	payloads = parseAll([]byte("$1073741824\r\nabc"))
+	if len(payloads) != 1 || payloads[0].Err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF, got %v", payloads[0].Err)
+	}
+	payloads = parseAll(data[:len(data)-maxPreallocBody])
+	if len(payloads) != 1 || payloads[0].Err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF, got %v", payloads[0].Err)
+	}
+}
@@ -39,6 +39,11 @@ func (r *NullBulkReply) ToBytes() []byte {
 	return nullBulkBytes
 }
 
+// ToRESP3Bytes RESP3 下返回空值 _
+func (r *NullBulkReply) ToRESP3Bytes() []byte {
+	return nullBytes
+}
+
 func MakeNullBulkReply() *NullBulkReply {
 	return &NullBulkReply{}
 }
@@ -22,11 +22,20 @@ var nullBulkReplyBytes = []byte("$-1")
 
 func (b *BulkReply) ToBytes() []byte {
 	if b.Arg == nil { // Arg 为空返回 -1
-		return nullBulkReplyBytes
+		return nullBulkBytes
 	}
 	return []byte("$" + strconv.Itoa(len(b.Arg)) + CRLF + string(b.Arg) + CRLF)
 }
 
+// ToRESP3Bytes RESP3 下 Arg 为空时返回空值 _
+
+func (b *BulkReply) ToRESP3Bytes() []byte {
+	if b.Arg == nil {
+		return nullBytes
+	}
+	return b.ToBytes()
+}
+
 func MakeBulkReply(arg []byte) *BulkReply {
 	return &BulkReply{
 		Arg: arg,
@@ -40,12 +49,22 @@ type MultiBulkReply struct {
 }
 
 func (r *MultiBulkReply) ToBytes() []byte {
+	return r.encode(nullBulkReplyBytes)
+}
+
+// ToRESP3Bytes RESP3 下数组中的空元素编码为 _
+
+func (r *MultiBulkReply) ToRESP3Bytes() []byte {
+	return r.encode(nullBytes[:1])
+}
+
+func (r *MultiBulkReply) encode(null []byte) []byte {
 	argLen := len(r.Args)
 	var buf bytes.Buffer // 用于拼装 Args [][]byte 中的多个一维字节
 	buf.WriteString("*" + strconv.Itoa(argLen) + CRLF)
 	for _, arg := range r.Args {
 		if arg == nil {
-			buf.WriteString(string(nullBulkReplyBytes) + CRLF)
+			buf.WriteString(string(null) + CRLF)
 		} else {
 			buf.WriteString("$" + strconv.Itoa(len(arg)) + CRLF + string(arg) + CRLF)
 		}
@@ -59,6 +78,38 @@ func MakeMultiBulkReply(args [][]byte) *MultiBulkReply {
 	}
 }
 
+/* ---- Multi Raw Reply ---- */
+
+// MultiRawReply 是由任意类型的回复组成的数组，用于嵌套数组、数字与字符串混合的数组等场景，如 ROLE 指令的回复
+
+type MultiRawReply struct {
+	Replies []resp.Reply
+}
+
+func MakeMultiRawReply(replies []resp.Reply) *MultiRawReply {
+	return &MultiRawReply{
+		Replies: replies,
+	}
+}
+
+func (r *MultiRawReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Replies)) + CRLF)
+	for _, rep := range r.Replies {
+		buf.Write(rep.ToBytes())
+	}
+	return buf.Bytes()
+}
+
+// ToRESP3Bytes 按 RESP3 编码数组中的元素，元素中可能有 map 等 RESP3 类型
+
+func (r *MultiRawReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(r.Replies)) + CRLF)
+	encodeAll(&buf, r.Replies, resp.RESP3)
+	return buf.Bytes()
+}
+
 /* ---- Status Reply ---- */
 
 // Redis 协议（RESP）中的一种回复类型，专门用于传输简单的状态信息，如操作成功提示
@@ -0,0 +1,271 @@
+package reply
+
+import (
+	"bytes"
+	"go-redis/interface/resp"
+	"math"
+	"strconv"
+)
+
+// RESP3 新增的回复类型：ToBytes 返回 RESP2 下的编码（如 map 展开为数组），ToRESP3Bytes 返回 RESP3 下的编码
+// 服务端按连接通过 HELLO 协商的协议版本，使用 Encode 编码回复
+
+type RESP3Reply interface {
+	resp.Reply
+	ToRESP3Bytes() []byte
+}
+
+// Encode 按协议版本编码回复，RESP2 连接上 RESP3 类型会被转换为 RESP2 中对应的类型
+
+func Encode(r resp.Reply, protocol int) []byte {
+	if protocol == resp.RESP3 {
+		if r3, ok := r.(RESP3Reply); ok {
+			return r3.ToRESP3Bytes()
+		}
+	}
+	return r.ToBytes()
+}
+
+// encodeAll 依次编码数组中的元素
+
+func encodeAll(buf *bytes.Buffer, replies []resp.Reply, protocol int) {
+	for _, r := range replies {
+		buf.Write(Encode(r, protocol))
+	}
+}
+
+/* ---- Null Reply ---- */
+
+// NullReply 是 RESP3 的空值，RESP2 下编码为空的数据块 $-1
+
+type NullReply struct{}
+
+var nullBytes = []byte("_\r\n")
+
+func (r *NullReply) ToBytes() []byte {
+	return nullBulkBytes
+}
+
+func (r *NullReply) ToRESP3Bytes() []byte {
+	return nullBytes
+}
+
+func MakeNullReply() *NullReply {
+	return &NullReply{}
+}
+
+/* ---- Map Reply ---- */
+
+// MapReply 是 RESP3 的 map，Pairs 依次为 k1, v1, k2, v2 ...，RESP2 下编码为同样顺序的数组，如 HELLO 的回复
+
+type MapReply struct {
+	Pairs []resp.Reply
+}
+
+func MakeMapReply(pairs []resp.Reply) *MapReply {
+	return &MapReply{
+		Pairs: pairs,
+	}
+}
+
+func (r *MapReply) ToBytes() []byte {
+	return r.encode('*', len(r.Pairs), resp.RESP2)
+}
+
+func (r *MapReply) ToRESP3Bytes() []byte {
+	return r.encode('%', len(r.Pairs)/2, resp.RESP3)
+}
+
+func (r *MapReply) encode(prefix byte, n int, protocol int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(string(prefix) + strconv.Itoa(n) + CRLF)
+	encodeAll(&buf, r.Pairs, protocol)
+	return buf.Bytes()
+}
+
+/* ---- Set Reply ---- */
+
+// SetReply 是 RESP3 的集合，RESP2 下编码为数组
+
+type SetReply struct {
+	Members []resp.Reply
+}
+
+func MakeSetReply(members []resp.Reply) *SetReply {
+	return &SetReply{
+		Members: members,
+	}
+}
+
+func (r *SetReply) ToBytes() []byte {
+	return MakeMultiRawReply(r.Members).ToBytes()
+}
+
+func (r *SetReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("~" + strconv.Itoa(len(r.Members)) + CRLF)
+	encodeAll(&buf, r.Members, resp.RESP3)
+	return buf.Bytes()
+}
+
+/* ---- Push Reply ---- */
+
+// PushReply 是服务端主动推送给客户端的消息，如客户端缓存失效通知，RESP2 下编码为数组
+
+type PushReply struct {
+	Data []resp.Reply
+}
+
+func MakePushReply(data []resp.Reply) *PushReply {
+	return &PushReply{
+		Data: data,
+	}
+}
+
+func (r *PushReply) ToBytes() []byte {
+	return MakeMultiRawReply(r.Data).ToBytes()
+}
+
+func (r *PushReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(">" + strconv.Itoa(len(r.Data)) + CRLF)
+	encodeAll(&buf, r.Data, resp.RESP3)
+	return buf.Bytes()
+}
+
+/* ---- Attribute Reply ---- */
+
+// AttributeReply 是附带了属性的回复，RESP3 下先编码属性（与 map 相同，以 | 开头）再编码回复本身，RESP2 下丢弃属性
+
+type AttributeReply struct {
+	Attrs *MapReply
+	Reply resp.Reply
+}
+
+func MakeAttributeReply(attrs *MapReply, r resp.Reply) *AttributeReply {
+	return &AttributeReply{
+		Attrs: attrs,
+		Reply: r,
+	}
+}
+
+func (r *AttributeReply) ToBytes() []byte {
+	return r.Reply.ToBytes()
+}
+
+func (r *AttributeReply) ToRESP3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(r.Attrs.encode('|', len(r.Attrs.Pairs)/2, resp.RESP3))
+	buf.Write(Encode(r.Reply, resp.RESP3))
+	return buf.Bytes()
+}
+
+/* ---- Double Reply ---- */
+
+// DoubleReply 是 RESP3 的浮点数，如 ZSCORE 的回复，RESP2 下编码为数据块
+
+type DoubleReply struct {
+	Value float64
+}
+
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{
+		Value: value,
+	}
+}
+
+// FormatDouble 按 Redis 的格式输出浮点数，无穷大为 inf 和 -inf
+
+func FormatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	}
+	return strconv.FormatFloat(value, 'g', 17, 64)
+}
+
+func (r *DoubleReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(FormatDouble(r.Value))).ToBytes()
+}
+
+func (r *DoubleReply) ToRESP3Bytes() []byte {
+	return []byte("," + FormatDouble(r.Value) + CRLF)
+}
+
+/* ---- Boolean Reply ---- */
+
+// BooleanReply 是 RESP3 的布尔值，RESP2 下编码为整数 1 和 0
+
+type BooleanReply struct {
+	Value bool
+}
+
+func MakeBooleanReply(value bool) *BooleanReply {
+	return &BooleanReply{
+		Value: value,
+	}
+}
+
+func (r *BooleanReply) ToBytes() []byte {
+	if r.Value {
+		return []byte(":1\r\n")
+	}
+	return []byte(":0\r\n")
+}
+
+func (r *BooleanReply) ToRESP3Bytes() []byte {
+	if r.Value {
+		return []byte("#t\r\n")
+	}
+	return []byte("#f\r\n")
+}
+
+/* ---- Big Number Reply ---- */
+
+// BigNumberReply 是 RESP3 中超出 64 位整数范围的整数，以十进制字符串保存，RESP2 下编码为数据块
+
+type BigNumberReply struct {
+	Value string
+}
+
+func MakeBigNumberReply(value string) *BigNumberReply {
+	return &BigNumberReply{
+		Value: value,
+	}
+}
+
+func (r *BigNumberReply) ToBytes() []byte {
+	return MakeBulkReply([]byte(r.Value)).ToBytes()
+}
+
+func (r *BigNumberReply) ToRESP3Bytes() []byte {
+	return []byte("(" + r.Value + CRLF)
+}
+
+/* ---- Verbatim String Reply ---- */
+
+// VerbatimReply 是 RESP3 中带格式的字符串，Format 为 3 个字符的格式如 txt、mkd，如 INFO 的回复，RESP2 下编码为数据块
+
+type VerbatimReply struct {
+	Format string
+	Text   []byte
+}
+
+func MakeVerbatimReply(format string, text []byte) *VerbatimReply {
+	return &VerbatimReply{
+		Format: format,
+		Text:   text,
+	}
+}
+
+func (r *VerbatimReply) ToBytes() []byte {
+	return MakeBulkReply(r.Text).ToBytes()
+}
+
+func (r *VerbatimReply) ToRESP3Bytes() []byte {
+	return []byte("=" + strconv.Itoa(len(r.Format)+1+len(r.Text)) + CRLF + r.Format + ":" + string(r.Text) + CRLF)
+}
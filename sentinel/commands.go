@@ -0,0 +1,254 @@
+package sentinel
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// execSentinel 实现 SENTINEL 指令的各个子命令
+
+func (s *Sentinel) execSentinel(c resp.Connection, args [][]byte) resp.Reply {
+	subCmd := strings.ToLower(string(args[0]))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch subCmd {
+	case "myid":
+		return reply.MakeBulkReply([]byte(s.myId))
+	case "masters":
+		names := make([]string, 0, len(s.masters))
+		for name := range s.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		replies := make([]resp.Reply, 0, len(names))
+		for _, name := range names {
+			replies = append(replies, s.masterFields(s.masters[name]))
+		}
+		return reply.MakeMultiRawReply(replies)
+	case "master", "replicas", "slaves", "sentinels", "get-master-addr-by-name", "failover":
+		if len(args) != 2 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel|" + subCmd + "' command")
+		}
+		m, ok := s.masters[string(args[1])]
+		if !ok {
+			if subCmd == "get-master-addr-by-name" {
+				return reply.MakeEmptyMultiBulkReply()
+			}
+			return reply.MakeErrReply("ERR No such master with that name")
+		}
+		switch subCmd {
+		case "master":
+			return s.masterFields(m)
+		case "replicas", "slaves":
+			return s.replicasFields(m)
+		case "sentinels":
+			return s.sentinelsFields(m)
+		case "get-master-addr-by-name":
+			return reply.MakeMultiBulkReply([][]byte{[]byte(m.inst.host), []byte(itoa(m.inst.port))})
+		default:
+			return s.execFailover(m)
+		}
+	case "is-master-down-by-addr":
+		if len(args) != 5 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel|" + subCmd + "' command")
+		}
+		return s.execIsMasterDownByAddr(args[1:])
+	case "hello":
+		if len(args) < 8 || (len(args)-8)%2 != 0 {
+			return reply.MakeErrReply("ERR wrong number of arguments for 'sentinel|" + subCmd + "' command")
+		}
+		return s.execHello(c, args[1:])
+	}
+	return reply.MakeErrReply("ERR Unknown sentinel subcommand '" + subCmd + "'")
+}
+
+// execIsMasterDownByAddr 实现 SENTINEL IS-MASTER-DOWN-BY-ADDR ip port current-epoch runid
+// 回复中的三个元素均为 bulk string，因为 resp/client 的解析器不支持数组中嵌套整数
+
+func (s *Sentinel) execIsMasterDownByAddr(args [][]byte) resp.Reply {
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	epoch, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	runId := string(args[3])
+	addr := net.JoinHostPort(string(args[0]), itoa(port))
+	var m *master
+	for _, candidate := range s.masters {
+		if candidate.inst.addr == addr {
+			m = candidate
+			break
+		}
+	}
+	down, leader, leaderEpoch := "0", "*", int64(0)
+	if m != nil {
+		if m.inst.sdown {
+			down = "1"
+		}
+		if runId != "*" {
+			leader, leaderEpoch = s.voteLeader(m, epoch, runId)
+		}
+	}
+	return reply.MakeMultiBulkReply([][]byte{
+		[]byte(down),
+		[]byte(leader),
+		[]byte(formatInt(leaderEpoch)),
+	})
+}
+
+// execHello 实现 SENTINEL HELLO master-name master-ip master-port config-epoch runid port current-epoch [sentinel-addr sentinel-runid ...]，
+// 见 sendHello
+
+func (s *Sentinel) execHello(c resp.Connection, args [][]byte) resp.Reply {
+	m, ok := s.masters[string(args[0])]
+	if !ok {
+		return reply.MakeErrReply("ERR No such master with that name")
+	}
+	masterPort, err1 := strconv.Atoi(string(args[2]))
+	configEpoch, err2 := strconv.ParseInt(string(args[3]), 10, 64)
+	port, err3 := strconv.Atoi(string(args[5]))
+	currentEpoch, err4 := strconv.ParseInt(string(args[6]), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	// 对方的地址取连接的来源 ip 加上对方告知的端口
+	tcpAddr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return reply.MakeErrReply("ERR unable to get the address of the sender")
+	}
+	senderAddr := net.JoinHostPort(tcpAddr.IP.String(), itoa(port))
+	s.handleHello(m, senderAddr, string(args[1]), masterPort, configEpoch, string(args[4]), currentEpoch)
+	for i := 7; i+1 < len(args); i += 2 {
+		s.learnSentinel(m, string(args[i]), string(args[i+1]))
+	}
+	return reply.MakeOkReply()
+}
+
+// execFailover 实现 SENTINEL FAILOVER，无需其他哨兵同意，立即进行故障转移
+
+func (s *Sentinel) execFailover(m *master) resp.Reply {
+	if m.failoverState != failoverNone {
+		return reply.MakeErrReply("INPROG Failover already in progress")
+	}
+	if s.selectReplica(m) == nil {
+		return reply.MakeErrReply("NOGOODSLAVE No suitable replica to promote")
+	}
+	s.startFailover(m, true)
+	return reply.MakeOkReply()
+}
+
+// execRole 实现 ROLE，回复 ["sentinel", [master-name, ...]]
+
+func (s *Sentinel) execRole() resp.Reply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([][]byte, 0, len(s.masters))
+	for name := range s.masters {
+		names = append(names, []byte(name))
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return string(names[i]) < string(names[j])
+	})
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte("sentinel")),
+		reply.MakeMultiBulkReply(names),
+	})
+}
+
+/* ---- fields ---- */
+
+func sinceMillis(t time.Time) string {
+	return formatInt(int64(time.Since(t) / time.Millisecond))
+}
+
+func (s *Sentinel) masterFields(m *master) resp.Reply {
+	flags := m.inst.flags("master")
+	if m.odown {
+		flags += ",o_down"
+	}
+	if m.failoverState != failoverNone {
+		flags += ",failover_in_progress"
+	}
+	fields := []string{
+		"name", m.name,
+		"ip", m.inst.host,
+		"port", itoa(m.inst.port),
+		"flags", flags,
+		"last-ok-ping-reply", sinceMillis(m.inst.lastAvail),
+		"info-refresh", sinceMillis(m.inst.lastInfo),
+		"role-reported", m.inst.role,
+		"config-epoch", formatInt(m.configEpoch),
+		"num-slaves", itoa(len(m.replicas)),
+		"num-other-sentinels", itoa(len(m.sentinels)),
+		"quorum", itoa(m.quorum),
+		"failover-timeout", formatInt(int64(m.failoverTimeout / time.Millisecond)),
+		"down-after-milliseconds", formatInt(int64(m.downAfter / time.Millisecond)),
+		"failover-state", failoverStateNames[m.failoverState],
+	}
+	return reply.MakeMultiBulkReply(utils.ToCmdLine(fields...))
+}
+
+func (s *Sentinel) replicasFields(m *master) resp.Reply {
+	addrs := make([]string, 0, len(m.replicas))
+	for addr := range m.replicas {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	replies := make([]resp.Reply, 0, len(addrs))
+	for _, addr := range addrs {
+		r := m.replicas[addr]
+		linkStatus := "err"
+		if r.linkUp {
+			linkStatus = "ok"
+		}
+		fields := []string{
+			"name", r.addr,
+			"ip", r.host,
+			"port", itoa(r.port),
+			"flags", r.flags("slave"),
+			"last-ok-ping-reply", sinceMillis(r.lastAvail),
+			"info-refresh", sinceMillis(r.lastInfo),
+			"role-reported", r.role,
+			"master-host", r.masterHost,
+			"master-port", itoa(r.masterPort),
+			"master-link-status", linkStatus,
+			"slave-repl-offset", formatInt(r.replOffset),
+		}
+		replies = append(replies, reply.MakeMultiBulkReply(utils.ToCmdLine(fields...)))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
+
+func (s *Sentinel) sentinelsFields(m *master) resp.Reply {
+	addrs := make([]string, 0, len(m.sentinels))
+	for addr := range m.sentinels {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	replies := make([]resp.Reply, 0, len(addrs))
+	for _, addr := range addrs {
+		p := m.sentinels[addr]
+		fields := []string{
+			"name", p.runId,
+			"ip", p.host,
+			"port", itoa(p.port),
+			"runid", p.runId,
+			"flags", p.flags("sentinel"),
+			"last-ok-ping-reply", sinceMillis(p.lastAvail),
+			"last-hello-message", sinceMillis(p.lastHello),
+			"voted-leader", p.leader,
+			"voted-leader-epoch", formatInt(p.leaderEpoch),
+		}
+		replies = append(replies, reply.MakeMultiBulkReply(utils.ToCmdLine(fields...)))
+	}
+	return reply.MakeMultiRawReply(replies)
+}
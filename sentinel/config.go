@@ -0,0 +1,180 @@
+package sentinel
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config 是哨兵的配置，格式与 redis-sentinel 的配置文件一致：
+//
+//	bind 0.0.0.0
+//	port 26379
+//	sentinel monitor <master-name> <ip> <port> <quorum>
+//	sentinel down-after-milliseconds <master-name> <milliseconds>
+//	sentinel failover-timeout <master-name> <milliseconds>
+//	sentinel known-sentinel <master-name> <ip> <port> [runid]
+//
+// 本实现没有发布订阅，哨兵之间无法通过主节点的 __sentinel__:hello 频道互相发现，
+// 因此至少需要通过 known-sentinel 告知每个哨兵一个其他哨兵的地址，之后哨兵会通过 SENTINEL HELLO 互相认识
+
+type Config struct {
+	Bind    string
+	Port    int
+	Masters []*MasterConfig
+}
+
+// MasterConfig 是一个被监控的主节点的配置
+
+type MasterConfig struct {
+	Name            string
+	Host            string
+	Port            int
+	Quorum          int           // 至少有 Quorum 个哨兵认为主节点主观下线时，才判定它客观下线
+	DownAfter       time.Duration // 超过该时间没有收到有效的 PING 回复时判定节点主观下线
+	FailoverTimeout time.Duration
+	KnownSentinels  []string // 其他哨兵的地址 ip:port
+}
+
+const (
+	defaultPort            = 26379
+	defaultDownAfter       = 30 * time.Second
+	defaultFailoverTimeout = 3 * time.Minute
+)
+
+// LoadConfig 读取哨兵的配置文件
+
+func LoadConfig(filename string) (*Config, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseConfig(file)
+}
+
+// ParseConfig 解析哨兵的配置
+
+func ParseConfig(src io.Reader) (*Config, error) {
+	cfg := &Config{
+		Bind: "0.0.0.0",
+		Port: defaultPort,
+	}
+	scanner := bufio.NewScanner(src)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var err error
+		switch strings.ToLower(fields[0]) {
+		case "bind":
+			if len(fields) != 2 {
+				err = errors.New("wrong number of arguments")
+			} else {
+				cfg.Bind = fields[1]
+			}
+		case "port":
+			if len(fields) != 2 {
+				err = errors.New("wrong number of arguments")
+			} else if cfg.Port, err = strconv.Atoi(fields[1]); err != nil {
+				err = errors.New("invalid port " + fields[1])
+			}
+		case "sentinel":
+			err = cfg.parseSentinelDirective(fields[1:])
+		default:
+			// 与哨兵无关的配置（如 logfile、daemonize 等）直接忽略
+		}
+		if err != nil {
+			return nil, errors.New("sentinel config line " + strconv.Itoa(lineNum) + ": " + err.Error())
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Masters) == 0 {
+		return nil, errors.New("no master to monitor, please add a \"sentinel monitor\" directive")
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) parseSentinelDirective(args []string) error {
+	if len(args) < 2 {
+		return errors.New("wrong number of arguments")
+	}
+	option := strings.ToLower(args[0])
+	if option == "monitor" {
+		if len(args) != 5 {
+			return errors.New("wrong number of arguments for sentinel monitor")
+		}
+		if cfg.getMaster(args[1]) != nil {
+			return errors.New("duplicated master name " + args[1])
+		}
+		port, err := strconv.Atoi(args[3])
+		if err != nil || port <= 0 || port > 65535 {
+			return errors.New("invalid port " + args[3])
+		}
+		quorum, err := strconv.Atoi(args[4])
+		if err != nil || quorum <= 0 {
+			return errors.New("quorum must be 1 or greater")
+		}
+		cfg.Masters = append(cfg.Masters, &MasterConfig{
+			Name:            args[1],
+			Host:            args[2],
+			Port:            port,
+			Quorum:          quorum,
+			DownAfter:       defaultDownAfter,
+			FailoverTimeout: defaultFailoverTimeout,
+		})
+		return nil
+	}
+
+	m := cfg.getMaster(args[1])
+	if m == nil {
+		return errors.New("no such master with specified name " + args[1])
+	}
+	switch option {
+	case "down-after-milliseconds", "failover-timeout":
+		if len(args) != 3 {
+			return errors.New("wrong number of arguments for sentinel " + option)
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || ms <= 0 {
+			return errors.New("invalid milliseconds " + args[2])
+		}
+		if option == "down-after-milliseconds" {
+			m.DownAfter = time.Duration(ms) * time.Millisecond
+		} else {
+			m.FailoverTimeout = time.Duration(ms) * time.Millisecond
+		}
+	case "known-sentinel":
+		if len(args) != 4 && len(args) != 5 {
+			return errors.New("wrong number of arguments for sentinel known-sentinel")
+		}
+		if _, err := strconv.Atoi(args[3]); err != nil {
+			return errors.New("invalid port " + args[3])
+		}
+		m.KnownSentinels = append(m.KnownSentinels, net.JoinHostPort(args[2], args[3]))
+	case "parallel-syncs", "auth-pass", "auth-user", "known-replica", "config-epoch", "leader-epoch":
+		// 这些配置暂不支持，忽略
+	default:
+		return errors.New("unknown sentinel option " + option)
+	}
+	return nil
+}
+
+func (cfg *Config) getMaster(name string) *MasterConfig {
+	for _, m := range cfg.Masters {
+		if m.Name == name {
+			return m
+		}
+	}
+	return nil
+}
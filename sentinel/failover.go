@@ -0,0 +1,353 @@
+package sentinel
+
+import (
+	"go-redis/lib/logger"
+	"go-redis/resp/reply"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 故障转移的各个阶段
+const (
+	failoverNone           = iota
+	failoverWaitStart      // 已发起投票，等待当选领头哨兵
+	failoverSelectReplica  // 当选后挑选要晋升的从节点
+	failoverWaitPromotion  // 已向选中的从节点发送 REPLICAOF NO ONE，等待它成为主节点
+	failoverReconfReplicas // 让其余的从节点改为复制新的主节点
+)
+
+var failoverStateNames = map[int]string{
+	failoverNone:           "none",
+	failoverWaitStart:      "wait_start",
+	failoverSelectReplica:  "select_slave",
+	failoverWaitPromotion:  "wait_promotion",
+	failoverReconfReplicas: "reconf_slaves",
+}
+
+func itoa(i int) string {
+	return strconv.Itoa(i)
+}
+
+func formatInt(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
+
+/* ---- leader election ---- */
+
+// startFailoverIfNeeded 主节点客观下线后进入新的纪元并发起选举，距离上一次尝试不足 2 * failover-timeout 时不重复发起，调用方需持有 s.mu
+
+func (s *Sentinel) startFailoverIfNeeded(m *master) {
+	if time.Now().Before(m.failoverStart.Add(2 * m.failoverTimeout)) {
+		return
+	}
+	s.startFailover(m, false)
+}
+
+func (s *Sentinel) startFailover(m *master, forced bool) {
+	s.currentEpoch++
+	m.failoverEpoch = s.currentEpoch
+	m.failoverState = failoverWaitStart
+	m.failoverForced = forced
+	// 加上随机的延迟，避免多个哨兵总是同时发起选举导致选票被瓜分
+	m.failoverStart = time.Now().Add(time.Duration(rand.Intn(1000)) * time.Millisecond)
+	m.failoverStateTime = time.Now()
+	if m.leaderEpoch < m.failoverEpoch { // 先给自己投一票
+		m.leader = s.myId
+		m.leaderEpoch = m.failoverEpoch
+	}
+	for _, p := range m.sentinels {
+		p.lastAsk = time.Time{} // 立即向其他哨兵拉票
+	}
+	logger.Info("sentinel: +new-epoch " + formatInt(s.currentEpoch))
+	logger.Info("sentinel: +try-failover master " + m.name + " " + m.inst.addr)
+}
+
+// askOtherSentinels 询问其他哨兵是否也认为主节点已经下线；发起选举期间同时请求对方投票给自己，调用方需持有 s.mu
+
+func (s *Sentinel) askOtherSentinels(m *master) {
+	runId := "*"
+	if m.failoverState == failoverWaitStart {
+		runId = s.myId
+	}
+	for _, p := range m.sentinels {
+		if p.asking || time.Since(p.lastAsk) < askPeriod {
+			continue
+		}
+		p.asking = true
+		p.lastAsk = time.Now()
+		go s.askSentinel(m, p, m.inst.host, m.inst.port, s.currentEpoch, runId)
+	}
+}
+
+// askSentinel 发送 SENTINEL IS-MASTER-DOWN-BY-ADDR ip port current-epoch runid
+// 回复为 [down-state, leader-runid, leader-epoch]，runid 为 * 时对方不投票，回复中的 leader 也为 *
+
+func (s *Sentinel) askSentinel(m *master, p *peer, host string, port int, epoch int64, runId string) {
+	result := p.send("SENTINEL", "IS-MASTER-DOWN-BY-ADDR", host, itoa(port), formatInt(epoch), runId)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.asking = false
+	rep, ok := result.(*reply.MultiBulkReply)
+	if !ok || len(rep.Args) != 3 {
+		return
+	}
+	p.masterDown = string(rep.Args[0]) == "1"
+	p.downReplyAt = time.Now()
+	if leader := string(rep.Args[1]); leader != "*" {
+		leaderEpoch, err := strconv.ParseInt(string(rep.Args[2]), 10, 64)
+		if err == nil {
+			p.leader = leader
+			p.leaderEpoch = leaderEpoch
+		}
+	}
+}
+
+// voteLeader 处理其他哨兵的拉票请求：每个纪元只投一次票，投给最先请求的哨兵，调用方需持有 s.mu
+
+func (s *Sentinel) voteLeader(m *master, epoch int64, runId string) (string, int64) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		logger.Info("sentinel: +new-epoch " + formatInt(epoch))
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader = runId
+		m.leaderEpoch = epoch
+		logger.Info("sentinel: +vote-for-leader " + runId + " " + formatInt(epoch))
+		if runId != s.myId {
+			// 已经投票给其他哨兵，短时间内自己不再发起故障转移
+			m.failoverStart = time.Now().Add(time.Duration(rand.Intn(1000)) * time.Millisecond)
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// getLeader 统计本纪元的选票，返回得票最多的哨兵及其票数
+func (s *Sentinel) getLeader(m *master) (string, int) {
+	votes := make(map[string]int)
+	if m.leaderEpoch == m.failoverEpoch {
+		votes[m.leader]++
+	}
+	for _, p := range m.sentinels {
+		if p.leaderEpoch == m.failoverEpoch && p.leader != "" {
+			votes[p.leader]++
+		}
+	}
+	winner, most := "", 0
+	for runId, n := range votes {
+		if n > most || (n == most && runId < winner) {
+			winner, most = runId, n
+		}
+	}
+	return winner, most
+}
+
+/* ---- failover ---- */
+
+// failoverStateMachine 推进故障转移，调用方需持有 s.mu
+
+func (s *Sentinel) failoverStateMachine(m *master) {
+	switch m.failoverState {
+	case failoverWaitStart:
+		leader, votes := s.getLeader(m)
+		// 需要获得超过半数哨兵的选票，且不少于 quorum
+		needed := (len(m.sentinels)+1)/2 + 1
+		if needed < m.quorum {
+			needed = m.quorum
+		}
+		if m.failoverForced || (leader == s.myId && votes >= needed) {
+			logger.Info("sentinel: +elected-leader master " + m.name + " " + m.inst.addr + " epoch " + formatInt(m.failoverEpoch))
+			s.setFailoverState(m, failoverSelectReplica)
+			return
+		}
+		electionTimeout := maxElectionDelay
+		if m.failoverTimeout < electionTimeout {
+			electionTimeout = m.failoverTimeout
+		}
+		if time.Since(m.failoverStateTime) > electionTimeout {
+			s.abortFailover(m, "not-elected")
+		}
+	case failoverSelectReplica:
+		r := s.selectReplica(m)
+		if r == nil {
+			s.abortFailover(m, "no-good-slave")
+			return
+		}
+		m.promoted = r
+		logger.Info("sentinel: +selected-slave " + r.addr + " @ " + m.name)
+		s.setFailoverState(m, failoverWaitPromotion)
+		go s.sendReplicaOf(r, "NO", "ONE")
+	case failoverWaitPromotion:
+		// 等待 INFO 显示被选中的从节点已经成为主节点，见 handleInfo
+		if time.Since(m.failoverStateTime) > m.failoverTimeout {
+			s.abortFailover(m, "slave-timeout")
+		}
+	case failoverReconfReplicas:
+		for _, r := range m.replicas {
+			if r == m.promoted {
+				continue
+			}
+			r.reconfAt = time.Now()
+			logger.Info("sentinel: +slave-reconf-sent " + r.addr + " @ " + m.name)
+			go s.sendReplicaOf(r, m.promoted.host, itoa(m.promoted.port))
+		}
+		if !m.inst.sdown { // 手动发起的故障转移中旧的主节点仍然在线，同样让它复制新的主节点
+			m.inst.reconfAt = time.Now()
+			go s.sendReplicaOf(m.inst, m.promoted.host, itoa(m.promoted.port))
+		}
+		old := m.inst.addr
+		s.switchMaster(m, m.promoted, m.failoverEpoch)
+		logger.Info("sentinel: +failover-end master " + m.name + " " + old)
+	}
+}
+
+func (s *Sentinel) setFailoverState(m *master, state int) {
+	m.failoverState = state
+	m.failoverStateTime = time.Now()
+	logger.Info("sentinel: +failover-state-" + failoverStateNames[state] + " master " + m.name + " " + m.inst.addr)
+}
+
+func (s *Sentinel) abortFailover(m *master, reason string) {
+	logger.Info("sentinel: -failover-abort-" + reason + " master " + m.name + " " + m.inst.addr)
+	m.failoverState = failoverNone
+	m.failoverForced = false
+	m.promoted = nil
+}
+
+// onReplicaPromoted 被选中的从节点已经成为主节点，调用方需持有 s.mu
+
+func (s *Sentinel) onReplicaPromoted(m *master) {
+	logger.Info("sentinel: +promoted-slave " + m.promoted.addr + " @ " + m.name)
+	s.setFailoverState(m, failoverReconfReplicas)
+}
+
+// selectReplica 挑选要晋升的从节点：排除下线的、长时间没有 INFO 回复的从节点，然后选择复制偏移量最大的一个
+
+func (s *Sentinel) selectReplica(m *master) *instance {
+	// 主节点下线后每秒获取一次 INFO，否则每 10 秒一次
+	infoValidity := 3 * infoPeriod
+	if m.inst.sdown {
+		infoValidity = 5 * time.Second
+	}
+	candidates := make([]*instance, 0, len(m.replicas))
+	for _, r := range m.replicas {
+		if r.sdown || r.role != "slave" || time.Since(r.lastAvail) > 5*pingPeriod || time.Since(r.lastInfo) > infoValidity {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].replOffset != candidates[j].replOffset {
+			return candidates[i].replOffset > candidates[j].replOffset
+		}
+		return candidates[i].addr < candidates[j].addr
+	})
+	return candidates[0]
+}
+
+// switchMaster 将主节点切换为 newMaster，旧的主节点变为从节点，它恢复后会被纠正为复制新的主节点，调用方需持有 s.mu
+
+func (s *Sentinel) switchMaster(m *master, newMaster *instance, epoch int64) {
+	old := m.inst
+	logger.Info("sentinel: +switch-master " + m.name + " " + old.host + " " + itoa(old.port) + " " +
+		newMaster.host + " " + itoa(newMaster.port))
+	delete(m.replicas, newMaster.addr)
+	old.role = ""
+	m.replicas[old.addr] = old
+	m.inst = newMaster
+	m.configEpoch = epoch
+	m.odown = false
+	m.failoverState = failoverNone
+	m.failoverForced = false
+	m.promoted = nil
+	for _, p := range m.sentinels {
+		p.masterDown = false
+	}
+}
+
+/* ---- hello ---- */
+
+// sendHello 定期向其他哨兵广播自己以及当前主节点的地址和版本，代替 Redis 中通过 __sentinel__:hello 频道发布的消息，
+// 其他哨兵据此认识本哨兵，并在本哨兵完成故障转移后更新主节点的地址；
+// 消息中还附带本哨兵认识的其他哨兵，这样只需配置一个 known-sentinel，所有哨兵最终都能互相认识，调用方需持有 s.mu
+
+func (s *Sentinel) sendHello(m *master, p *peer) {
+	if time.Since(p.lastHello) < helloPeriod {
+		return
+	}
+	p.lastHello = time.Now()
+	args := []string{"SENTINEL", "HELLO", m.name, m.inst.host, itoa(m.inst.port), formatInt(m.configEpoch),
+		s.myId, itoa(s.port), formatInt(s.currentEpoch)}
+	for _, other := range m.sentinels {
+		if other != p && other.runId != "" {
+			args = append(args, other.addr, other.runId)
+		}
+	}
+	go p.send(args...)
+}
+
+// handleHello 处理 SENTINEL HELLO master-name master-ip master-port config-epoch runid port current-epoch，调用方需持有 s.mu
+
+func (s *Sentinel) handleHello(m *master, senderAddr string, masterHost string, masterPort int,
+	configEpoch int64, runId string, currentEpoch int64) {
+	if runId == s.myId {
+		return
+	}
+	if currentEpoch > s.currentEpoch {
+		s.currentEpoch = currentEpoch
+		logger.Info("sentinel: +new-epoch " + formatInt(currentEpoch))
+	}
+	p := s.learnSentinel(m, senderAddr, runId)
+	if p == nil {
+		return
+	}
+	p.lastAvail = time.Now()
+
+	// 对方的主节点地址版本更新，说明对方完成了一次故障转移
+	if configEpoch > m.configEpoch {
+		newMaster := makeInstance(masterHost, masterPort)
+		if newMaster.addr == m.inst.addr {
+			m.configEpoch = configEpoch
+			return
+		}
+		if r, ok := m.replicas[newMaster.addr]; ok {
+			newMaster = r
+		}
+		logger.Info("sentinel: +config-update-from sentinel " + senderAddr + " " + runId + " @ " + m.name)
+		if m.failoverState != failoverNone {
+			s.abortFailover(m, "config-update")
+		}
+		s.switchMaster(m, newMaster, configEpoch)
+	}
+}
+
+// learnSentinel 记录一个监控该主节点的哨兵，返回其记录，调用方需持有 s.mu
+
+func (s *Sentinel) learnSentinel(m *master, addr string, runId string) *peer {
+	if runId == s.myId {
+		return nil
+	}
+	if p, ok := m.sentinels[addr]; ok {
+		p.runId = runId
+		return p
+	}
+	inst, ok := makeInstanceFromAddr(addr)
+	if !ok {
+		return nil
+	}
+	// 同一个哨兵换了地址时替换旧的记录
+	for oldAddr, old := range m.sentinels {
+		if old.runId == runId {
+			old.closeLink()
+			delete(m.sentinels, oldAddr)
+		}
+	}
+	p := &peer{instance: inst, runId: runId}
+	m.sentinels[inst.addr] = p
+	logger.Info("sentinel: +sentinel " + inst.addr + " " + runId + " @ " + m.name)
+	return p
+}
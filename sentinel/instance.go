@@ -0,0 +1,198 @@
+package sentinel
+
+import (
+	"fmt"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// instance 是哨兵连接的一个节点：被监控的主节点、从节点，或者其他哨兵
+// 除 linkMu 和 client 外，其余字段都由 Sentinel.mu 保护
+
+type instance struct {
+	addr string // host:port
+	host string
+	port int
+
+	linkMu sync.Mutex
+	client *client.Client
+
+	createdAt time.Time
+	lastAvail time.Time // 最近一次收到有效 PING 回复的时间
+	lastPing  time.Time // 最近一次发送 PING 的时间
+	lastInfo  time.Time // 最近一次成功获取 INFO 的时间
+	pinging   bool      // 是否有尚未返回的 PING，防止节点无响应时堆积请求
+	infoing   bool
+	sdown     bool      // 是否主观下线
+	reconfAt  time.Time // 最近一次向该节点发送 REPLICAOF 进行纠正的时间
+
+	// 以下字段来自节点的 INFO replication
+	role          string
+	masterHost    string
+	masterPort    int
+	linkUp        bool // 从节点与其主节点之间的复制连接是否正常
+	replOffset    int64
+	roleChangedAt time.Time // 角色或所复制的主节点最近一次发生变化的时间
+}
+
+func makeInstance(host string, port int) *instance {
+	now := time.Now()
+	return &instance{
+		addr:      net.JoinHostPort(host, strconv.Itoa(port)),
+		host:      host,
+		port:      port,
+		createdAt: now,
+		lastAvail: now, // 刚加入的节点先视为可用，之后按 PING 的结果判断
+	}
+}
+
+func makeInstanceFromAddr(addr string) (*instance, bool) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, false
+	}
+	return makeInstance(host, port), true
+}
+
+// send 通过 resp/client 向节点发送一条指令，连接不存在或已经失效时重新建立连接
+
+func (inst *instance) send(args ...string) (result resp.Reply) {
+	defer func() {
+		// 连接失效时 client 会在后台关闭，与此同时发送请求可能会 panic，视为一次连接错误
+		if err := recover(); err != nil {
+			logger.Warn(fmt.Sprintf("sentinel: send to %s failed: %v", inst.addr, err))
+			result = reply.MakeErrReply("client closed")
+		}
+	}()
+	inst.linkMu.Lock()
+	if inst.client == nil || inst.client.IsClosed() {
+		c, err := client.MakeClient(inst.addr)
+		if err != nil {
+			inst.linkMu.Unlock()
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		c.Start()
+		inst.client = c
+	}
+	c := inst.client
+	inst.linkMu.Unlock()
+	result = c.Send(utils.ToCmdLine(args...))
+	if result == nil {
+		return reply.MakeErrReply("ERR empty reply")
+	}
+	return result
+}
+
+// closeLink 关闭与节点之间的连接
+
+func (inst *instance) closeLink() {
+	inst.linkMu.Lock()
+	defer inst.linkMu.Unlock()
+	if inst.client != nil {
+		inst.client.Close()
+		inst.client = nil
+	}
+}
+
+// isAvailableReply 判断 PING 的回复是否说明节点可用，节点正在加载数据时同样视为可用
+
+func isAvailableReply(r resp.Reply) bool {
+	switch rep := r.(type) {
+	case *reply.StatusReply:
+		return rep.Status == "PONG"
+	case *reply.PongReply:
+		return true
+	case reply.ErrorReply:
+		msg := rep.Error()
+		return strings.HasPrefix(msg, "LOADING") || strings.HasPrefix(msg, "MASTERDOWN")
+	}
+	return false
+}
+
+// replicaInfo 是主节点 INFO 中 slaveN 一行描述的从节点
+
+type replicaInfo struct {
+	host   string
+	port   int
+	online bool
+}
+
+// applyInfo 解析 INFO replication 的结果并更新节点状态，返回主节点 INFO 中列出的从节点
+
+func (inst *instance) applyInfo(info string) []replicaInfo {
+	replicas := make([]replicaInfo, 0)
+	oldRole, oldMasterHost, oldMasterPort := inst.role, inst.masterHost, inst.masterPort
+	inst.masterHost, inst.masterPort, inst.linkUp = "", 0, false
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimRight(line, "\r")
+		pivot := strings.IndexByte(line, ':')
+		if pivot <= 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value := line[:pivot], line[pivot+1:]
+		switch {
+		case key == "role":
+			inst.role = value
+		case key == "master_host":
+			inst.masterHost = value
+		case key == "master_port":
+			inst.masterPort, _ = strconv.Atoi(value)
+		case key == "master_link_status":
+			inst.linkUp = value == "up"
+		case key == "slave_repl_offset":
+			inst.replOffset, _ = strconv.ParseInt(value, 10, 64)
+		case key == "master_repl_offset" && inst.role == "master":
+			inst.replOffset, _ = strconv.ParseInt(value, 10, 64)
+		case len(key) > 5 && strings.HasPrefix(key, "slave") && key[5] >= '0' && key[5] <= '9':
+			// slave0:ip=127.0.0.1,port=6380,state=online,offset=100,lag=0
+			r := replicaInfo{}
+			for _, kv := range strings.Split(value, ",") {
+				parts := strings.SplitN(kv, "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+				switch parts[0] {
+				case "ip":
+					r.host = parts[1]
+				case "port":
+					r.port, _ = strconv.Atoi(parts[1])
+				case "state":
+					r.online = parts[1] == "online"
+				}
+			}
+			if r.host != "" && r.port > 0 {
+				replicas = append(replicas, r)
+			}
+		}
+	}
+	inst.lastInfo = time.Now()
+	if inst.role != oldRole || inst.masterHost != oldMasterHost || inst.masterPort != oldMasterPort {
+		inst.roleChangedAt = inst.lastInfo
+	}
+	return replicas
+}
+
+// flags 返回 SENTINEL MASTERS 等指令中展示的节点状态
+
+func (inst *instance) flags(role string) string {
+	flags := []string{role}
+	if inst.sdown {
+		flags = append(flags, "s_down")
+	}
+	if time.Since(inst.lastAvail) > 5*pingPeriod {
+		flags = append(flags, "disconnected")
+	}
+	return strings.Join(flags, ",")
+}
@@ -0,0 +1,335 @@
+// Package sentinel 实现哨兵模式：监控主节点及其从节点，主节点下线后由哨兵们协商选出领头哨兵，
+// 将最合适的从节点晋升为新的主节点，并让其余的从节点改为复制它
+package sentinel
+
+import (
+	"go-redis/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cronPeriod       = 100 * time.Millisecond
+	pingPeriod       = time.Second
+	infoPeriod       = 10 * time.Second
+	helloPeriod      = 2 * time.Second
+	askPeriod        = time.Second
+	maxElectionDelay = 10 * time.Second // 等待选举结果的最长时间
+	runIdLen         = 40
+)
+
+// Sentinel 是一个哨兵节点，实现了 database.Database 接口，由 resp/handler 处理客户端连接
+
+type Sentinel struct {
+	mu           sync.Mutex
+	myId         string
+	port         int // 告知其他哨兵的端口
+	currentEpoch int64
+	masters      map[string]*master
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+// master 记录一个被监控的主节点，以及它的从节点和同样监控它的其他哨兵
+
+type master struct {
+	name            string
+	inst            *instance
+	quorum          int
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	configEpoch     int64 // 主节点地址的版本，每完成一次故障转移加一，哨兵之间以更大的版本为准
+
+	replicas  map[string]*instance // addr -> 从节点
+	sentinels map[string]*peer     // addr -> 其他哨兵
+
+	odown bool // 是否客观下线
+
+	// 本哨兵在各个纪元中的投票，每个纪元只投一次
+	leader      string
+	leaderEpoch int64
+
+	// 故障转移的状态
+	failoverState     int
+	failoverEpoch     int64
+	failoverStart     time.Time // 最近一次尝试故障转移的时间，两次尝试之间至少间隔 2 * failoverTimeout
+	failoverStateTime time.Time
+	failoverForced    bool // 由 SENTINEL FAILOVER 发起，无需其他哨兵同意
+	promoted          *instance
+}
+
+// peer 是同样监控该主节点的另一个哨兵
+
+type peer struct {
+	*instance
+	runId       string
+	masterDown  bool      // 对方最近一次回复中是否认为主节点已主观下线
+	downReplyAt time.Time // 最近一次收到 is-master-down-by-addr 回复的时间
+	leader      string    // 对方在 leaderEpoch 纪元中投票给了谁
+	leaderEpoch int64
+	lastAsk     time.Time
+	asking      bool
+	lastHello   time.Time
+}
+
+// MakeSentinel 根据配置创建哨兵并开始监控
+
+func MakeSentinel(cfg *Config) *Sentinel {
+	s := &Sentinel{
+		myId:      utils.RandHexString(runIdLen),
+		port:      cfg.Port,
+		masters:   make(map[string]*master),
+		closeChan: make(chan struct{}),
+	}
+	for _, mc := range cfg.Masters {
+		m := &master{
+			name:            mc.Name,
+			inst:            makeInstance(mc.Host, mc.Port),
+			quorum:          mc.Quorum,
+			downAfter:       mc.DownAfter,
+			failoverTimeout: mc.FailoverTimeout,
+			replicas:        make(map[string]*instance),
+			sentinels:       make(map[string]*peer),
+		}
+		for _, addr := range mc.KnownSentinels {
+			if inst, ok := makeInstanceFromAddr(addr); ok {
+				m.sentinels[inst.addr] = &peer{instance: inst}
+			}
+		}
+		s.masters[m.name] = m
+		logger.Info("sentinel: +monitor master " + m.name + " " + m.inst.addr + " quorum " + itoa(m.quorum))
+	}
+	logger.Info("sentinel: myid " + s.myId)
+	go s.cron()
+	return s
+}
+
+// cron 每 100ms 检查一次所有主节点的状态
+func (s *Sentinel) cron() {
+	ticker := time.NewTicker(cronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			for _, m := range s.masters {
+				s.masterCron(m)
+			}
+			s.mu.Unlock()
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// masterCron 处理一个主节点的定时任务，调用方需持有 s.mu
+func (s *Sentinel) masterCron(m *master) {
+	// 1. 定期向所有节点发送 PING，向主从节点发送 INFO，向其他哨兵发送 HELLO
+	s.sendPeriodicCommands(m, m.inst)
+	for _, r := range m.replicas {
+		s.sendPeriodicCommands(m, r)
+	}
+	for _, p := range m.sentinels {
+		s.sendPeriodicCommands(m, p.instance)
+		s.sendHello(m, p)
+	}
+
+	// 2. 判断主观下线、客观下线
+	s.checkSubjectivelyDown(m, m.inst, "master")
+	for _, r := range m.replicas {
+		s.checkSubjectivelyDown(m, r, "slave")
+	}
+	s.checkObjectivelyDown(m)
+
+	// 3. 主节点客观下线后开始故障转移
+	if m.odown && m.failoverState == failoverNone {
+		s.startFailoverIfNeeded(m)
+	}
+	if m.inst.sdown || m.failoverState == failoverWaitStart {
+		s.askOtherSentinels(m)
+	}
+	s.failoverStateMachine(m)
+}
+
+// sendPeriodicCommands 按周期向节点发送 PING 和 INFO，网络请求在独立的协程中进行，调用方需持有 s.mu
+func (s *Sentinel) sendPeriodicCommands(m *master, inst *instance) {
+	now := time.Now()
+	if !inst.pinging && now.Sub(inst.lastPing) >= pingPeriod {
+		inst.pinging = true
+		inst.lastPing = now
+		go s.ping(inst)
+	}
+	if _, isPeer := m.sentinels[inst.addr]; isPeer {
+		return
+	}
+	period := infoPeriod
+	if m.inst.sdown || m.failoverState != failoverNone { // 故障转移期间需要更及时地了解从节点的角色变化
+		period = time.Second
+	}
+	if !inst.infoing && now.Sub(inst.lastInfo) >= period {
+		inst.infoing = true
+		go s.refreshInfo(m, inst)
+	}
+}
+
+func (s *Sentinel) ping(inst *instance) {
+	result := inst.send("PING")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst.pinging = false
+	if isAvailableReply(result) {
+		inst.lastAvail = time.Now()
+	}
+}
+
+func (s *Sentinel) refreshInfo(m *master, inst *instance) {
+	result := inst.send("INFO", "replication")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst.infoing = false
+	bulk, ok := result.(*reply.BulkReply)
+	if !ok {
+		return
+	}
+	replicas := inst.applyInfo(string(bulk.Arg))
+	s.handleInfo(m, inst, replicas)
+}
+
+// handleInfo 根据节点 INFO 的结果发现新的从节点，并纠正角色不正确的从节点，调用方需持有 s.mu
+func (s *Sentinel) handleInfo(m *master, inst *instance, replicas []replicaInfo) {
+	if s.masters[m.name] != m {
+		return
+	}
+	if inst == m.inst {
+		if inst.role != "master" {
+			return
+		}
+		for _, ri := range replicas {
+			r := makeInstance(ri.host, ri.port)
+			if r.addr == m.inst.addr {
+				continue
+			}
+			if _, ok := m.replicas[r.addr]; !ok {
+				m.replicas[r.addr] = r
+				logger.Info("sentinel: +slave " + r.addr + " @ " + m.name + " " + m.inst.addr)
+			}
+		}
+		return
+	}
+	if m.replicas[inst.addr] != inst {
+		return
+	}
+	if m.failoverState != failoverNone {
+		if m.failoverState == failoverWaitPromotion && inst == m.promoted && inst.role == "master" {
+			s.onReplicaPromoted(m)
+		}
+		return
+	}
+	// 从节点的角色与哨兵记录的不一致，如旧的主节点恢复后仍以主节点身份运行，让它改为复制当前的主节点
+	// 角色刚刚发生变化时可能是其他哨兵正在进行故障转移，等待一段时间，让其他哨兵有机会通过 HELLO 告知新的主节点
+	if m.inst.sdown || inst.sdown || time.Since(inst.reconfAt) < m.failoverTimeout ||
+		time.Since(inst.roleChangedAt) < 4*helloPeriod {
+		return
+	}
+	wrongMaster := inst.role == "slave" && (inst.masterHost != m.inst.host || inst.masterPort != m.inst.port)
+	if inst.role == "master" || wrongMaster {
+		inst.reconfAt = time.Now()
+		logger.Info("sentinel: +convert-to-slave " + inst.addr + " @ " + m.name + " " + m.inst.addr)
+		go s.sendReplicaOf(inst, m.inst.host, itoa(m.inst.port))
+	}
+}
+
+// sendReplicaOf 向节点发送 REPLICAOF host port，host 和 port 为 NO ONE 时让节点成为主节点
+
+func (s *Sentinel) sendReplicaOf(inst *instance, host string, port string) {
+	result := inst.send("REPLICAOF", host, port)
+	if reply.IsErrorReply(result) {
+		logger.Warn("sentinel: REPLICAOF " + host + " " + port + " to " + inst.addr + " failed: " + string(result.ToBytes()))
+	}
+}
+
+// checkSubjectivelyDown 超过 down-after-milliseconds 没有收到有效的 PING 回复时判定节点主观下线
+func (s *Sentinel) checkSubjectivelyDown(m *master, inst *instance, role string) {
+	down := time.Since(inst.lastAvail) > m.downAfter
+	if down && !inst.sdown {
+		inst.sdown = true
+		logger.Info("sentinel: +sdown " + role + " " + inst.addr + " @ " + m.name)
+	} else if !down && inst.sdown {
+		inst.sdown = false
+		logger.Info("sentinel: -sdown " + role + " " + inst.addr + " @ " + m.name)
+	}
+}
+
+// checkObjectivelyDown 认为主节点主观下线的哨兵（包括自己）达到 quorum 个时，判定主节点客观下线
+func (s *Sentinel) checkObjectivelyDown(m *master) {
+	odown := false
+	if m.inst.sdown {
+		votes := 1
+		for _, p := range m.sentinels {
+			if p.masterDown && time.Since(p.downReplyAt) < 5*askPeriod {
+				votes++
+			}
+		}
+		odown = votes >= m.quorum
+	}
+	if odown && !m.odown {
+		m.odown = true
+		logger.Info("sentinel: +odown master " + m.name + " " + m.inst.addr + " #quorum " + itoa(m.quorum))
+	} else if !odown && m.odown {
+		m.odown = false
+		logger.Info("sentinel: -odown master " + m.name + " " + m.inst.addr)
+	}
+}
+
+// Exec 执行客户端发来的指令
+
+func (s *Sentinel) Exec(c resp.Connection, args [][]byte) resp.Reply {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	cmdName := strings.ToLower(string(args[0]))
+	switch cmdName {
+	case "ping":
+		return reply.MakePongReply()
+	case "sentinel":
+		if len(args) < 2 {
+			return reply.MakeArgNumErrReply(cmdName)
+		}
+		return s.execSentinel(c, args[1:])
+	case "role":
+		return s.execRole()
+	case "hello":
+		return database.ExecHello(c, args[1:], "sentinel", "master")
+	}
+	return reply.MakeErrReply("ERR unknown command '" + cmdName + "'")
+}
+
+func (s *Sentinel) AfterClientClose(c resp.Connection) {
+}
+
+// Close 停止监控并断开与所有节点的连接
+
+func (s *Sentinel) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, m := range s.masters {
+			m.inst.closeLink()
+			for _, r := range m.replicas {
+				r.closeLink()
+			}
+			for _, p := range m.sentinels {
+				p.closeLink()
+			}
+		}
+	})
+}
@@ -0,0 +1,424 @@
+//go:build linux
+// +build linux
+
+package tcp
+
+import (
+	"context"
+	"errors"
+	"go-redis/interface/tcp"
+	"go-redis/lib/logger"
+	"io"
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 事件驱动的网络模式：所有连接注册到同一个 epoll 实例，一个协程等待可读事件，交给固定数量的工作协程处理
+// 空闲连接只占用一个 fd 和解析器的少量状态，不再需要常驻的协程和读缓冲区
+//
+// 连接以 EPOLLONESHOT 注册，一次可读事件只会交给一个工作协程，处理完（读到 EAGAIN）后再重新注册，
+// 因此同一个连接上的指令不会被并发执行
+// 工作协程执行阻塞的指令（如 WAIT）时会一直占用，io-threads 需要大于同时阻塞的客户端数量
+//
+// 发送缓冲区满时 Write 等待连接可写：连接注册到事件循环的另一个 epoll 实例中等待 EPOLLOUT，
+// 由专门的协程通知，等待期间只挂起调用 Write 的协程，不会影响其他连接的可读事件
+
+const (
+	maxEvents    = 256
+	pollInterval = 200 // epoll_wait 的超时时间，单位毫秒，超时后检查事件循环是否已关闭
+)
+
+var errDeadlineUnsupported = errors.New("deadline is not supported in event loop mode")
+
+// ListenAndServeEpoll 以事件驱动模式处理 listener 接受的连接，workers 为工作协程的数量，为 0 时使用 CPU 核数
+// listener 仍由 Go 运行时接受连接，接受后复制出 fd 交给 epoll，原连接随即关闭；TLS 连接仍然每个连接一个协程
+
+func ListenAndServeEpoll(listener net.Listener, handler tcp.EventHandler, closeChan <-chan struct{}, workers int) error {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	wepfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		_ = syscall.Close(epfd)
+		return err
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	loop := &eventLoop{
+		epfd:  epfd,
+		wepfd: wepfd,
+		conns: make(map[int]*eventConn),
+		tasks: make(chan *eventConn, maxEvents),
+	}
+
+	go func() {
+		<-closeChan
+		logger.Info("shutting down")
+		_ = listener.Close()
+		_ = handler.Close()
+	}()
+	defer func() {
+		_ = listener.Close()
+		_ = handler.Close()
+	}()
+
+	var waitDone sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitDone.Add(1)
+		go func() {
+			defer waitDone.Done()
+			loop.work()
+		}()
+	}
+	go loop.poll()
+	waitDone.Add(1)
+	go func() {
+		defer waitDone.Done()
+		loop.pollWritable()
+	}()
+	logger.Info("event loop started with " + strconv.Itoa(workers) + " workers")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		logger.Info("accepted link")
+		if _, ok := conn.(syscall.Conn); !ok {
+			// TLS 连接需要由 crypto/tls 读写，不能直接交给 epoll，仍然使用一个协程处理
+			waitDone.Add(1)
+			go func() {
+				defer waitDone.Done()
+				handler.Handle(context.Background(), conn)
+			}()
+			continue
+		}
+		if err := loop.register(conn, handler); err != nil {
+			logger.Warn("register connection failed: " + err.Error())
+		}
+	}
+	_ = handler.Close()
+	loop.close()
+	waitDone.Wait()
+	// 工作协程和等待可写事件的协程都已退出，不会再有 epoll_ctl 调用，此时才能关闭 epoll
+	_ = syscall.Close(epfd)
+	_ = syscall.Close(wepfd)
+	return nil
+}
+
+type eventLoop struct {
+	epfd   int
+	wepfd  int // 等待可写事件的 epoll，与 epfd 分开，注册 EPOLLOUT 不会改变连接在 epfd 中的可读事件
+	closed int32
+
+	mu    sync.Mutex
+	conns map[int]*eventConn // fd -> 连接
+
+	tasks chan *eventConn // 有事件的连接，由工作协程处理
+}
+
+// register 复制连接的 fd 并注册到 epoll，原连接由 Go 运行时关闭
+
+func (l *eventLoop) register(conn net.Conn, handler tcp.EventHandler) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		_ = conn.Close()
+		return errors.New("unsupported connection type")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	fd := -1
+	var dupErr error
+	err = raw.Control(func(s uintptr) {
+		fd, dupErr = dupCloseOnExec(int(s))
+	})
+	c := &eventConn{
+		loop:     l,
+		local:    conn.LocalAddr(),
+		remote:   conn.RemoteAddr(),
+		writable: make(chan struct{}, 1),
+	}
+	_ = conn.Close()
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return err
+	}
+	c.fd = fd
+
+	session := handler.OnOpen(c)
+	if session == nil {
+		return nil // handler 已经关闭了连接
+	}
+	c.session = session
+	l.mu.Lock()
+	l.conns[fd] = c
+	l.mu.Unlock()
+	// 注册之前到达的数据会让 fd 立即可读，不会丢失事件
+	err = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{
+		Events: readEvents,
+		Fd:     int32(fd),
+	})
+	if err != nil {
+		_ = c.Close()
+	}
+	return err
+}
+
+const readEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poll 等待可读事件并分发给工作协程，事件循环关闭后关闭任务队列
+
+func (l *eventLoop) poll() {
+	defer close(l.tasks)
+	events := make([]syscall.EpollEvent, maxEvents)
+	for atomic.LoadInt32(&l.closed) == 0 {
+		n, err := syscall.EpollWait(l.epfd, events, pollInterval)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			logger.Error("epoll wait failed: " + err.Error())
+			return
+		}
+		for i := 0; i < n; i++ {
+			l.mu.Lock()
+			c := l.conns[int(events[i].Fd)]
+			l.mu.Unlock()
+			if c != nil {
+				l.tasks <- c
+			}
+		}
+	}
+}
+
+// pollWritable 等待 Write 注册的可写事件，唤醒等待中的 Write，事件循环关闭后退出
+
+func (l *eventLoop) pollWritable() {
+	events := make([]syscall.EpollEvent, maxEvents)
+	for atomic.LoadInt32(&l.closed) == 0 {
+		n, err := syscall.EpollWait(l.wepfd, events, pollInterval)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			logger.Error("epoll wait failed: " + err.Error())
+			return
+		}
+		for i := 0; i < n; i++ {
+			l.mu.Lock()
+			c := l.conns[int(events[i].Fd)]
+			l.mu.Unlock()
+			if c != nil {
+				c.notifyWritable()
+			}
+		}
+	}
+}
+
+// work 处理有事件的连接：读取并执行指令直到 EAGAIN，再重新注册可读事件
+
+func (l *eventLoop) work() {
+	for c := range l.tasks {
+		if err := c.session.OnReadable(); err != nil {
+			_ = c.Close() // handler 已经关闭了连接，这里确保从 epoll 中移除
+			continue
+		}
+		c.mu.RLock()
+		if atomic.LoadInt32(&c.closed) == 0 {
+			err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.fd, &syscall.EpollEvent{
+				Events: readEvents,
+				Fd:     int32(c.fd),
+			})
+			if err != nil {
+				logger.Warn("rearm connection failed: " + err.Error())
+			}
+		}
+		c.mu.RUnlock()
+	}
+}
+
+func (l *eventLoop) remove(fd int) {
+	l.mu.Lock()
+	delete(l.conns, fd)
+	l.mu.Unlock()
+	_ = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+	_ = syscall.EpollCtl(l.wepfd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+// close 停止事件循环，poll 最多在 pollInterval 之后退出并关闭任务队列，工作协程随之退出
+
+func (l *eventLoop) close() {
+	if !atomic.CompareAndSwapInt32(&l.closed, 0, 1) {
+		return
+	}
+	l.mu.Lock()
+	conns := make([]*eventConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+// eventConn 是注册在 epoll 中的非阻塞连接，实现 net.Conn 供 handler 使用
+// Read 在没有数据时返回 syscall.EAGAIN，Write 在发送缓冲区满时等待 fd 可写
+
+type eventConn struct {
+	fd      int
+	loop    *eventLoop
+	session tcp.Session
+	local   net.Addr
+	remote  net.Addr
+
+	// Read、Write 持有读锁，Close 持有写锁，保证 fd 关闭（并可能被新连接复用）时没有正在进行的读写
+	mu     sync.RWMutex
+	closed int32
+
+	wmu        sync.Mutex    // 保证同一时间只有一个 Write，写操作不会交错
+	waitingOut bool          // fd 是否已经注册到 wepfd，注册后再次等待只需要 EPOLL_CTL_MOD
+	writable   chan struct{} // 收到可写事件或连接关闭时通知等待中的 Write
+}
+
+func (c *eventConn) Read(p []byte) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+	for {
+		n, err := syscall.Read(c.fd, p)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 && len(p) > 0 {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+func (c *eventConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	written := 0
+	for written < len(p) {
+		if atomic.LoadInt32(&c.closed) == 1 {
+			return written, net.ErrClosed
+		}
+		n, err := syscall.Write(c.fd, p[written:])
+		if n > 0 {
+			written += n
+		}
+		switch err {
+		case nil, syscall.EINTR:
+		case syscall.EAGAIN:
+			if err := c.waitWritable(); err != nil {
+				return written, err
+			}
+		default:
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// waitWritable 等待 fd 可写，发送缓冲区满时才会调用，调用方持有 wmu
+// 以 EPOLLONESHOT 注册到事件循环的 wepfd，每次最多等待 pollInterval，之后由 Write 检查连接是否已关闭
+
+func (c *eventConn) waitWritable() error {
+	op := syscall.EPOLL_CTL_MOD
+	if !c.waitingOut {
+		op = syscall.EPOLL_CTL_ADD
+	}
+	err := syscall.EpollCtl(c.loop.wepfd, op, c.fd, &syscall.EpollEvent{
+		Events: syscall.EPOLLOUT | syscall.EPOLLONESHOT,
+		Fd:     int32(c.fd),
+	})
+	if err != nil {
+		return err
+	}
+	c.waitingOut = true
+	timer := time.NewTimer(time.Duration(pollInterval) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case <-c.writable:
+	case <-timer.C:
+	}
+	return nil
+}
+
+// notifyWritable 唤醒等待中的 Write，没有等待者时保留一次通知，Write 重试写入后会再次等待
+
+func (c *eventConn) notifyWritable() {
+	select {
+	case c.writable <- struct{}{}:
+	default:
+	}
+}
+
+func (c *eventConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	c.notifyWritable() // 不必等到超时，等待中的 Write 立即返回
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loop.remove(c.fd)
+	return syscall.Close(c.fd)
+}
+
+func (c *eventConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *eventConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *eventConn) SetDeadline(t time.Time) error {
+	return errDeadlineUnsupported
+}
+
+func (c *eventConn) SetReadDeadline(t time.Time) error {
+	return errDeadlineUnsupported
+}
+
+func (c *eventConn) SetWriteDeadline(t time.Time) error {
+	return errDeadlineUnsupported
+}
+
+// dupCloseOnExec 复制 fd 并设置 close-on-exec
+
+func dupCloseOnExec(fd int) (int, error) {
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	newFd, err := syscall.Dup(fd)
+	if err != nil {
+		return -1, err
+	}
+	syscall.CloseOnExec(newFd)
+	return newFd, nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package tcp
+
+import (
+	"go-redis/interface/tcp"
+	"net"
+)
+
+// ListenAndServeEpoll 只支持 Linux，其他平台直接返回 ErrEventLoopUnsupported，由调用者回退到 goroutine 模式
+
+func ListenAndServeEpoll(listener net.Listener, handler tcp.EventHandler, closeChan <-chan struct{}, workers int) error {
+	return ErrEventLoopUnsupported
+}
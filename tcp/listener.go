@@ -0,0 +1,75 @@
+package tcp
+
+import (
+	"net"
+	"sync"
+)
+
+// multiListener 把多个 listener 合并为一个，如同时监听明文端口和 TLS 端口，任意一个 listener 出错时 Accept 返回该错误
+
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newMultiListener(listeners ...net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	ml := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go ml.serve(l)
+	}
+	return ml
+}
+
+func (ml *multiListener) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		select {
+		case ml.accepted <- acceptResult{conn: conn, err: err}:
+		case <-ml.done:
+			if conn != nil {
+				_ = conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-ml.accepted:
+		return r.conn, r.err
+	case <-ml.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ml *multiListener) Close() error {
+	ml.closeOnce.Do(func() {
+		close(ml.done)
+		for _, l := range ml.listeners {
+			_ = l.Close()
+		}
+	})
+	return nil
+}
+
+func (ml *multiListener) Addr() net.Addr {
+	return ml.listeners[0].Addr()
+}
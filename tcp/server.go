@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"go-redis/interface/tcp"
 	"go-redis/lib/logger"
 	"net"
@@ -9,15 +11,27 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Config struct {
-	Address string
+	Address    string      // 明文端口的监听地址，为空时不监听明文端口
+	TLSAddress string      // TLS 端口的监听地址，为空时不监听 TLS 端口
+	TLSConfig  *tls.Config // TLSAddress 不为空时使用
+	UnixSocket string      // Unix socket 的路径，为空时不监听
+	UnixPerm   os.FileMode // Unix socket 文件的权限，为 0 时不修改
+	EventLoop  bool        // 使用 epoll 事件循环处理连接，handler 需要实现 tcp.EventHandler
+	Workers    int         // 事件循环的工作协程数量，为 0 时使用 CPU 核数
+	// TCP 连接发送 keepalive 探测的间隔，用于发现已经断开但没有正常关闭的连接，负数表示关闭 keepalive，为 0 时使用 Go 的默认值
+	KeepAlive time.Duration
 }
 
+// ErrEventLoopUnsupported 表示当前平台不支持事件循环模式
+var ErrEventLoopUnsupported = errors.New("event loop mode is only supported on linux")
+
 func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 	closeChan := make(chan struct{})
-	sigChan := make(chan os.Signal) // 用于传输系统的信号
+	sigChan := make(chan os.Signal, 1) // 用于传输系统的信号
 	// 捕获指定的操作系统信号，并通过 Go 通道（sigChan）将这些信号传递给程序，从而实现优雅关闭或动态配置重载等功能
 	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
@@ -27,15 +41,75 @@ func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
 			closeChan <- struct{}{}
 		}
 	}()
-	listener, err := net.Listen("tcp", cfg.Address)
-	if err != nil {
-		return err
+	lc := net.ListenConfig{KeepAlive: cfg.KeepAlive} // 接受的连接都会按 KeepAlive 设置 SO_KEEPALIVE
+	var listeners []net.Listener
+	if cfg.Address != "" {
+		listener, err := lc.Listen(context.Background(), "tcp", cfg.Address)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	if cfg.TLSAddress != "" {
+		listener, err := lc.Listen(context.Background(), "tcp", cfg.TLSAddress)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return err
+		}
+		logger.Info("tls listening on " + cfg.TLSAddress)
+		listeners = append(listeners, tls.NewListener(listener, cfg.TLSConfig))
+	}
+	if cfg.UnixSocket != "" {
+		listener, err := listenUnix(cfg.UnixSocket, cfg.UnixPerm)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return err
+		}
+		logger.Info("unix socket listening on " + cfg.UnixSocket)
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return errors.New("no address to listen on")
 	}
+	listener := newMultiListener(listeners...)
 	logger.Info("start listen")
+	if cfg.EventLoop {
+		if eventHandler, ok := handler.(tcp.EventHandler); !ok {
+			logger.Warn("handler does not support event loop mode, fallback to goroutine mode")
+		} else if err := ListenAndServeEpoll(listener, eventHandler, closeChan, cfg.Workers); err != ErrEventLoopUnsupported {
+			return err
+		} else {
+			logger.Warn(err.Error() + ", fallback to goroutine mode")
+		}
+	}
 	ListenAndServe(listener, handler, closeChan)
 	return nil
 }
 
+// listenUnix 监听 Unix socket，与 Redis 相同先删除上次运行残留的 socket 文件
+// 关闭 listener 时 socket 文件会被自动删除
+
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
 func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
 	// 如果收到外部终止信号（如用户主动关闭），关闭前系统会传递一个信号，告知 listener 和 handler 关闭
 	go func() {